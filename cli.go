@@ -0,0 +1,255 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+)
+
+// commands are offline subcommands.
+var commands = map[string]func(args []string, w io.Writer, l *log.Logger) error{
+	"encrypt": runEncrypt,
+	"decrypt": runDecrypt,
+	"stats":   runStats,
+	"verify":  runVerify,
+}
+
+// blobStorage is a storage of the only one file with a fixed path.
+type blobStorage struct {
+	path string
+}
+
+// Writer returns a new file writer.
+func (bs *blobStorage) Writer(string) (io.WriteCloser, error) {
+	return os.OpenFile(bs.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// Reader returns a file reader.
+func (bs *blobStorage) Reader(string) (io.ReadCloser, error) {
+	return os.Open(bs.path)
+}
+
+// Remove deletes a file.
+func (bs *blobStorage) Remove(string) error {
+	return os.Remove(bs.path)
+}
+
+// Exists always returns false to allow an overwriting of the file.
+func (bs *blobStorage) Exists(string) bool {
+	return false
+}
+
+// Size returns a file size.
+func (bs *blobStorage) Size(string) (int64, error) {
+	info, err := os.Stat(bs.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// runEncrypt encrypts a file without the HTTP server and database,
+// it prints parameters those are required for decryption.
+func runEncrypt(args []string, w io.Writer, l *log.Logger) error {
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	in := fs.String("in", "", "input file")
+	out := fs.String("out", "", "output encrypted file")
+	password := fs.String("password", "", "password")
+	iter := fs.Int("iter", db.DefaultIter, "number of pbkdf2 iterations")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*in == "") || (*out == "") || (*password == "") {
+		return errors.New("required flags: -in, -out, -password")
+	}
+	inFile, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := inFile.Close(); err != nil {
+			l.Printf("close input file error: %v", err)
+		}
+	}()
+	item := &db.Item{
+		Name:    filepath.Base(*in),
+		Iter:    *iter,
+		Storage: &blobStorage{path: *out},
+	}
+	err = item.Encrypt(inFile, *password, l)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Salt: %v\nHash: %v\nName: %v\nIterations: %v\n",
+		item.Salt, item.Hash, item.Name, item.Iter,
+	)
+	return err
+}
+
+// runDecrypt decrypts a file, encrypted by runEncrypt, without the HTTP server and database.
+func runDecrypt(args []string, w io.Writer, l *log.Logger) error {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	in := fs.String("in", "", "input encrypted file")
+	out := fs.String("out", "", "output file, original name in the current directory by default")
+	password := fs.String("password", "", "password")
+	salt := fs.String("salt", "", "salt")
+	hash := fs.String("hash", "", "hash")
+	name := fs.String("name", "", "encrypted name")
+	iter := fs.Int("iter", db.DefaultIter, "number of pbkdf2 iterations")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*in == "") || (*password == "") || (*salt == "") || (*hash == "") || (*name == "") {
+		return errors.New("required flags: -in, -password, -salt, -hash, -name")
+	}
+	item := &db.Item{
+		Name:    *name,
+		Salt:    *salt,
+		Hash:    *hash,
+		Iter:    *iter,
+		Format:  db.FormatGCM,
+		Storage: &blobStorage{path: *in},
+	}
+	key, err := item.IsValidSecret(*password)
+	if err != nil {
+		return err
+	}
+	// a name is known only after decryption, so use a temporary file
+	tmpFile, err := ioutil.TempFile(filepath.Dir(*in), ".unigma-*")
+	if err != nil {
+		return err
+	}
+	err = item.Decrypt(tmpFile, key, l)
+	if e := tmpFile.Close(); (e != nil) && (err == nil) {
+		err = e
+	}
+	if err != nil {
+		if e := os.Remove(tmpFile.Name()); e != nil {
+			l.Printf("remove temporary file error: %v", e)
+		}
+		return err
+	}
+	if *out == "" {
+		*out = filepath.Base(item.Name)
+	}
+	err = os.Rename(tmpFile.Name(), *out)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Decrypted: %v\n", *out)
+	return err
+}
+
+// runStats prints storage statistics in text, CSV or JSON format.
+func runStats(args []string, w io.Writer, l *log.Logger) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	config := fs.String("config", Config, "configuration file")
+	format := fs.String("format", "text", "output format: text, csv or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := conf.New(*config, l)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			l.Printf("close configuration error: %v", err)
+		}
+	}()
+	stats, err := db.Stats(cfg.Db)
+	if err != nil {
+		return err
+	}
+	return writeStats(w, stats, *format)
+}
+
+// writeStats writes storage statistics to w in the format.
+func writeStats(w io.Writer, stats db.StatsResult, format string) error {
+	switch format {
+	case "text":
+		_, err := fmt.Fprintf(w, "Items: %v\nBytes: %v\nExpiring in 24h: %v\nAverage counter: %.2f\n",
+			stats.Items, stats.Bytes, stats.Expiring, stats.AvgCounter,
+		)
+		return err
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"items", "bytes", "expiring", "avg_counter"})
+		cw.Write([]string{
+			strconv.FormatInt(stats.Items, 10),
+			strconv.FormatInt(stats.Bytes, 10),
+			strconv.FormatInt(stats.Expiring, 10),
+			strconv.FormatFloat(stats.AvgCounter, 'f', 2, 64),
+		})
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		return json.NewEncoder(w).Encode(stats)
+	}
+	return fmt.Errorf("unsupported format %v", format)
+}
+
+// runVerify checks that stored files are consistent with database items without their passwords,
+// it prints missing, mismatched by size and orphaned files and fails if any of them is found.
+func runVerify(args []string, w io.Writer, l *log.Logger) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	config := fs.String("config", Config, "configuration file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := conf.New(*config, l)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			l.Printf("close configuration error: %v", err)
+		}
+	}()
+	if cfg.StorageDir == "" {
+		return errors.New("only file system storage can be verified")
+	}
+	result, err := db.VerifyStorage(cfg.Db, cfg.StorageDir)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "Checked items: %v\n", result.Checked); err != nil {
+		return err
+	}
+	groups := []struct {
+		title string
+		names []string
+	}{
+		{title: "Missing", names: result.Missing},
+		{title: "Mismatched", names: result.Mismatched},
+		{title: "Orphans", names: result.Orphans},
+	}
+	for _, g := range groups {
+		if _, err = fmt.Fprintf(w, "%v: %v\n", g.title, len(g.names)); err != nil {
+			return err
+		}
+		for _, name := range g.names {
+			if _, err = fmt.Fprintf(w, "\t%v\n", name); err != nil {
+				return err
+			}
+		}
+	}
+	if !result.IsConsistent() {
+		return errors.New("storage is inconsistent")
+	}
+	return nil
+}
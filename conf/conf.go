@@ -6,142 +6,1017 @@
 package conf
 
 import (
+	"crypto/x509"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	_ "github.com/lib/pq"           // PostgreSQL driver package
 	_ "github.com/mattn/go-sqlite3" // SQLite3 driver package
 	"github.com/z0rr0/unigma/db"
+	"github.com/z0rr0/unigma/limiter"
+	"github.com/z0rr0/unigma/logging"
+	"github.com/z0rr0/unigma/metrics"
 	"github.com/z0rr0/unigma/page"
+	"github.com/z0rr0/unigma/scanner"
+	"github.com/z0rr0/unigma/webhook"
 )
 
+const (
+	// MinIterations is minimal allowed number of pbkdf2 iterations.
+	MinIterations = 10000
+	// DefaultGCQueue is default size of GC queue.
+	DefaultGCQueue = 64
+	// DefaultGCBatch is default number of expired items deleted in one transaction.
+	DefaultGCBatch = 500
+	// DefaultSQLiteConns is default max number of open and idle SQLite connections,
+	// writes are serialized by the database lock anyway.
+	DefaultSQLiteConns = 8
+	// SQLiteBusyTimeout is a time in milliseconds to wait the SQLite lock before "database is locked" error.
+	SQLiteBusyTimeout = 5000
+	// DefaultOrphanGrace is default age in seconds of files without items which are removed by GC.
+	DefaultOrphanGrace = 86400
+	// MinAutoPasswordLength is minimal and default length in bytes of auto-generated passwords.
+	MinAutoPasswordLength = 8
+	// WebhookQueue is max number of not delivered webhook events.
+	WebhookQueue = 64
+	// DefaultMaintenanceRetry is default delay in seconds before a retry of unavailable service request.
+	DefaultMaintenanceRetry = 60
+	// DefaultStatusCache is default period in seconds of cached public status.
+	DefaultStatusCache = 60
+	// MinSaltLength is minimal length of the server salt which is added to all passwords.
+	MinSaltLength = 16
+	// MaxSaltVersionLength is max length of the salt version name which is stored with items.
+	MaxSaltVersionLength = 64
+	// DefaultMultipartMemory is default max memory size in bytes to parse an upload form,
+	// larger files are stored in temporary files.
+	DefaultMultipartMemory = 32 << 20
+	// DefaultFileField is default name of the upload form field with files.
+	DefaultFileField = "file"
+	// maxFileFieldLength is max length of the upload form field name.
+	maxFileFieldLength = 64
+)
+
+// Maintenance modes, uploads are refused in read-only mode and all requests of files in full one.
+const (
+	MaintenanceOff      = "off"
+	MaintenanceReadOnly = "read-only"
+	MaintenanceFull     = "full"
+)
+
+// Response formats of the short upload.
+const (
+	ShortVerbose = "verbose"
+	ShortURL     = "plain-url"
+	ShortJSON    = "json"
+)
+
+// defaultTTLPresets are TTL choices of the index page if custom ones are not set,
+// their labels are keys of localized UI strings.
+var defaultTTLPresets = []TTLPreset{
+	{Label: "index.ttl.10m", Seconds: 600},
+	{Label: "index.ttl.1h", Seconds: 3600},
+	{Label: "index.ttl.1d", Seconds: 86400},
+	{Label: "index.ttl.1w", Seconds: 604800},
+}
+
+// TTLPreset is a TTL choice of the index page.
+type TTLPreset struct {
+	Label   string `json:"label"`
+	Seconds int    `json:"seconds"`
+}
+
 // settings is app settings.
 type settings struct {
-	TTL   int `json:"ttl"`
-	Times int `json:"times"`
-	Size  int `json:"size"`
+	TTL                int         `json:"ttl"`
+	MinTTL             int         `json:"min_ttl"`
+	Times              int         `json:"times"`
+	Size               int         `json:"size"`
+	Iterations         int         `json:"iterations"`
+	MinPasswordLength  int         `json:"min_password_length"`
+	StrongPassword     bool        `json:"strong_password"`
+	MaxAttempts        int         `json:"max_attempts"`
+	MaxUploads         int         `json:"max_concurrent_uploads"`
+	MaxDownloads       int         `json:"max_concurrent_downloads"`
+	AutoPasswordLength int         `json:"auto_password_length"`
+	MaxStorageBytes    int64       `json:"max_storage_bytes"`
+	ShortFormat        string      `json:"short_format"`
+	MultipartMemory    int64       `json:"multipart_memory"`
+	FileField          string      `json:"file_field"`
+	AllowedExtensions  []string    `json:"allowed_extensions"`
+	BlockedExtensions  []string    `json:"blocked_extensions"`
+	ContentTypes       []string    `json:"content_types"`
+	TTLPresets         []TTLPreset `json:"ttl_presets"`
+}
+
+// s3Settings is S3-compatible object storage settings.
+type s3Settings struct {
+	Endpoint  string `json:"endpoint"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Secure    bool   `json:"secure"`
 }
 
 // Cfg is configuration settings.
 type Cfg struct {
-	DbSource   string   `json:"db"`
-	Storage    string   `json:"storage"`
-	Host       string   `json:"host"`
-	Port       uint     `json:"port"`
-	Timeout    int64    `json:"timeout"`
-	Secure     bool     `json:"secure"`
-	Salt       string   `json:"salt"`
-	GCPeriod   int64    `json:"gc_period"`
-	Settings   settings `json:"settings"`
-	StorageDir string
-	Db         *sql.DB
-	Templates  map[string]*template.Template
-	ErrLogger  *log.Logger
-	timeout    time.Duration
-	Ch         chan *db.Item
+	Driver            string            `json:"driver"`
+	DbSource          string            `json:"db"`
+	MaxOpenConns      int               `json:"max_open_conns"`
+	MaxIdleConns      int               `json:"max_idle_conns"`
+	ConnMaxLifetime   int64             `json:"conn_max_lifetime"`
+	Storage           string            `json:"storage"`
+	ShardDepth        int               `json:"shard_depth"`
+	PruneShards       bool              `json:"prune_shards"`
+	FileMode          string            `json:"file_mode"`
+	S3                s3Settings        `json:"s3"`
+	Host              string            `json:"host"`
+	Port              uint              `json:"port"`
+	Timeout           int64             `json:"timeout"`
+	ReadTimeout       int64             `json:"read_timeout"`
+	WriteTimeout      int64             `json:"write_timeout"`
+	IdleTimeout       int64             `json:"idle_timeout"`
+	MaintenanceRetry  int64             `json:"maintenance_retry"`
+	StatusCache       int64             `json:"status_cache"`
+	Secure            bool              `json:"secure"`
+	CertFile          string            `json:"cert_file"`
+	KeyFile           string            `json:"key_file"`
+	AdminClientCA     string            `json:"admin_client_ca"`
+	Salt              string            `json:"salt"`
+	Salts             map[string]string `json:"salts"`
+	SaltVersion       string            `json:"salt_version"`
+	GCPeriod          int64             `json:"gc_period"`
+	GCQueue           int               `json:"gc_queue"`
+	GCBatch           int               `json:"gc_batch"`
+	OrphanGrace       int64             `json:"orphan_grace"`
+	Metrics           bool              `json:"metrics"`
+	Compress          bool              `json:"compress"`
+	StripMetadata     bool              `json:"strip_metadata"`
+	Deduplicate       bool              `json:"dedup"`
+	Proxy             bool              `json:"trusted_proxy"`
+	TrustProxyHeaders bool              `json:"trust_proxy_headers"`
+	AllowedHosts      []string          `json:"allowed_hosts"`
+	AdminToken        string            `json:"admin_token"`
+	LogFormat         string            `json:"log_format"`
+	LogClientIP       string            `json:"log_client_ip"`
+	TemplateDir       string            `json:"template_dir"`
+	StaticDir         string            `json:"static_dir"`
+	APIOnly           bool              `json:"api_only"`
+	AllowHints        bool              `json:"allow_hints"`
+	AllowPasswordless bool              `json:"allow_passwordless"`
+	Notice            string            `json:"notice"`
+	BasePath          string            `json:"base_path"`
+	RevealExpired     bool              `json:"reveal_expired"`
+	DeferredCounter   bool              `json:"deferred_counter"`
+	VerifyChecksum    bool              `json:"verify_checksum"`
+	WebhookURL        string            `json:"webhook_url"`
+	WebhookSecret     string            `json:"webhook_secret"`
+	LabelKey          string            `json:"label_key"`
+	SessionKey        string            `json:"session_key"`
+	EnvelopeKeys      map[string]string `json:"envelope_keys"`
+	EnvelopeVersion   int               `json:"envelope_version"`
+	ClamdAddr         string            `json:"clamd_addr"`
+	Settings          settings          `json:"settings"`
+	StorageDir        string
+	Backend           db.Storage
+	Dedup             *db.Dedup
+	Collector         metrics.Collector
+	Limiter           *limiter.Limiter
+	Uploads           limiter.Semaphore
+	Downloads         limiter.Semaphore
+	SizeCache         *db.SizeCache
+	ActiveCache       *db.ActiveCache
+	Webhook           *webhook.Sender
+	Scanner           *scanner.Client
+	Db                *sql.DB
+	Templates         map[string]*template.Template
+	ErrLogger         *log.Logger
+	timeout           time.Duration
+	labelKey          []byte
+	sessionKey        []byte
+	adminCAs          *x509.CertPool
+	maintenance       atomic.Value
+	Ch                chan *db.Item
 }
 
 // isValid checks the settings are valid.
 func (c *Cfg) isValid() error {
-	fullPath, err := filepath.Abs(strings.Trim(c.Storage, " "))
+	switch c.Driver {
+	case "":
+		c.Driver = "sqlite3"
+	case "sqlite3", "postgres":
+	default:
+		return fmt.Errorf("unsupported database driver %v", c.Driver)
+	}
+	switch c.LogFormat {
+	case "":
+		c.LogFormat = logging.FormatText
+	case logging.FormatText, logging.FormatJSON:
+	default:
+		return fmt.Errorf("unsupported log format %v", c.LogFormat)
+	}
+	switch c.LogClientIP {
+	case "":
+		c.LogClientIP = logging.ClientIPOff
+	case logging.ClientIPOff, logging.ClientIPFull, logging.ClientIPTruncated:
+	default:
+		return fmt.Errorf("unsupported log_client_ip mode %v", c.LogClientIP)
+	}
+	err := c.checkPool()
 	if err != nil {
 		return err
 	}
-	info, err := os.Stat(fullPath)
+	err = c.checkSalts()
 	if err != nil {
 		return err
 	}
-	if !info.IsDir() {
-		return errors.New("storage is not a directory")
+	err = c.loadStorage()
+	if err != nil {
+		return err
 	}
-	mode := uint(info.Mode().Perm())
-	if mode&uint(0600) != 0600 {
-		return errors.New("storage dir is not writable or readable")
+	err = c.loadEnvelope()
+	if err != nil {
+		return err
+	}
+	err = c.loadTLS()
+	if err != nil {
+		return err
+	}
+	err = c.loadAdminCA()
+	if err != nil {
+		return err
+	}
+	err = c.checkWebhook()
+	if err != nil {
+		return err
+	}
+	err = c.loadLabelKey()
+	if err != nil {
+		return err
+	}
+	err = c.loadSessionKey()
+	if err != nil {
+		return err
+	}
+	err = c.loadAllowedHosts()
+	if err != nil {
+		return err
 	}
-	c.StorageDir = fullPath
-
 	if c.Timeout < 1 {
 		return errors.New("invalid timeout value")
 	}
+	err = c.loadServerTimeouts()
+	if err != nil {
+		return err
+	}
+	if c.MaintenanceRetry == 0 {
+		c.MaintenanceRetry = DefaultMaintenanceRetry
+	}
+	if c.MaintenanceRetry < 0 {
+		return errors.New("maintenance_retry should be positive")
+	}
+	if c.StatusCache == 0 {
+		c.StatusCache = DefaultStatusCache
+	}
+	if c.StatusCache < 0 {
+		return errors.New("status_cache should be positive")
+	}
 	if c.Port < 1 {
 		return errors.New("port should be positive")
 	}
 	if c.Settings.TTL < 1 {
 		return errors.New("ttl setting should be positive")
 	}
+	if c.Settings.MinTTL == 0 {
+		c.Settings.MinTTL = 1
+	}
+	if (c.Settings.MinTTL < 1) || (c.Settings.MinTTL > c.Settings.TTL) {
+		return fmt.Errorf("min_ttl setting should be in range [1, %v]", c.Settings.TTL)
+	}
 	if c.Settings.Times < 1 {
 		return errors.New("times setting should be positive")
 	}
 	if c.Settings.Size < 1 {
 		return errors.New("size setting should be positive")
 	}
+	if c.Settings.Iterations == 0 {
+		c.Settings.Iterations = db.DefaultIter
+	}
+	if c.Settings.Iterations < MinIterations {
+		return fmt.Errorf("iterations setting should be at least %v", MinIterations)
+	}
+	if c.Settings.MinPasswordLength < 0 {
+		return errors.New("min_password_length setting should not be negative")
+	}
+	if c.Settings.AutoPasswordLength == 0 {
+		c.Settings.AutoPasswordLength = MinAutoPasswordLength
+	}
+	if c.Settings.AutoPasswordLength < MinAutoPasswordLength {
+		return fmt.Errorf("auto_password_length setting should be at least %v", MinAutoPasswordLength)
+	}
+	switch c.Settings.ShortFormat {
+	case "":
+		c.Settings.ShortFormat = ShortVerbose
+	case ShortVerbose, ShortURL, ShortJSON:
+	default:
+		return fmt.Errorf("unsupported short_format %v", c.Settings.ShortFormat)
+	}
+	if c.Settings.MultipartMemory == 0 {
+		c.Settings.MultipartMemory = DefaultMultipartMemory
+	}
+	if c.Settings.MultipartMemory < 0 {
+		return errors.New("multipart_memory setting should not be negative")
+	}
+	if c.Settings.FileField == "" {
+		c.Settings.FileField = DefaultFileField
+	}
+	if !isFieldName(c.Settings.FileField) {
+		return fmt.Errorf("file_field setting %q should contain only latin letters, digits, '_' and '-'", c.Settings.FileField)
+	}
+	if c.Settings.MaxStorageBytes < 0 {
+		return errors.New("max_storage_bytes setting should not be negative")
+	}
+	if c.Settings.MaxAttempts < 0 {
+		return errors.New("max_attempts setting should not be negative")
+	}
+	if (c.Settings.MaxUploads < 0) || (c.Settings.MaxDownloads < 0) {
+		return errors.New("max_concurrent_uploads and max_concurrent_downloads settings should not be negative")
+	}
+	c.Settings.AllowedExtensions, err = loadExtensions(c.Settings.AllowedExtensions)
+	if err != nil {
+		return err
+	}
+	c.Settings.BlockedExtensions, err = loadExtensions(c.Settings.BlockedExtensions)
+	if err != nil {
+		return err
+	}
+	c.Settings.ContentTypes, err = loadContentTypes(c.Settings.ContentTypes)
+	if err != nil {
+		return err
+	}
+	c.Settings.TTLPresets, err = loadTTLPresets(c.Settings.TTLPresets, c.Settings.MinTTL, c.Settings.TTL)
+	if err != nil {
+		return err
+	}
 	if c.GCPeriod < 1 {
 		return errors.New("gc_period should be positive")
 	}
-	err = c.loadTemplates()
+	switch {
+	case c.GCQueue == 0:
+		c.GCQueue = DefaultGCQueue
+	case c.GCQueue < 0:
+		return errors.New("gc_queue should not be negative")
+	}
+	switch {
+	case c.GCBatch == 0:
+		c.GCBatch = DefaultGCBatch
+	case c.GCBatch < 0:
+		return errors.New("gc_batch should not be negative")
+	}
+	switch {
+	case c.OrphanGrace == 0:
+		c.OrphanGrace = DefaultOrphanGrace
+	case c.OrphanGrace < 0:
+		return errors.New("orphan_grace should be positive")
+	}
+	err = c.loadBasePath()
 	if err != nil {
 		return err
 	}
+	if c.StaticDir != "" {
+		info, err := os.Stat(c.StaticDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("static_dir %v is not a directory", c.StaticDir)
+		}
+	}
+	if !c.APIOnly {
+		// HTML pages are not served
+		err = c.loadTemplates()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Metrics {
+		c.Collector = metrics.NewPrometheus()
+	} else {
+		c.Collector = metrics.Nop{}
+	}
+	c.Limiter = limiter.New(c.Settings.MaxAttempts, time.Minute)
+	c.Uploads = limiter.NewSemaphore(c.Settings.MaxUploads)
+	c.Downloads = limiter.NewSemaphore(c.Settings.MaxDownloads)
+	c.SizeCache = &db.SizeCache{}
+	c.ActiveCache = &db.ActiveCache{Period: time.Duration(c.StatusCache) * time.Second}
 	c.timeout = time.Duration(c.Timeout) * time.Second
-	c.Ch = make(chan *db.Item, 1)
+	c.Ch = make(chan *db.Item, c.GCQueue)
+	return nil
+}
+
+// checkPool validates settings of the database connections pool, zero values are not limits,
+// but SQLite connections are limited by default.
+func (c *Cfg) checkPool() error {
+	if (c.MaxOpenConns < 0) || (c.MaxIdleConns < 0) || (c.ConnMaxLifetime < 0) {
+		return errors.New("max_open_conns, max_idle_conns and conn_max_lifetime should not be negative")
+	}
+	if c.Driver != "sqlite3" {
+		return nil
+	}
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = DefaultSQLiteConns
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = c.MaxOpenConns
+	}
 	return nil
 }
 
-// loadTemplates loads HTML templates to memory.
+// dataSource returns the database connection string. SQLite gets WAL journal mode, so reads don't wait writes,
+// a busy timeout and immediate transactions, so concurrent writers wait the lock instead of "database is locked" errors.
+// Parameters which are already set in "db" value are not changed.
+func (c *Cfg) dataSource() string {
+	if c.Driver != "sqlite3" {
+		return c.DbSource
+	}
+	params := []struct {
+		names []string
+		value string
+	}{
+		{names: []string{"_journal_mode", "_journal"}, value: "WAL"},
+		{names: []string{"_busy_timeout", "_timeout"}, value: strconv.Itoa(SQLiteBusyTimeout)},
+		{names: []string{"_txlock"}, value: "immediate"},
+	}
+	source, query := c.DbSource, ""
+	if i := strings.IndexByte(source, '?'); i > -1 {
+		source, query = source[:i], source[i+1:]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		// the driver reports the error
+		return c.DbSource
+	}
+	var added []string
+	for _, p := range params {
+		found := false
+		for _, name := range p.names {
+			if _, ok := values[name]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, p.names[0]+"="+p.value)
+		}
+	}
+	if len(added) == 0 {
+		return c.DbSource
+	}
+	if query != "" {
+		added = append([]string{query}, added...)
+	}
+	return source + "?" + strings.Join(added, "&")
+}
+
+// loadServerTimeouts checks HTTP server timeouts, not set values are equal to the service timeout.
+func (c *Cfg) loadServerTimeouts() error {
+	timeouts := []struct {
+		name  string
+		value *int64
+	}{
+		{name: "read_timeout", value: &c.ReadTimeout},
+		{name: "write_timeout", value: &c.WriteTimeout},
+		{name: "idle_timeout", value: &c.IdleTimeout},
+	}
+	for _, t := range timeouts {
+		switch {
+		case *t.value == 0:
+			*t.value = c.Timeout
+		case *t.value < 0:
+			return fmt.Errorf("%v should not be negative", t.name)
+		}
+	}
+	return nil
+}
+
+// isFieldName checks the form field name is not empty and it's not longer than maxFileFieldLength,
+// only latin letters, digits, '_' and '-' are allowed.
+func isFieldName(name string) bool {
+	if (name == "") || (len(name) > maxFileFieldLength) {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case (c >= 'a') && (c <= 'z'), (c >= 'A') && (c <= 'Z'), (c >= '0') && (c <= '9'), c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// loadExtensions returns file extensions in lower case with a leading dot.
+func loadExtensions(values []string) ([]string, error) {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		ext := strings.ToLower(strings.Trim(value, " "))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if ext == "." {
+			return nil, errors.New("empty file extension in settings")
+		}
+		result = append(result, ext)
+	}
+	return result, nil
+}
+
+// loadContentTypes normalizes media types which can be set by uploaders instead of detected ones.
+func loadContentTypes(values []string) ([]string, error) {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if (err != nil) || (len(params) > 0) || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("invalid content type %q in settings", value)
+		}
+		result = append(result, mediaType)
+	}
+	return result, nil
+}
+
+// loadTTLPresets checks TTL presets are in limits of min and max TTL,
+// default ones which exceed them are skipped if custom presets are not set.
+func loadTTLPresets(presets []TTLPreset, minTTL, maxTTL int) ([]TTLPreset, error) {
+	if len(presets) == 0 {
+		result := make([]TTLPreset, 0, len(defaultTTLPresets))
+		for _, p := range defaultTTLPresets {
+			if (p.Seconds >= minTTL) && (p.Seconds <= maxTTL) {
+				result = append(result, p)
+			}
+		}
+		return result, nil
+	}
+	for _, p := range presets {
+		if strings.TrimSpace(p.Label) == "" {
+			return nil, errors.New("empty ttl_presets label")
+		}
+		if (p.Seconds < minTTL) || (p.Seconds > maxTTL) {
+			return nil, fmt.Errorf("ttl_presets value %v should be in range [%v, %v]", p.Seconds, minTTL, maxTTL)
+		}
+	}
+	return presets, nil
+}
+
+// loadStorage checks storage settings and initializes the backend.
+// S3-compatible storage is used if its endpoint is set, otherwise it's a local directory.
+func (c *Cfg) loadStorage() error {
+	if c.S3.Endpoint != "" {
+		if c.S3.Bucket == "" {
+			return errors.New("s3 bucket is required")
+		}
+		backend, err := db.NewS3Storage(c.S3.Endpoint, c.S3.AccessKey, c.S3.SecretKey, c.S3.Region, c.S3.Bucket, c.S3.Secure)
+		if err != nil {
+			return err
+		}
+		c.Backend = backend
+		return nil
+	}
+	if (c.ShardDepth < 0) || (c.ShardDepth > db.MaxShardDepth) {
+		return fmt.Errorf("shard_depth should be in range [0, %v]", db.MaxShardDepth)
+	}
+	fullPath, err := filepath.Abs(strings.Trim(c.Storage, " "))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("storage is not a directory")
+	}
+	mode := uint(info.Mode().Perm())
+	if mode&uint(0600) != 0600 {
+		return errors.New("storage dir is not writable or readable")
+	}
+	fileMode, err := parseFileMode(c.FileMode)
+	if err != nil {
+		return err
+	}
+	backend := &db.FileStorage{Dir: fullPath, Depth: c.ShardDepth, Mode: fileMode, Prune: c.PruneShards}
+	if err = backend.CheckMode(); err != nil {
+		return err
+	}
+	c.StorageDir = fullPath
+	c.Backend = backend
+	return nil
+}
+
+// loadEnvelope decodes hex master keys of encryption at rest by their versions and wraps the storage backend,
+// versions are numbers in range [1 - 255]. Zero current version only reads files encrypted by the keys,
+// so the layer can be disabled, but a removed key makes its files unreadable.
+func (c *Cfg) loadEnvelope() error {
+	if len(c.EnvelopeKeys) == 0 {
+		if c.EnvelopeVersion != 0 {
+			return errors.New("envelope_version requires envelope_keys")
+		}
+		return nil
+	}
+	keys := make(map[byte][]byte, len(c.EnvelopeKeys))
+	for name, value := range c.EnvelopeKeys {
+		version, err := strconv.ParseUint(name, 10, 8)
+		if (err != nil) || (version == 0) {
+			return fmt.Errorf("envelope key version should be a number in range [1 - 255]: %q", name)
+		}
+		key, err := hex.DecodeString(value)
+		if (err != nil) || (len(key) != db.EnvelopeKeySize) {
+			return fmt.Errorf("envelope key %v should be %v hex encoded bytes", name, db.EnvelopeKeySize)
+		}
+		keys[byte(version)] = key
+	}
+	_, ok := keys[byte(c.EnvelopeVersion)]
+	if (c.EnvelopeVersion < 0) || (c.EnvelopeVersion > 255) || ((c.EnvelopeVersion != 0) && !ok) {
+		return fmt.Errorf("unknown current envelope version %v", c.EnvelopeVersion)
+	}
+	c.Backend = &db.EnvelopeStorage{Storage: c.Backend, Keys: keys, Version: byte(c.EnvelopeVersion)}
+	return nil
+}
+
+// parseFileMode converts octal permissions of stored files, they should allow read and write
+// for the owner and can't be more permissive than 0660.
+func parseFileMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return db.DefaultFileMode, nil
+	}
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("file_mode should be an octal number: %v", value)
+	}
+	mode := os.FileMode(n)
+	if mode&^0660 != 0 {
+		return 0, fmt.Errorf("file_mode %v is more permissive than 0660", value)
+	}
+	if mode&0600 != 0600 {
+		return 0, fmt.Errorf("file_mode %v should allow read and write for the owner", value)
+	}
+	return mode, nil
+}
+
+// checkWebhook checks webhook settings, the secret is required to sign requests.
+func (c *Cfg) checkWebhook() error {
+	if c.WebhookURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.WebhookURL)
+	if err != nil {
+		return err
+	}
+	if ((u.Scheme != "http") && (u.Scheme != "https")) || (u.Host == "") {
+		return fmt.Errorf("invalid webhook_url %v", c.WebhookURL)
+	}
+	if c.WebhookSecret == "" {
+		return errors.New("webhook_secret is required for webhook_url")
+	}
+	return nil
+}
+
+// loadLabelKey decodes hex server key of items labels, labels are disabled if it's empty.
+func (c *Cfg) loadLabelKey() error {
+	if c.LabelKey == "" {
+		c.labelKey = nil
+		return nil
+	}
+	key, err := hex.DecodeString(c.LabelKey)
+	if (err != nil) || (len(key) != db.LabelKeySize) {
+		return fmt.Errorf("label_key should be %v hex encoded bytes", db.LabelKeySize)
+	}
+	c.labelKey = key
+	return nil
+}
+
+// loadSessionKey decodes hex server key of uploader sessions, sessions are disabled if it's empty.
+func (c *Cfg) loadSessionKey() error {
+	if c.SessionKey == "" {
+		c.sessionKey = nil
+		return nil
+	}
+	key, err := hex.DecodeString(c.SessionKey)
+	if (err != nil) || (len(key) != db.SessionKeySize) {
+		return fmt.Errorf("session_key should be %v hex encoded bytes", db.SessionKeySize)
+	}
+	c.sessionKey = key
+	return nil
+}
+
+// loadAllowedHosts checks host names which can be used from X-Forwarded-Host header,
+// they are required if proxy headers are trusted to prevent host header poisoning of links.
+// Ports, IPv6 brackets and letter case are ignored when the hosts are compared.
+func (c *Cfg) loadAllowedHosts() error {
+	hosts := make([]string, 0, len(c.AllowedHosts))
+	for _, value := range c.AllowedHosts {
+		host := strings.TrimSpace(value)
+		if host == "" {
+			return errors.New("empty host in allowed_hosts")
+		}
+		hosts = append(hosts, host)
+	}
+	if c.TrustProxyHeaders && (len(hosts) == 0) {
+		return errors.New("allowed_hosts is required for trust_proxy_headers")
+	}
+	c.AllowedHosts = hosts
+	return nil
+}
+
+// loadTLS checks TLS certificate and key files, they both should be set and readable.
+// Secure flag is forced for TLS because all generated URLs should use HTTPS scheme.
+func (c *Cfg) loadTLS() error {
+	if (c.CertFile == "") && (c.KeyFile == "") {
+		return nil
+	}
+	if (c.CertFile == "") || (c.KeyFile == "") {
+		return errors.New("both cert_file and key_file are required for TLS")
+	}
+	for _, name := range []*string{&c.CertFile, &c.KeyFile} {
+		fullPath, err := filepath.Abs(strings.Trim(*name, " "))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		*name = fullPath
+	}
+	c.Secure = true
+	return nil
+}
+
+// loadAdminCA loads PEM certificates of authorities which issue client certificates of admins,
+// they are checked only by TLS connections, so cert_file and key_file are required.
+func (c *Cfg) loadAdminCA() error {
+	if c.AdminClientCA == "" {
+		c.adminCAs = nil
+		return nil
+	}
+	if !c.TLS() {
+		return errors.New("admin_client_ca requires cert_file and key_file")
+	}
+	data, err := ioutil.ReadFile(strings.Trim(c.AdminClientCA, " "))
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in admin_client_ca %v", c.AdminClientCA)
+	}
+	c.adminCAs = pool
+	return nil
+}
+
+// AdminClientCAs returns authorities of admins client certificates, it's nil if they are not required.
+func (c *Cfg) AdminClientCAs() *x509.CertPool {
+	return c.adminCAs
+}
+
+// loadTemplates loads HTML templates to memory. If template_dir is set,
+// "<name>.html" files from it are used instead of embedded pages, a missing file is replaced by the default.
 func (c *Cfg) loadTemplates() error {
 	if len(c.Templates) > 0 {
 		return errors.New("templates are already loaded")
 	}
 	pages := map[string]string{
-		"index":  page.Index,
-		"error":  page.Error,
-		"result": page.Result,
-		"read":   page.Read,
+		"index":   page.Index,
+		"error":   page.Error,
+		"result":  page.Result,
+		"read":    page.Read,
+		"confirm": page.Confirm,
+		"claim":   page.Claim,
+		"used":    page.Used,
+		"expired": page.Expired,
 	}
-	c.Templates = make(map[string]*template.Template, len(pages))
-	for name, content := range pages {
-		tpl, err := template.New(name).Parse(content)
+	if c.TemplateDir != "" {
+		info, err := os.Stat(c.TemplateDir)
 		if err != nil {
 			return err
 		}
-		c.Templates[name] = tpl
+		if !info.IsDir() {
+			return fmt.Errorf("template_dir %v is not a directory", c.TemplateDir)
+		}
 	}
+	templates := make(map[string]*template.Template, len(pages))
+	for name, content := range pages {
+		if c.TemplateDir != "" {
+			data, err := ioutil.ReadFile(filepath.Join(c.TemplateDir, name+".html"))
+			switch {
+			case err == nil:
+				content = string(data)
+			case !os.IsNotExist(err):
+				return err
+			}
+		}
+		tpl, err := template.New(name).Funcs(page.Funcs(c.BasePath)).Parse(content)
+		if err != nil {
+			return fmt.Errorf("template %v: %v", name, err)
+		}
+		templates[name] = tpl
+	}
+	c.Templates = templates
 	return nil
 }
 
+// loadBasePath normalizes the sub-path of the service, it's empty for the root deployment
+// or starts with a slash without a trailing one.
+func (c *Cfg) loadBasePath() error {
+	basePath := strings.Trim(c.BasePath, "/ ")
+	if basePath == "" {
+		c.BasePath = ""
+		return nil
+	}
+	basePath = "/" + basePath
+	if (path.Clean(basePath) != basePath) || strings.ContainsAny(basePath, "?#%") {
+		return fmt.Errorf("invalid base_path %q", c.BasePath)
+	}
+	c.BasePath = basePath
+	return nil
+}
+
+// URLPath returns the service path p with the base path prefix.
+func (c *Cfg) URLPath(p string) string {
+	return c.BasePath + p
+}
+
+// StripBasePath returns the service path of the request path without the base path prefix,
+// false is returned if the path is out of the base one.
+func (c *Cfg) StripBasePath(p string) (string, bool) {
+	if c.BasePath == "" {
+		return p, true
+	}
+	if p == c.BasePath {
+		return "/", true
+	}
+	if !strings.HasPrefix(p, c.BasePath+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(p, c.BasePath), true
+}
+
 // Addr returns service's net address.
 func (c *Cfg) Addr() string {
 	return net.JoinHostPort(c.Host, fmt.Sprint(c.Port))
 }
 
+// TLS returns true if the service should serve HTTPS directly.
+func (c *Cfg) TLS() bool {
+	return (c.CertFile != "") && (c.KeyFile != "")
+}
+
 // HandleTimeout is service timeout.
 func (c *Cfg) HandleTimeout() time.Duration {
 	return c.timeout
 }
 
+// LabelSecret returns the server key of items labels, it's nil if labels are disabled.
+func (c *Cfg) LabelSecret() []byte {
+	return c.labelKey
+}
+
+// SessionSecret returns the server key of uploader sessions, it's nil if sessions are disabled.
+func (c *Cfg) SessionSecret() []byte {
+	return c.sessionKey
+}
+
+// ServerTimeouts returns read, write and idle timeouts of HTTP server.
+func (c *Cfg) ServerTimeouts() (time.Duration, time.Duration, time.Duration) {
+	return time.Duration(c.ReadTimeout) * time.Second,
+		time.Duration(c.WriteTimeout) * time.Second,
+		time.Duration(c.IdleTimeout) * time.Second
+}
+
 // MaxFileSize return max file size.
 func (c *Cfg) MaxFileSize() int {
 	return c.Settings.Size << 20
 }
 
+// Maintenance returns current maintenance mode.
+func (c *Cfg) Maintenance() string {
+	if mode, ok := c.maintenance.Load().(string); ok {
+		return mode
+	}
+	return MaintenanceOff
+}
+
+// MaintenanceDelay returns a delay before a retry of the request if the service is unavailable.
+func (c *Cfg) MaintenanceDelay() time.Duration {
+	return time.Duration(c.MaintenanceRetry) * time.Second
+}
+
+// SetMaintenance changes maintenance mode, it's not saved and is off after restart.
+func (c *Cfg) SetMaintenance(mode string) error {
+	switch mode {
+	case MaintenanceOff, MaintenanceReadOnly, MaintenanceFull:
+		c.maintenance.Store(mode)
+		return nil
+	}
+	return fmt.Errorf("unsupported maintenance mode %v", mode)
+}
+
+// TrustedHosts returns allowed hosts of X-Forwarded-Host header,
+// it's nil if proxy headers are not trusted.
+func (c *Cfg) TrustedHosts() []string {
+	if !c.TrustProxyHeaders {
+		return nil
+	}
+	return c.AllowedHosts
+}
+
+// IsAllowedFile checks the file name by allowed and blocked extensions settings.
+// The comparison is case-insensitive and uses suffixes, so compound extensions
+// like ".tar.gz" are supported. An empty allowed list permits all not blocked files.
+func (c *Cfg) IsAllowedFile(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range c.Settings.BlockedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return false
+		}
+	}
+	if len(c.Settings.AllowedExtensions) == 0 {
+		return true
+	}
+	for _, ext := range c.Settings.AllowedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowedContentType checks the media type can be set by uploaders,
+// an empty allowed list disables such overrides.
+func (c *Cfg) IsAllowedContentType(mediaType string) bool {
+	for _, t := range c.Settings.ContentTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
 // Close frees resources.
 func (c *Cfg) Close() error {
+	c.Webhook.Close()
 	close(c.Ch)
 	return c.Db.Close()
 }
 
-// Secret returns secret string.
-func (c *Cfg) Secret(p string) string {
-	return p + c.Salt
+// checkSalts validates the legacy salt and named versions, the current version should be one of them.
+// The legacy salt can be omitted only if the current version is set.
+func (c *Cfg) checkSalts() error {
+	if (c.SaltVersion == "") || (c.Salt != "") {
+		if len(c.Salt) < MinSaltLength {
+			return fmt.Errorf("salt should contain at least %v characters, "+
+				"note that a new salt makes all already stored items unreadable", MinSaltLength)
+		}
+	}
+	for version, salt := range c.Salts {
+		if (version == "") || (len(version) > MaxSaltVersionLength) {
+			return fmt.Errorf("salt version name length should be in range [1 - %v]", MaxSaltVersionLength)
+		}
+		if len(salt) < MinSaltLength {
+			return fmt.Errorf("salt version %q should contain at least %v characters", version, MinSaltLength)
+		}
+	}
+	if _, ok := c.Salts[c.SaltVersion]; (c.SaltVersion != "") && !ok {
+		return fmt.Errorf("unknown current salt version %q", c.SaltVersion)
+	}
+	return nil
+}
+
+// Secret returns secret string of the password with the server salt of the version,
+// empty version is the legacy salt. A removed version makes its items unreadable.
+func (c *Cfg) Secret(p, version string) string {
+	if version == "" {
+		return p + c.Salt
+	}
+	return p + c.Salts[version]
 }
 
 // New returns new configuration.
@@ -167,11 +1042,26 @@ func New(filename string, l *log.Logger) (*Cfg, error) {
 	if err != nil {
 		return nil, err
 	}
-	database, err := sql.Open("sqlite3", c.DbSource)
+	database, err := sql.Open(c.Driver, c.dataSource())
 	if err != nil {
 		return nil, err
 	}
+	database.SetMaxOpenConns(c.MaxOpenConns)
+	database.SetMaxIdleConns(c.MaxIdleConns)
+	database.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetime) * time.Second)
+	_, err = db.Migrate(database)
+	if err != nil {
+		if e := database.Close(); e != nil {
+			l.Printf("close database: %v", e)
+		}
+		return nil, err
+	}
 	c.Db = database
+	if c.Deduplicate {
+		c.Dedup = db.NewDedup(database, c.Secret("", c.SaltVersion))
+	}
 	c.ErrLogger = l
+	c.Webhook = webhook.New(c.WebhookURL, c.WebhookSecret, WebhookQueue, c.timeout, l)
+	c.Scanner = scanner.New(c.ClamdAddr, c.timeout)
 	return c, nil
 }
@@ -1,9 +1,20 @@
 package conf
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/z0rr0/unigma/db"
 )
 
 const (
@@ -25,6 +36,9 @@ func TestNew(t *testing.T) {
 	if cfg.Addr() == "" {
 		t.Error("empty address")
 	}
+	if n := cfg.Settings.Iterations; n < MinIterations {
+		t.Errorf("failed iterations: %v", n)
+	}
 	cfg.Settings.Size = 4
 	if m := cfg.MaxFileSize(); m != (1048576 * 4) {
 		t.Error(m)
@@ -34,3 +48,704 @@ func TestNew(t *testing.T) {
 		t.Errorf("close error: %v", err)
 	}
 }
+
+func TestLoadTLS(t *testing.T) {
+	f, err := ioutil.TempFile("", "unigma-tls-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name()
+	defer func() {
+		if err := os.Remove(name); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		cert, key string
+		fail, tls bool
+	}{
+		{},
+		{cert: name, key: name, tls: true},
+		{cert: name, fail: true},
+		{key: name, fail: true},
+		{cert: name, key: "/bad_file_path.pem", fail: true},
+	}
+	for i, c := range cases {
+		cfg := &Cfg{CertFile: c.cert, KeyFile: c.key}
+		err = cfg.loadTLS()
+		if c.fail {
+			if err == nil {
+				t.Errorf("[%v] expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%v] unexpected error: %v", i, err)
+		}
+		if cfg.TLS() != c.tls {
+			t.Errorf("[%v] failed TLS", i)
+		}
+		if cfg.Secure != c.tls {
+			t.Errorf("[%v] failed secure flag", i)
+		}
+	}
+}
+
+func TestAutoPasswordLength(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	if n := cfg.Settings.AutoPasswordLength; n < MinAutoPasswordLength {
+		t.Errorf("failed auto password length: %v", n)
+	}
+	cfg.Settings.AutoPasswordLength = MinAutoPasswordLength - 1
+	cfg.Templates = nil
+	if err = cfg.isValid(); err == nil {
+		t.Error("expected error for short auto password length")
+	}
+}
+
+func TestShortFormat(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	if f := cfg.Settings.ShortFormat; f != ShortVerbose {
+		t.Errorf("failed default short format: %v", f)
+	}
+	cfg.Settings.ShortFormat = "xml"
+	cfg.Templates = nil
+	if err = cfg.isValid(); err == nil {
+		t.Error("expected error for unsupported short format")
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	if (cfg.Settings.MultipartMemory != DefaultMultipartMemory) || (cfg.Settings.FileField != DefaultFileField) {
+		t.Errorf("failed multipart settings: %v, %v", cfg.Settings.MultipartMemory, cfg.Settings.FileField)
+	}
+	for _, name := range []string{"document", "upload_file-1"} {
+		cfg.Settings.FileField = name
+		cfg.Templates = nil
+		if err = cfg.isValid(); err != nil {
+			t.Errorf("failed field name %v: %v", name, err)
+		}
+	}
+	for _, name := range []string{"my file", "файл", "a\"b", strings.Repeat("a", maxFileFieldLength+1)} {
+		cfg.Settings.FileField = name
+		cfg.Templates = nil
+		if err = cfg.isValid(); err == nil {
+			t.Errorf("expected error for field name %v", name)
+		}
+	}
+	cfg.Settings.FileField = DefaultFileField
+	cfg.Settings.MultipartMemory = -1
+	cfg.Templates = nil
+	if err = cfg.isValid(); err == nil {
+		t.Error("expected error for negative multipart memory")
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	if cfg.Settings.MinTTL != 1 {
+		t.Errorf("failed default min TTL: %v", cfg.Settings.MinTTL)
+	}
+	cfg.Settings.MinTTL = cfg.Settings.TTL + 1
+	cfg.Templates = nil
+	if err = cfg.isValid(); err == nil {
+		t.Error("expected error for min TTL greater than max")
+	}
+}
+
+func TestTTLPresets(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	if n := len(cfg.Settings.TTLPresets); n != len(defaultTTLPresets) {
+		t.Errorf("failed default presets number: %v", n)
+	}
+	presets, err := loadTTLPresets(nil, 1, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(presets); n != 2 {
+		t.Errorf("failed limited default presets number: %v", n)
+	}
+	values := []struct {
+		presets []TTLPreset
+		fail    bool
+	}{
+		{presets: []TTLPreset{{Label: "2 days", Seconds: 172800}}},
+		{presets: []TTLPreset{{Label: "", Seconds: 60}}, fail: true},
+		{presets: []TTLPreset{{Label: "zero", Seconds: 0}}, fail: true},
+		{presets: []TTLPreset{{Label: "year", Seconds: 31536000}}, fail: true},
+	}
+	for i, v := range values {
+		_, err = loadTTLPresets(v.presets, 1, cfg.Settings.TTL)
+		if v.fail != (err != nil) {
+			t.Errorf("[%v] failed check: %v", i, err)
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout = 0, 600, 0
+	if err = cfg.loadServerTimeouts(); err != nil {
+		t.Fatal(err)
+	}
+	read, write, idle := cfg.ServerTimeouts()
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if (read != timeout) || (write != 10*time.Minute) || (idle != timeout) {
+		t.Errorf("failed timeouts: %v, %v, %v", read, write, idle)
+	}
+	cfg.IdleTimeout = -1
+	if err = cfg.loadServerTimeouts(); err == nil {
+		t.Error("expected error for negative timeout")
+	}
+}
+
+func TestTrustedHosts(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	cfg.AllowedHosts = []string{" Example.COM:443 ", "[::1]"}
+	if err = cfg.loadAllowedHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := cfg.TrustedHosts(); hosts != nil {
+		t.Errorf("not trusted hosts are returned: %v", hosts)
+	}
+	cfg.TrustProxyHeaders = true
+	if hosts := cfg.TrustedHosts(); (len(hosts) != 2) || (hosts[0] != "Example.COM:443") || (hosts[1] != "[::1]") {
+		t.Errorf("failed trusted hosts: %v", hosts)
+	}
+	cfg.AllowedHosts = nil
+	if err = cfg.loadAllowedHosts(); err == nil {
+		t.Error("expected error for empty allowed_hosts")
+	}
+	cfg.AllowedHosts = []string{" "}
+	if err = cfg.loadAllowedHosts(); err == nil {
+		t.Error("expected error for empty host")
+	}
+}
+
+func TestTemplateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-templates-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("custom {{.MaxSize}}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Cfg{TemplateDir: dir}
+	if err = cfg.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cfg.Templates); n != 8 {
+		t.Errorf("failed templates count: %v", n)
+	}
+	b := &bytes.Buffer{}
+	if err = cfg.Templates["index"].Execute(b, struct{ MaxSize int }{MaxSize: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); s != "custom 16" {
+		t.Errorf("failed custom template: %v", s)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "read.html"), []byte("{{.Bad"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = &Cfg{TemplateDir: dir}
+	if err = cfg.loadTemplates(); err == nil {
+		t.Error("expected error for invalid template")
+	}
+	cfg = &Cfg{TemplateDir: filepath.Join(dir, "index.html")}
+	if err = cfg.loadTemplates(); err == nil {
+		t.Error("expected error for not directory")
+	}
+}
+
+func TestIsAllowedFile(t *testing.T) {
+	allowed, err := loadExtensions([]string{"PDF", ".tar.gz", " .txt "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := loadExtensions([]string{".exe", "sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadExtensions([]string{" . "}); err == nil {
+		t.Error("expected error for empty extension")
+	}
+	cfg := &Cfg{}
+	cases := []struct {
+		name    string
+		allowed []string
+		blocked []string
+		result  bool
+	}{
+		{name: "test.exe", result: true},
+		{name: "test.exe", blocked: blocked},
+		{name: "TEST.EXE", blocked: blocked},
+		{name: "test.pdf", blocked: blocked, result: true},
+		{name: "test.pdf", allowed: allowed, blocked: blocked, result: true},
+		{name: "test.Pdf", allowed: allowed, result: true},
+		{name: "test.tar.gz", allowed: allowed, result: true},
+		{name: "test.gz", allowed: allowed},
+		{name: "test.txt.exe", allowed: allowed, blocked: blocked},
+		{name: "test.exe", allowed: allowed},
+	}
+	for i, c := range cases {
+		cfg.Settings.AllowedExtensions, cfg.Settings.BlockedExtensions = c.allowed, c.blocked
+		if r := cfg.IsAllowedFile(c.name); r != c.result {
+			t.Errorf("[%v] failed result for %v: %v", i, c.name, r)
+		}
+	}
+}
+
+func TestIsAllowedContentType(t *testing.T) {
+	for _, v := range []string{"text", "text/plain; charset=utf-8", "", "text/"} {
+		if _, err := loadContentTypes([]string{v}); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+	types, err := loadContentTypes([]string{"Text/Plain", " application/json "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Cfg{}
+	if cfg.IsAllowedContentType("text/plain") {
+		t.Error("allowed type without settings")
+	}
+	cfg.Settings.ContentTypes = types
+	cases := map[string]bool{"text/plain": true, "application/json": true, "text/html": false, "text": false}
+	for value, expected := range cases {
+		if r := cfg.IsAllowedContentType(value); r != expected {
+			t.Errorf("failed result for %v: %v", value, r)
+		}
+	}
+}
+
+func TestCheckWebhook(t *testing.T) {
+	cases := []struct {
+		url    string
+		secret string
+		valid  bool
+	}{
+		{valid: true},
+		{url: "https://example.com/hook", secret: "abc", valid: true},
+		{url: "http://localhost:8080/hook", secret: "abc", valid: true},
+		{url: "https://example.com/hook"},
+		{url: "ftp://example.com/hook", secret: "abc"},
+		{url: "example.com/hook", secret: "abc"},
+	}
+	for i, c := range cases {
+		cfg := &Cfg{WebhookURL: c.url, WebhookSecret: c.secret}
+		if err := cfg.checkWebhook(); (err == nil) != c.valid {
+			t.Errorf("[%v] failed check: %v", i, err)
+		}
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	values := []struct {
+		value string
+		mode  os.FileMode
+		fail  bool
+	}{
+		{value: "", mode: 0600},
+		{value: "0600", mode: 0600},
+		{value: "640", mode: 0640},
+		{value: "0660", mode: 0660},
+		{value: "0644", fail: true},
+		{value: "0700", fail: true},
+		{value: "0400", fail: true},
+		{value: "0o600", fail: true},
+		{value: "rw", fail: true},
+	}
+	for i, v := range values {
+		mode, err := parseFileMode(v.value)
+		if v.fail != (err != nil) {
+			t.Errorf("[%v] failed check: %v", i, err)
+		}
+		if mode != v.mode {
+			t.Errorf("[%v] failed mode: %#o", i, mode)
+		}
+	}
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	cfg.FileMode = "0640"
+	cfg.Templates = nil
+	if err = cfg.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	hash := "file-mode-test"
+	f, err := cfg.Backend.Writer(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Error(err)
+	}
+	defer func() {
+		if err := cfg.Backend.Remove(hash); err != nil {
+			t.Error(err)
+		}
+	}()
+	info, err := os.Stat(filepath.Join(cfg.StorageDir, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0640 {
+		t.Errorf("failed file mode: %#o", mode)
+	}
+}
+
+func TestSalt(t *testing.T) {
+	data, err := ioutil.ReadFile(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "unigma-salt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	config := filepath.Join(dir, "config.json")
+	for _, salt := range []string{"", "abc", "123456789012345"} {
+		settings["salt"] = salt
+		if data, err = json.Marshal(settings); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(config, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = New(config, loggerInfo); err == nil {
+			t.Errorf("expected error for salt %q", salt)
+		}
+	}
+	settings["salt"] = "1234567890123456"
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := New(config, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckSalts(t *testing.T) {
+	salt := "1234567890123456"
+	values := []struct {
+		cfg   *Cfg
+		valid bool
+	}{
+		{cfg: &Cfg{Salt: salt}, valid: true},
+		{cfg: &Cfg{Salts: map[string]string{"v1": salt}, SaltVersion: "v1"}, valid: true},
+		{cfg: &Cfg{Salt: salt, Salts: map[string]string{"v1": salt}}, valid: true},
+		{cfg: &Cfg{Salts: map[string]string{"v1": salt}}},
+		{cfg: &Cfg{Salt: "short", Salts: map[string]string{"v1": salt}, SaltVersion: "v1"}},
+		{cfg: &Cfg{Salt: salt, Salts: map[string]string{"v1": "short"}}},
+		{cfg: &Cfg{Salt: salt, Salts: map[string]string{"": salt}}},
+		{cfg: &Cfg{Salt: salt, Salts: map[string]string{strings.Repeat("v", MaxSaltVersionLength+1): salt}}},
+		{cfg: &Cfg{Salt: salt, Salts: map[string]string{"v1": salt}, SaltVersion: "v2"}},
+	}
+	for i, v := range values {
+		err := v.cfg.checkSalts()
+		if v.valid && (err != nil) {
+			t.Errorf("[%v] unexpected error: %v", i, err)
+		}
+		if !v.valid && (err == nil) {
+			t.Errorf("[%v] expected error", i)
+		}
+	}
+	cfg := &Cfg{Salt: "legacy", Salts: map[string]string{"v1": "first"}}
+	if s := cfg.Secret("p", ""); s != "plegacy" {
+		t.Errorf("failed legacy secret: %v", s)
+	}
+	if s := cfg.Secret("p", "v1"); s != "pfirst" {
+		t.Errorf("failed version secret: %v", s)
+	}
+}
+
+func TestLoadEnvelope(t *testing.T) {
+	key := strings.Repeat("ab", db.EnvelopeKeySize)
+	values := []struct {
+		keys    map[string]string
+		version int
+		valid   bool
+	}{
+		{valid: true},
+		{keys: map[string]string{"1": key}, valid: true},
+		{keys: map[string]string{"1": key, "2": key}, version: 2, valid: true},
+		{version: 1},
+		{keys: map[string]string{"1": key}, version: 2},
+		{keys: map[string]string{"1": key}, version: 257},
+		{keys: map[string]string{"0": key}},
+		{keys: map[string]string{"256": key}},
+		{keys: map[string]string{"v1": key}},
+		{keys: map[string]string{"1": "abc"}},
+	}
+	for i, v := range values {
+		cfg := &Cfg{EnvelopeKeys: v.keys, EnvelopeVersion: v.version, Backend: &db.FileStorage{}}
+		err := cfg.loadEnvelope()
+		if v.valid && (err != nil) {
+			t.Errorf("[%v] unexpected error: %v", i, err)
+		}
+		if !v.valid && (err == nil) {
+			t.Errorf("[%v] expected error", i)
+		}
+		if _, ok := cfg.Backend.(*db.EnvelopeStorage); (err == nil) && (ok != (len(v.keys) > 0)) {
+			t.Errorf("[%v] failed backend: %T", i, cfg.Backend)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	values := []struct {
+		value, expected string
+		valid           bool
+	}{
+		{value: "", expected: "", valid: true},
+		{value: "/", expected: "", valid: true},
+		{value: "unigma", expected: "/unigma", valid: true},
+		{value: "/unigma/", expected: "/unigma", valid: true},
+		{value: "/a/b", expected: "/a/b", valid: true},
+		{value: "/a/../b"},
+		{value: "/a//b"},
+		{value: "/a?b"},
+	}
+	for i, v := range values {
+		cfg := &Cfg{BasePath: v.value}
+		err := cfg.loadBasePath()
+		if !v.valid {
+			if err == nil {
+				t.Errorf("[%v] expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%v] unexpected error: %v", i, err)
+		}
+		if cfg.BasePath != v.expected {
+			t.Errorf("[%v] failed base path: %v", i, cfg.BasePath)
+		}
+	}
+	cfg := &Cfg{BasePath: "/unigma"}
+	if p := cfg.URLPath("/upload"); p != "/unigma/upload" {
+		t.Errorf("failed URL path: %v", p)
+	}
+	paths := map[string]string{
+		"/unigma":        "/",
+		"/unigma/":       "/",
+		"/unigma/upload": "/upload",
+		"/upload":        "",
+		"/unigmax":       "",
+	}
+	for p, expected := range paths {
+		servicePath, ok := cfg.StripBasePath(p)
+		if (servicePath != expected) || (ok != (expected != "")) {
+			t.Errorf("failed stripped path %v: %v, %v", p, servicePath, ok)
+		}
+	}
+}
+
+func TestAdminClientCA(t *testing.T) {
+	cfg, err := New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	if cfg.AdminClientCAs() != nil {
+		t.Error("client certificates are required by default")
+	}
+	cfg.AdminClientCA = "/tmp/unigma_ca.pem"
+	cfg.Templates = nil
+	if err = cfg.isValid(); err == nil {
+		t.Error("expected error for admin_client_ca without TLS")
+	}
+}
+
+func TestDataSource(t *testing.T) {
+	cases := []struct {
+		driver string
+		source string
+		result string
+	}{
+		{driver: "postgres", source: "postgres://localhost/unigma", result: "postgres://localhost/unigma"},
+		{driver: "sqlite3", source: "db.sqlite", result: "db.sqlite?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"},
+		{driver: "sqlite3", source: "file:db.sqlite?_timeout=100", result: "file:db.sqlite?_timeout=100&_journal_mode=WAL&_txlock=immediate"},
+		{driver: "sqlite3", source: "db.sqlite?_journal=DELETE&_busy_timeout=1&_txlock=deferred", result: "db.sqlite?_journal=DELETE&_busy_timeout=1&_txlock=deferred"},
+	}
+	for i, c := range cases {
+		cfg := &Cfg{Driver: c.driver, DbSource: c.source}
+		if r := cfg.dataSource(); r != c.result {
+			t.Errorf("[%v] failed source: %v", i, r)
+		}
+	}
+	cfg := &Cfg{Driver: "sqlite3"}
+	if err := cfg.checkPool(); err != nil {
+		t.Fatal(err)
+	}
+	if (cfg.MaxOpenConns != DefaultSQLiteConns) || (cfg.MaxIdleConns != DefaultSQLiteConns) {
+		t.Errorf("failed default pool: %v, %v", cfg.MaxOpenConns, cfg.MaxIdleConns)
+	}
+	cfg = &Cfg{Driver: "postgres", MaxIdleConns: 2}
+	if err := cfg.checkPool(); err != nil {
+		t.Fatal(err)
+	}
+	if (cfg.MaxOpenConns != 0) || (cfg.MaxIdleConns != 2) {
+		t.Errorf("failed pool: %v, %v", cfg.MaxOpenConns, cfg.MaxIdleConns)
+	}
+	cfg = &Cfg{Driver: "sqlite3", MaxOpenConns: -1}
+	if err := cfg.checkPool(); err == nil {
+		t.Error("expected error for negative value")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-pool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	data, err := ioutil.ReadFile(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["db"] = filepath.Join(dir, "db.sqlite")
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := New(config, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfg.Db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	const workers, times = 16, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*(times+1))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				errs <- err
+				return
+			}
+			now := time.Now().UTC()
+			item := &db.Item{Name: "abc", Salt: "abc", Hash: hex.EncodeToString(b), Counter: times, Created: now, Expired: now.Add(time.Hour)}
+			if err := item.Save(cfg.Db); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < times; j++ {
+				if _, err := item.Decrement(cfg.Db, loggerInfo); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write error: %v", err)
+	}
+	var n int
+	if err = cfg.Db.QueryRow("SELECT COUNT(*) FROM `storage` WHERE `counter`=0;").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != workers {
+		t.Errorf("failed number of used items: %v", n)
+	}
+}
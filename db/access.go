@@ -0,0 +1,72 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"net"
+	"time"
+)
+
+// AccessLogTTL is a lifetime of access log records, they are kept after item's deletion.
+const AccessLogTTL = 30 * 24 * time.Hour
+
+// Access is a record of a download attempt.
+type Access struct {
+	Success bool      `json:"success"`
+	IP      string    `json:"ip"`
+	Created time.Time `json:"created"`
+}
+
+// truncateIP hides the host part of the address, IPv4 is masked by /24 and IPv6 by /48.
+func truncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// RecordAccess saves a download attempt of the item with truncated client's IP address.
+func (item *Item) RecordAccess(db *sql.DB, success bool, ip string) error {
+	query := dialectOf(db).query("INSERT INTO `access_log` (`hash`, `success`, `ip`, `created`) VALUES (?, ?, ?, ?);")
+	_, err := db.Exec(query, item.Hash, success, truncateIP(ip), time.Now().UTC())
+	return err
+}
+
+// ReadAccessLog returns download attempts of the item with the hash in chronological order.
+func ReadAccessLog(db *sql.DB, hash string) ([]*Access, error) {
+	query := dialectOf(db).query("SELECT `success`, `ip`, `created` FROM `access_log` WHERE `hash`=? ORDER BY `id`;")
+	rows, err := db.Query(query, hash)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Access, 0)
+	for rows.Next() {
+		a := &Access{}
+		if err = rows.Scan(&a.Success, &a.IP, &a.Created); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	return result, rows.Err()
+}
+
+// deleteAccessLog removes outdated access log records.
+func deleteAccessLog(db *sql.DB) (int64, error) {
+	query := dialectOf(db).query("DELETE FROM `access_log` WHERE `created`<?;")
+	r, err := db.Exec(query, time.Now().UTC().Add(-AccessLogTTL))
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
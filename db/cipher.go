@@ -0,0 +1,290 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// FormatOFB is a legacy storage format, AES-256-OFB stream without a header.
+	FormatOFB = 0
+	// FormatGCM is AES-256-GCM storage format, the file starts with a version byte
+	// and contains sealed chunks of gcmChunkSize bytes.
+	FormatGCM = 1
+	// FormatSealed is client-side encrypted data, it's stored and returned as is.
+	FormatSealed = 2
+	// gcmChunkSize is a plain text size of one sealed chunk.
+	gcmChunkSize = 64 << 10
+	// gcmTagSize is authentication tag size of one sealed chunk.
+	gcmTagSize = 16
+	// LabelKeySize is a size of the server key of items labels.
+	LabelKeySize = 32
+)
+
+// ErrIntegrity is an error of an authenticated decryption.
+var ErrIntegrity = errors.New("integrity check failed")
+
+// gcmNonce returns a nonce for the chunk number n,
+// the first byte marks the last chunk to detect a truncation.
+func gcmNonce(aead cipher.AEAD, n uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// newGCM returns AES-GCM AEAD for the key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealText returns a hex encoded random nonce with the text sealed by AES-GCM.
+func sealText(text string, key []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(aead.Seal(nonce, nonce, []byte(text), nil)), nil
+}
+
+// openText returns plain text of the value which is sealed by sealText,
+// it's ErrIntegrity if the value was modified.
+func openText(value string, key []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return "", ErrIntegrity
+	}
+	if len(data) < aead.NonceSize() {
+		return "", ErrIntegrity
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrIntegrity
+	}
+	return string(plain), nil
+}
+
+// EncryptLabel encrypts item's label by the server key, it doesn't depend on user's password.
+// The result is a hex encoded random nonce with a sealed label.
+func EncryptLabel(label string, key []byte) (string, error) {
+	return sealText(label, key)
+}
+
+// DecryptLabel decrypts item's label by the server key.
+func DecryptLabel(value string, key []byte) (string, error) {
+	return openText(value, key)
+}
+
+// encryptGCM reads plain text from r and writes the version byte and sealed chunks to w.
+// It returns a size of the plain text.
+func encryptGCM(w io.Writer, r io.Reader, key []byte) (int64, error) {
+	var size int64
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.Write([]byte{FormatGCM}); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReaderSize(r, gcmChunkSize)
+	buf := make([]byte, gcmChunkSize, gcmChunkSize+aead.Overhead())
+	for n := uint64(0); ; n++ {
+		m, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+		size += int64(m)
+		last := m < gcmChunkSize
+		if !last {
+			// a full chunk can be the last one too
+			if _, e := reader.Peek(1); e == io.EOF {
+				last = true
+			}
+		}
+		sealed := aead.Seal(buf[:0], gcmNonce(aead, n, last), buf[:m], nil)
+		if _, err = w.Write(sealed); err != nil {
+			return size, err
+		}
+		if last {
+			return size, nil
+		}
+		buf = buf[:gcmChunkSize]
+	}
+}
+
+// decryptGCM reads the version byte and sealed chunks from r and writes plain text to w.
+// It returns ErrIntegrity if any chunk was modified or the stream was truncated.
+func decryptGCM(w io.Writer, r io.Reader, key []byte) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if err = readVersion(r, FormatGCM); err != nil {
+		return err
+	}
+	return openChunks(w, r, aead, 0)
+}
+
+// decryptGCMRange decrypts only chunks which contain plain text bytes [start; end]
+// and writes these bytes to w.
+func decryptGCMRange(w io.Writer, r io.ReadSeeker, key []byte, start, end int64) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if err = readVersion(r, FormatGCM); err != nil {
+		return err
+	}
+	n := start / gcmChunkSize
+	_, err = r.Seek(1+n*int64(gcmChunkSize+aead.Overhead()), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	rw := &rangeWriter{w: w, skip: start - n*gcmChunkSize, left: end - start + 1}
+	err = openChunks(rw, r, aead, uint64(n))
+	if err == errRangeDone {
+		return nil
+	}
+	return err
+}
+
+// readVersion reads the version byte from r and compares it with expected format.
+func readVersion(r io.Reader, format byte) error {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		if err == io.EOF {
+			return ErrIntegrity
+		}
+		return err
+	}
+	if version[0] != format {
+		return fmt.Errorf("unexpected storage format %v", version[0])
+	}
+	return nil
+}
+
+// openChunks reads sealed chunks from r starting from the chunk number n,
+// and writes plain text to w.
+func openChunks(w io.Writer, r io.Reader, aead cipher.AEAD, n uint64) error {
+	reader := bufio.NewReaderSize(r, gcmChunkSize+aead.Overhead())
+	buf := make([]byte, gcmChunkSize+aead.Overhead())
+	for ; ; n++ {
+		m, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := m < len(buf)
+		if !last {
+			if _, e := reader.Peek(1); e == io.EOF {
+				last = true
+			}
+		}
+		plain, err := aead.Open(buf[:0], gcmNonce(aead, n, last), buf[:m], nil)
+		if err != nil {
+			return ErrIntegrity
+		}
+		if _, err = w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf = buf[:cap(buf)]
+	}
+}
+
+// gcmPlainSize returns plain text size for FormatGCM file with size fileSize.
+func gcmPlainSize(fileSize int64) int64 {
+	const sealedSize = gcmChunkSize + gcmTagSize
+	body := fileSize - 1 // version byte
+	size := (body / sealedSize) * gcmChunkSize
+	if tail := body % sealedSize; tail > gcmTagSize {
+		size += tail - gcmTagSize
+	}
+	return size
+}
+
+// decryptOFBRange decrypts legacy FormatOFB stream bytes [start; end] and writes them to w.
+func decryptOFBRange(w io.Writer, r io.ReadSeeker, key []byte, start, end int64) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	var iv [aes.BlockSize]byte
+	stream := cipher.NewOFB(block, iv[:])
+	// OFB key stream doesn't depend on data, so just skip first start bytes
+	buf := make([]byte, 32<<10)
+	for skip := start; skip > 0; {
+		n := int64(len(buf))
+		if skip < n {
+			n = skip
+		}
+		stream.XORKeyStream(buf[:n], buf[:n])
+		skip -= n
+	}
+	if _, err = r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	reader := &cipher.StreamReader{S: stream, R: r}
+	_, err = io.CopyN(w, reader, end-start+1)
+	return err
+}
+
+// errRangeDone is returned by rangeWriter when all required bytes are written.
+var errRangeDone = errors.New("range is done")
+
+// rangeWriter skips first bytes and writes only left bytes to w.
+type rangeWriter struct {
+	w    io.Writer
+	skip int64
+	left int64
+}
+
+// Write implements io.Writer interface.
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if rw.skip > 0 {
+		if rw.skip >= int64(len(p)) {
+			rw.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[rw.skip:]
+		rw.skip = 0
+	}
+	if int64(len(p)) > rw.left {
+		p = p[:rw.left]
+	}
+	if _, err := rw.w.Write(p); err != nil {
+		return 0, err
+	}
+	rw.left -= int64(len(p))
+	if rw.left == 0 {
+		return n, errRangeDone
+	}
+	return n, nil
+}
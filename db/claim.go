@@ -0,0 +1,95 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"regexp"
+	"time"
+)
+
+const (
+	// ClaimTTL is max lifetime of a claim token, it's not longer than the item's one.
+	ClaimTTL = 24 * time.Hour
+	// claimLength is a length of claim token in bytes, it's also a key of the password encryption.
+	claimLength = 32
+)
+
+var rgClaim = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// IsClaimToken checks the value can be a claim token.
+func IsClaimToken(token string) bool {
+	return rgClaim.MatchString(token)
+}
+
+// NewClaim saves the password which can be revealed only once by a new claim token.
+// The password is encrypted by the token and only the token's hash is kept.
+func NewClaim(db *sql.DB, password string, expired time.Time) (string, error) {
+	key := make([]byte, claimLength)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(key)
+	value, err := encryptText(password, key)
+	if err != nil {
+		return "", err
+	}
+	query := dialectOf(db).query("INSERT INTO `claim` (`token`, `password`, `expired`) VALUES (?, ?, ?);")
+	_, err = db.Exec(query, ownerHash(token), value, expired)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Claim returns the password of the token and deletes it,
+// an empty value is returned for unknown, already claimed or expired token.
+func Claim(db *sql.DB, token string) (string, error) {
+	key, err := hex.DecodeString(token)
+	if (err != nil) || (len(key) != claimLength) {
+		return "", nil
+	}
+	var value string
+	d, hash := dialectOf(db), ownerHash(token)
+	err = InTransaction(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow(d.query("SELECT `password` FROM `claim` WHERE `token`=? AND `expired`>?;"), hash, time.Now().UTC()).Scan(&value)
+		if err != nil {
+			return err
+		}
+		r, err := tx.Exec(d.query("DELETE FROM `claim` WHERE `token`=?;"), hash)
+		if err != nil {
+			return err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// a concurrent request has already claimed it
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return decryptText(value, key)
+}
+
+// deleteClaims removes expired claim tokens.
+func deleteClaims(db *sql.DB) (int64, error) {
+	query := dialectOf(db).query("DELETE FROM `claim` WHERE `expired`<?;")
+	r, err := db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// countReader counts read bytes.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader interface.
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// compressReader is a reader of compressed data.
+type compressReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops the compression and waits its finish, so the source is not used after that.
+func (cr *compressReader) Close() error {
+	err := cr.PipeReader.Close()
+	<-cr.done
+	return err
+}
+
+// compress returns a reader of gzip compressed data from r.
+// It should be closed to stop compression if not all data is read.
+func compress(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	cr := &compressReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(cr.done)
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, r)
+		if e := gz.Close(); err == nil {
+			err = e
+		}
+		pw.CloseWithError(err)
+	}()
+	return cr
+}
+
+// decryptGCMCompressed decrypts FormatGCM stream of compressed data and writes decompressed result to w.
+func decryptGCMCompressed(w io.Writer, r io.Reader, key []byte) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := decryptGCM(pw, r, key)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := decompress(w, pr)
+	// stop decryption if decompression is failed
+	pr.CloseWithError(err)
+	if e := <-done; err == nil {
+		err = e
+	}
+	return err
+}
+
+// decompress writes decompressed data from r to w.
+func decompress(w io.Writer, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, gz)
+	if e := gz.Close(); err == nil {
+		err = e
+	}
+	return err
+}
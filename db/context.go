@@ -0,0 +1,46 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader stops reading when its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader interface.
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// contextReadCloser is a cancellable reader of the storage.
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+// contextReadSeekCloser is a cancellable reader of the storage which supports seeking.
+type contextReadSeekCloser struct {
+	contextReadCloser
+	io.Seeker
+}
+
+// withContext returns the storage reader which is stopped when ctx is done,
+// it keeps io.Seeker interface if r implements it.
+func withContext(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	rc := contextReadCloser{contextReader: contextReader{ctx: ctx, r: r}, Closer: r}
+	if s, ok := r.(io.Seeker); ok {
+		return &contextReadSeekCloser{contextReadCloser: rc, Seeker: s}
+	}
+	return &rc
+}
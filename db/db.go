@@ -6,14 +6,17 @@
 package db
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"mime"
@@ -25,6 +28,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/sha3"
@@ -33,29 +37,95 @@ import (
 const (
 	// saltSize is random salt, also used for storage file name
 	saltSize = 128
-	// pbkdf2Iter is number of pbkdf2 iterations
-	pbkdf2Iter = 32768
+	// DefaultIter is default number of pbkdf2 iterations,
+	// it is also used for items without stored value.
+	DefaultIter = 32768
 	// key length for AES-256
 	aesKeyLength = 32
 	// hashLength is length of file hash.
 	hashLength = 32
+	// storageIDLength is length of random storage file name in bytes.
+	storageIDLength = 32
+	// sealedNamePrefix marks a name sealed by AES-GCM, other names are legacy AES-CFB ones.
+	sealedNamePrefix = "gcm:"
 )
 
 var (
+	// ErrPassword is an error of invalid password.
+	ErrPassword = errors.New("failed password")
+	// ErrSealed is an error of invalid salt or hash of client-side encrypted data.
+	ErrSealed = errors.New("invalid salt or hash")
+	// ErrChecksum is an error of decrypted content which doesn't match the checksum of uploaded one.
+	ErrChecksum = errors.New("checksum mismatch")
 	// nameRegexp is regular expression to check encrypted name template.
 	nameRegexp = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{%d}$", hashLength*2))
+	// inlineTypes are content types which can be shown by a browser without XSS risk.
+	inlineTypes = map[string]bool{
+		"image/png":       true,
+		"image/jpeg":      true,
+		"image/gif":       true,
+		"image/webp":      true,
+		"application/pdf": true,
+		"text/plain":      true,
+	}
+	// compressibleTypes are not text content types which are worth to be compressed on the fly,
+	// other ones like images or archives are already compressed.
+	compressibleTypes = map[string]bool{
+		"application/json":       true,
+		"application/javascript": true,
+		"application/xml":        true,
+		"application/x-sh":       true,
+		"image/svg+xml":          true,
+	}
 )
 
 // Item is base data struct for incoming data.
 type Item struct {
-	ID      int64
-	Name    string
-	Path    string
-	Salt    string
-	Hash    string
-	Counter int
-	Created time.Time
-	Expired time.Time
+	ID         int64
+	Name       string
+	Path       string
+	Salt       string
+	Hash       string
+	StorageID  string
+	Counter    int
+	Format     int
+	Iter       int
+	MIME       string
+	Size       int64
+	Confirm    bool
+	Compressed bool
+	Owner      string
+	// Label is an optional note for admins, it's encrypted by the server key, not by user's password.
+	Label string
+	// MaxFails is a number of failed passwords which destroys the item, zero value is no limit.
+	MaxFails int
+	Fails    int
+	// SaltVersion is a name of the server salt which was used for the item, empty value is the legacy one.
+	SaltVersion string
+	// Checksum is SHA-256 of the plain content encrypted by the item's key, it's empty for old and sealed items.
+	Checksum string
+	// Session is a hash of the uploader session, it's empty if sessions are disabled.
+	Session string
+	// Blob is an identifier of the shared file of deduplicated item, it's empty for other ones.
+	Blob string
+	// ContentKey is a key of the shared file encrypted by the item's key.
+	ContentKey string
+	// Hint is an optional plain text reminder of the password which is shown on the download page.
+	Hint string
+	// Passwordless is a random password sealed by the server key, it's empty for items with user's passwords.
+	Passwordless string
+	Created      time.Time
+	Expired      time.Time
+	Storage      Storage
+	// Dedup enables deduplication of new item's content, nil value disables it.
+	Dedup  *Dedup
+	Inline bool
+	// DownloadName replaces the decrypted name in Content-Disposition header.
+	DownloadName string
+	// Verify requests the checksum check of the decrypted content.
+	Verify bool
+	// sum is hex encoded plain checksum, it's known only after encryption or verified decryption.
+	sum string
 }
 
 // InTransaction runs method f and does commit or rollback.
@@ -80,7 +150,11 @@ func InTransaction(db *sql.DB, f func(tx *sql.Tx) error) error {
 }
 
 // ContentType returns string content-type for stored file.
+// It's a saved during encryption value or it's detected by item's name.
 func (item *Item) ContentType() string {
+	if item.MIME != "" {
+		return item.MIME
+	}
 	var ext string
 	i := strings.LastIndex(item.Name, ".")
 	if i > -1 {
@@ -93,9 +167,28 @@ func (item *Item) ContentType() string {
 	return m
 }
 
+// Iterations returns number of pbkdf2 iterations used for item's key.
+func (item *Item) Iterations() int {
+	if item.Iter < 1 {
+		return DefaultIter
+	}
+	return item.Iter
+}
+
 // FullPath return full path for item's file.
 func (item *Item) FullPath() string {
-	return filepath.Join(item.Path, item.Hash)
+	if fs, ok := fileStorage(item.Storage); ok {
+		return fs.fullPath(item.storageKey())
+	}
+	return filepath.Join(item.Path, item.storageKey())
+}
+
+// backend returns item's storage, it's a file system storage in item's path by default.
+func (item *Item) backend() Storage {
+	if item.Storage == nil {
+		return &FileStorage{Dir: item.Path}
+	}
+	return item.Storage
 }
 
 // IsValidSecret checks the secret.
@@ -108,170 +201,538 @@ func (item *Item) IsValidSecret(secret string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	key, keyHash := Key(secret, salt)
+	key, keyHash := Key(secret, salt, item.Iterations())
 	if !hmac.Equal(hash, keyHash) {
-		return nil, errors.New("failed password")
+		return nil, ErrPassword
 	}
 	return key, nil
 }
 
-func (item *Item) encryptName(key []byte) error {
-	if item.Name == "" {
-		return errors.New("encrypt empty name")
-	}
+// encryptText returns hex encoded cipher text of the short item's metadata.
+func encryptText(text string, key []byte) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil
+		return "", errors.New("new cipher creation")
 	}
-	plainText := []byte(item.Name)
+	plainText := []byte(text)
 	cipherText := make([]byte, aes.BlockSize+len(plainText))
 	iv := cipherText[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return errors.New("iv random generation error")
+		return "", errors.New("iv random generation error")
 	}
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(cipherText[aes.BlockSize:], plainText)
-	item.Name = hex.EncodeToString(cipherText)
-	return nil
+	return hex.EncodeToString(cipherText), nil
 }
 
-func (item *Item) decryptName(key []byte) error {
-	if item.Name == "" {
-		return errors.New("decrypt empty name")
-	}
-	cipherText, err := hex.DecodeString(item.Name)
+// decryptText returns plain text of the metadata which is encrypted by encryptText.
+func decryptText(text string, key []byte) (string, error) {
+	cipherText, err := hex.DecodeString(text)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if len(cipherText) < aes.BlockSize {
-		return errors.New("invalid cipher block length")
+		return "", errors.New("invalid cipher block length")
 	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return errors.New("new cipher creation")
+		return "", errors.New("new cipher creation")
 	}
 	iv := cipherText[:aes.BlockSize]
 	cipherText = cipherText[aes.BlockSize:]
 	stream := cipher.NewCFBDecrypter(block, iv)
 	stream.XORKeyStream(cipherText, cipherText)
-	item.Name = string(cipherText)
+	return string(cipherText), nil
+}
+
+// encryptName seals the item's name by its key, so a modified name is detected during decryption.
+func (item *Item) encryptName(key []byte) error {
+	if item.Name == "" {
+		return errors.New("encrypt empty name")
+	}
+	name, err := sealText(item.Name, key)
+	if err != nil {
+		return err
+	}
+	item.Name = sealedNamePrefix + name
 	return nil
 }
 
+// decryptName restores the item's name, it's ErrIntegrity if the sealed name was modified.
+// Legacy names are not authenticated, so they are only checked to be a valid UTF-8 text.
+func (item *Item) decryptName(key []byte) error {
+	if item.Name == "" {
+		return errors.New("decrypt empty name")
+	}
+	var (
+		name string
+		err  error
+	)
+	if strings.HasPrefix(item.Name, sealedNamePrefix) {
+		name, err = openText(strings.TrimPrefix(item.Name, sealedNamePrefix), key)
+	} else {
+		name, err = decryptText(item.Name, key)
+		if (err == nil) && !utf8.ValidString(name) {
+			err = ErrIntegrity
+		}
+	}
+	if err != nil {
+		return err
+	}
+	item.Name = name
+	return nil
+}
+
+// ContentChecksum returns hex encoded SHA-256 of the plain content,
+// it's empty if the item wasn't encrypted or verified by the key yet.
+func (item *Item) ContentChecksum() string {
+	return item.sum
+}
+
+// PlainName returns decrypted name of the item, the item itself is not changed.
+func (item *Item) PlainName(key []byte) (string, error) {
+	c := *item
+	if err := c.decryptName(key); err != nil {
+		return "", err
+	}
+	return c.Name, nil
+}
+
 // Encrypt encrypts source file and fills the item by result.
+// The item's Iter value is used as number of pbkdf2 iterations, DefaultIter if it is not set.
 func (item *Item) Encrypt(inFile io.Reader, secret string, l *log.Logger) error {
+	return item.EncryptContext(context.Background(), inFile, secret, l)
+}
+
+// EncryptContext is Encrypt which is stopped when ctx is done,
+// a partially written file is removed in this case.
+func (item *Item) EncryptContext(ctx context.Context, inFile io.Reader, secret string, l *log.Logger) error {
+	if item.Dedup != nil {
+		return item.encryptShared(ctx, inFile, secret, l)
+	}
+	// the checksum is calculated before compression and encryption
+	h := sha256.New()
+	inFile = io.TeeReader(&contextReader{ctx: ctx, r: inFile}, h)
+	key, err := item.newKey(secret)
+	if err != nil {
+		return err
+	}
+	err = item.newStorageID()
+	if err != nil {
+		return err
+	}
+	err = item.writeContent(inFile, key, l)
+	if err == nil {
+		item.sum = hex.EncodeToString(h.Sum(nil))
+		item.Checksum, err = encryptText(item.sum, key)
+	}
+	if err != nil {
+		// don't keep partially written file
+		if e := item.DeleteFile(); e != nil && !os.IsNotExist(e) {
+			l.Printf("remove partial encypted file error: %v", e)
+		}
+	}
+	return err
+}
+
+// newKey generates a new salt and returns the key of the secret, item's name is encrypted by it.
+func (item *Item) newKey(secret string) ([]byte, error) {
 	salt := make([]byte, saltSize)
 	_, err := rand.Read(salt)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	key, keyHash := Key(secret, salt)
+	item.Iter = item.Iterations()
+	key, keyHash := Key(secret, salt, item.Iter)
+	// content-type is detected by plain name
+	item.MIME = item.ContentType()
 	err = item.encryptName(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	item.Hash = hex.EncodeToString(keyHash)
-	// it is to be called after encryptName
-	fullPath := item.FullPath()
-	if item.IsFileExists() {
-		return fmt.Errorf("file %v already exists", fullPath)
-	}
 	item.Salt = hex.EncodeToString(salt)
-	block, err := aes.NewCipher(key)
+	return key, nil
+}
+
+// writeContent encrypts the content to item's storage file, it's compressed before if it's enabled.
+// The item's size is a plain one.
+func (item *Item) writeContent(inFile io.Reader, key []byte, l *log.Logger) error {
+	item.Format = FormatGCM
+	outFile, err := item.backend().Writer(item.storageKey())
 	if err != nil {
 		return err
 	}
-	// the key is unique for each cipher-text, then it's ok to use a zero IV.
-	var iv [aes.BlockSize]byte
-	stream := cipher.NewOFB(block, iv[:])
-	outFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	// copy the input file to the output file, encrypting as we go.
+	if item.Compressed {
+		// compression is useless after encryption, and the size is a plain one
+		plain := &countReader{r: inFile}
+		compressed := compress(plain)
+		_, err = encryptGCM(outFile, compressed, key)
+		if e := compressed.Close(); e != nil {
+			l.Printf("close compression error: %v", e)
+		}
+		item.Size = plain.n
+	} else {
+		item.Size, err = encryptGCM(outFile, inFile, key)
+	}
+	// a backend can finish writing only during closing
+	if e := outFile.Close(); e != nil {
+		l.Printf("close encypted file error: %v", e)
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ValidateSealed checks salt and hash lengths of client-side encrypted data.
+func ValidateSealed(salt, hash string) error {
+	b, err := hex.DecodeString(salt)
+	if (err != nil) || (len(b) != saltSize) || !IsNameHash(hash) {
+		return ErrSealed
+	}
+	return nil
+}
+
+// Seal stores client-side encrypted data as is, the item's salt and hash should be already set.
+func (item *Item) Seal(inFile io.Reader, l *log.Logger) error {
+	err := ValidateSealed(item.Salt, item.Hash)
+	if err != nil {
+		return err
+	}
+	err = item.newStorageID()
+	if err != nil {
+		return err
+	}
+	item.Format = FormatSealed
+	outFile, err := item.backend().Writer(item.storageKey())
+	if err != nil {
+		return err
+	}
+	item.Size, err = io.Copy(outFile, inFile)
+	if e := outFile.Close(); e != nil {
+		l.Printf("close sealed file error: %v", e)
+		if err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		if e := item.DeleteFile(); e != nil && !os.IsNotExist(e) {
+			l.Printf("remove partial sealed file error: %v", e)
+		}
+	}
+	return err
+}
+
+// Stream writes client-side encrypted data to w as is.
+func (item *Item) Stream(w io.Writer, l *log.Logger) error {
+	return item.StreamContext(context.Background(), w, l)
+}
+
+// StreamContext is Stream which is stopped when ctx is done.
+func (item *Item) StreamContext(ctx context.Context, w io.Writer, l *log.Logger) error {
+	reader, err := item.backend().Reader(item.storageKey())
 	if err != nil {
 		return err
 	}
+	inFile := withContext(ctx, reader)
 	defer func() {
-		if err := outFile.Close(); err != nil {
-			l.Printf("close encypted file error: %v", err)
+		if err := inFile.Close(); err != nil {
+			l.Printf("close sealed file error: %v", err)
 		}
 	}()
-	writer := &cipher.StreamWriter{S: stream, W: outFile}
-	// copy the input file to the output file, encrypting as we go.
-	if _, err := io.Copy(writer, inFile); err != nil {
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-disposition", contentDisposition("attachment", item.Hash))
+		httpWriter.Header().Set("Content-Type", "application/octet-stream")
+		if item.Size > 0 {
+			httpWriter.Header().Set("Content-Length", strconv.FormatInt(item.Size, 10))
+		}
+	}
+	_, err = io.Copy(w, inFile)
+	return err
+}
+
+// DeleteFile removes only item's related file from the storage.
+// A shared file of deduplicated item is removed only with its last reference.
+func (item *Item) DeleteFile() error {
+	last, err := item.releaseFile()
+	if (err != nil) || !last {
 		return err
 	}
-	return nil
+	return item.backend().Remove(item.storageKey())
 }
 
 // Decrypt decrypts item related file and writes result to w.
 func (item *Item) Decrypt(w io.Writer, key []byte, l *log.Logger) error {
+	return item.DecryptContext(context.Background(), w, key, l)
+}
+
+// DecryptContext is Decrypt which is stopped when ctx is done,
+// for example, when a client closes the connection.
+func (item *Item) DecryptContext(ctx context.Context, w io.Writer, key []byte, l *log.Logger) error {
 	err := item.decryptName(key)
 	if err != nil {
 		return err
 	}
-	fileName := filepath.Join(item.Path, item.Hash)
-	inFile, err := os.Open(fileName)
+	var h hash.Hash
+	out := w
+	if item.Verify && (item.Checksum != "") {
+		item.sum, err = decryptText(item.Checksum, key)
+		if err != nil {
+			return err
+		}
+		h = sha256.New()
+		out = io.MultiWriter(w, h)
+	}
+	key, err = item.contentKey(key)
+	if err != nil {
+		return err
+	}
+	reader, err := item.backend().Reader(item.storageKey())
 	if err != nil {
 		return err
 	}
+	inFile := withContext(ctx, reader)
 	defer func() {
 		if err := inFile.Close(); err != nil {
 			l.Printf("close in-encypted file error: %v", err)
 		}
 	}()
-	block, err := aes.NewCipher(key)
+	item.setHeaders(w)
+	if httpWriter, ok := w.(http.ResponseWriter); ok && (item.Size > 0) {
+		httpWriter.Header().Set("Content-Length", strconv.FormatInt(item.Size, 10))
+	}
+	// copy the input file to the output file, decrypting as we go.
+	switch {
+	case item.Compressed:
+		err = decryptGCMCompressed(out, inFile, key)
+	case item.Format == FormatGCM:
+		err = decryptGCM(out, inFile, key)
+	default:
+		err = decryptOFB(out, inFile, key)
+	}
+	if (err == nil) && (h != nil) && (hex.EncodeToString(h.Sum(nil)) != item.sum) {
+		return ErrChecksum
+	}
+	return err
+}
+
+// DecryptRange decrypts item related file and writes only bytes [start; end] to w.
+// If w is http.ResponseWriter and it's not a full content,
+// then "206 Partial Content" status and Content-Range header are set.
+func (item *Item) DecryptRange(w io.Writer, key []byte, start, end int64, l *log.Logger) error {
+	return item.DecryptRangeContext(context.Background(), w, key, start, end, l)
+}
+
+// DecryptRangeContext is DecryptRange which is stopped when ctx is done.
+func (item *Item) DecryptRangeContext(ctx context.Context, w io.Writer, key []byte, start, end int64, l *log.Logger) error {
+	size, err := item.ContentSize()
 	if err != nil {
 		return err
 	}
+	if (start < 0) || (start > end) || (end >= size) {
+		return fmt.Errorf("invalid range [%v - %v] for size %v", start, end, size)
+	}
+	err = item.decryptName(key)
+	if err != nil {
+		return err
+	}
+	key, err = item.contentKey(key)
+	if err != nil {
+		return err
+	}
+	storageReader, err := item.backend().Reader(item.storageKey())
+	if err != nil {
+		return err
+	}
+	reader := withContext(ctx, storageReader)
+	defer func() {
+		if err := reader.Close(); err != nil {
+			l.Printf("close in-encypted file error: %v", err)
+		}
+	}()
+	inFile, ok := reader.(io.ReadSeeker)
+	if !ok && !item.Compressed {
+		return errors.New("storage reader doesn't support seeking")
+	}
+	item.setHeaders(w)
 	httpWriter, ok := w.(http.ResponseWriter)
-	if ok {
-		httpWriter.Header().Set(
-			"Content-disposition",
-			fmt.Sprintf("attachment; filename=\"%v\"", item.Name),
-		)
-		httpWriter.Header().Set("Content-Type", item.ContentType())
+	if ok && ((start > 0) || (end < size-1)) {
+		httpWriter.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		httpWriter.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		httpWriter.WriteHeader(http.StatusPartialContent)
+	}
+	switch {
+	case item.Compressed:
+		// compressed data can't be sought, so all previous bytes are decompressed
+		err = decryptGCMCompressed(&rangeWriter{w: w, skip: start, left: end - start + 1}, reader, key)
+		if err == errRangeDone {
+			return nil
+		}
+		return err
+	case item.Format == FormatGCM:
+		return decryptGCMRange(w, inFile, key, start, end)
+	}
+	return decryptOFBRange(w, inFile, key, start, end)
+}
+
+// ContentSize returns a size of decrypted content.
+func (item *Item) ContentSize() (int64, error) {
+	if item.Compressed {
+		// stored size is not related to the content one
+		return item.Size, nil
+	}
+	size, err := item.backend().Size(item.storageKey())
+	if err != nil {
+		return 0, err
+	}
+	if item.Format == FormatGCM {
+		return gcmPlainSize(size), nil
+	}
+	return size, nil
+}
+
+// IsInlineType returns true if the content type is safe to be shown by a browser,
+// it can't contain active content like HTML or SVG scripts.
+func IsInlineType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return inlineTypes[mediaType]
+}
+
+// IsCompressibleType returns true if the content type is text-based one,
+// so its transfer compression makes sense.
+func IsCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// setHeaders sets HTTP headers if w is http.ResponseWriter,
+// the content is inline only if it's requested and safe.
+// Every download decrements the counter, so the content must not be cached by proxies.
+func (item *Item) setHeaders(w io.Writer) {
+	httpWriter, ok := w.(http.ResponseWriter)
+	if !ok {
+		return
+	}
+	httpWriter.Header().Set("Cache-Control", "no-store, private")
+	httpWriter.Header().Set("Pragma", "no-cache")
+	disposition := "attachment"
+	if item.Inline && IsInlineType(item.ContentType()) {
+		disposition = "inline"
+		httpWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	name := item.Name
+	if item.DownloadName != "" {
+		name = item.DownloadName
+	}
+	httpWriter.Header().Set("Content-disposition", contentDisposition(disposition, name))
+	httpWriter.Header().Set("Content-Type", item.ContentType())
+	httpWriter.Header().Set("Accept-Ranges", "bytes")
+}
+
+// decryptOFB decrypts legacy FormatOFB stream.
+func decryptOFB(w io.Writer, r io.Reader, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
 	}
 	// if the key is unique for each cipher-text, then it's ok to use a zero IV.
 	var iv [aes.BlockSize]byte
 	stream := cipher.NewOFB(block, iv[:])
-
-	reader := &cipher.StreamReader{S: stream, R: inFile}
-	// copy the input file to the output file, decrypting as we go.
+	reader := &cipher.StreamReader{S: stream, R: r}
 	if _, err := io.Copy(w, reader); err != nil {
 		return err
 	}
 	return nil
 }
 
-// GetURL returns item's URL.
-func (item *Item) GetURL(r *http.Request, secure bool) *url.URL {
+// GetURL returns item's URL. If trusted hosts are set, the service is behind a reverse proxy,
+// so X-Forwarded-Proto and X-Forwarded-Host headers are preferred,
+// but the forwarded host is used only if it's in the trusted list.
+// Not empty basePath is a prefix of the service URLs if it's deployed by a sub-path.
+func (item *Item) GetURL(r *http.Request, secure bool, trusted []string, basePath string) *url.URL {
 	// r.URL.Scheme is blank, so use hint from settings
-	scheme := "http"
+	scheme, host := "http", r.Host
 	if secure {
 		scheme = "https"
 	}
+	if len(trusted) > 0 {
+		if s := forwardedScheme(r); s != "" {
+			scheme = s
+		}
+		if h := forwardedHost(r, trusted); h != "" {
+			host = h
+		}
+	}
 	return &url.URL{
 		Scheme: scheme,
-		Host:   r.Host,
-		Path:   item.Hash,
+		Host:   host,
+		Path:   strings.TrimSuffix(basePath, "/") + "/" + item.Hash,
 	}
 }
 
+// IsExpired returns true if item's TTL is over.
+func (item *Item) IsExpired() bool {
+	return item.Expired.Before(time.Now())
+}
+
+// storageKey returns a name of item's file in the storage,
+// it's the hash for items which were stored before random storage IDs.
+func (item *Item) storageKey() string {
+	if item.StorageID != "" {
+		return item.StorageID
+	}
+	return item.Hash
+}
+
+// newStorageID sets a random storage file name,
+// so it doesn't depend on the secret and can't collide with other items.
+func (item *Item) newStorageID() error {
+	b := make([]byte, storageIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	item.StorageID = hex.EncodeToString(b)
+	return nil
+}
+
 // IsFileExists checks item's related file exists.
 func (item *Item) IsFileExists() bool {
-	_, err := os.Stat(item.FullPath())
-	if err == nil {
-		return true
-	}
-	return false
+	return item.backend().Exists(item.storageKey())
 }
 
 // Save saves the item to database.
 func (item *Item) Save(db *sql.DB) error {
+	d := dialectOf(db)
 	return InTransaction(db, func(tx *sql.Tx) error {
-		stmt, err := tx.Prepare("INSERT INTO `storage` (`name`, `path`, `hash`, `salt`, `counter`, `created`, `updated`, `expired`) VALUES (?, ?, ?, ?, ?, ?, ?, ?);")
+		query := "INSERT INTO `storage` (`name`, `path`, `hash`, `storage_id`, `salt`, `counter`, `format`, `iter`, `mime`, `size`, `confirm`, `compressed`, `owner`, `label`, `max_fails`, `salt_version`, `checksum`, `session`, `blob_id`, `content_key`, `hint`, `passwordless`, `created`, `updated`, `expired`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		if d == postgresDialect {
+			// PostgreSQL driver doesn't support LastInsertId
+			query += " RETURNING `id`"
+		}
+		stmt, err := tx.Prepare(d.query(query + ";"))
 		if err != nil {
 			return err
 		}
-		r, err := stmt.Exec(item.Name, item.Path, item.Hash, item.Salt, item.Counter, item.Created, item.Created, item.Expired)
+		args := []interface{}{
+			item.Name, item.Path, item.Hash, item.StorageID, item.Salt, item.Counter, item.Format,
+			item.Iter, item.MIME, item.Size, item.Confirm, item.Compressed, item.Owner, item.Label, item.MaxFails, item.SaltVersion, item.Checksum, item.Session, item.Blob, item.ContentKey, item.Hint, item.Passwordless, item.Created, item.Created, item.Expired,
+		}
+		if d == postgresDialect {
+			err = stmt.QueryRow(args...).Scan(&item.ID)
+			if err != nil {
+				return err
+			}
+			return stmt.Close()
+		}
+		r, err := stmt.Exec(args...)
 		if err != nil {
 			return err
 		}
@@ -287,8 +748,9 @@ func (item *Item) Save(db *sql.DB) error {
 // Decrement updates items' counter. The first returned parameter is "updated" flags.
 func (item *Item) Decrement(db *sql.DB, le *log.Logger) (bool, error) {
 	counter := item.Counter
+	d := dialectOf(db)
 	err := InTransaction(db, func(tx *sql.Tx) error {
-		stmt, err := tx.Prepare("UPDATE `storage` SET `counter`=`counter`-1, `updated`=? WHERE `counter`>0 AND `id`=?;")
+		stmt, err := tx.Prepare(d.query("UPDATE `storage` SET `counter`=`counter`-1, `updated`=? WHERE `counter`>0 AND `id`=?;"))
 		if err != nil {
 			return err
 		}
@@ -297,14 +759,18 @@ func (item *Item) Decrement(db *sql.DB, le *log.Logger) (bool, error) {
 				le.Printf("failed close stmt: %v\n", err)
 			}
 		}()
-		_, err = stmt.Exec(time.Now().UTC(), item.ID)
+		result, err := stmt.Exec(time.Now().UTC(), item.ID)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return nil
-			}
 			return err
 		}
-		item.Counter--
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		// a concurrent request can already use the last download
+		if n > 0 {
+			item.Counter--
+		}
 		return nil
 	})
 	if err != nil {
@@ -313,20 +779,51 @@ func (item *Item) Decrement(db *sql.DB, le *log.Logger) (bool, error) {
 	return counter != item.Counter, nil
 }
 
-// Delete removes items from database and related file from file system.
+// Fail increments a number of failed passwords of the item. Its counter is reset
+// when the number reaches MaxFails limit, so the first returned parameter is "destroyed" flag.
+func (item *Item) Fail(db *sql.DB) (bool, error) {
+	if item.MaxFails < 1 {
+		return false, nil
+	}
+	d := dialectOf(db)
+	err := InTransaction(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			d.query("UPDATE `storage` SET `fails`=`fails`+1, `counter`=CASE WHEN `fails`+1>=`max_fails` THEN 0 ELSE `counter` END, `updated`=? WHERE `counter`>0 AND `id`=?;"),
+			time.Now().UTC(), item.ID,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(d.query("SELECT `fails`, `counter` FROM `storage` WHERE `id`=?;"), item.ID).Scan(&item.Fails, &item.Counter)
+	})
+	if err != nil {
+		return false, err
+	}
+	return item.Counter < 1, nil
+}
+
+// Delete removes items from database and related file from file system,
+// a shared file of deduplicated item is removed only with its last reference.
 func (item *Item) Delete(db *sql.DB, le *log.Logger) error {
+	var last bool
+	d := dialectOf(db)
 	e := InTransaction(db, func(tx *sql.Tx) error {
 		// delete an item
-		_, err := deleteByIDs(tx, le, item.ID)
+		_, err := deleteByIDs(tx, d, le, item.ID)
 		if err != nil {
 			return err
 		}
-		return nil
+		last, err = item.release(tx, d)
+		return err
 	})
 	if e != nil {
 		return fmt.Errorf("failed item delete by id: %v", e)
 	}
-	return os.Remove(item.FullPath())
+	if !last {
+		// the shared file is used by other items
+		return nil
+	}
+	return item.backend().Remove(item.storageKey())
 }
 
 // IsNameHash checks name can be an encrypted file name.
@@ -335,16 +832,53 @@ func IsNameHash(name string) bool {
 }
 
 // Key calculates and returns secret key and its SHA512 hash.
-func Key(secret string, salt []byte) ([]byte, []byte) {
-	key := pbkdf2.Key([]byte(secret), salt, pbkdf2Iter, aesKeyLength, sha3.New512)
+func Key(secret string, salt []byte, iter int) ([]byte, []byte) {
+	key := pbkdf2.Key([]byte(secret), salt, iter, aesKeyLength, sha3.New512)
 	b := make([]byte, hashLength)
 	sha3.ShakeSum256(b, append(key, salt...))
 	return key, b
 }
 
+// Item states which are returned by ReadState.
+const (
+	StateNotFound = iota
+	StateActive
+	StateExpired
+	StateUsed
+)
+
 // Read reads an item by its hash from database.
 func Read(db *sql.DB, hash string, le *log.Logger) (*Item, error) {
-	stmt, err := db.Prepare("SELECT `id`, `name`, `path`, `hash`, `salt`, `counter`, `created`, `expired` FROM `storage` WHERE `counter`>0 AND `hash`=?;")
+	return read(db, "`counter`>0 AND `hash`=?", hash, le)
+}
+
+// ReadAny reads an item by its hash including already used and expired ones, which are not yet deleted by GC.
+func ReadAny(db *sql.DB, hash string, le *log.Logger) (*Item, error) {
+	return read(db, "`hash`=?", hash, le)
+}
+
+// ReadState reads an item by its hash including already used and expired ones,
+// which are not yet deleted by GC. Only an active or used item is returned, it's nil for other states,
+// a used item can be read only to resume its already counted download.
+func ReadState(db *sql.DB, hash string, le *log.Logger) (*Item, int, error) {
+	item, err := ReadAny(db, hash, le)
+	if err != nil {
+		return nil, StateNotFound, err
+	}
+	switch {
+	case item.ID == 0:
+		return nil, StateNotFound, nil
+	case item.Counter < 1:
+		return item, StateUsed, nil
+	case item.IsExpired():
+		return nil, StateExpired, nil
+	}
+	return item, StateActive, nil
+}
+
+// read reads an item by its hash with the condition, an empty item is returned if it's not found.
+func read(db *sql.DB, condition, hash string, le *log.Logger) (*Item, error) {
+	stmt, err := db.Prepare(dialectOf(db).query("SELECT `id`, `name`, `path`, `hash`, `storage_id`, `salt`, `counter`, `format`, `iter`, `mime`, `size`, `confirm`, `compressed`, `owner`, `max_fails`, `fails`, `salt_version`, `checksum`, `session`, `blob_id`, `content_key`, `hint`, `passwordless`, `created`, `expired` FROM `storage` WHERE " + condition + ";"))
 	if err != nil {
 		return nil, err
 	}
@@ -359,8 +893,25 @@ func Read(db *sql.DB, hash string, le *log.Logger) (*Item, error) {
 		&item.Name,
 		&item.Path,
 		&item.Hash,
+		&item.StorageID,
 		&item.Salt,
 		&item.Counter,
+		&item.Format,
+		&item.Iter,
+		&item.MIME,
+		&item.Size,
+		&item.Confirm,
+		&item.Compressed,
+		&item.Owner,
+		&item.MaxFails,
+		&item.Fails,
+		&item.SaltVersion,
+		&item.Checksum,
+		&item.Session,
+		&item.Blob,
+		&item.ContentKey,
+		&item.Hint,
+		&item.Passwordless,
 		&item.Created,
 		&item.Expired,
 	)
@@ -373,9 +924,56 @@ func Read(db *sql.DB, hash string, le *log.Logger) (*Item, error) {
 	return item, nil
 }
 
+// IsHashExists checks that an item with the hash is already stored, including fully used ones.
+func IsHashExists(db *sql.DB, hash string) (bool, error) {
+	var n int
+	err := db.QueryRow(dialectOf(db).query("SELECT COUNT(*) FROM `storage` WHERE `hash`=?;"), hash).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// List returns all stored items with only their non-secret metadata.
+func List(db *sql.DB, le *log.Logger) ([]*Item, error) {
+	stmt, err := db.Prepare(dialectOf(db).query("SELECT `id`, `hash`, `size`, `counter`, `label`, `created`, `expired` FROM `storage` ORDER BY `id`;"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			le.Printf("failed close stmt: %v\n", err)
+		}
+	}()
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0)
+	for rows.Next() {
+		item := &Item{}
+		err = rows.Scan(&item.ID, &item.Hash, &item.Size, &item.Counter, &item.Label, &item.Created, &item.Expired)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return items, rows.Err()
+}
+
 // deleteByIDs removes items by their identifiers.
-func deleteByIDs(tx *sql.Tx, le *log.Logger, ids ...int64) (int64, error) {
-	stmt, err := tx.Prepare("DELETE FROM `storage` WHERE `id` IN (?);")
+func deleteByIDs(tx *sql.Tx, d dialect, le *log.Logger, ids ...int64) (int64, error) {
+	n := len(ids)
+	if n == 0 {
+		return 0, nil
+	}
+	// every identifier is a separate parameter
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+	stmt, err := tx.Prepare(d.query("DELETE FROM `storage` WHERE `id` IN (" + placeholders + ");"))
 	if err != nil {
 		return 0, err
 	}
@@ -384,25 +982,48 @@ func deleteByIDs(tx *sql.Tx, le *log.Logger, ids ...int64) (int64, error) {
 			le.Printf("failed close stmt: %v\n", err)
 		}
 	}()
-	strIDs := make([]string, len(ids))
+	args := make([]interface{}, n)
 	for i, v := range ids {
-		strIDs[i] = strconv.FormatInt(v, 10)
+		args[i] = v
 	}
-	result, err := stmt.Exec(strings.Join(strIDs, ","))
+	result, err := stmt.Exec(args...)
 	if err != nil {
 		return 0, err
 	}
 	return result.RowsAffected()
 }
 
-func deleteByDate(db *sql.DB, le *log.Logger) (int64, error) {
-	var n int64
+// deleteByDate removes expired or already fully downloaded items and their files from the storage st,
+// if st is nil then a file system storage in item's path is used. Fully downloaded items are kept
+// for ResumePeriod after the last download, so it can be resumed.
+// Items are processed by batches with a separate transaction for every one,
+// so a big backlog doesn't hold a long transaction. It returns all deleted items,
+// they are returned also with an error because previous batches are already committed.
+func deleteByDate(db *sql.DB, st Storage, batch int, le *log.Logger) ([]*Item, error) {
+	if batch < 1 {
+		return nil, fmt.Errorf("invalid GC batch size %v", batch)
+	}
+	var result []*Item
+	now := time.Now().UTC()
+	for {
+		items, err := deleteBatch(db, st, now, batch, le)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, items...)
+		if len(items) < batch {
+			return result, nil
+		}
+	}
+}
+
+// deleteBatch removes no more than batch expired items and their files in one transaction.
+func deleteBatch(db *sql.DB, st Storage, now time.Time, batch int, le *log.Logger) ([]*Item, error) {
+	var items []*Item
+	d := dialectOf(db)
 	err := InTransaction(db, func(tx *sql.Tx) error {
-		var (
-			paths []string
-			ids   []int64
-		)
-		stmt, e := tx.Prepare("SELECT `id`, `path`, `hash` FROM `storage` WHERE `expired`<?;")
+		var ids []int64
+		stmt, e := tx.Prepare(d.query("SELECT `id`, `path`, `hash`, `storage_id`, `blob_id`, `counter` FROM `storage` WHERE `expired`<? OR (`counter`<1 AND `updated`<?) ORDER BY `id` LIMIT ?;"))
 		if e != nil {
 			return e
 		}
@@ -411,17 +1032,17 @@ func deleteByDate(db *sql.DB, le *log.Logger) (int64, error) {
 				le.Printf("failed close stmt: %v\n", err)
 			}
 		}()
-		rows, e := stmt.Query(time.Now().UTC())
+		rows, e := stmt.Query(now, now.Add(-ResumePeriod), batch)
 		if e != nil {
 			return e
 		}
-		item := &Item{} // use only one item to collect paths
 		for rows.Next() {
-			e = rows.Scan(&item.ID, &item.Path, &item.Hash)
+			item := &Item{Storage: st}
+			e = rows.Scan(&item.ID, &item.Path, &item.Hash, &item.StorageID, &item.Blob, &item.Counter)
 			if e != nil {
 				return e
 			}
-			paths = append(paths, item.FullPath())
+			items = append(items, item)
 			ids = append(ids, item.ID)
 		}
 		e = rows.Close()
@@ -429,48 +1050,157 @@ func deleteByDate(db *sql.DB, le *log.Logger) (int64, error) {
 			return e
 		}
 		// delete items from db
-		n, e = deleteByIDs(tx, le, ids...)
+		_, e = deleteByIDs(tx, d, le, ids...)
 		if e != nil {
 			return e
 		}
-		// delete files
-		for _, p := range paths {
-			e = os.RemoveAll(p)
+		// delete files, shared ones only without references
+		for _, item := range items {
+			last, e := item.release(tx, d)
 			if e != nil {
 				return e
 			}
+			if !last {
+				continue
+			}
+			e = item.backend().Remove(item.storageKey())
+			if (e != nil) && !os.IsNotExist(e) {
+				return e
+			}
 		}
 		return nil
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return items, nil
+}
+
+// GCCollector counts items deleted by GC, metrics collectors implement it.
+type GCCollector interface {
+	GCDeleted(n int64)
+}
+
+// GCConfig is settings of GC monitoring. Files of expired items are deleted from the Storage,
+// nil value means a file system storage, every Period they are deleted by batches of Batch size.
+// Files without items of FileStorage are removed once per Grace period if they are older than it,
+// zero Grace disables it. Collector and OnDelete are optional, OnDelete is called for every deleted item.
+type GCConfig struct {
+	Db        *sql.DB
+	Storage   Storage
+	Collector GCCollector
+	SizeCache *SizeCache
+	OnDelete  func(item *Item)
+	Info      *log.Logger
+	Err       *log.Logger
+	Period    time.Duration
+	Batch     int
+	Grace     time.Duration
+}
+
+// deleted updates the size cache and metrics after items deletion.
+func (c *GCConfig) deleted(items ...*Item) {
+	c.SizeCache.Invalidate()
+	if c.Collector != nil {
+		c.Collector.GCDeleted(int64(len(items)))
+	}
+	if c.OnDelete == nil {
+		return
+	}
+	for _, item := range items {
+		c.OnDelete(item)
 	}
-	return n, nil
 }
 
 // GCMonitor is garbage collection monitoring to delete expired by date or counter items.
-func GCMonitor(ch <-chan *Item, closed chan struct{}, db *sql.DB, li, le *log.Logger, period time.Duration) {
-	tc := time.Tick(period)
-	li.Printf("GC monitor is running, perid=%v\n", period)
+// Items from ch are deleted immediately, other ones are found every period of the settings c.
+func GCMonitor(ch <-chan *Item, closed chan struct{}, c *GCConfig) {
+	var swept time.Time
+	tc := time.Tick(c.Period)
+	c.Info.Printf("GC monitor is running, perid=%v\n", c.Period)
 	for {
 		select {
 		case item := <-ch:
-			if err := item.Delete(db, le); err != nil {
-				le.Println(err)
-			} else {
-				li.Printf("deleted item=%v\n", item.ID)
-			}
+			gcDelete(item, c)
 		case <-tc:
-			if n, err := deleteByDate(db, le); err != nil {
-				le.Println(err)
-			} else {
-				if n > 0 {
-					li.Printf("deleted %v expired items\n", n)
+			if _, err := deleteUnlocks(c.Db); err != nil {
+				c.Err.Println(err)
+			}
+			if _, err := deleteClaims(c.Db); err != nil {
+				c.Err.Println(err)
+			}
+			if _, err := deleteAccessLog(c.Db); err != nil {
+				c.Err.Println(err)
+			}
+			if _, err := deleteSessions(c.Db); err != nil {
+				c.Err.Println(err)
+			}
+			items, err := deleteByDate(c.Db, c.Storage, c.Batch, c.Err)
+			if err != nil {
+				c.Err.Println(err)
+			}
+			if n := len(items); n > 0 {
+				c.deleted(items...)
+				c.Info.Printf("deleted %v expired items\n", n)
+			}
+			if (c.Grace > 0) && (time.Since(swept) >= c.Grace) {
+				swept = time.Now()
+				if n, err := deleteOrphans(c.Db, c.Storage, c.Grace, c.Err); err != nil {
+					c.Err.Println(err)
+				} else if n > 0 {
+					c.Info.Printf("deleted %v orphaned files\n", n)
 				}
 			}
 		case <-closed:
-			li.Println("gc monitor stopped")
-			return
+			// items queued by already finished requests are not lost
+			for {
+				select {
+				case item, ok := <-ch:
+					if !ok {
+						c.Info.Println("gc monitor stopped")
+						return
+					}
+					gcDelete(item, c)
+				default:
+					c.Info.Println("gc monitor stopped")
+					return
+				}
+			}
+		}
+	}
+}
+
+// deleteOrphans removes files of the file system storage st which have no items and are older than grace period.
+// Other storages are skipped. It returns a number of removed files.
+func deleteOrphans(db *sql.DB, st Storage, grace time.Duration, le *log.Logger) (int, error) {
+	fs, ok := fileStorage(st)
+	if !ok {
+		return 0, nil
+	}
+	orphans, err := OrphanFiles(db, fs.Dir, grace)
+	if err != nil {
+		return 0, fmt.Errorf("failed orphaned files search: %v", err)
+	}
+	n := 0
+	for _, path := range orphans {
+		if err := os.Remove(path); err != nil {
+			le.Printf("failed remove orphaned file: %v\n", err)
+			continue
+		}
+		n++
+		if fs.Prune {
+			fs.prune(filepath.Dir(path))
 		}
 	}
+	return n, nil
+}
+
+// gcDelete removes the item which was queued to GC.
+func gcDelete(item *Item, c *GCConfig) {
+	if err := item.Delete(c.Db, c.Err); err != nil {
+		c.Err.Println(err)
+		return
+	}
+	c.deleted(item)
+	c.Info.Printf("deleted item=%v\n", item.ID)
 }
@@ -2,8 +2,14 @@ package db
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http/httptest"
 	"os"
@@ -18,12 +24,61 @@ import (
 const (
 	testDB      = "/tmp/unigma_db.sqlite"
 	testStorage = "/tmp/unigma_storage"
+	testGCBatch = 500
 )
 
 var (
 	loggerInfo = log.New(os.Stdout, "[TEST]", log.Ltime|log.Lshortfile)
 )
 
+// memStorage is in-memory storage for tests.
+type memStorage struct {
+	files map[string]*bytes.Buffer
+}
+
+type memWriter struct {
+	*bytes.Buffer
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+func (ms *memStorage) Writer(hash string) (io.WriteCloser, error) {
+	b := &bytes.Buffer{}
+	ms.files[hash] = b
+	return &memWriter{b}, nil
+}
+
+func (ms *memStorage) Reader(hash string) (io.ReadCloser, error) {
+	b, ok := ms.files[hash]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.Bytes())), nil
+}
+
+func (ms *memStorage) Remove(hash string) error {
+	if _, ok := ms.files[hash]; !ok {
+		return os.ErrNotExist
+	}
+	delete(ms.files, hash)
+	return nil
+}
+
+func (ms *memStorage) Exists(hash string) bool {
+	_, ok := ms.files[hash]
+	return ok
+}
+
+func (ms *memStorage) Size(hash string) (int64, error) {
+	b, ok := ms.files[hash]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(b.Len()), nil
+}
+
 func createFile(name string) error {
 	outFile, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
@@ -135,8 +190,8 @@ func TestRead(t *testing.T) {
 
 func TestKey(t *testing.T) {
 	secret, salt := "secret", []byte("abcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefga")
-	key1, h1 := Key(secret, salt)
-	key2, h2 := Key(secret, salt)
+	key1, h1 := Key(secret, salt, DefaultIter)
+	key2, h2 := Key(secret, salt, DefaultIter)
 	if n := bytes.Compare(key1, key2); n != 0 {
 		t.Errorf("Failed compare keys: %v", n)
 	}
@@ -145,6 +200,17 @@ func TestKey(t *testing.T) {
 	}
 }
 
+func TestDialect(t *testing.T) {
+	query := "SELECT `id` FROM `storage` WHERE `hash`=? AND `counter`>?;"
+	if q := sqliteDialect.query(query); q != query {
+		t.Errorf("failed sqlite query: %v", q)
+	}
+	expected := `SELECT "id" FROM "storage" WHERE "hash"=$1 AND "counter">$2;`
+	if q := postgresDialect.query(query); q != expected {
+		t.Errorf("failed postgres query: %v", q)
+	}
+}
+
 func TestIsNameHash(t *testing.T) {
 	values := map[string]bool{
 		"":  false,
@@ -201,7 +267,16 @@ func TestGCMonitor(t *testing.T) {
 	monitoring := make(chan *Item)
 	period := 200 * time.Millisecond
 
-	go GCMonitor(monitoring, closing, db, loggerInfo, loggerInfo, period)
+	deleted := make(chan string, 3)
+	gc := &GCConfig{
+		Db:       db,
+		OnDelete: func(item *Item) { deleted <- item.Hash },
+		Info:     loggerInfo,
+		Err:      loggerInfo,
+		Period:   period,
+		Batch:    testGCBatch,
+	}
+	go GCMonitor(monitoring, closing, gc)
 
 	time.Sleep(period * 2) // delete item1
 	monitoring <- item2    // delete item2
@@ -217,6 +292,9 @@ func TestGCMonitor(t *testing.T) {
 	if !ids[item3.ID] {
 		t.Error("no found item")
 	}
+	if n := len(deleted); n != 2 {
+		t.Errorf("failed number of delete notifications: %v", n)
+	}
 	close(closing)
 	time.Sleep(period)
 	close(monitoring)
@@ -227,6 +305,94 @@ func TestGCMonitor(t *testing.T) {
 	}
 }
 
+func TestDeleteByDateBatches(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	const batch = 2
+	now := time.Now().UTC()
+	items := make([]*Item, 2*batch+1)
+	for i := range items {
+		items[i], err = createItem(db, fmt.Sprintf("cd117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2af%02d", i), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// other tests can add expired items too
+	deleted, err := deleteByDate(db, nil, batch, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(deleted); n < len(items) {
+		t.Errorf("failed deleted count: %v", n)
+	}
+	ids, err := readIDs(db, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if ids[item.ID] {
+			t.Errorf("item %v is not deleted", item.ID)
+		}
+		if item.IsFileExists() {
+			t.Errorf("file %v is not deleted", item.Hash)
+		}
+	}
+	if _, err = deleteByDate(db, nil, 0, loggerInfo); err == nil {
+		t.Error("expected error for zero batch size")
+	}
+}
+
+func TestDeleteByDate(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	now := time.Now().UTC()
+	hashes := []string{
+		"ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd7",
+		"ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd8",
+		"ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd9",
+	}
+	items := make([]*Item, len(hashes))
+	for i, hash := range hashes {
+		items[i], err = createItem(db, hash, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := deleteByDate(db, nil, testGCBatch, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(deleted); n != len(items) {
+		t.Errorf("failed deleted count: %v", n)
+	}
+	ids, err := readIDs(db, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if ids[item.ID] {
+			t.Errorf("item %v is not deleted", item.ID)
+		}
+		if item.IsFileExists() {
+			t.Errorf("file %v is not deleted", item.Hash)
+		}
+	}
+}
+
 func TestItem_IsFileExists(t *testing.T) {
 	db, err := sql.Open("sqlite3", testDB)
 	if err != nil {
@@ -307,6 +473,25 @@ func TestItem_ContentType(t *testing.T) {
 	}
 }
 
+func TestIsCompressibleType(t *testing.T) {
+	values := map[string]bool{
+		"":                          false,
+		"text/plain; charset=utf-8": true,
+		"text/csv":                  true,
+		"application/json":          true,
+		"image/svg+xml":             true,
+		"image/png":                 false,
+		"application/zip":           false,
+		"application/gzip":          false,
+		"application/octet-stream":  false,
+	}
+	for contentType, value := range values {
+		if ok := IsCompressibleType(contentType); ok != value {
+			t.Errorf("invalid value for %q: %v", contentType, ok)
+		}
+	}
+}
+
 func TestItem_IsValidSecret(t *testing.T) {
 	secret := "secret"
 	item := &Item{
@@ -343,6 +528,35 @@ func TestItem_IsValidSecret(t *testing.T) {
 	}
 }
 
+func TestItem_Iterations(t *testing.T) {
+	item := &Item{}
+	if n := item.Iterations(); n != DefaultIter {
+		t.Errorf("unexpected legacy iterations: %v", n)
+	}
+	secret := "secret"
+	item = &Item{
+		Name:    "test.txt",
+		Counter: 1,
+		Iter:    10000,
+		Path:    testStorage,
+		Created: time.Now().UTC(),
+	}
+	err := item.Encrypt(strings.NewReader("test"), secret, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = item.IsValidSecret(secret); err != nil {
+		t.Error(err)
+	}
+	item.Iter = 0
+	if _, err = item.IsValidSecret(secret); err == nil {
+		t.Error("unexpected result")
+	}
+	if err = os.Remove(item.FullPath()); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestItem_Encrypt(t *testing.T) {
 	var writer bytes.Buffer
 	content := []byte("test")
@@ -365,6 +579,9 @@ func TestItem_Encrypt(t *testing.T) {
 	if item.Name == initName {
 		t.Errorf("name is not encrypted: %v", item.Name)
 	}
+	if item.Size != int64(len(content)) {
+		t.Errorf("failed size: %v", item.Size)
+	}
 	f, err := os.Open(item.FullPath())
 	if err != nil {
 		t.Fatal(err)
@@ -385,7 +602,7 @@ func TestItem_Encrypt(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	key, _ := Key(secret, salt)
+	key, _ := Key(secret, salt, DefaultIter)
 	err = item.Decrypt(&writer, key, loggerInfo)
 	if err != nil {
 		t.Error(err)
@@ -405,49 +622,2117 @@ func TestItem_Encrypt(t *testing.T) {
 			t.Error(err)
 		}
 	}()
+	err = item.Save(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := Read(db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Size != int64(len(content)) {
+		t.Errorf("failed stored size: %v", stored.Size)
+	}
 	err = item.Delete(db, loggerInfo)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
-func TestItem_GetURL(t *testing.T) {
-	db, err := sql.Open("sqlite3", testDB)
+func TestItem_DecryptIntegrity(t *testing.T) {
+	var writer bytes.Buffer
+	secret := "secret"
+	now := time.Now().UTC()
+	item := &Item{
+		Name:    "test.txt",
+		Counter: 1,
+		Path:    testStorage,
+		Created: now,
+		Expired: now,
+	}
+	err := item.Encrypt(strings.NewReader("test content"), secret, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Format != FormatGCM {
+		t.Errorf("unexpected format: %v", item.Format)
+	}
+	f, err := os.OpenFile(item.FullPath(), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modify the first byte of cipher-text after the version byte
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, 1); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = f.WriteAt(b, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = item.Decrypt(&writer, key, loggerInfo)
+	if err != ErrIntegrity {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = os.Remove(item.FullPath()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestItem_NameIntegrity(t *testing.T) {
+	var writer bytes.Buffer
+	secret := "secret"
+	now := time.Now().UTC()
+	item := &Item{Name: "test.txt", Counter: 1, Path: testStorage, Created: now, Expired: now}
+	err := item.Encrypt(strings.NewReader("test content"), secret, loggerInfo)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer func() {
-		if err := db.Close(); err != nil {
+		if err := os.Remove(item.FullPath()); err != nil {
 			t.Error(err)
 		}
 	}()
-	item, err := createItem(db, "abc", time.Now().UTC())
+	if !strings.HasPrefix(item.Name, sealedNamePrefix) {
+		t.Errorf("name is not sealed: %v", item.Name)
+	}
+	key, err := item.IsValidSecret(secret)
 	if err != nil {
 		t.Fatal(err)
 	}
-	r := httptest.NewRequest("GET", "/", nil)
-	r.Host = "unigma.com"
+	encryptedName := item.Name
+	// flip a byte of the sealed name
+	name := []byte(encryptedName)
+	i := len(sealedNamePrefix) + 1
+	if name[i] == '0' {
+		name[i] = '1'
+	} else {
+		name[i] = '0'
+	}
+	item.Name = string(name)
+	if _, err = item.PlainName(key); err != ErrIntegrity {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = item.Decrypt(&writer, key, loggerInfo); err != ErrIntegrity {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if writer.Len() > 0 {
+		t.Errorf("content is written: %v", writer.Len())
+	}
+	item.Name = encryptedName
+	if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "test.txt" {
+		t.Errorf("failed name: %v", item.Name)
+	}
+	// legacy not authenticated name
+	item.Name, err = encryptText("legacy.txt", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err = hex.DecodeString(item.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := item.PlainName(key); (err != nil) || (value != "legacy.txt") {
+		t.Errorf("failed legacy name: %v, %v", value, err)
+	}
+	name[len(name)-1] ^= 0x80
+	item.Name = hex.EncodeToString(name)
+	if _, err = item.PlainName(key); err != ErrIntegrity {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
 
-	uri := item.GetURL(r, false)
-	if u := uri.String(); u != "http://unigma.com/abc" {
-		t.Error(u)
+func TestGCMChunks(t *testing.T) {
+	key := make([]byte, aesKeyLength)
+	sizes := []int{0, 1, gcmChunkSize - 1, gcmChunkSize, gcmChunkSize + 1, gcmChunkSize * 2}
+	for _, size := range sizes {
+		var encrypted, decrypted bytes.Buffer
+		content := bytes.Repeat([]byte("a"), size)
+		n, err := encryptGCM(&encrypted, bytes.NewReader(content), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(size) {
+			t.Errorf("size=%v: failed encrypted size %v", size, n)
+		}
+		data := encrypted.Bytes()
+		if err := decryptGCM(&decrypted, bytes.NewReader(data), key); err != nil {
+			t.Errorf("size=%v: %v", size, err)
+		}
+		if !bytes.Equal(content, decrypted.Bytes()) {
+			t.Errorf("size=%v: failed content", size)
+		}
+		// truncation is detected
+		if size > gcmChunkSize {
+			truncated := data[:1+gcmChunkSize+16]
+			if err := decryptGCM(&decrypted, bytes.NewReader(truncated), key); err != ErrIntegrity {
+				t.Errorf("size=%v: unexpected error: %v", size, err)
+			}
+		}
 	}
-	uri = item.GetURL(r, true)
-	if u := uri.String(); u != "https://unigma.com/abc" {
-		t.Error(u)
+}
+
+func TestDecryptOFB(t *testing.T) {
+	var writer bytes.Buffer
+	key := make([]byte, aesKeyLength)
+	// legacy format, AES-256-OFB with zero IV: "test"
+	encrypted, err := hex.DecodeString("a8f0b30c")
+	if err != nil {
+		t.Fatal(err)
 	}
-	err = item.Delete(db, loggerInfo)
+	if err = decryptOFB(&writer, bytes.NewReader(encrypted), key); err != nil {
+		t.Fatal(err)
+	}
+	if s := writer.String(); s != "test" {
+		t.Errorf("failed content: %v", s)
+	}
+}
+
+func TestItem_DecryptRange(t *testing.T) {
+	secret := "secret"
+	now := time.Now().UTC()
+	content := make([]byte, gcmChunkSize*2+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	item := &Item{
+		Name:    "test.bin",
+		Counter: 1,
+		Path:    testStorage,
+		Created: now,
+		Expired: now,
+	}
+	err := item.Encrypt(bytes.NewReader(content), secret, loggerInfo)
 	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := item.ContentSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("failed size %v", size)
+	}
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedName := item.Name
+	ranges := [][2]int64{
+		{0, 0},
+		{0, size - 1},
+		{10, 20},
+		{gcmChunkSize - 5, gcmChunkSize + 5},
+		{gcmChunkSize * 2, size - 1},
+		{size - 1, size - 1},
+	}
+	for _, rng := range ranges {
+		var writer bytes.Buffer
+		item.Name = encryptedName
+		err = item.DecryptRange(&writer, key, rng[0], rng[1], loggerInfo)
+		if err != nil {
+			t.Errorf("range %v: %v", rng, err)
+			continue
+		}
+		if !bytes.Equal(writer.Bytes(), content[rng[0]:rng[1]+1]) {
+			t.Errorf("range %v: failed content", rng)
+		}
+	}
+	item.Name = encryptedName
+	err = item.DecryptRange(&bytes.Buffer{}, key, 0, size, loggerInfo)
+	if err == nil {
+		t.Error("unexpected result")
+	}
+	if err = os.Remove(item.FullPath()); err != nil {
 		t.Error(err)
 	}
 }
 
-func BenchmarkKey(b *testing.B) {
-	secret, salt := "secret", []byte("abcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefga")
-	for n := 0; n < b.N; n++ {
-		key, h := Key(secret, salt)
-		if (len(key) == 0) || (len(h) == 0) {
-			b.Error("unexpected error")
+// cancelReader cancels the context after the first reading.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	defer cr.cancel()
+	return cr.r.Read(p)
+}
+
+// cancelWriter cancels the context after the first writing.
+type cancelWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (cw *cancelWriter) Write(p []byte) (int, error) {
+	defer cw.cancel()
+	return cw.Buffer.Write(p)
+}
+
+func TestItem_Context(t *testing.T) {
+	secret := "secret"
+	now := time.Now().UTC()
+	content := bytes.Repeat([]byte("0123456789"), gcmChunkSize/2)
+	item := &Item{
+		Name:    "test.bin",
+		Counter: 1,
+		Path:    testStorage,
+		Created: now,
+		Expired: now,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := item.EncryptContext(ctx, &cancelReader{r: bytes.NewReader(content), cancel: cancel}, secret, loggerInfo)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected encryption error: %v", err)
+	}
+	if item.IsFileExists() {
+		t.Error("partial file is not removed")
+	}
+	item.Name = "test.bin"
+	if err = item.Encrypt(bytes.NewReader(content), secret, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := item.DeleteFile(); err != nil {
+			t.Error(err)
+		}
+	}()
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedName := item.Name
+	ctx, cancel = context.WithCancel(context.Background())
+	writer := &cancelWriter{cancel: cancel}
+	err = item.DecryptContext(ctx, writer, key, loggerInfo)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected decryption error: %v", err)
+	}
+	if n := writer.Len(); n >= len(content) {
+		t.Errorf("decryption is not stopped: %v", n)
+	}
+	item.Name = encryptedName
+	ctx, cancel = context.WithCancel(context.Background())
+	writer = &cancelWriter{cancel: cancel}
+	err = item.DecryptRangeContext(ctx, writer, key, 10, int64(len(content)-1), loggerInfo)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected range decryption error: %v", err)
+	}
+}
+
+func TestDecryptOFBRange(t *testing.T) {
+	var writer bytes.Buffer
+	key := make([]byte, aesKeyLength)
+	encrypted, err := hex.DecodeString("a8f0b30c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = decryptOFBRange(&writer, bytes.NewReader(encrypted), key, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s := writer.String(); s != "es" {
+		t.Errorf("failed content: %v", s)
+	}
+}
+
+func TestItem_Storage(t *testing.T) {
+	var writer bytes.Buffer
+	secret := "secret"
+	now := time.Now().UTC()
+	storage := &memStorage{files: make(map[string]*bytes.Buffer)}
+	item := &Item{
+		Name:    "test.txt",
+		Counter: 1,
+		Path:    testStorage,
+		Created: now,
+		Expired: now,
+		Storage: storage,
+	}
+	err := item.Encrypt(strings.NewReader("test"), secret, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(item.FullPath()); !os.IsNotExist(err) {
+		t.Errorf("unexpected file system usage: %v", err)
+	}
+	if !item.IsFileExists() {
+		t.Error("file does not exist")
+	}
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if s := writer.String(); s != "test" {
+		t.Errorf("failed content: %v", s)
+	}
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err = item.Delete(db, loggerInfo); err != nil {
+		t.Error(err)
+	}
+	if n := len(storage.files); n != 0 {
+		t.Errorf("failed storage size: %v", n)
+	}
+}
+
+func TestItem_GetURL(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item, err := createItem(db, "abc", time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "unigma.com"
+
+	uri := item.GetURL(r, false, nil, "")
+	if u := uri.String(); u != "http://unigma.com/abc" {
+		t.Error(u)
+	}
+	uri = item.GetURL(r, true, nil, "")
+	if u := uri.String(); u != "https://unigma.com/abc" {
+		t.Error(u)
+	}
+	for _, basePath := range []string{"/unigma", "/unigma/"} {
+		if u := item.GetURL(r, false, nil, basePath).String(); u != "http://unigma.com/unigma/abc" {
+			t.Errorf("failed URL with base path %v: %v", basePath, u)
+		}
+	}
+	trusted := []string{"public.com", "::1"}
+	values := []struct {
+		host, proto string
+		trusted     []string
+		expected    string
+	}{
+		// direct request, proxy headers are ignored
+		{host: "public.com", proto: "https", expected: "http://unigma.com/abc"},
+		{host: "public.com", proto: "https", trusted: trusted, expected: "https://public.com/abc"},
+		{host: "Public.com:8443, other.com", proto: "HTTPS", trusted: trusted, expected: "https://public.com:8443/abc"},
+		{host: "[::1]:8080", trusted: trusted, expected: "http://[::1]:8080/abc"},
+		{host: "::1", trusted: trusted, expected: "http://[::1]/abc"},
+		{host: "public.com", trusted: []string{" Public.COM:443 "}, expected: "http://public.com/abc"},
+		// spoofed host is rejected by the allowlist
+		{host: "evil.com", proto: "https", trusted: trusted, expected: "https://unigma.com/abc"},
+		{host: "public.com.evil.com", proto: "ftp", trusted: trusted, expected: "http://unigma.com/abc"},
+	}
+	for i, v := range values {
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Host = "unigma.com"
+		r.Header.Set("X-Forwarded-Host", v.host)
+		if v.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", v.proto)
+		}
+		if u := item.GetURL(r, false, v.trusted, "").String(); u != v.expected {
+			t.Errorf("[%v] failed URL: %v", i, u)
+		}
+	}
+	err = item.Delete(db, loggerInfo)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkKey(b *testing.B) {
+	secret, salt := "secret", []byte("abcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefgabcdefga")
+	for n := 0; n < b.N; n++ {
+		key, h := Key(secret, salt, DefaultIter)
+		if (len(key) == 0) || (len(h) == 0) {
+			b.Error("unexpected error")
+		}
+	}
+}
+
+func TestItem_Unlock(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item, err := createItem(db, "ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afe1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := item.Unlock(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := item.IsUnlocked(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("not unlocked")
+	}
+	other := &Item{ID: item.ID + 1000}
+	for i, c := range []struct {
+		item  *Item
+		token string
+	}{{item, ""}, {item, "bad"}, {other, token}} {
+		ok, err = c.item.IsUnlocked(db, c.token)
+		if err != nil {
+			t.Error(err)
+		}
+		if ok {
+			t.Errorf("[%v] unexpected unlock", i)
+		}
+	}
+	_, err = db.Exec("UPDATE `unlock` SET `expired`=? WHERE `token`=?;", time.Now().UTC().Add(-time.Second), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = item.IsUnlocked(db, token); ok || (err != nil) {
+		t.Errorf("expired token is valid: %v", err)
+	}
+	n, err := deleteUnlocks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("failed deleted unlocks: %v", n)
+	}
+	if err = item.Delete(db, loggerInfo); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteByDateCounter(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item, err := createItem(db, "ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afe2", time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := item.Decrement(db, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("not decremented")
+	}
+	// the download can be resumed, so the used item is kept for a while
+	if _, err = deleteByDate(db, nil, testGCBatch, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := readIDs(db, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ids[item.ID] {
+		t.Errorf("item %v is deleted before resume period", item.ID)
+	}
+	updated := time.Now().UTC().Add(-ResumePeriod - time.Second)
+	if _, err = db.Exec("UPDATE `storage` SET `updated`=? WHERE `id`=?;", updated, item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = deleteByDate(db, nil, testGCBatch, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err = readIDs(db, t); err != nil {
+		t.Fatal(err)
+	}
+	if ids[item.ID] {
+		t.Errorf("item %v is not deleted", item.ID)
+	}
+	if item.IsFileExists() {
+		t.Errorf("file %v is not deleted", item.Hash)
+	}
+}
+
+func TestFileStorage_Shards(t *testing.T) {
+	hash := "ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd7"
+	expected := []string{
+		filepath.Join(testStorage, hash),
+		filepath.Join(testStorage, "ab", hash),
+		filepath.Join(testStorage, "ab", "11", hash),
+	}
+	for depth, path := range expected {
+		fs := &FileStorage{Dir: testStorage, Depth: depth}
+		if p := fs.fullPath(hash); p != path {
+			t.Errorf("[%v] failed path: %v", depth, p)
+		}
+	}
+	secret := "secret"
+	for depth := 1; depth <= 2; depth++ {
+		dir, err := ioutil.TempDir("", "unigma")
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC()
+		item := &Item{
+			Name:    "test.txt",
+			Counter: 1,
+			Path:    dir,
+			Created: now,
+			Expired: now,
+			Storage: &FileStorage{Dir: dir, Depth: depth},
+		}
+		err = item.Encrypt(strings.NewReader("test"), secret, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(dir, item.FullPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(strings.Split(rel, string(filepath.Separator))); n != depth+1 {
+			t.Errorf("[%v] failed path: %v", depth, rel)
+		}
+		if !item.IsFileExists() {
+			t.Errorf("[%v] file does not exist", depth)
+		}
+		key, err := item.IsValidSecret(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var writer bytes.Buffer
+		if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if s := writer.String(); s != "test" {
+			t.Errorf("[%v] failed content: %v", depth, s)
+		}
+		if err = item.DeleteFile(); err != nil {
+			t.Error(err)
+		}
+		if item.IsFileExists() {
+			t.Errorf("[%v] file is not deleted", depth)
+		}
+		if err = os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFileStorage_Prune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	hashes := []string{
+		"ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd7",
+		"ab227372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd7",
+	}
+	fs := &FileStorage{Dir: dir, Depth: 2, Prune: true}
+	for _, hash := range hashes {
+		w, err := fs.Writer(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "ab" directory still has other file
+	if err = fs.Remove(hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ab", "11")); !os.IsNotExist(err) {
+		t.Errorf("empty shard is not pruned: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ab", "22")); err != nil {
+		t.Errorf("not empty shard is pruned: %v", err)
+	}
+	if err = fs.Remove(hashes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ab")); !os.IsNotExist(err) {
+		t.Errorf("empty shard is not pruned: %v", err)
+	}
+	if _, err = os.Stat(dir); err != nil {
+		t.Errorf("storage directory is pruned: %v", err)
+	}
+	// not pruned storage keeps empty directories
+	fs.Prune = false
+	w, err := fs.Writer(hashes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Remove(hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ab", "11")); err != nil {
+		t.Errorf("shard is pruned: %v", err)
+	}
+}
+
+func TestItem_Checksum(t *testing.T) {
+	secret := "secret"
+	content := "checksum content"
+	sum := sha256.Sum256([]byte(content))
+	now := time.Now().UTC()
+	storage := &memStorage{files: make(map[string]*bytes.Buffer)}
+	item := &Item{Name: "test.txt", Counter: 1, Created: now, Expired: now, Storage: storage}
+	err := item.Encrypt(strings.NewReader(content), secret, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ContentChecksum() != hex.EncodeToString(sum[:]) {
+		t.Errorf("failed checksum: %v", item.ContentChecksum())
+	}
+	if (item.Checksum == "") || (item.Checksum == item.ContentChecksum()) {
+		t.Errorf("checksum is not encrypted: %v", item.Checksum)
+	}
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Verify = true
+	name := item.Name
+	var writer bytes.Buffer
+	if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if writer.String() != content {
+		t.Error("failed content")
+	}
+	// stored checksum of other content
+	item.Name = name
+	item.Checksum, err = encryptText(strings.Repeat("0", 64), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Reset()
+	if err = item.Decrypt(&writer, key, loggerInfo); !errors.Is(err, ErrChecksum) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// verification is disabled
+	item.Name = name
+	item.Verify = false
+	writer.Reset()
+	if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestItem_Compressed(t *testing.T) {
+	secret := "secret"
+	content := strings.Repeat("compressible log line\n", 10000)
+	now := time.Now().UTC()
+	storage := &memStorage{files: make(map[string]*bytes.Buffer)}
+	item := &Item{
+		Name:       "test.log",
+		Counter:    1,
+		Compressed: true,
+		Created:    now,
+		Expired:    now,
+		Storage:    storage,
+	}
+	err := item.Encrypt(strings.NewReader(content), secret, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Size != int64(len(content)) {
+		t.Errorf("failed size: %v", item.Size)
+	}
+	stored, err := storage.Size(item.StorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored >= int64(len(content))/10 {
+		t.Errorf("stored file is not compressed: %v", stored)
+	}
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writer bytes.Buffer
+	name := item.Name
+	if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if writer.String() != content {
+		t.Error("failed content")
+	}
+	item.Name = name
+	size, err := item.ContentSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("failed content size: %v", size)
+	}
+	writer.Reset()
+	if err = item.DecryptRange(&writer, key, 5, 100, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if writer.String() != content[5:101] {
+		t.Errorf("failed range content: %v", writer.String())
+	}
+	item.Name = name
+	// broken data
+	storage.files[item.StorageID].Bytes()[stored/2] ^= 1
+	if err = item.Decrypt(ioutil.Discard, key, loggerInfo); err == nil {
+		t.Error("expected integrity error")
+	}
+}
+
+func TestItem_IsOwner(t *testing.T) {
+	item := &Item{}
+	if item.IsOwner("") {
+		t.Error("owner without token")
+	}
+	token, err := item.NewOwner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Owner == token {
+		t.Error("plain owner token is stored")
+	}
+	if !item.IsOwner(token) {
+		t.Error("failed owner check")
+	}
+	if item.IsOwner(token + "a") {
+		t.Error("unexpected owner")
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile(filepath.Join("..", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "stats.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Stats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (StatsResult{}) {
+		t.Errorf("failed empty stats: %+v", result)
+	}
+	now := time.Now().UTC()
+	items := []*Item{
+		{Hash: "a", Size: 100, Counter: 1, Expired: now.Add(time.Hour)},
+		{Hash: "b", Size: 200, Counter: 2, Expired: now.Add(2 * time.Hour)},
+		{Hash: "c", Size: 300, Counter: 6, Expired: now.Add(48 * time.Hour)},
+	}
+	for _, item := range items {
+		item.Created = now
+		if err = item.Save(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err = Stats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := StatsResult{Items: 3, Bytes: 600, Expiring: 2, AvgCounter: 3}
+	if result != expected {
+		t.Errorf("failed stats: %+v", result)
+	}
+}
+
+func TestActiveCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile(filepath.Join("..", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "active.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	items := []*Item{
+		{Hash: "a", Counter: 1, Expired: now.Add(time.Hour)},
+		{Hash: "b", Counter: 3, Expired: now.Add(2 * time.Hour)},
+		{Hash: "c", Counter: 1, Expired: now.Add(-time.Hour)},
+		{Hash: "d", Counter: 0, Expired: now.Add(time.Hour)},
+	}
+	for _, item := range items {
+		item.Created = now
+		if err = item.Save(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := ActiveCount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("failed active count: %v", n)
+	}
+	// nil cache is disabled
+	var nilCache *ActiveCache
+	if n, err = nilCache.Get(db); (err != nil) || (n != 2) {
+		t.Errorf("failed nil cache count: %v, %v", n, err)
+	}
+	cache := &ActiveCache{Period: time.Hour}
+	if n, err = cache.Get(db); (err != nil) || (n != 2) {
+		t.Errorf("failed cache count: %v, %v", n, err)
+	}
+	item := &Item{Hash: "e", Counter: 1, Created: now, Expired: now.Add(time.Hour)}
+	if err = item.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = cache.Get(db); (err != nil) || (n != 2) {
+		t.Errorf("failed cached count: %v, %v", n, err)
+	}
+	cache.Period = 0
+	if n, err = cache.Get(db); (err != nil) || (n != 3) {
+		t.Errorf("failed updated count: %v, %v", n, err)
+	}
+}
+
+func TestItem_RecordAccess(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item := &Item{Hash: "ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afe1"}
+	if err = item.RecordAccess(db, false, "192.0.2.15"); err != nil {
+		t.Fatal(err)
+	}
+	if err = item.RecordAccess(db, true, "2001:db8:1:2::15"); err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadAccessLog(db, item.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(records); n != 2 {
+		t.Fatalf("failed records count: %v", n)
+	}
+	if records[0].Success || (records[0].IP != "192.0.2.0") {
+		t.Errorf("failed first record: %+v", records[0])
+	}
+	if !records[1].Success || (records[1].IP != "2001:db8:1::") {
+		t.Errorf("failed second record: %+v", records[1])
+	}
+	if ip := truncateIP("bad"); ip != "" {
+		t.Errorf("failed invalid IP: %v", ip)
+	}
+	_, err = db.Exec("UPDATE `access_log` SET `created`=? WHERE `hash`=?;", time.Now().UTC().Add(-AccessLogTTL-time.Hour), item.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := deleteAccessLog(db); err != nil || n != 2 {
+		t.Errorf("failed access log deletion: %v, %v", n, err)
+	}
+}
+
+func TestSizeCache(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	sc := &SizeCache{}
+	total, err := sc.Get(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Add(10)
+	if size, _ := sc.Get(db); size != total+10 {
+		t.Errorf("failed cached size: %v", size)
+	}
+	sc.Invalidate()
+	if sc.valid {
+		t.Error("cache is not invalidated")
+	}
+	if _, err = sc.Get(db); (err != nil) || !sc.valid {
+		t.Errorf("cache is not updated: %v", err)
+	}
+	var disabled *SizeCache
+	disabled.Add(10)
+	disabled.Invalidate()
+	if _, err = disabled.Get(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "test.txt", expected: `attachment; filename="test.txt"`},
+		{name: "evil\r\nSet-Cookie: a=b.txt", expected: `attachment; filename="evilSet-Cookie: a=b.txt"`},
+		{name: "../../etc/passwd", expected: `attachment; filename="....etcpasswd"`},
+		{name: `a"b.txt`, expected: `attachment; filename="a_b.txt"; filename*=UTF-8''a%22b.txt`},
+		{name: "отчёт 1.pdf", expected: `attachment; filename="_____ 1.pdf"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82%201.pdf`},
+		{name: "\r\n", expected: `attachment; filename="file"`},
+	}
+	for i, c := range cases {
+		if value := contentDisposition("attachment", c.name); value != c.expected {
+			t.Errorf("[%v] failed value: %v", i, value)
+		}
+	}
+}
+
+func TestItem_StorageID(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	now := time.Now().UTC()
+	items := make([]*Item, 2)
+	for i := range items {
+		item := &Item{
+			Name:    "test.txt",
+			Counter: 1,
+			Path:    testStorage,
+			Created: now,
+			Expired: now.Add(time.Minute),
+		}
+		if err = item.Encrypt(strings.NewReader("test"), secret, loggerInfo); err != nil {
+			t.Fatalf("[%v] %v", i, err)
+		}
+		if err = item.Save(db); err != nil {
+			t.Fatalf("[%v] %v", i, err)
+		}
+		if (len(item.StorageID) != storageIDLength*2) || (item.StorageID == item.Hash) {
+			t.Errorf("[%v] failed storage ID: %v", i, item.StorageID)
+		}
+		if filepath.Base(item.FullPath()) != item.StorageID {
+			t.Errorf("[%v] failed path: %v", i, item.FullPath())
+		}
+		items[i] = item
+	}
+	if items[0].FullPath() == items[1].FullPath() {
+		t.Error("the same file for identical uploads")
+	}
+	for i, item := range items {
+		stored, err := Read(db, item.Hash, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.StorageID != item.StorageID {
+			t.Errorf("[%v] failed stored storage ID: %v", i, stored.StorageID)
+		}
+		if !stored.IsFileExists() {
+			t.Errorf("[%v] file does not exist", i)
+		}
+		exists, err := IsHashExists(db, item.Hash)
+		if err != nil || !exists {
+			t.Errorf("[%v] hash is not found: %v", i, err)
+		}
+		if err = item.Delete(db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+		if item.IsFileExists() {
+			t.Errorf("[%v] file is not deleted", i)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	s, err := NewSession(db, "test.txt", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSessionID(s.ID) {
+		t.Errorf("failed session ID: %v", s.ID)
+	}
+	if err = s.Append(db, 1, strings.NewReader("abc")); err != ErrSessionOffset {
+		t.Errorf("failed offset error: %v", err)
+	}
+	if err = s.Append(db, 0, strings.NewReader("01234")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Append(db, 5, strings.NewReader("567890")); err != ErrSessionSize {
+		t.Errorf("failed size error: %v", err)
+	}
+	if err = s.Append(db, 5, strings.NewReader("56789")); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ReadSession(db, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (stored == nil) || (stored.Received != 10) || !stored.IsComplete() || (stored.Name != "test.txt") {
+		t.Fatalf("failed session: %+v", stored)
+	}
+	data, err := ioutil.ReadFile(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789" {
+		t.Errorf("failed session data: %s", data)
+	}
+	// expired session is removed by GC
+	_, err = db.Exec("UPDATE `upload_session` SET `expired`=? WHERE `id`=?;", time.Now().UTC().Add(-time.Minute), s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = ReadSession(db, s.ID); (err != nil) || (stored != nil) {
+		t.Errorf("expired session is returned: %+v, %v", stored, err)
+	}
+	if n, err := deleteSessions(db); (err != nil) || (n < 1) {
+		t.Errorf("failed sessions deletion: %v, %v", n, err)
+	}
+	if _, err = os.Stat(s.Path()); !os.IsNotExist(err) {
+		t.Errorf("session file is not deleted: %v", err)
+	}
+}
+
+func TestSession_AppendConcurrent(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	n, reserved, err := SessionsUsage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSession(db, "test.txt", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.Delete(db); err != nil {
+			t.Error(err)
+		}
+	}()
+	m, total, err := SessionsUsage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (m != n+1) || (total != reserved+10) {
+		t.Errorf("failed sessions usage: %v, %v", m, total)
+	}
+	stale, err := ReadSession(db, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- s.Append(db, 0, pr)
+	}()
+	// wait the first request starts writing
+	if _, err = pw.Write([]byte("012")); err != nil {
+		t.Fatal(err)
+	}
+	if err = stale.Append(db, 0, strings.NewReader("abcde")); err != ErrSessionOffset {
+		t.Errorf("concurrent append is not refused: %v", err)
+	}
+	if _, err = pw.Write([]byte("34")); err != nil {
+		t.Fatal(err)
+	}
+	if err = pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	// stale session can't truncate already received data
+	if err = stale.Append(db, 0, strings.NewReader("abcde")); err != ErrSessionOffset {
+		t.Errorf("stale append is not refused: %v", err)
+	}
+	if stale.Received != 5 {
+		t.Errorf("failed received bytes: %v", stale.Received)
+	}
+	if err = stale.Append(db, 5, strings.NewReader("56789")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789" {
+		t.Errorf("failed session data: %s", data)
+	}
+}
+
+func TestItem_Label(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	key := bytes.Repeat([]byte{1}, LabelKeySize)
+	label, err := EncryptLabel("quarterly report", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(label, hex.EncodeToString([]byte("quarterly"))) {
+		t.Errorf("label is not encrypted: %v", label)
+	}
+	if _, err = DecryptLabel(label, bytes.Repeat([]byte{2}, LabelKeySize)); err != ErrIntegrity {
+		t.Errorf("expected integrity error for other key: %v", err)
+	}
+	now := time.Now().UTC()
+	item := &Item{Name: "test.txt", Label: label, Counter: 1, Path: testStorage, Created: now, Expired: now.Add(time.Minute)}
+	err = item.Encrypt(strings.NewReader("content"), "secret", loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = item.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := item.Delete(db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}()
+	items, err := List(db, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed *Item
+	for _, i := range items {
+		if i.ID == item.ID {
+			listed = i
+		}
+	}
+	if listed == nil {
+		t.Fatal("item is not listed")
+	}
+	value, err := DecryptLabel(listed.Label, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "quarterly report" {
+		t.Errorf("failed label: %v", value)
+	}
+	// the file name is encrypted only by user's password
+	stored, err := Read(db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name == "test.txt" {
+		t.Errorf("name is not encrypted: %v", stored.Name)
+	}
+	if _, err = DecryptLabel(stored.Name, key); err == nil {
+		t.Error("name is decrypted by the server key")
+	}
+}
+
+func TestItem_Fail(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	now := time.Now().UTC()
+	item := &Item{Name: "test.txt", Counter: 3, MaxFails: 2, Path: testStorage, Created: now, Expired: now.Add(time.Minute)}
+	err = item.Encrypt(strings.NewReader("content"), "secret", loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = item.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := item.Delete(db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}()
+	destroyed, err := item.Fail(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destroyed || (item.Fails != 1) || (item.Counter != 3) {
+		t.Errorf("failed first attempt: %v, fails=%v, counter=%v", destroyed, item.Fails, item.Counter)
+	}
+	stored, err := Read(db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (stored.MaxFails != 2) || (stored.Fails != 1) {
+		t.Errorf("failed stored item: max_fails=%v, fails=%v", stored.MaxFails, stored.Fails)
+	}
+	destroyed, err = item.Fail(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !destroyed || (item.Counter != 0) {
+		t.Errorf("item is not destroyed: counter=%v", item.Counter)
+	}
+	stored, err = Read(db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != 0 {
+		t.Errorf("destroyed item is read: %v", stored.ID)
+	}
+	// no limit
+	noLimit := &Item{ID: item.ID}
+	if destroyed, err = noLimit.Fail(db); err != nil || destroyed {
+		t.Errorf("unexpected result without limit: %v, %v", destroyed, err)
+	}
+}
+
+func TestVerifyStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-verify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	storageDir := filepath.Join(dir, "storage")
+	if err = os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileStorage{Dir: storageDir, Depth: 1}
+	now := time.Now().UTC()
+	create := func(content string, compressed bool, sizeDelta int64) *Item {
+		item := &Item{Name: "test.txt", Counter: 1, Path: storageDir, Storage: fs, Compressed: compressed, Created: now, Expired: now.Add(time.Minute)}
+		if err := item.Encrypt(strings.NewReader(content), "secret", loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		item.Size += sizeDelta
+		if err := item.Save(db); err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	create("consistent content", false, 0)
+	create(strings.Repeat("a", 2*gcmChunkSize), false, 0)
+	create("compressed content", true, 0)
+	missing := create("missing content", false, 0)
+	if err = missing.DeleteFile(); err != nil {
+		t.Fatal(err)
+	}
+	mismatched := create("mismatched content", false, 1)
+	orphan := filepath.Join(storageDir, "orphan")
+	if err = ioutil.WriteFile(orphan, []byte("orphan"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := VerifyStorage(db, storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 5 {
+		t.Errorf("failed checked number: %v", result.Checked)
+	}
+	if result.IsConsistent() {
+		t.Error("storage is consistent")
+	}
+	if (len(result.Missing) != 1) || (result.Missing[0] != missing.StorageID) {
+		t.Errorf("failed missing files: %v", result.Missing)
+	}
+	if (len(result.Mismatched) != 1) || (result.Mismatched[0] != mismatched.StorageID) {
+		t.Errorf("failed mismatched files: %v", result.Mismatched)
+	}
+	if (len(result.Orphans) != 1) || (result.Orphans[0] != orphan) {
+		t.Errorf("failed orphaned files: %v", result.Orphans)
+	}
+	// a truncated file has inconsistent structure
+	item := &Item{Format: FormatGCM, Compressed: true}
+	if isConsistentSize(item, 1+gcmTagSize-1) {
+		t.Error("truncated file is consistent")
+	}
+	if !isConsistentSize(item, 1+gcmTagSize) {
+		t.Error("empty file is not consistent")
+	}
+}
+
+func TestReadState(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	now := time.Now().UTC()
+	values := []struct {
+		counter int
+		expired time.Time
+		state   int
+	}{
+		{counter: 1, expired: now.Add(time.Minute), state: StateActive},
+		{counter: 1, expired: now.Add(-time.Minute), state: StateExpired},
+		{counter: 0, expired: now.Add(time.Minute), state: StateUsed},
+	}
+	for i, v := range values {
+		item := &Item{Name: "test.txt", Counter: v.counter, Path: testStorage, Created: now, Expired: v.expired}
+		if err = item.Encrypt(strings.NewReader("content"), "secret", loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if err = item.Save(db); err != nil {
+			t.Fatal(err)
+		}
+		stored, state, err := ReadState(db, item.Hash, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != v.state {
+			t.Errorf("[%v] failed state: %v", i, state)
+		}
+		if ((state == StateActive) || (state == StateUsed)) != (stored != nil) {
+			t.Errorf("[%v] failed item: %v", i, stored)
+		}
+		if err = item.Delete(db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}
+	_, state, err := ReadState(db, strings.Repeat("a", 64), loggerInfo)
+	if (err != nil) || (state != StateNotFound) {
+		t.Errorf("failed not found state: %v, %v", state, err)
+	}
+}
+
+func TestNewUploader(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, SessionKeySize)
+	value, err := NewUploader(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsUploader(value, key) {
+		t.Errorf("failed signature: %v", value)
+	}
+	if IsUploader(value, bytes.Repeat([]byte{2}, SessionKeySize)) {
+		t.Error("signature of other key")
+	}
+	for _, v := range []string{"", ".", value[:32], value[:33], value[:32] + "." + strings.Repeat("0", 64)} {
+		if IsUploader(v, key) {
+			t.Errorf("invalid value is accepted: %q", v)
+		}
+	}
+	item := &Item{}
+	if item.IsUploader(value) {
+		t.Error("item without session")
+	}
+	item.SetUploader(value)
+	if (item.Session == value) || !item.IsUploader(value) || item.IsUploader("") {
+		t.Errorf("failed item session: %v", item.Session)
+	}
+}
+
+func TestOrphanFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-orphan-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	storageDir := filepath.Join(dir, "storage")
+	if err = os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileStorage{Dir: storageDir, Depth: 1, Prune: true}
+	now := time.Now().UTC()
+	old := time.Now().Add(-2 * time.Hour)
+	encrypt := func() *Item {
+		item := &Item{Name: "test.txt", Counter: 1, Path: storageDir, Storage: fs, Created: now, Expired: now.Add(time.Hour)}
+		if err := item.Encrypt(strings.NewReader("content"), "secret", loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	// an old file of the item is kept
+	saved := encrypt()
+	if err = saved.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(fs.fullPath(saved.storageKey()), old, old); err != nil {
+		t.Fatal(err)
+	}
+	// a new file of an upload in progress is kept
+	progress := encrypt()
+	// an old file of the interrupted upload is removed, its shard name can't collide with random ones
+	orphan := filepath.Join(storageDir, "zz", "zz00")
+	if err = os.Mkdir(filepath.Dir(orphan), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(orphan, []byte("orphan"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(orphan, old, old); err != nil {
+		t.Fatal(err)
+	}
+	orphans, err := OrphanFiles(db, storageDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(orphans) != 1) || (orphans[0] != orphan) {
+		t.Errorf("failed orphaned files: %v", orphans)
+	}
+	closing := make(chan struct{})
+	monitoring := make(chan *Item)
+	period := 100 * time.Millisecond
+	gc := &GCConfig{Db: db, Storage: fs, Info: loggerInfo, Err: loggerInfo, Period: period, Batch: testGCBatch, Grace: time.Hour}
+	go GCMonitor(monitoring, closing, gc)
+	time.Sleep(period * 3)
+	close(closing)
+	time.Sleep(period)
+	close(monitoring)
+
+	if _, err = os.Stat(filepath.Dir(orphan)); !os.IsNotExist(err) {
+		t.Errorf("orphaned file directory is not removed: %v", err)
+	}
+	if !saved.IsFileExists() || !progress.IsFileExists() {
+		t.Error("file is removed")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	token, err := NewClaim(db, "secret", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsClaimToken(token) {
+		t.Errorf("failed token: %v", token)
+	}
+	var stored string
+	if err = db.QueryRow("SELECT `password` FROM `claim` WHERE `token`=?;", ownerHash(token)).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "secret") {
+		t.Error("password is not encrypted")
+	}
+	password, err := Claim(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "secret" {
+		t.Errorf("failed password: %v", password)
+	}
+	if password, err = Claim(db, token); (err != nil) || (password != "") {
+		t.Errorf("claimed twice: %v, %v", password, err)
+	}
+	// expired token
+	token, err = NewClaim(db, "secret", time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, err = Claim(db, token); (err != nil) || (password != "") {
+		t.Errorf("expired token is claimed: %v, %v", password, err)
+	}
+	n, err := deleteClaims(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("failed deleted claims: %v", n)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	content := strings.Repeat("plain content ", 100)
+	s, err := newSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := s.file.Name()
+	if _, err = io.Copy(s.Writer(), strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(data) != len(content)) || strings.Contains(string(data), "plain") {
+		t.Errorf("spool file is not encrypted: %q", data[:32])
+	}
+	r, err := s.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("failed spool content: %q", data[:32])
+	}
+	s.Close(log.New(os.Stdout, "", 0))
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("spool file is not removed: %v", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	content := "deduplicated content"
+	now := time.Now().UTC()
+	storage := &memStorage{files: make(map[string]*bytes.Buffer)}
+	dedup := NewDedup(db, "server secret")
+	items := make([]*Item, 2)
+	for i, secret := range []string{"secret1", "secret2"} {
+		item := &Item{Name: "test.txt", Counter: 1, Created: now, Expired: now.Add(time.Minute), Storage: storage, Dedup: dedup}
+		if err = item.Encrypt(strings.NewReader(content), secret, loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if err = item.Save(db); err != nil {
+			t.Fatal(err)
+		}
+		items[i] = item
+	}
+	if n := len(storage.files); n != 1 {
+		t.Fatalf("failed number of stored files: %v", n)
+	}
+	if (items[0].Blob == "") || (items[0].Blob != items[1].Blob) || (items[0].StorageID != items[1].StorageID) {
+		t.Fatalf("items don't share a blob: %v, %v", items[0].Blob, items[1].Blob)
+	}
+	if items[0].Hash == items[1].Hash {
+		t.Error("items have the same hash")
+	}
+	refs := func() int {
+		var n int
+		err := db.QueryRow("SELECT `refcount` FROM `blob` WHERE `id`=?;", items[0].Blob).Scan(&n)
+		if (err != nil) && (err != sql.ErrNoRows) {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := refs(); n != 2 {
+		t.Errorf("failed refcount: %v", n)
+	}
+	// every item is read by its own password
+	for i, secret := range []string{"secret1", "secret2"} {
+		item, err := Read(db, items[i].Hash, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Storage = storage
+		key, err := item.IsValidSecret(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Verify = true
+		var writer bytes.Buffer
+		if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if writer.String() != content {
+			t.Errorf("failed content: %v", writer.String())
+		}
+		items[i] = item
+	}
+	if err = items[0].Delete(db, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if !items[1].IsFileExists() {
+		t.Error("shared file is removed with a reference")
+	}
+	if n := refs(); n != 1 {
+		t.Errorf("failed refcount after delete: %v", n)
+	}
+	if err = items[1].Delete(db, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if items[1].IsFileExists() {
+		t.Error("shared file is not removed")
+	}
+	if n := refs(); n != 0 {
+		t.Errorf("blob is not removed: %v", n)
+	}
+	// other content is stored separately
+	item := &Item{Name: "test.txt", Counter: 1, Created: now, Expired: now, Storage: storage, Dedup: dedup}
+	if err = item.Encrypt(strings.NewReader(content+"!"), "secret", loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if item.Blob == items[1].Blob {
+		t.Error("different content shares a blob")
+	}
+	if err = item.DeleteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.files) != 0 {
+		t.Errorf("not removed files: %v", len(storage.files))
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-migrate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	n, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) {
+		t.Errorf("failed applied migrations: %v", n)
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("failed schema version: %v", version)
+	}
+	// the schema is usable
+	item, err := createItem(db, strings.Repeat("a", 64), time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := Read(db, item.Hash, loggerInfo); (err != nil) || (stored.ID != item.ID) {
+		t.Errorf("failed read: %v, %v", stored, err)
+	}
+	if _, err = NewClaim(db, "secret", time.Now().UTC().Add(time.Minute)); err != nil {
+		t.Error(err)
+	}
+	// the second run is no-op
+	if n, err = Migrate(db); (err != nil) || (n != 0) {
+		t.Errorf("repeated migration: %v, %v", n, err)
+	}
+	var rows int
+	if err = db.QueryRow("SELECT COUNT(*) FROM `schema_version`;").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != len(migrations) {
+		t.Errorf("failed versions: %v", rows)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-migrate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// a database created before migrations with some of manually added columns
+	_, err = db.Exec("CREATE TABLE `storage` (`id` INTEGER PRIMARY KEY AUTOINCREMENT, `name` TEXT, `path` TEXT, " +
+		"`counter` INTEGER NOT NULL DEFAULT 1, `format` INTEGER NOT NULL DEFAULT 0, `hash` VARCHAR(64) NOT NULL, " +
+		"`salt` VARCHAR(256) NOT NULL, `created` DATETIME NOT NULL, `updated` DATETIME NOT NULL, `expired` DATETIME NOT NULL);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	item, err := createItem(db, strings.Repeat("b", 64), time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := Read(db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != item.ID {
+		t.Errorf("failed read: %v", stored.ID)
+	}
+}
+
+func TestItem_Rechallenge(t *testing.T) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	content := "rechallenged content"
+	now := time.Now().UTC()
+	storage := &memStorage{files: make(map[string]*bytes.Buffer)}
+	dedup := NewDedup(db, "server secret")
+	for _, shared := range []*Dedup{nil, dedup} {
+		item := &Item{Name: "test.txt", Counter: 1, Created: now, Expired: now.Add(time.Minute), Storage: storage, Dedup: shared}
+		if err = item.Encrypt(strings.NewReader(content), "old", loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if err = item.Save(db); err != nil {
+			t.Fatal(err)
+		}
+		oldHash, oldStorageID := item.Hash, item.StorageID
+		if err = item.Rechallenge(db, "wrong", "new", loggerInfo); err != ErrPassword {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err = item.Rechallenge(db, "old", "new", loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if item.Hash == oldHash {
+			t.Error("hash is not changed")
+		}
+		if (shared == nil) && (item.StorageID == oldStorageID || storage.Exists(oldStorageID)) {
+			t.Errorf("old file is not replaced: %v", oldStorageID)
+		}
+		if old, err := Read(db, oldHash, loggerInfo); (err != nil) || (old.ID != 0) {
+			t.Errorf("item is read by old hash: %v, %v", old.ID, err)
+		}
+		stored, err := Read(db, item.Hash, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.ID != item.ID {
+			t.Fatalf("failed read: %v", stored.ID)
+		}
+		stored.Storage = storage
+		if _, err = stored.IsValidSecret("old"); err != ErrPassword {
+			t.Errorf("old password is valid: %v", err)
+		}
+		key, err := stored.IsValidSecret("new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored.Verify = true
+		var writer bytes.Buffer
+		if err = stored.Decrypt(&writer, key, loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if (writer.String() != content) || (stored.Name != "test.txt") {
+			t.Errorf("failed decrypted item: %v, %v", writer.String(), stored.Name)
+		}
+		if err = stored.Delete(db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(storage.files) != 0 {
+		t.Errorf("not removed files: %v", len(storage.files))
+	}
+	sealed := &Item{Format: FormatSealed}
+	if err = sealed.Rechallenge(db, "old", "new", loggerInfo); err != ErrRechallengeSealed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestItem_Passwordless(t *testing.T) {
+	item := &Item{}
+	if item.IsPasswordless() {
+		t.Error("item is passwordless without a password")
+	}
+	key := PasswordlessKey("server secret")
+	password, err := item.NewPasswordless(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.IsPasswordless() || (len(password) != passwordlessLength*2) {
+		t.Fatalf("failed passwordless item: %v, %v", item.Passwordless, password)
+	}
+	other, err := (&Item{}).NewPasswordless(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == password {
+		t.Error("random passwords are equal")
+	}
+	value, err := item.PasswordlessPassword(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != password {
+		t.Errorf("unexpected password: %v", value)
+	}
+	if _, err = item.PasswordlessPassword(PasswordlessKey("other secret")); err != ErrIntegrity {
+		t.Errorf("password is opened by other key: %v", err)
+	}
+}
+
+func TestEnvelopeStorage(t *testing.T) {
+	secret := "secret"
+	now := time.Now().UTC()
+	content := make([]byte, gcmChunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	fs := &FileStorage{Dir: testStorage}
+	es := &EnvelopeStorage{Storage: fs, Keys: map[byte][]byte{1: bytes.Repeat([]byte{1}, EnvelopeKeySize)}, Version: 1}
+	item := &Item{Name: "test.bin", Counter: 1, Path: testStorage, Storage: es, Created: now, Expired: now}
+	err := item.Encrypt(bytes.NewReader(content), secret, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Remove(item.FullPath()); err != nil {
+			t.Error(err)
+		}
+	}()
+	readAll := func(st Storage) []byte {
+		r, err := st.Reader(item.storageKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := r.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	stored, encrypted := readAll(fs), readAll(es)
+	if !bytes.HasPrefix(stored, []byte(envelopeMagic)) || (stored[len(envelopeMagic)] != 1) {
+		t.Errorf("failed envelope header: %x", stored[:envelopeHeaderSize])
+	}
+	if (len(stored) != len(encrypted)+envelopeHeaderSize) || bytes.Equal(stored[envelopeHeaderSize:], encrypted) {
+		t.Error("stored data is not encrypted at rest")
+	}
+	if encrypted[0] != FormatGCM {
+		t.Errorf("failed user encrypted data: %x", encrypted[0])
+	}
+	size, err := item.ContentSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("failed size %v", size)
+	}
+	key, err := item.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedName := item.Name
+	var writer bytes.Buffer
+	if err = item.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(writer.Bytes(), content) {
+		t.Error("failed content")
+	}
+	// seeking in the middle of the CTR block
+	writer.Reset()
+	item.Name = encryptedName
+	if err = item.DecryptRange(&writer, key, gcmChunkSize-5, gcmChunkSize+5, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(writer.Bytes(), content[gcmChunkSize-5:gcmChunkSize+6]) {
+		t.Error("failed range content")
+	}
+	// files without the header and new files of zero version are read as is
+	es.Version = 0
+	plain := &Item{Name: "test.txt", Counter: 1, Path: testStorage, Storage: es, Created: now, Expired: now}
+	if err = plain.Encrypt(strings.NewReader("plain"), secret, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Remove(plain.FullPath()); err != nil {
+			t.Error(err)
+		}
+	}()
+	key, err = plain.IsValidSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Reset()
+	if err = plain.Decrypt(&writer, key, loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if s := writer.String(); s != "plain" {
+		t.Errorf("failed plain content: %v", s)
+	}
+	// unknown key version
+	es.Keys = map[byte][]byte{2: bytes.Repeat([]byte{2}, EnvelopeKeySize)}
+	if _, err = es.Reader(item.storageKey()); err == nil {
+		t.Error("unexpected read by unknown key version")
+	}
+}
+
+func TestItem_ResumeToken(t *testing.T) {
+	item := &Item{Hash: strings.Repeat("a", 64)}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	token := item.ResumeToken(key, time.Now().Add(time.Minute))
+	if !item.IsResumeToken(key, token) {
+		t.Error("valid token is not accepted")
+	}
+	other := &Item{Hash: strings.Repeat("b", 64)}
+	values := []struct {
+		item  *Item
+		key   []byte
+		token string
+	}{
+		{item: item, key: []byte("other key"), token: token},
+		{item: other, key: key, token: token},
+		{item: item, key: key, token: item.ResumeToken(key, time.Now().Add(-time.Second))},
+		{item: item, key: key, token: "1" + token},
+		{item: item, key: key, token: strings.Replace(token, ".", "", 1)},
+		{item: item, key: key, token: ""},
+	}
+	for i, v := range values {
+		if v.item.IsResumeToken(v.key, v.token) {
+			t.Errorf("[%v] invalid token is accepted", i)
 		}
 	}
 }
@@ -0,0 +1,243 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Dedup is a content deduplication of encrypted items, files with the same plain content are stored once.
+// Such file is encrypted by a key derived from the content fingerprint, and every item keeps
+// this key encrypted by its own one, so the item's password is still required to read it.
+type Dedup struct {
+	DB  *sql.DB
+	Key []byte
+}
+
+// NewDedup returns a deduplication which fingerprint key is derived from the server secret.
+func NewDedup(db *sql.DB, secret string) *Dedup {
+	mac := hmac.New(sha3.New256, []byte(secret))
+	mac.Write([]byte("dedup"))
+	return &Dedup{DB: db, Key: mac.Sum(nil)}
+}
+
+// derive returns a value of the purpose for the content fingerprint,
+// the fingerprint and content key can't be restored by a blob identifier.
+func (d *Dedup) derive(fingerprint []byte, purpose string) []byte {
+	mac := hmac.New(sha3.New256, d.Key)
+	mac.Write([]byte(purpose))
+	mac.Write(fingerprint)
+	return mac.Sum(nil)
+}
+
+// spool is a temporary file of the plain content, it's encrypted by AES-CTR with a random key,
+// so the plain content isn't written to the disk. The key is used only once, so the IV is zero.
+type spool struct {
+	file  *os.File
+	block cipher.Block
+}
+
+// newSpool creates a new spool file in the system temporary directory.
+func newSpool() (*spool, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "unigma-dedup-")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{file: f, block: block}, nil
+}
+
+// Writer returns a writer which encrypts data to the spool file from its beginning.
+func (s *spool) Writer() io.Writer {
+	return cipher.StreamWriter{S: cipher.NewCTR(s.block, make([]byte, aes.BlockSize)), W: s.file}
+}
+
+// Reader returns a reader of the plain content from the spool file beginning.
+func (s *spool) Reader() (io.Reader, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &cipher.StreamReader{S: cipher.NewCTR(s.block, make([]byte, aes.BlockSize)), R: s.file}, nil
+}
+
+// Close closes and removes the spool file.
+func (s *spool) Close(l *log.Logger) {
+	if err := s.file.Close(); err != nil {
+		l.Printf("close spool file error: %v", err)
+	}
+	if err := os.Remove(s.file.Name()); err != nil {
+		l.Printf("remove spool file error: %v", err)
+	}
+}
+
+// encryptShared is EncryptContext of the deduplicated item. The plain content is spooled to an encrypted
+// temporary file to calculate its keyed SHA-3 fingerprint, then the item references an existing blob
+// with the same fingerprint or a new blob is written.
+func (item *Item) encryptShared(ctx context.Context, inFile io.Reader, secret string, l *log.Logger) error {
+	tmpFile, err := newSpool()
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close(l)
+	h, fp := sha256.New(), hmac.New(sha3.New256, item.Dedup.Key)
+	size, err := io.Copy(io.MultiWriter(tmpFile.Writer(), h, fp), &contextReader{ctx: ctx, r: inFile})
+	if err != nil {
+		return err
+	}
+	key, err := item.newKey(secret)
+	if err != nil {
+		return err
+	}
+	fingerprint := fp.Sum(nil)
+	contentKey := item.Dedup.derive(fingerprint, "key")
+	item.sum = hex.EncodeToString(h.Sum(nil))
+	item.Checksum, err = encryptText(item.sum, key)
+	if err != nil {
+		return err
+	}
+	item.ContentKey, err = encryptText(hex.EncodeToString(contentKey), key)
+	if err != nil {
+		return err
+	}
+	item.Format = FormatGCM
+	item.Size = size
+	blob := hex.EncodeToString(item.Dedup.derive(fingerprint, "blob"))
+	ok, err := item.acquireBlob(blob)
+	if err != nil || ok {
+		return err
+	}
+	plain, err := tmpFile.Reader()
+	if err != nil {
+		return err
+	}
+	err = item.newStorageID()
+	if err != nil {
+		return err
+	}
+	err = item.writeContent(plain, contentKey, l)
+	if err == nil {
+		err = item.insertBlob(blob)
+	}
+	if err == nil {
+		return nil
+	}
+	// don't keep partially written or duplicate file
+	if e := item.DeleteFile(); e != nil && !os.IsNotExist(e) {
+		l.Printf("remove partial encypted file error: %v", e)
+	}
+	// the same content can be stored by a concurrent upload
+	if ok, e := item.acquireBlob(blob); e == nil && ok {
+		return nil
+	}
+	return err
+}
+
+// acquireBlob adds a reference of the item to the existing blob, the item uses its file.
+// It returns false if there is no such blob.
+func (item *Item) acquireBlob(blob string) (bool, error) {
+	d := dialectOf(item.Dedup.DB)
+	var (
+		storageID  string
+		compressed bool
+	)
+	err := InTransaction(item.Dedup.DB, func(tx *sql.Tx) error {
+		_, err := tx.Exec(d.query("UPDATE `blob` SET `refcount`=`refcount`+1 WHERE `id`=?;"), blob)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(d.query("SELECT `storage_id`, `compressed` FROM `blob` WHERE `id`=?;"), blob).Scan(&storageID, &compressed)
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	item.StorageID, item.Compressed, item.Blob = storageID, compressed, blob
+	return true, nil
+}
+
+// insertBlob saves the item's file as a new blob with one reference.
+func (item *Item) insertBlob(blob string) error {
+	query := dialectOf(item.Dedup.DB).query("INSERT INTO `blob` (`id`, `storage_id`, `compressed`, `refcount`) VALUES (?, ?, ?, 1);")
+	_, err := item.Dedup.DB.Exec(query, blob, item.StorageID, item.Compressed)
+	if err != nil {
+		return err
+	}
+	item.Blob = blob
+	return nil
+}
+
+// release removes the item's reference of its blob, it returns true if the item's file
+// is not used anymore and should be removed. Not deduplicated items always own their files.
+func (item *Item) release(tx *sql.Tx, d dialect) (bool, error) {
+	if item.Blob == "" {
+		return true, nil
+	}
+	_, err := tx.Exec(d.query("UPDATE `blob` SET `refcount`=`refcount`-1 WHERE `id`=?;"), item.Blob)
+	if err != nil {
+		return false, err
+	}
+	r, err := tx.Exec(d.query("DELETE FROM `blob` WHERE `id`=? AND `refcount`<1;"), item.Blob)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// releaseFile removes the item's reference of its blob by the deduplication database,
+// it returns true if the file should be removed.
+func (item *Item) releaseFile() (bool, error) {
+	if item.Blob == "" {
+		return true, nil
+	}
+	if item.Dedup == nil {
+		return false, errors.New("shared file can't be released without deduplication")
+	}
+	var last bool
+	err := InTransaction(item.Dedup.DB, func(tx *sql.Tx) error {
+		var e error
+		last, e = item.release(tx, dialectOf(item.Dedup.DB))
+		return e
+	})
+	return last, err
+}
+
+// contentKey returns the key of the item's file, it's the item's key itself if the file isn't shared.
+func (item *Item) contentKey(key []byte) ([]byte, error) {
+	if item.ContentKey == "" {
+		return key, nil
+	}
+	value, err := decryptText(item.ContentKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(value)
+}
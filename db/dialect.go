@@ -0,0 +1,56 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// dialect is SQL dialect of a database driver.
+type dialect int
+
+const (
+	// sqliteDialect uses `name` identifiers and ? placeholders.
+	sqliteDialect dialect = iota
+	// postgresDialect uses "name" identifiers and $N placeholders.
+	postgresDialect
+)
+
+// dialectOf returns SQL dialect of the database connection.
+func dialectOf(db *sql.DB) dialect {
+	if _, ok := db.Driver().(*pq.Driver); ok {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+// query converts SQLite-style query q to the dialect.
+func (d dialect) query(q string) string {
+	if d != postgresDialect {
+		return q
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	b.Grow(len(q) + 8)
+	for _, c := range q {
+		switch c {
+		case '`':
+			b.WriteRune('"')
+		case '?':
+			n++
+			b.WriteRune('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
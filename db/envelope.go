@@ -0,0 +1,229 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// EnvelopeKeySize is a size of the server master keys of encryption at rest.
+	EnvelopeKeySize = 32
+	// envelopeMagic starts files encrypted at rest, it's followed by a key version byte and a random IV.
+	envelopeMagic = "UNGMENV"
+	// envelopeHeaderSize is a size of the magic, key version and IV.
+	envelopeHeaderSize = len(envelopeMagic) + 1 + aes.BlockSize
+)
+
+// EnvelopeStorage is encryption at rest of other storage. Files, which are already encrypted by items' keys,
+// are encrypted once more by a server master key, so stored data is useless without the server configuration.
+// It's AES-256-CTR stream, so files are still seekable, their integrity is checked by items' formats.
+// Keys are found by a version byte of the file header, new files use the current Version,
+// they're written as is if it's zero. Files without the header are also read as is,
+// so the layer can be enabled for an existing storage.
+type EnvelopeStorage struct {
+	Storage
+	Keys    map[byte][]byte
+	Version byte
+}
+
+// Writer returns a writer which encrypts data by the current master key.
+func (es *EnvelopeStorage) Writer(hash string) (io.WriteCloser, error) {
+	if es.Version == 0 {
+		return es.Storage.Writer(hash)
+	}
+	block, err := aes.NewCipher(es.Keys[es.Version])
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, envelopeHeaderSize)
+	copy(header, envelopeMagic)
+	header[len(envelopeMagic)] = es.Version
+	iv := header[len(envelopeMagic)+1:]
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	w, err := es.Storage.Writer(hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		if e := w.Close(); e != nil {
+			return nil, fmt.Errorf("%v, close error: %v", err, e)
+		}
+		return nil, err
+	}
+	return cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w}, nil
+}
+
+// Reader returns a reader of decrypted data, it implements io.Seeker interface if the storage reader does it.
+func (es *EnvelopeStorage) Reader(hash string) (io.ReadCloser, error) {
+	r, err := es.Storage.Reader(hash)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, envelopeHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if (err != nil) && (err != io.EOF) && (err != io.ErrUnexpectedEOF) {
+		return nil, closeWithError(r, err)
+	}
+	if !isEnvelope(header[:n]) {
+		return plainReader(r, header[:n])
+	}
+	block, err := aes.NewCipher(es.Keys[header[len(envelopeMagic)]])
+	if err != nil {
+		err = fmt.Errorf("unknown envelope key version %v", header[len(envelopeMagic)])
+		return nil, closeWithError(r, err)
+	}
+	er := &envelopeReader{r: r, block: block, iv: header[len(envelopeMagic)+1:]}
+	er.stream = er.streamAt(0)
+	if _, ok := r.(io.Seeker); ok {
+		return &envelopeReadSeeker{er}, nil
+	}
+	return er, nil
+}
+
+// Size returns a size of decrypted data.
+func (es *EnvelopeStorage) Size(hash string) (int64, error) {
+	size, err := es.Storage.Size(hash)
+	if (err != nil) || (size < int64(envelopeHeaderSize)) {
+		return size, err
+	}
+	r, err := es.Storage.Reader(hash)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, envelopeHeaderSize)
+	_, err = io.ReadFull(r, header)
+	if e := r.Close(); (err == nil) && (e != nil) {
+		err = e
+	}
+	if err != nil {
+		return 0, err
+	}
+	if isEnvelope(header) {
+		size -= int64(envelopeHeaderSize)
+	}
+	return size, nil
+}
+
+// isEnvelope checks the header is one of a file encrypted at rest.
+func isEnvelope(header []byte) bool {
+	return (len(header) == envelopeHeaderSize) && bytes.HasPrefix(header, []byte(envelopeMagic))
+}
+
+// envelopeOverhead returns a size of the envelope header of the file system storage file,
+// it's zero for files without encryption at rest.
+func envelopeOverhead(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, envelopeHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if e := f.Close(); e != nil {
+		return 0, e
+	}
+	if (err != nil) && (err != io.EOF) && (err != io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+	if isEnvelope(header[:n]) {
+		return int64(envelopeHeaderSize), nil
+	}
+	return 0, nil
+}
+
+// closeWithError closes r and returns err with a close error if it's failed.
+func closeWithError(r io.Closer, err error) error {
+	if e := r.Close(); e != nil {
+		return fmt.Errorf("%v, close error: %v", err, e)
+	}
+	return err
+}
+
+// plainReader returns a reader of the file without encryption at rest, head is its already read bytes.
+func plainReader(r io.ReadCloser, head []byte) (io.ReadCloser, error) {
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return nil, closeWithError(r, err)
+		}
+		return r, nil
+	}
+	return &headReadCloser{Reader: io.MultiReader(bytes.NewReader(head), r), Closer: r}, nil
+}
+
+// headReadCloser is a storage reader with its already read head.
+type headReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// envelopeReader decrypts data of the storage reader.
+type envelopeReader struct {
+	r      io.ReadCloser
+	block  cipher.Block
+	iv     []byte
+	stream cipher.Stream
+}
+
+// Read implements io.Reader interface.
+func (er *envelopeReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	er.stream.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Close implements io.Closer interface.
+func (er *envelopeReader) Close() error {
+	return er.r.Close()
+}
+
+// streamAt returns CTR stream from the offset of decrypted data,
+// the counter is the IV increased by a number of previous blocks.
+func (er *envelopeReader) streamAt(offset int64) cipher.Stream {
+	counter := make([]byte, len(er.iv))
+	copy(counter, er.iv)
+	n := uint64(offset / aes.BlockSize)
+	for i := len(counter) - 1; (i >= 0) && (n > 0); i-- {
+		sum := uint64(counter[i]) + (n & 0xff)
+		counter[i] = byte(sum)
+		n = (n >> 8) + (sum >> 8)
+	}
+	stream := cipher.NewCTR(er.block, counter)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		buf := make([]byte, skip)
+		stream.XORKeyStream(buf, buf)
+	}
+	return stream
+}
+
+// envelopeReadSeeker is envelopeReader of the seekable storage reader.
+type envelopeReadSeeker struct {
+	*envelopeReader
+}
+
+// Seek implements io.Seeker interface, offsets are ones of decrypted data.
+func (ers *envelopeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += int64(envelopeHeaderSize)
+	}
+	pos, err := ers.r.(io.Seeker).Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	pos -= int64(envelopeHeaderSize)
+	if pos < 0 {
+		return 0, errors.New("seek before the start of envelope data")
+	}
+	ers.stream = ers.streamAt(pos)
+	return pos, nil
+}
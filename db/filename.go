@@ -0,0 +1,64 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// defaultFileName is used if nothing is left after the name sanitizing.
+const defaultFileName = "file"
+
+// sanitizeName removes control characters and path separators from the file name.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || (r == '/') || (r == '\\') || (r == unicode.ReplacementChar) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if (name == "") || (name == ".") || (name == "..") {
+		return defaultFileName
+	}
+	return name
+}
+
+// isAttrChar checks that the byte can be used in RFC 5987 extended value as is.
+func isAttrChar(c byte) bool {
+	switch {
+	case ('a' <= c) && (c <= 'z'), ('A' <= c) && (c <= 'Z'), ('0' <= c) && (c <= '9'):
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// contentDisposition returns Content-Disposition header value by RFC 6266.
+// The name is sanitized, a non-ASCII name is set by "filename*" parameter
+// and its ASCII fallback is in "filename" one.
+func contentDisposition(disposition, name string) string {
+	name = sanitizeName(name)
+	fallback := strings.Map(func(r rune) rune {
+		if (r > unicode.MaxASCII) || (r == '"') {
+			return '_'
+		}
+		return r
+	}, name)
+	value := fmt.Sprintf("%v; filename=\"%v\"", disposition, fallback)
+	if fallback == name {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; isAttrChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return value + "; filename*=UTF-8''" + b.String()
+}
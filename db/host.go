@@ -0,0 +1,53 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// normalizeHost returns a host name without port and IPv6 brackets in lower case.
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// forwardedHost returns the first value of X-Forwarded-Host header
+// if its host name is in the allowed list, otherwise it's empty.
+// An IPv6 address is always returned in brackets.
+func forwardedHost(r *http.Request, allowed []string) string {
+	value := strings.TrimSpace(strings.SplitN(r.Header.Get("X-Forwarded-Host"), ",", 2)[0])
+	if value == "" {
+		return ""
+	}
+	hostname := normalizeHost(value)
+	for _, host := range allowed {
+		if hostname != normalizeHost(host) {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(value); err == nil {
+			return net.JoinHostPort(hostname, port)
+		}
+		if strings.Contains(hostname, ":") {
+			return "[" + hostname + "]"
+		}
+		return hostname
+	}
+	return ""
+}
+
+// forwardedScheme returns a scheme from X-Forwarded-Proto header if it's "http" or "https".
+func forwardedScheme(r *http.Request) string {
+	value := strings.ToLower(strings.TrimSpace(strings.SplitN(r.Header.Get("X-Forwarded-Proto"), ",", 2)[0]))
+	if (value == "http") || (value == "https") {
+		return value
+	}
+	return ""
+}
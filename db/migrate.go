@@ -0,0 +1,201 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migration is a step of the schema upgrade, it's applied in one transaction.
+// Steps should be idempotent, because the schema can be already changed manually.
+type migration func(tx *sql.Tx, d dialect) error
+
+// migrations are ordered schema upgrades, a schema version is a number of applied ones,
+// new steps are only appended to the end.
+var migrations = []migration{
+	migrateBase,
+	migrateHint,
+	migratePasswordless,
+}
+
+// schemaTypes are column types which are different for SQLite and PostgreSQL.
+var schemaTypes = map[dialect]*strings.Replacer{
+	sqliteDialect: strings.NewReplacer(
+		"{serial}", "INTEGER PRIMARY KEY AUTOINCREMENT",
+		"{bigint}", "INTEGER",
+		"{bool}", "INTEGER NOT NULL DEFAULT 0",
+		"{time}", "DATETIME",
+	),
+	postgresDialect: strings.NewReplacer(
+		"{serial}", "BIGSERIAL PRIMARY KEY",
+		"{bigint}", "BIGINT",
+		"{bool}", "BOOLEAN NOT NULL DEFAULT FALSE",
+		"{time}", "TIMESTAMP WITH TIME ZONE",
+	),
+}
+
+// schema converts the statement with {type} placeholders to the dialect.
+func (d dialect) schema(q string) string {
+	return d.query(schemaTypes[d].Replace(q))
+}
+
+// baseTables are tables of the schema version 1, they are the same as ones of schema.sql.
+var baseTables = []string{
+	"CREATE TABLE IF NOT EXISTS `storage` (`id` {serial}, `name` TEXT, `path` TEXT, `counter` INTEGER NOT NULL DEFAULT 1, " +
+		"`hash` VARCHAR(64) NOT NULL, `salt` VARCHAR(256) NOT NULL, " +
+		"`created` {time} NOT NULL, `updated` {time} NOT NULL, `expired` {time} NOT NULL);",
+	"CREATE TABLE IF NOT EXISTS `unlock` (`token` VARCHAR(64) PRIMARY KEY, `item` {bigint} NOT NULL, `expired` {time} NOT NULL);",
+	"CREATE TABLE IF NOT EXISTS `claim` (`token` VARCHAR(64) PRIMARY KEY, `password` VARCHAR(512) NOT NULL, `expired` {time} NOT NULL);",
+	"CREATE TABLE IF NOT EXISTS `blob` (`id` VARCHAR(64) PRIMARY KEY, `storage_id` VARCHAR(64) NOT NULL, " +
+		"`compressed` {bool}, `refcount` INTEGER NOT NULL DEFAULT 1);",
+	"CREATE TABLE IF NOT EXISTS `access_log` (`id` {serial}, `hash` VARCHAR(64) NOT NULL, `success` {bool}, " +
+		"`ip` VARCHAR(64) NOT NULL DEFAULT '', `created` {time} NOT NULL);",
+	"CREATE TABLE IF NOT EXISTS `upload_session` (`id` VARCHAR(64) PRIMARY KEY, `name` TEXT NOT NULL DEFAULT '', " +
+		"`received` {bigint} NOT NULL DEFAULT 0, `total` {bigint} NOT NULL, `created` {time} NOT NULL, `expired` {time} NOT NULL);",
+}
+
+// baseColumns are columns of the storage table which were added after its creation, in order of addition.
+var baseColumns = [][2]string{
+	{"format", "INTEGER NOT NULL DEFAULT 0"},
+	{"iter", "INTEGER NOT NULL DEFAULT 0"},
+	{"mime", "TEXT NOT NULL DEFAULT ''"},
+	{"size", "{bigint} NOT NULL DEFAULT 0"},
+	{"confirm", "{bool}"},
+	{"compressed", "{bool}"},
+	{"owner", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"storage_id", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"label", "TEXT NOT NULL DEFAULT ''"},
+	{"max_fails", "INTEGER NOT NULL DEFAULT 0"},
+	{"fails", "INTEGER NOT NULL DEFAULT 0"},
+	{"salt_version", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"checksum", "VARCHAR(256) NOT NULL DEFAULT ''"},
+	{"session", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"blob_id", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"content_key", "VARCHAR(256) NOT NULL DEFAULT ''"},
+}
+
+// baseIndexes are indexes of the schema version 1.
+var baseIndexes = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS `hash` ON `storage` (`hash`);",
+	"CREATE INDEX IF NOT EXISTS `expired` ON `storage` (`expired`);",
+	"CREATE INDEX IF NOT EXISTS `session` ON `storage` (`session`);",
+	"CREATE INDEX IF NOT EXISTS `unlock_expired` ON `unlock` (`expired`);",
+	"CREATE INDEX IF NOT EXISTS `claim_expired` ON `claim` (`expired`);",
+	"CREATE INDEX IF NOT EXISTS `access_log_hash` ON `access_log` (`hash`);",
+	"CREATE INDEX IF NOT EXISTS `access_log_created` ON `access_log` (`created`);",
+	"CREATE INDEX IF NOT EXISTS `upload_session_expired` ON `upload_session` (`expired`);",
+}
+
+// migrateBase creates the full schema for an empty database,
+// missing tables, columns and indexes are added to a database which was created before migrations.
+func migrateBase(tx *sql.Tx, d dialect) error {
+	for _, q := range baseTables {
+		if _, err := tx.Exec(d.schema(q)); err != nil {
+			return err
+		}
+	}
+	for _, c := range baseColumns {
+		if err := addColumn(tx, d, "storage", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	for _, q := range baseIndexes {
+		if _, err := tx.Exec(d.schema(q)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateHint adds the column of optional password hints.
+func migrateHint(tx *sql.Tx, d dialect) error {
+	return addColumn(tx, d, "storage", "hint", "TEXT NOT NULL DEFAULT ''")
+}
+
+// migratePasswordless adds the column of sealed random passwords of items without user's ones.
+func migratePasswordless(tx *sql.Tx, d dialect) error {
+	return addColumn(tx, d, "storage", "passwordless", "VARCHAR(256) NOT NULL DEFAULT ''")
+}
+
+// addColumn adds the column to the table if it doesn't exist yet.
+func addColumn(tx *sql.Tx, d dialect, table, column, definition string) error {
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE `name`=?;"
+	if d == postgresDialect {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=? AND column_name=?;"
+	}
+	var n int
+	if err := tx.QueryRow(d.query(query), table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := tx.Exec(d.schema(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s;", table, column, definition)))
+	return err
+}
+
+// SchemaVersion returns a number of applied migrations, it's zero for a database without them.
+func SchemaVersion(db *sql.DB) (int, error) {
+	d := dialectOf(db)
+	_, err := db.Exec(d.schema("CREATE TABLE IF NOT EXISTS `schema_version` (`version` INTEGER PRIMARY KEY, `applied` {time} NOT NULL);"))
+	if err != nil {
+		return 0, err
+	}
+	return schemaVersion(db, d)
+}
+
+// queryRower is a database or a transaction which can query one row.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// schemaVersion returns the latest applied migration.
+func schemaVersion(q queryRower, d dialect) (int, error) {
+	var version int
+	err := q.QueryRow(d.query("SELECT COALESCE(MAX(`version`), 0) FROM `schema_version`;")).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Migrate upgrades the database schema to the current version, every migration is applied once,
+// so it's safe to call it on every start. It returns a number of applied migrations.
+func Migrate(db *sql.DB) (int, error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return 0, fmt.Errorf("schema version: %v", err)
+	}
+	if version > len(migrations) {
+		return 0, fmt.Errorf("schema version %v is newer than supported %v", version, len(migrations))
+	}
+	d, n := dialectOf(db), 0
+	for v := version + 1; v <= len(migrations); v++ {
+		applied := false
+		err = InTransaction(db, func(tx *sql.Tx) error {
+			// a concurrent process can already apply it
+			current, err := schemaVersion(tx, d)
+			if (err != nil) || (current >= v) {
+				return err
+			}
+			if err = migrations[v-1](tx, d); err != nil {
+				return err
+			}
+			_, err = tx.Exec(d.query("INSERT INTO `schema_version` (`version`, `applied`) VALUES (?, ?);"), v, time.Now().UTC())
+			applied = err == nil
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("schema migration %v: %v", v, err)
+		}
+		if applied {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// SessionKeySize is a size of the server key which signs uploader sessions.
+	SessionKeySize = 32
+	// uploaderLength is a length of uploader session ID in bytes.
+	uploaderLength = 16
+)
+
+// NewUploader generates a new signed uploader session value,
+// it's an account-less identifier of the browser which uploads files.
+func NewUploader(key []byte) (string, error) {
+	b := make([]byte, uploaderLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	return id + "." + uploaderSign(id, key), nil
+}
+
+// uploaderSign returns hex encoded HMAC-SHA256 of the session ID.
+func uploaderSign(id string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsUploader checks the signature of the uploader session value.
+func IsUploader(value string, key []byte) bool {
+	i := strings.IndexByte(value, '.')
+	if (i < 1) || (len(key) == 0) {
+		return false
+	}
+	id, sign := value[:i], value[i+1:]
+	return hmac.Equal([]byte(sign), []byte(uploaderSign(id, key)))
+}
+
+// SetUploader links the item with the uploader session, only its hash is kept.
+func (item *Item) SetUploader(value string) {
+	item.Session = ownerHash(value)
+}
+
+// IsUploader checks the item was uploaded in the session, items without a session don't belong to anyone.
+func (item *Item) IsUploader(value string) bool {
+	return (item.Session != "") && (value != "") && hmac.Equal([]byte(ownerHash(value)), []byte(item.Session))
+}
+
+// ListUploader returns active items of the uploader session with only their non-secret metadata.
+func ListUploader(db *sql.DB, value string, le *log.Logger) ([]*Item, error) {
+	query := "SELECT `id`, `hash`, `counter`, `created`, `expired` FROM `storage` WHERE `session`=? AND `counter`>0 AND `expired`>? ORDER BY `id`;"
+	stmt, err := db.Prepare(dialectOf(db).query(query))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			le.Printf("failed close stmt: %v\n", err)
+		}
+	}()
+	rows, err := stmt.Query(ownerHash(value), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0)
+	for rows.Next() {
+		item := &Item{}
+		err = rows.Scan(&item.ID, &item.Hash, &item.Counter, &item.Created, &item.Expired)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return items, rows.Err()
+}
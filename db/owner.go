@@ -0,0 +1,67 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// ownerLength is a length of owner token in bytes.
+const ownerLength = 16
+
+// ownerHash returns a hash of owner token.
+func ownerHash(token string) string {
+	h := sha3.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// NewOwner generates a new owner token, only its hash is kept in the item.
+func (item *Item) NewOwner() (string, error) {
+	b := make([]byte, ownerLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	item.Owner = ownerHash(token)
+	return token, nil
+}
+
+// IsOwner checks the owner token, items without an owner can't be managed.
+func (item *Item) IsOwner(token string) bool {
+	if (item.Owner == "") || (token == "") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ownerHash(token)), []byte(item.Owner)) == 1
+}
+
+// Extend sets new expiration time and counter of the item.
+func (item *Item) Extend(db *sql.DB, expired time.Time, counter int, le *log.Logger) error {
+	d := dialectOf(db)
+	return InTransaction(db, func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(d.query("UPDATE `storage` SET `expired`=?, `counter`=?, `updated`=? WHERE `id`=?;"))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := stmt.Close(); err != nil {
+				le.Printf("failed close stmt: %v\n", err)
+			}
+		}()
+		_, err = stmt.Exec(expired, counter, time.Now().UTC(), item.ID)
+		if err != nil {
+			return err
+		}
+		item.Expired, item.Counter = expired, counter
+		return nil
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// passwordlessLength is a length in bytes of the random password of an item without user's one.
+const passwordlessLength = 32
+
+// PasswordlessKey returns a key of sealed passwords of items without user's passwords,
+// it's derived from the server secret.
+func PasswordlessKey(secret string) []byte {
+	mac := hmac.New(sha3.New256, []byte(secret))
+	mac.Write([]byte("passwordless"))
+	return mac.Sum(nil)
+}
+
+// IsPasswordless returns true if the item doesn't require user's password.
+func (item *Item) IsPasswordless() bool {
+	return item.Passwordless != ""
+}
+
+// NewPasswordless generates a random password of the item and keeps it sealed by the server key,
+// so the content is still encrypted by a strong per-item key. It returns the password.
+func (item *Item) NewPasswordless(key []byte) (string, error) {
+	b := make([]byte, passwordlessLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(b)
+	value, err := sealText(password, key)
+	if err != nil {
+		return "", err
+	}
+	item.Passwordless = value
+	return password, nil
+}
+
+// PasswordlessPassword returns the random password of the item without user's one.
+func (item *Item) PasswordlessPassword(key []byte) (string, error) {
+	return openText(item.Passwordless, key)
+}
@@ -0,0 +1,71 @@
+//go:build postgres
+// +build postgres
+
+package db
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq" // PostgreSQL driver package
+)
+
+// TestPostgres is an integration test, it requires a database with schema.postgres.sql
+// and its connection string in UNIGMA_POSTGRES environment variable.
+func TestPostgres(t *testing.T) {
+	source := os.Getenv("UNIGMA_POSTGRES")
+	if source == "" {
+		t.Skip("UNIGMA_POSTGRES is not set")
+	}
+	db, err := sql.Open("postgres", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if d := dialectOf(db); d != postgresDialect {
+		t.Fatalf("failed dialect: %v", d)
+	}
+	now := time.Now().UTC()
+	item, err := createItem(db, "ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd1", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID < 1 {
+		t.Errorf("failed id: %v", item.ID)
+	}
+	stored, err := Read(db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != item.ID {
+		t.Errorf("failed read: %v", stored.ID)
+	}
+	ok, err := stored.Decrement(db, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("no decrement update")
+	}
+	// expired item
+	_, err = createItem(db, "ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afd2", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := deleteByDate(db, nil, testGCBatch, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(deleted); n != 1 {
+		t.Errorf("failed deleted: %v", n)
+	}
+	if err = stored.Delete(db, loggerInfo); err != nil {
+		t.Error(err)
+	}
+}
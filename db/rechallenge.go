@@ -0,0 +1,149 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	// ErrRechallengeSealed is an error of password change of client-side encrypted data.
+	ErrRechallengeSealed = errors.New("password of client-side encrypted data can't be changed")
+	// errRechallengeConcurrent is an error of the item which is changed by a concurrent request.
+	errRechallengeConcurrent = errors.New("item is changed by a concurrent request")
+)
+
+// Rechallenge changes the item's password without a new upload. The old secret is verified,
+// then the name and content are encrypted by a new salt and key of the new secret.
+// A new storage file replaces the old one only after the database update, so the item
+// is never left without a readable file. The item's hash is changed too, so is its URL.
+// A shared file of deduplicated item isn't rewritten, only its content key is encrypted by the new key.
+// The item's hint is saved too, so it should be set for the new password before the call.
+func (item *Item) Rechallenge(db *sql.DB, oldSecret, newSecret string, l *log.Logger) error {
+	if item.Format == FormatSealed {
+		return ErrRechallengeSealed
+	}
+	key, err := item.IsValidSecret(oldSecret)
+	if err != nil {
+		return err
+	}
+	c := *item
+	c.Dedup, c.Storage = nil, item.backend()
+	if c.Blob != "" {
+		err = c.rewrapShared(key, newSecret)
+	} else {
+		err = c.reencrypt(key, newSecret, l)
+	}
+	if err != nil {
+		return err
+	}
+	err = c.swap(db, item.Hash)
+	if err != nil {
+		if c.Blob == "" {
+			// the new file isn't referenced by the item
+			if e := c.backend().Remove(c.storageKey()); e != nil {
+				l.Printf("remove rechallenged file error: %v", e)
+			}
+		}
+		return err
+	}
+	if (item.Blob == "") && (item.storageKey() != c.storageKey()) {
+		if e := item.backend().Remove(item.storageKey()); e != nil {
+			l.Printf("remove old file of rechallenged item=%v: %v", item.ID, e)
+		}
+	}
+	c.Dedup, c.Storage = item.Dedup, item.Storage
+	*item = c
+	return nil
+}
+
+// reencrypt decrypts the item's content to a temporary file and encrypts it by the new secret
+// to a new storage file, the checksum of the content is verified if it's known.
+func (item *Item) reencrypt(key []byte, newSecret string, l *log.Logger) error {
+	tmpFile, err := ioutil.TempFile("", "unigma-rechallenge-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tmpFile.Close(); err != nil {
+			l.Printf("close rechallenge file error: %v", err)
+		}
+		if err := os.Remove(tmpFile.Name()); err != nil {
+			l.Printf("remove rechallenge file error: %v", err)
+		}
+	}()
+	item.Verify = item.Checksum != ""
+	err = item.Decrypt(tmpFile, key, l)
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	item.Verify, item.Format = false, FormatGCM
+	return item.Encrypt(tmpFile, newSecret, l)
+}
+
+// rewrapShared encrypts the item's name, checksum and content key of the shared file by the new secret.
+func (item *Item) rewrapShared(key []byte, newSecret string) error {
+	err := item.decryptName(key)
+	if err != nil {
+		return err
+	}
+	if item.Checksum != "" {
+		item.sum, err = decryptText(item.Checksum, key)
+		if err != nil {
+			return err
+		}
+	}
+	contentKey, err := item.contentKey(key)
+	if err != nil {
+		return err
+	}
+	key, err = item.newKey(newSecret)
+	if err != nil {
+		return err
+	}
+	if item.sum != "" {
+		item.Checksum, err = encryptText(item.sum, key)
+		if err != nil {
+			return err
+		}
+	}
+	item.ContentKey, err = encryptText(hex.EncodeToString(contentKey), key)
+	return err
+}
+
+// swap updates the item's encryption fields if its hash is still the old one.
+func (item *Item) swap(db *sql.DB, oldHash string) error {
+	d := dialectOf(db)
+	return InTransaction(db, func(tx *sql.Tx) error {
+		query := "UPDATE `storage` SET `name`=?, `hash`=?, `salt`=?, `storage_id`=?, `format`=?, `iter`=?, `size`=?, " +
+			"`checksum`=?, `content_key`=?, `hint`=?, `updated`=? WHERE `id`=? AND `hash`=?;"
+		r, err := tx.Exec(d.query(query),
+			item.Name, item.Hash, item.Salt, item.StorageID, item.Format, item.Iter, item.Size,
+			item.Checksum, item.ContentKey, item.Hint, time.Now().UTC(), item.ID, oldHash,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errRechallengeConcurrent
+		}
+		return nil
+	})
+}
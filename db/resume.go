@@ -0,0 +1,49 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResumePeriod is a period when an already counted download can be resumed by its token,
+// fully used items are kept by GC during this period after the last download.
+const ResumePeriod = 10 * time.Minute
+
+// resumeMAC returns HMAC-SHA256 of the item's hash and the token expiration time by the item's key.
+func (item *Item) resumeMAC(key []byte, expired int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(item.Hash + "." + strconv.FormatInt(expired, 10)))
+	return mac.Sum(nil)
+}
+
+// ResumeToken returns a token which allows to resume the download until the expired time.
+// It's signed by the item's key, so it can be checked only with a valid password.
+func (item *Item) ResumeToken(key []byte, expired time.Time) string {
+	ts := expired.Unix()
+	return strconv.FormatInt(ts, 10) + "." + hex.EncodeToString(item.resumeMAC(key, ts))
+}
+
+// IsResumeToken checks the resume token of the item is valid and not expired.
+func (item *Item) IsResumeToken(key []byte, token string) bool {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return false
+	}
+	ts, err := strconv.ParseInt(token[:i], 10, 64)
+	if (err != nil) || (time.Now().Unix() > ts) {
+		return false
+	}
+	mac, err := hex.DecodeString(token[i+1:])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, item.resumeMAC(key, ts))
+}
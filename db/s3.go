@@ -0,0 +1,90 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Storage is S3-compatible object storage.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+// s3Writer uploads all written data as one object.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// Write implements io.Writer interface.
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close finishes the upload and returns its result.
+func (w *s3Writer) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// NewS3Storage returns new S3-compatible storage for the bucket.
+func NewS3Storage(endpoint, accessKey, secretKey, region, bucket string, secure bool) (*S3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+// Writer returns a new object writer, the object is stored after successful Close call.
+func (s *S3Storage) Writer(hash string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, hash, pr, -1,
+			minio.PutObjectOptions{ContentType: "application/octet-stream"},
+		)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// Reader returns an object reader, it also implements io.Seeker interface.
+func (s *S3Storage) Reader(hash string) (io.ReadCloser, error) {
+	return s.client.GetObject(context.Background(), s.bucket, hash, minio.GetObjectOptions{})
+}
+
+// Remove deletes an object.
+func (s *S3Storage) Remove(hash string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, hash, minio.RemoveObjectOptions{})
+}
+
+// Exists checks an object exists.
+func (s *S3Storage) Exists(hash string) bool {
+	_, err := s.client.StatObject(context.Background(), s.bucket, hash, minio.StatObjectOptions{})
+	return err == nil
+}
+
+// Size returns an object size.
+func (s *S3Storage) Size(hash string) (int64, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, hash, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
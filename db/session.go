@@ -0,0 +1,245 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionTTL is a lifetime of not finished resumable upload session.
+	SessionTTL = 24 * time.Hour
+	// sessionIDLength is a length of upload session ID in bytes.
+	sessionIDLength = 16
+)
+
+var (
+	// ErrSessionOffset is an error of data which doesn't continue already received bytes.
+	ErrSessionOffset = errors.New("upload offset mismatch")
+	// ErrSessionSize is an error of data which exceeds the declared upload length.
+	ErrSessionSize = errors.New("upload exceeds its length")
+
+	rgSessionID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	// appending is a set of sessions which data is being written now.
+	appending = struct {
+		sync.Mutex
+		ids map[string]struct{}
+	}{ids: make(map[string]struct{})}
+)
+
+// Session is a resumable upload, its data is collected in a temporary file before encryption.
+type Session struct {
+	ID       string
+	Name     string
+	Received int64
+	Total    int64
+	Created  time.Time
+	Expired  time.Time
+}
+
+// IsSessionID checks the value can be an upload session ID.
+func IsSessionID(id string) bool {
+	return rgSessionID.MatchString(id)
+}
+
+// Path returns a full path of the temporary file with session's data.
+func (s *Session) Path() string {
+	return filepath.Join(os.TempDir(), "unigma-upload-"+s.ID)
+}
+
+// NewSession creates an upload session of the file with the name and total size,
+// its temporary file is empty.
+func NewSession(db *sql.DB, name string, total int64) (*Session, error) {
+	b := make([]byte, sessionIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	s := &Session{ID: hex.EncodeToString(b), Name: name, Total: total, Created: now, Expired: now.Add(SessionTTL)}
+	f, err := os.OpenFile(s.Path(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	query := dialectOf(db).query("INSERT INTO `upload_session` (`id`, `name`, `received`, `total`, `created`, `expired`) VALUES (?, ?, ?, ?, ?, ?);")
+	_, err = db.Exec(query, s.ID, s.Name, s.Received, s.Total, s.Created, s.Expired)
+	if err != nil {
+		if e := os.Remove(s.Path()); e != nil {
+			return nil, e
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadSession returns not expired upload session by its ID, nil value means it's not found.
+func ReadSession(db *sql.DB, id string) (*Session, error) {
+	s := &Session{ID: id}
+	query := dialectOf(db).query("SELECT `name`, `received`, `total`, `created`, `expired` FROM `upload_session` WHERE `id`=? AND `expired`>?;")
+	err := db.QueryRow(query, id, time.Now().UTC()).Scan(&s.Name, &s.Received, &s.Total, &s.Created, &s.Expired)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// IsComplete returns true if all declared bytes are received.
+func (s *Session) IsComplete() bool {
+	return s.Received == s.Total
+}
+
+// lock marks the session as being appended, it returns false if other request already does it.
+func (s *Session) lock() bool {
+	appending.Lock()
+	defer appending.Unlock()
+	if _, ok := appending.ids[s.ID]; ok {
+		return false
+	}
+	appending.ids[s.ID] = struct{}{}
+	return true
+}
+
+// unlock releases the session after append.
+func (s *Session) unlock() {
+	appending.Lock()
+	delete(appending.ids, s.ID)
+	appending.Unlock()
+}
+
+// Append writes data from r to the session file, offset should be equal to already received bytes
+// and data beyond the total size isn't accepted. Bytes which were received before a read error are kept,
+// so the client can resume the upload. It updates received bytes counter.
+// Only one request can append the session at the same time, a concurrent one gets ErrSessionOffset.
+func (s *Session) Append(db *sql.DB, offset int64, r io.Reader) error {
+	if !s.lock() {
+		return ErrSessionOffset
+	}
+	defer s.unlock()
+	// received bytes could be changed by other request after the session was read
+	query := dialectOf(db).query("SELECT `received` FROM `upload_session` WHERE `id`=?;")
+	err := db.QueryRow(query, s.ID).Scan(&s.Received)
+	if err == sql.ErrNoRows {
+		return ErrSessionOffset
+	}
+	if err != nil {
+		return err
+	}
+	if offset != s.Received {
+		return ErrSessionOffset
+	}
+	f, err := os.OpenFile(s.Path(), os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// a tail of a failed previous request is dropped
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		if e := f.Close(); e != nil {
+			return e
+		}
+		return err
+	}
+	// one extra byte is read to detect too large data
+	n, readErr := io.Copy(f, io.LimitReader(r, s.Total-offset+1))
+	if offset+n > s.Total {
+		n, readErr = 0, ErrSessionSize
+		err = f.Truncate(offset)
+	}
+	if e := f.Close(); (err == nil) && (e != nil) {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		query = dialectOf(db).query("UPDATE `upload_session` SET `received`=? WHERE `id`=? AND `received`=?;")
+		result, err := db.Exec(query, offset+n, s.ID, offset)
+		if err != nil {
+			return err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			// other request has changed the session
+			return ErrSessionOffset
+		}
+		s.Received = offset + n
+	}
+	return readErr
+}
+
+// SessionsUsage returns a number of not expired upload sessions and a sum of their declared sizes.
+func SessionsUsage(db *sql.DB) (int64, int64, error) {
+	var n, total int64
+	query := dialectOf(db).query("SELECT COUNT(*), COALESCE(SUM(`total`), 0) FROM `upload_session` WHERE `expired`>?;")
+	err := db.QueryRow(query, time.Now().UTC()).Scan(&n, &total)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, total, nil
+}
+
+// Delete removes the session and its temporary file.
+func (s *Session) Delete(db *sql.DB) error {
+	query := dialectOf(db).query("DELETE FROM `upload_session` WHERE `id`=?;")
+	if _, err := db.Exec(query, s.ID); err != nil {
+		return err
+	}
+	err := os.Remove(s.Path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// deleteSessions removes expired upload sessions and their temporary files.
+func deleteSessions(db *sql.DB) (int64, error) {
+	query := dialectOf(db).query("SELECT `id` FROM `upload_session` WHERE `expired`<?;")
+	rows, err := db.Query(query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	var sessions []*Session
+	for rows.Next() {
+		s := &Session{}
+		if err = rows.Scan(&s.ID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Close(); err != nil {
+		return 0, err
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		if err = s.Delete(db); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(sessions)), nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// StatsResult is aggregated storage statistics.
+type StatsResult struct {
+	Items      int64   `json:"items"`
+	Bytes      int64   `json:"bytes"`
+	Expiring   int64   `json:"expiring"`
+	AvgCounter float64 `json:"avg_counter"`
+}
+
+// Stats returns storage statistics, expiring items are ones with TTL ending in the next 24 hours.
+func Stats(db *sql.DB) (StatsResult, error) {
+	var result StatsResult
+	d := dialectOf(db)
+	err := db.QueryRow(
+		d.query("SELECT COUNT(*), COALESCE(SUM(`size`), 0), COALESCE(AVG(`counter`), 0) FROM `storage`;"),
+	).Scan(&result.Items, &result.Bytes, &result.AvgCounter)
+	if err != nil {
+		return result, err
+	}
+	now := time.Now().UTC()
+	err = db.QueryRow(
+		d.query("SELECT COUNT(*) FROM `storage` WHERE `expired`>=? AND `expired`<?;"),
+		now, now.Add(24*time.Hour),
+	).Scan(&result.Expiring)
+	return result, err
+}
+
+// TotalSize returns total size of stored items.
+func TotalSize(db *sql.DB) (int64, error) {
+	var size int64
+	err := db.QueryRow(dialectOf(db).query("SELECT COALESCE(SUM(`size`), 0) FROM `storage`;")).Scan(&size)
+	return size, err
+}
+
+// ActiveCount returns a number of items which can be downloaded.
+func ActiveCount(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow(
+		dialectOf(db).query("SELECT COUNT(*) FROM `storage` WHERE `counter`>0 AND `expired`>?;"),
+		time.Now().UTC(),
+	).Scan(&n)
+	return n, err
+}
+
+// ActiveCache caches a number of active items during Period, so public status requests don't query the database.
+// Nil value is a disabled cache, Get always reads the database in this case.
+type ActiveCache struct {
+	sync.Mutex
+	Period  time.Duration
+	count   int
+	updated time.Time
+}
+
+// Get returns cached number of active items, it's read from the database after the period end.
+func (ac *ActiveCache) Get(db *sql.DB) (int, error) {
+	if ac == nil {
+		return ActiveCount(db)
+	}
+	ac.Lock()
+	defer ac.Unlock()
+	now := time.Now()
+	if !ac.updated.IsZero() && (now.Sub(ac.updated) < ac.Period) {
+		return ac.count, nil
+	}
+	n, err := ActiveCount(db)
+	if err != nil {
+		return 0, err
+	}
+	ac.count, ac.updated = n, now
+	return n, nil
+}
+
+// SizeCache caches total size of stored items to avoid a full scan per upload.
+// Nil value is a disabled cache, Get always reads the database in this case.
+type SizeCache struct {
+	sync.Mutex
+	size  int64
+	valid bool
+}
+
+// Get returns cached total size, it's read from the database only after invalidation.
+func (sc *SizeCache) Get(db *sql.DB) (int64, error) {
+	if sc == nil {
+		return TotalSize(db)
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.valid {
+		return sc.size, nil
+	}
+	size, err := TotalSize(db)
+	if err != nil {
+		return 0, err
+	}
+	sc.size, sc.valid = size, true
+	return size, nil
+}
+
+// Add increases cached total size by a new item's size.
+func (sc *SizeCache) Add(n int64) {
+	if sc == nil {
+		return
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	sc.size += n
+}
+
+// Invalidate resets the cache after items deletion, the next Get reads the database.
+func (sc *SizeCache) Invalidate() {
+	if sc == nil {
+		return
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	sc.valid = false
+}
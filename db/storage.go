@@ -0,0 +1,185 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Storage is a backend to keep encrypted files by their hashes.
+type Storage interface {
+	Writer(hash string) (io.WriteCloser, error)
+	Reader(hash string) (io.ReadCloser, error)
+	Remove(hash string) error
+	Exists(hash string) bool
+	Size(hash string) (int64, error)
+}
+
+const (
+	// MaxShardDepth is max number of nested subdirectories of the file system storage.
+	MaxShardDepth = 3
+	// DefaultFileMode is permissions of stored files if other mode is not set.
+	DefaultFileMode os.FileMode = 0600
+)
+
+// FileStorage is a local file system storage.
+// Files are stored in Depth nested subdirectories named by hash bytes,
+// so zero Depth is a flat layout. Mode is permissions of new files, DefaultFileMode is used if it's zero.
+// If Prune is set, then subdirectories are removed after their last file.
+type FileStorage struct {
+	Dir   string
+	Depth int
+	Mode  os.FileMode
+	Prune bool
+}
+
+// fileStorage returns the file system storage st, it can be under encryption at rest.
+func fileStorage(st Storage) (*FileStorage, bool) {
+	if es, ok := st.(*EnvelopeStorage); ok {
+		st = es.Storage
+	}
+	fs, ok := st.(*FileStorage)
+	return fs, ok
+}
+
+// fileMode returns permissions of new files.
+func (fs *FileStorage) fileMode() os.FileMode {
+	if fs.Mode == 0 {
+		return DefaultFileMode
+	}
+	return fs.Mode
+}
+
+// dirMode returns permissions of new subdirectories, group can list them if it can read files.
+func (fs *FileStorage) dirMode() os.FileMode {
+	mode := os.FileMode(0700)
+	if fs.Mode&0040 != 0 {
+		mode |= 0050
+	}
+	if fs.Mode&0020 != 0 {
+		mode |= 0020
+	}
+	return mode
+}
+
+// fullPath returns full path of a file by its hash.
+func (fs *FileStorage) fullPath(hash string) string {
+	parts := make([]string, 0, fs.Depth+2)
+	parts = append(parts, fs.Dir)
+	for i := 0; (i < fs.Depth) && (len(hash) >= 2*(i+1)); i++ {
+		parts = append(parts, hash[2*i:2*(i+1)])
+	}
+	return filepath.Join(append(parts, hash)...)
+}
+
+// Writer returns a new file writer, subdirectories are created if needed.
+func (fs *FileStorage) Writer(hash string) (io.WriteCloser, error) {
+	name := fs.fullPath(hash)
+	if fs.Depth == 0 {
+		return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.fileMode())
+	}
+	var (
+		f   *os.File
+		err error
+	)
+	// a concurrent pruning can remove just created subdirectory, so one more attempt is done
+	for i := 0; i < 2; i++ {
+		if err = os.MkdirAll(filepath.Dir(name), fs.dirMode()); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.fileMode())
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// CheckMode creates a temporary file and verifies that it gets the expected permissions,
+// so a process umask which removes required bits is detected before uploads.
+func (fs *FileStorage) CheckMode() error {
+	f, err := ioutil.TempFile(fs.Dir, ".mode-check-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer func() {
+		// the error is not important, the file is only a probe
+		_ = os.Remove(name)
+	}()
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// TempFile always uses 0600, so the file is recreated with the storage mode
+	if err = os.Remove(name); err != nil {
+		return err
+	}
+	f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fs.fileMode())
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if mode := info.Mode().Perm(); mode != fs.fileMode() {
+		return fmt.Errorf("new files get mode %#o instead of %#o, check umask", mode, fs.fileMode())
+	}
+	return nil
+}
+
+// Reader returns a file reader, it also implements io.Seeker interface.
+func (fs *FileStorage) Reader(hash string) (io.ReadCloser, error) {
+	return os.Open(fs.fullPath(hash))
+}
+
+// Remove deletes a file and its empty subdirectories if pruning is enabled.
+func (fs *FileStorage) Remove(hash string) error {
+	name := fs.fullPath(hash)
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	if fs.Prune {
+		fs.prune(filepath.Dir(name))
+	}
+	return nil
+}
+
+// prune removes empty subdirectories from dir up to the storage root one, which is never deleted.
+// It's the best effort, the first not empty or failed directory stops it.
+func (fs *FileStorage) prune(dir string) {
+	root := filepath.Clean(fs.Dir)
+	for i := 0; (i < fs.Depth) && (dir != root); i++ {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Exists checks a file exists.
+func (fs *FileStorage) Exists(hash string) bool {
+	_, err := os.Stat(fs.fullPath(hash))
+	return err == nil
+}
+
+// Size returns a file size.
+func (fs *FileStorage) Size(hash string) (int64, error) {
+	info, err := os.Stat(fs.fullPath(hash))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// UnlockTTL is a lifetime of an unlock token.
+	UnlockTTL = 10 * time.Minute
+	// unlockLength is a length of unlock token in bytes.
+	unlockLength = 32
+)
+
+// Unlock issues a new unlock token for the item, the token confirms a download intention.
+func (item *Item) Unlock(db *sql.DB) (string, error) {
+	b := make([]byte, unlockLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	query := dialectOf(db).query("INSERT INTO `unlock` (`token`, `item`, `expired`) VALUES (?, ?, ?);")
+	_, err = db.Exec(query, token, item.ID, time.Now().UTC().Add(UnlockTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// IsUnlocked checks that the token is issued for the item and isn't expired yet.
+func (item *Item) IsUnlocked(db *sql.DB, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	var n int
+	query := dialectOf(db).query("SELECT COUNT(*) FROM `unlock` WHERE `token`=? AND `item`=? AND `expired`>?;")
+	err := db.QueryRow(query, token, item.ID, time.Now().UTC()).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// deleteUnlocks removes expired unlock tokens.
+func deleteUnlocks(db *sql.DB) (int64, error) {
+	query := dialectOf(db).query("DELETE FROM `unlock` WHERE `expired`<?;")
+	r, err := db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VerifyResult is a report of the storage consistency check.
+// Missing and Mismatched contain storage file names of items, Orphans contains paths of files without items.
+type VerifyResult struct {
+	Checked    int      `json:"checked"`
+	Missing    []string `json:"missing"`
+	Mismatched []string `json:"mismatched"`
+	Orphans    []string `json:"orphans"`
+}
+
+// IsConsistent returns true if no problems are found.
+func (v *VerifyResult) IsConsistent() bool {
+	return len(v.Missing)+len(v.Mismatched)+len(v.Orphans) == 0
+}
+
+// storageFiles returns paths of all files in the directory and its subdirectories by their names,
+// hidden files are skipped.
+func storageFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			files[info.Name()] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// isConsistentSize checks a size of the stored file by item's format, it doesn't need a password.
+// Only the structure of compressed files can be checked, because their plain size is stored.
+func isConsistentSize(item *Item, fileSize int64) bool {
+	if item.Format != FormatGCM {
+		return item.Compressed || (fileSize == item.Size)
+	}
+	const sealedSize = gcmChunkSize + gcmTagSize
+	// the version byte and at least one sealed chunk, the last one can't be shorter than its tag
+	body := fileSize - 1
+	if tail := body % sealedSize; (body < gcmTagSize) || ((tail > 0) && (tail < gcmTagSize)) {
+		return false
+	}
+	return item.Compressed || (gcmPlainSize(fileSize) == item.Size)
+}
+
+// VerifyStorage checks that every item has a file in the storage directory with a consistent size,
+// and that the directory doesn't contain files without items. Files are found by names in all subdirectories,
+// so any shard depth is supported.
+func VerifyStorage(db *sql.DB, storageDir string) (*VerifyResult, error) {
+	files, err := storageFiles(storageDir)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(dialectOf(db).query("SELECT `hash`, `storage_id`, `format`, `size`, `compressed` FROM `storage` ORDER BY `id`;"))
+	if err != nil {
+		return nil, err
+	}
+	result := &VerifyResult{}
+	used := make(map[string]bool, len(files))
+	for rows.Next() {
+		item := &Item{}
+		err = rows.Scan(&item.Hash, &item.StorageID, &item.Format, &item.Size, &item.Compressed)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		result.Checked++
+		key := item.storageKey()
+		path, ok := files[key]
+		if !ok {
+			result.Missing = append(result.Missing, key)
+			continue
+		}
+		used[key] = true
+		info, err := os.Stat(path)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		// the header of encryption at rest is not a part of item's data
+		overhead, err := envelopeOverhead(path)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if !isConsistentSize(item, info.Size()-overhead) {
+			result.Mismatched = append(result.Mismatched, key)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for name, path := range files {
+		if !used[name] {
+			result.Orphans = append(result.Orphans, path)
+		}
+	}
+	sort.Strings(result.Orphans)
+	return result, nil
+}
+
+// OrphanFiles returns paths of files in the storage directory without items, which are not modified
+// for olderThan duration. Such files are left by interrupted uploads, but a file of an upload in progress
+// has no item yet too, so the duration should exceed the longest upload.
+func OrphanFiles(db *sql.DB, storageDir string, olderThan time.Duration) ([]string, error) {
+	// files are listed before items, so a file of just saved item can't be lost
+	files, err := storageFiles(storageDir)
+	if err != nil {
+		return nil, err
+	}
+	// a shared file of deduplicated items is referenced by its blob too
+	rows, err := db.Query(dialectOf(db).query("SELECT `hash`, `storage_id` FROM `storage` UNION ALL SELECT `id`, `storage_id` FROM `blob`;"))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		item := &Item{}
+		if err = rows.Scan(&item.Hash, &item.StorageID); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		delete(files, item.storageKey())
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(-olderThan)
+	orphans := make([]string, 0, len(files))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// it's already removed
+				continue
+			}
+			return nil, err
+		}
+		if info.ModTime().Before(deadline) {
+			orphans = append(orphans, path)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
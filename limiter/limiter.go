@@ -0,0 +1,152 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+// Package limiter implements a limiter of failed attempts per client
+// and a semaphore of concurrent operations.
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// window is a counter of failed attempts since its start.
+type window struct {
+	start time.Time
+	count int
+}
+
+// Limiter is a fixed window limiter of failed attempts per client key.
+// Zero max value disables the limits.
+type Limiter struct {
+	sync.Mutex
+	max     int
+	period  time.Duration
+	cleaned time.Time
+	clients map[string]*window
+	now     func() time.Time
+}
+
+// New returns new limiter which allows max failed attempts per period.
+func New(max int, period time.Duration) *Limiter {
+	return &Limiter{
+		max:     max,
+		period:  period,
+		cleaned: time.Now(),
+		clients: make(map[string]*window),
+		now:     time.Now,
+	}
+}
+
+// Allow checks that the client doesn't exceed the limit of failed attempts.
+func (l *Limiter) Allow(key string) bool {
+	if l.max < 1 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	w, ok := l.clients[key]
+	if !ok || l.expired(w, l.now()) {
+		return true
+	}
+	return w.count < l.max
+}
+
+// Fail registers a failed attempt of the client.
+func (l *Limiter) Fail(key string) {
+	if l.max < 1 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.cleanup(now)
+	w, ok := l.clients[key]
+	if !ok || l.expired(w, now) {
+		l.clients[key] = &window{start: now, count: 1}
+		return
+	}
+	w.count++
+}
+
+// Attempt reserves an attempt of the client if it doesn't exceed the limit, the attempt is counted
+// as a failed one until it's refunded. The check and the counting are atomic, so concurrent requests
+// of the same client can't exceed the limit before their results are known.
+func (l *Limiter) Attempt(key string) bool {
+	if l.max < 1 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.cleanup(now)
+	w, ok := l.clients[key]
+	if !ok || l.expired(w, now) {
+		l.clients[key] = &window{start: now, count: 1}
+		return true
+	}
+	if w.count >= l.max {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// Refund returns the reserved attempt of the client, it's called if the attempt is successful.
+func (l *Limiter) Refund(key string) {
+	if l.max < 1 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	w, ok := l.clients[key]
+	if ok && !l.expired(w, l.now()) && (w.count > 0) {
+		w.count--
+	}
+}
+
+// Retry returns a time after which the client is allowed again, it's zero if the client isn't limited.
+func (l *Limiter) Retry(key string) time.Duration {
+	if l.max < 1 {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	w, ok := l.clients[key]
+	if !ok || l.expired(w, now) || (w.count < l.max) {
+		return 0
+	}
+	return w.start.Add(l.period).Sub(now)
+}
+
+// Period returns a duration of the limits window.
+func (l *Limiter) Period() time.Duration {
+	return l.period
+}
+
+// Len returns a number of tracked clients.
+func (l *Limiter) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.clients)
+}
+
+// expired returns true if the window is already finished.
+func (l *Limiter) expired(w *window, now time.Time) bool {
+	return now.Sub(w.start) >= l.period
+}
+
+// cleanup removes expired windows no more often than once per period.
+func (l *Limiter) cleanup(now time.Time) {
+	if now.Sub(l.cleaned) < l.period {
+		return
+	}
+	for key, w := range l.clients {
+		if l.expired(w, now) {
+			delete(l.clients, key)
+		}
+	}
+	l.cleaned = now
+}
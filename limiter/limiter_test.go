@@ -0,0 +1,145 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := New(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	if !l.Allow("a") {
+		t.Error("not allowed new client")
+	}
+	l.Fail("a")
+	if !l.Allow("a") {
+		t.Error("not allowed after one fail")
+	}
+	l.Fail("a")
+	if l.Allow("a") {
+		t.Error("allowed after limit")
+	}
+	if !l.Allow("b") {
+		t.Error("not allowed other client")
+	}
+	l.Fail("b")
+	// next window
+	now = now.Add(time.Minute)
+	if !l.Allow("a") {
+		t.Error("not allowed in new window")
+	}
+	now = now.Add(time.Minute)
+	l.Fail("c")
+	if n := l.Len(); n != 1 {
+		t.Errorf("failed cleanup: %v", n)
+	}
+}
+
+func TestLimiterAttempt(t *testing.T) {
+	l := New(3, time.Minute)
+	// concurrent attempts are reserved before their results are known
+	var (
+		wg      sync.WaitGroup
+		allowed int
+		mu      sync.Mutex
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.Attempt("a") {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Errorf("failed number of allowed attempts: %v", allowed)
+	}
+	// a successful attempt is refunded
+	l.Refund("a")
+	if !l.Attempt("a") {
+		t.Error("refunded attempt is not allowed")
+	}
+	if l.Attempt("a") {
+		t.Error("allowed after limit")
+	}
+	l.Refund("b")
+	if n := l.Len(); n != 1 {
+		t.Errorf("failed length: %v", n)
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := New(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		l.Fail("a")
+	}
+	if !l.Allow("a") {
+		t.Error("not allowed")
+	}
+	if n := l.Len(); n != 0 {
+		t.Errorf("failed length: %v", n)
+	}
+}
+
+func TestLimiterRetry(t *testing.T) {
+	now := time.Now()
+	l := New(1, time.Minute)
+	l.now = func() time.Time { return now }
+	if d := l.Retry("a"); d != 0 {
+		t.Errorf("failed retry of new client: %v", d)
+	}
+	l.Fail("a")
+	now = now.Add(20 * time.Second)
+	if d := l.Retry("a"); d != 40*time.Second {
+		t.Errorf("failed retry of limited client: %v", d)
+	}
+	now = now.Add(40 * time.Second)
+	if d := l.Retry("a"); d != 0 {
+		t.Errorf("failed retry in new window: %v", d)
+	}
+	if p := l.Period(); p != time.Minute {
+		t.Errorf("failed period: %v", p)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	ctx := context.Background()
+	s := NewSemaphore(2)
+	for i := 0; i < 2; i++ {
+		if !s.Acquire(ctx, time.Millisecond) {
+			t.Fatalf("[%v] not acquired", i)
+		}
+	}
+	if s.Acquire(ctx, 10*time.Millisecond) {
+		t.Error("acquired overflow slot")
+	}
+	// a released slot is taken by a waiting caller
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Release()
+	}()
+	if !s.Acquire(ctx, time.Second) {
+		t.Error("not acquired released slot")
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if s.Acquire(canceled, time.Second) {
+		t.Error("acquired with canceled context")
+	}
+	// disabled semaphore
+	s = NewSemaphore(0)
+	for i := 0; i < 10; i++ {
+		if !s.Acquire(ctx, 0) {
+			t.Fatalf("[%v] not acquired without limit", i)
+		}
+		s.Release()
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// Semaphore limits a number of concurrent operations.
+// Nil value has no limits.
+type Semaphore chan struct{}
+
+// NewSemaphore returns new semaphore for max concurrent operations, it's nil if max is not positive.
+func NewSemaphore(max int) Semaphore {
+	if max < 1 {
+		return nil
+	}
+	return make(Semaphore, max)
+}
+
+// Acquire takes a slot waiting it not longer than wait duration or ctx done.
+// It returns false if the slot is not taken, so Release must not be called.
+func (s Semaphore) Acquire(ctx context.Context, wait time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// Release frees the slot which was taken by Acquire.
+func (s Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+// Package logging contains structured log writers for standard loggers.
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Modes of client IP logging.
+const (
+	ClientIPOff       = "off"
+	ClientIPFull      = "full"
+	ClientIPTruncated = "truncated"
+)
+
+// JSONWriter writes every log line as a JSON object.
+type JSONWriter struct {
+	sync.Mutex
+	level string
+	out   io.Writer
+	now   func() time.Time
+}
+
+// NewJSONWriter returns new JSON writer with the log level.
+func NewJSONWriter(out io.Writer, level string) *JSONWriter {
+	return &JSONWriter{level: level, out: out, now: time.Now}
+}
+
+// Write implements io.Writer interface, p is one log line.
+func (w *JSONWriter) Write(p []byte) (int, error) {
+	err := w.Log(strings.TrimRight(string(p), "\n"), nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Log writes the message with additional fields,
+// they can't overwrite level, message and timestamp.
+func (w *JSONWriter) Log(msg string, fields map[string]interface{}) error {
+	record := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["level"] = w.level
+	record["msg"] = msg
+	record["ts"] = w.now().UTC().Format(time.RFC3339Nano)
+	w.Lock()
+	defer w.Unlock()
+	return json.NewEncoder(w.out).Encode(record)
+}
+
+// SetJSON switches the logger to JSON format and returns its writer.
+func SetJSON(l *log.Logger, level string) *JSONWriter {
+	w := NewJSONWriter(l.Writer(), level)
+	l.SetFlags(0)
+	l.SetPrefix("")
+	l.SetOutput(w)
+	return w
+}
+
+// TruncateIP returns the IP address without its host part, the last octet of IPv4
+// and the last 80 bits of IPv6 are zeroed. It's empty for an invalid address.
+func TruncateIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
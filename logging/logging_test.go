@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"testing"
+)
+
+func TestSetJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := log.New(&b, "[TEST]", log.Ltime|log.Lshortfile)
+	w := SetJSON(l, "info")
+	l.Println("first line")
+	l.Printf("second %v", "line")
+	err := w.Log("request", map[string]interface{}{"method": "GET", "code": 200, "level": "bad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{"first line", "second line", "request"}
+	scanner := bufio.NewScanner(&b)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		record := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("[%v] invalid JSON line: %v", i, err)
+		}
+		if record["level"] != "info" {
+			t.Errorf("[%v] failed level: %v", i, record["level"])
+		}
+		if (i < len(messages)) && (record["msg"] != messages[i]) {
+			t.Errorf("[%v] failed message: %v", i, record["msg"])
+		}
+		if ts, ok := record["ts"].(string); !ok || (ts == "") {
+			t.Errorf("[%v] failed timestamp: %v", i, record["ts"])
+		}
+		if (i == 2) && ((record["method"] != "GET") || (record["code"] != float64(200))) {
+			t.Errorf("[%v] failed fields: %v", i, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(messages) {
+		t.Errorf("failed lines number: %v", i)
+	}
+}
+
+func TestTruncateIP(t *testing.T) {
+	values := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "192.168.1.123", expected: "192.168.1.0"},
+		{ip: "10.0.0.1", expected: "10.0.0.0"},
+		{ip: "2001:db8:85a3:8d3:1319:8a2e:370:7348", expected: "2001:db8:85a3::"},
+		{ip: "::ffff:192.168.1.123", expected: "192.168.1.0"},
+		{ip: "::1", expected: "::"},
+		{ip: "unknown", expected: ""},
+	}
+	for i, v := range values {
+		if ip := TruncateIP(v.ip); ip != v.expected {
+			t.Errorf("[%v] failed truncated IP: %v", i, ip)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+// Package metrics contains service's metrics collectors.
+package metrics
+
+// Download errors reasons.
+const (
+	ReasonBadPassword = "bad_password"
+	ReasonBadRequest  = "bad_request"
+	ReasonNotFound    = "not_found"
+	ReasonServer      = "server_error"
+	ReasonRateLimit   = "rate_limit"
+	ReasonBusy        = "busy"
+)
+
+// Collector collects service's events.
+type Collector interface {
+	Upload(size int64)
+	Download()
+	DownloadError(reason string)
+	GCDeleted(n int64)
+}
+
+// Nop is a collector which does nothing.
+type Nop struct{}
+
+// Upload does nothing.
+func (Nop) Upload(int64) {}
+
+// Download does nothing.
+func (Nop) Download() {}
+
+// DownloadError does nothing.
+func (Nop) DownloadError(string) {}
+
+// GCDeleted does nothing.
+func (Nop) GCDeleted(int64) {}
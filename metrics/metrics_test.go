@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheus(t *testing.T) {
+	var c Collector = NewPrometheus()
+	c.Upload(1024)
+	c.Download()
+	c.DownloadError(ReasonBadPassword)
+	c.DownloadError(ReasonBadPassword)
+	c.GCDeleted(3)
+
+	p := c.(*Prometheus)
+	if v := testutil.ToFloat64(p.uploads); v != 1 {
+		t.Errorf("failed uploads: %v", v)
+	}
+	if v := testutil.ToFloat64(p.downloads); v != 1 {
+		t.Errorf("failed downloads: %v", v)
+	}
+	if v := testutil.ToFloat64(p.downloadErrors.WithLabelValues(ReasonBadPassword)); v != 2 {
+		t.Errorf("failed download errors: %v", v)
+	}
+	if v := testutil.ToFloat64(p.gcDeleted); v != 3 {
+		t.Errorf("failed gc deleted: %v", v)
+	}
+	if n := testutil.CollectAndCount(p.fileSize); n != 1 {
+		t.Errorf("failed file size histogram: %v", n)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus is a collector of Prometheus metrics.
+type Prometheus struct {
+	registry       *prometheus.Registry
+	uploads        prometheus.Counter
+	downloads      prometheus.Counter
+	downloadErrors *prometheus.CounterVec
+	gcDeleted      prometheus.Counter
+	fileSize       prometheus.Histogram
+}
+
+// NewPrometheus returns new Prometheus collector with its own registry.
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		uploads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "unigma_uploads_total",
+			Help: "Number of successful uploads.",
+		}),
+		downloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "unigma_downloads_total",
+			Help: "Number of successful downloads.",
+		}),
+		downloadErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "unigma_download_errors_total",
+			Help: "Number of failed downloads.",
+		}, []string{"reason"}),
+		gcDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "unigma_gc_deleted_total",
+			Help: "Number of items deleted by GC.",
+		}),
+		fileSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "unigma_file_size_bytes",
+			Help:    "Sizes of uploaded files.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+	}
+	p.registry.MustRegister(p.uploads, p.downloads, p.downloadErrors, p.gcDeleted, p.fileSize)
+	return p
+}
+
+// Upload increments uploads counter and observes the file size.
+func (p *Prometheus) Upload(size int64) {
+	p.uploads.Inc()
+	p.fileSize.Observe(float64(size))
+}
+
+// Download increments downloads counter.
+func (p *Prometheus) Download() {
+	p.downloads.Inc()
+}
+
+// DownloadError increments download errors counter.
+func (p *Prometheus) DownloadError(reason string) {
+	p.downloadErrors.WithLabelValues(reason).Inc()
+}
+
+// GCDeleted increases GC deleted items counter.
+func (p *Prometheus) GCDeleted(n int64) {
+	p.gcDeleted.Add(float64(n))
+}
+
+// Handler returns HTTP handler for metrics.
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
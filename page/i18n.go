@@ -0,0 +1,166 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package page
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// DefaultLang is a language of UI strings if nothing else matches.
+const DefaultLang = "en"
+
+// catalogs are UI strings by language and key.
+var catalogs = map[string]map[string]string{
+	"en": {
+		"error":                     "Error",
+		"error.message":             "Sorry, it is an error",
+		"not_found":                 "Not found",
+		"not_found.message":         "Page not found",
+		"bad_request.message":       "Failed validation data",
+		"method_not_allowed":        "Method not allowed",
+		"too_many_requests":         "Too many requests",
+		"too_many_requests.message": "Too many failed attempts, try again later",
+		"too_large":                 "Too large",
+		"too_large.message":         "File is too large, max size is %v Mb",
+		"storage_full":              "Storage is full",
+		"storage_full.message":      "Storage is full, try again later",
+		"maintenance":               "Maintenance",
+		"maintenance.message":       "Service is under maintenance, try again later",
+		"busy":                      "Server is busy",
+		"busy.message":              "Too many files are processed now, try again in a few seconds",
+		"scan_unavailable":          "Antivirus is unavailable",
+		"scan_unavailable.message":  "Files can't be checked by antivirus now, try again later",
+		"unavailable":               "Service unavailable",
+		"unavailable.message":       "Service is temporarily unavailable, try again later",
+		"reference":                 "Reference",
+		"submit":                    "Submit",
+		"index.file":                "File",
+		"index.max":                 "max",
+		"index.mb":                  "Mb",
+		"index.ttl":                 "TTL",
+		"index.ttl.10m":             "10 minutes",
+		"index.ttl.1h":              "a hour",
+		"index.ttl.1d":              "a day",
+		"index.ttl.1w":              "a week",
+		"index.ttl.max":             "max",
+		"index.times":               "times",
+		"index.password":            "password",
+		"index.secret":              "secret",
+		"index.confirm":             "confirm",
+		"index.hint":                "password hint",
+		"result.owner":              "Owner token",
+		"used.message":              "This link has already been fully used",
+		"expired.message":           "This link has expired",
+		"read.password":             "Password",
+		"read.inline":               "open in browser",
+		"read.hint":                 "Password hint",
+		"read.passwordless":         "The file doesn't require a password.",
+		"confirm.message":           "The file requires a confirmation before the download.",
+		"confirm.submit":            "Confirm",
+		"claim.message":             "The password can be shown only once.",
+		"claim.submit":              "Show password",
+	},
+	"ru": {
+		"error":                     "Ошибка",
+		"error.message":             "Извините, произошла ошибка",
+		"not_found":                 "Не найдено",
+		"not_found.message":         "Страница не найдена",
+		"bad_request.message":       "Некорректные данные",
+		"method_not_allowed":        "Метод не поддерживается",
+		"too_many_requests":         "Слишком много запросов",
+		"too_many_requests.message": "Слишком много неудачных попыток, попробуйте позже",
+		"too_large":                 "Слишком большой файл",
+		"too_large.message":         "Файл слишком большой, максимальный размер %v Мб",
+		"storage_full":              "Хранилище заполнено",
+		"storage_full.message":      "Хранилище заполнено, попробуйте позже",
+		"maintenance":               "Обслуживание",
+		"maintenance.message":       "Сервис на обслуживании, попробуйте позже",
+		"busy":                      "Сервер занят",
+		"busy.message":              "Сейчас обрабатывается слишком много файлов, попробуйте через несколько секунд",
+		"scan_unavailable":          "Антивирус недоступен",
+		"scan_unavailable.message":  "Файлы сейчас не могут быть проверены антивирусом, попробуйте позже",
+		"unavailable":               "Сервис недоступен",
+		"unavailable.message":       "Сервис временно недоступен, попробуйте позже",
+		"reference":                 "Код запроса",
+		"submit":                    "Отправить",
+		"index.file":                "Файл",
+		"index.max":                 "макс.",
+		"index.mb":                  "Мб",
+		"index.ttl":                 "Срок хранения",
+		"index.ttl.10m":             "10 минут",
+		"index.ttl.1h":              "час",
+		"index.ttl.1d":              "день",
+		"index.ttl.1w":              "неделя",
+		"index.ttl.max":             "максимум",
+		"index.times":               "скачиваний",
+		"index.password":            "пароль",
+		"index.secret":              "секрет",
+		"index.confirm":             "подтверждение",
+		"index.hint":                "подсказка к паролю",
+		"result.owner":              "Токен владельца",
+		"used.message":              "Ссылка уже полностью использована",
+		"expired.message":           "Срок действия ссылки истёк",
+		"read.password":             "Пароль",
+		"read.inline":               "открыть в браузере",
+		"read.hint":                 "Подсказка к паролю",
+		"read.passwordless":         "Файл не требует пароля.",
+		"confirm.message":           "Файл требует подтверждения перед скачиванием.",
+		"confirm.submit":            "Подтвердить",
+		"claim.message":             "Пароль можно показать только один раз.",
+		"claim.submit":              "Показать пароль",
+	},
+}
+
+// T returns UI string by its key for the language,
+// English one is used if there is no translation and the key itself if it's unknown.
+func T(lang, key string) string {
+	if value, ok := catalogs[lang][key]; ok {
+		return value
+	}
+	if value, ok := catalogs[DefaultLang][key]; ok {
+		return value
+	}
+	return key
+}
+
+// Lang returns the most preferred supported language of Accept-Language header value,
+// only primary tags are compared. It's DefaultLang if nothing matches.
+func Lang(accept string) string {
+	lang, weight := DefaultLang, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexByte(tag, '-'); i > 0 {
+			tag = tag[:i]
+		}
+		if _, ok := catalogs[tag]; !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q > weight {
+			lang, weight = tag, q
+		}
+	}
+	return lang
+}
+
+// Funcs returns template functions which are used by pages, "T" is a translation of UI string
+// and "URL" is a service path with basePath prefix, it's empty for the root deployment.
+func Funcs(basePath string) template.FuncMap {
+	return template.FuncMap{
+		"T":   T,
+		"URL": func(p string) string { return basePath + p },
+	}
+}
@@ -2,7 +2,8 @@
 // All rights reserved. Use of this source code is governed
 // by a MIT-style license that can be found in the LICENSE file.
 
-// Package page contains HTML text templates.
+// Package page contains HTML text templates and their localized UI strings,
+// templates should be parsed with Funcs functions.
 package page
 
 const (
@@ -13,22 +14,24 @@ const (
 	<head>
 		<meta charset=utf-8>
 		<title>Unigma</title>
+		<style>.invalid {outline: 1px solid red;}</style>
 	</head>
 	<body>
 		<h1>Unigma</h1>
-		{{if .Err}}<p><i>{{.Msg}}</i></p>{{end}}
-		<form method="POST" action="/upload" enctype="multipart/form-data">
-			File <small>(max {{.MaxSize}} Mb)</small>: 
-			<input type="file" name="file" required>
-			TTL: <select name="ttl" required>
-				<option value='600'>10 minutes</option>
-				<option value='3600'>a hour</option>
-				<option value='86400' selected>a day</option>
-				<option value='604800'>a week</option>
+		{{if .Notice}}<p><b>{{.Notice}}</b></p>{{end}}
+		{{if .Err}}<p>{{with .Msgs}}{{range .}}<i>{{.}}</i><br>{{end}}{{else}}<i>{{.Msg}}</i> {{end}}{{if .RequestID}}<small>{{T .Lang "reference"}}: {{.RequestID}}</small>{{end}}</p>{{end}}
+		<form method="POST" action="{{URL "/upload"}}" enctype="multipart/form-data">
+			{{T .Lang "index.file"}} <small>({{T .Lang "index.max"}} {{.MaxSize}} {{T .Lang "index.mb"}})</small>: 
+			<input type="file" name="{{.FileField}}"{{with .Invalid}}{{if .file}} class="invalid"{{end}}{{end}} multiple required>
+			{{T .Lang "index.ttl"}}: <select name="ttl"{{with .Invalid}}{{if .ttl}} class="invalid"{{end}}{{end}} required>
+				{{range .Presets}}<option value='{{.Seconds}}'{{if eq .Seconds $.TTL}} selected{{end}}>{{T $.Lang .Label}}</option>
+				{{end}}
 			</select>
-			times: <input type="number" name="times" min="1" max="1000" value="1" required>
-			password: <input type="password" name="password" placeholder="secret" required>
-			<input type="submit" value="Submit">
+			{{T .Lang "index.times"}}: <input type="number" name="times"{{with .Invalid}}{{if .times}} class="invalid"{{end}}{{end}} min="1" max="{{.MaxTimes}}" value="1" required>
+			{{T .Lang "index.password"}}: <input type="password" name="password"{{with .Invalid}}{{if .password}} class="invalid"{{end}}{{end}} placeholder="{{T .Lang "index.secret"}}" required>
+			{{if .Hints}}{{T .Lang "index.hint"}}: <input type="text" name="hint"{{with .Invalid}}{{if .hint}} class="invalid"{{end}}{{end}} maxlength="{{.MaxHint}}">{{end}}
+			<label><input type="checkbox" name="confirm" value="1"> {{T .Lang "index.confirm"}}</label>
+			<input type="submit" value="{{T .Lang "submit"}}">
 		</form>
 		<p>
 			<small><a href="https://github.com/z0rr0/unigma" title="github.com/z0rr0/enigma">github.com</a></small>
@@ -45,8 +48,9 @@ const (
 		<title>Unigma</title>
 	</head>
 	<body>
-		<h1><a href="/" title="Unigma">Unigma</a></h1>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
 		<strong><a href="{{ .URL }}">{{ .URL }}</a></strong>
+		{{if .Owner}}<p><small>{{T .Lang "result.owner"}}: {{ .Owner }}</small></p>{{end}}
 	</body>
 </html>
 `
@@ -59,8 +63,39 @@ const (
 		<title>Unigma - {{ .Err }}</title>
 	</head>
 	<body>
-		<h1><a href="/" title="Unigma">Unigma</a></h1>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
 		<h4>{{ .Msg }}</h4>
+		{{if .RequestID}}<p><small>{{T .Lang "reference"}}: {{ .RequestID }}</small></p>{{end}}
+	</body>
+</html>
+`
+	// Used is HTML template for already fully used link.
+	Used = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset=utf-8>
+		<title>Unigma - {{ .Err }}</title>
+	</head>
+	<body>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
+		<h4>{{T .Lang "used.message"}}</h4>
+		{{if .RequestID}}<p><small>{{T .Lang "reference"}}: {{ .RequestID }}</small></p>{{end}}
+	</body>
+</html>
+`
+	// Expired is HTML template for expired link.
+	Expired = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset=utf-8>
+		<title>Unigma - {{ .Err }}</title>
+	</head>
+	<body>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
+		<h4>{{T .Lang "expired.message"}}</h4>
+		{{if .RequestID}}<p><small>{{T .Lang "reference"}}: {{ .RequestID }}</small></p>{{end}}
 	</body>
 </html>
 `
@@ -73,12 +108,50 @@ const (
 		<title>Unigma</title>
 	</head>
 	<body>
-		<h1><a href="/" title="Unigma">Unigma</a></h1>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
+		{{if .Notice}}<p><b>{{.Notice}}</b></p>{{end}}
+		{{if .Hint}}<p>{{T .Lang "read.hint"}}: {{.Hint}}</p>{{end}}
+		<form method="POST">
+			{{if .Passwordless}}{{T .Lang "read.passwordless"}}{{else}}{{T .Lang "read.password"}}: <input type="password" name="password" required>{{end}}
+			<label><input type="checkbox" name="inline" value="1"> {{T .Lang "read.inline"}}</label>
+			<input type="submit" value="{{T .Lang "submit"}}">
+		</form>
+		{{if .Err}}<i>{{.Msg}}</i>{{if .RequestID}} <small>{{T .Lang "reference"}}: {{.RequestID}}</small>{{end}}{{end}}
+	</body>
+</html>
+`
+	// Confirm is HTML template for download confirmation.
+	Confirm = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset=utf-8>
+		<title>Unigma</title>
+	</head>
+	<body>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
+		<p>{{T .Lang "confirm.message"}}</p>
+		<form method="POST">
+			<input type="hidden" name="confirm" value="1">
+			<input type="submit" value="{{T .Lang "confirm.submit"}}">
+		</form>
+	</body>
+</html>
+`
+	// Claim is HTML template for a password claim, the password is revealed only by the form submit.
+	Claim = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset=utf-8>
+		<title>Unigma</title>
+	</head>
+	<body>
+		<h1><a href="{{URL "/"}}" title="Unigma">Unigma</a></h1>
+		<p>{{T .Lang "claim.message"}}</p>
 		<form method="POST">
-			Password: <input type="password" name="password" required>
-			<input type="submit" value="Submit">
+			<input type="submit" value="{{T .Lang "claim.submit"}}">
 		</form>
-		{{if .Err}}<i>{{.Msg}}</i>{{end}}
 	</body>
 </html>
 `
@@ -8,19 +8,74 @@ import (
 
 func TestTemplates(t *testing.T) {
 	pages := map[string]string{
-		"index":  Index,
-		"error":  Error,
-		"result": Result,
-		"read":   Read,
+		"index":   Index,
+		"error":   Error,
+		"result":  Result,
+		"read":    Read,
+		"confirm": Confirm,
+		"claim":   Claim,
+		"used":    Used,
+		"expired": Expired,
 	}
 	for name, p := range pages {
-		tpl, err := template.New(name).Parse(p)
+		tpl, err := template.New(name).Funcs(Funcs("")).Parse(p)
 		if err != nil {
 			t.Errorf("failed parse '%v': %v", name, err)
 		}
-		err = tpl.Execute(ioutil.Discard, nil)
-		if err != nil {
-			t.Errorf("failed execute '%v': %v", name, err)
+		for lang := range catalogs {
+			err = tpl.Execute(ioutil.Discard, map[string]string{"Lang": lang, "Err": "error", "RequestID": "abc"})
+			if err != nil {
+				t.Errorf("failed execute '%v' [%v]: %v", name, lang, err)
+			}
+		}
+	}
+}
+
+func TestCatalogs(t *testing.T) {
+	for lang, catalog := range catalogs {
+		if lang == DefaultLang {
+			continue
+		}
+		for key := range catalogs[DefaultLang] {
+			if _, ok := catalog[key]; !ok {
+				t.Errorf("missed key %v in %v catalog", key, lang)
+			}
+		}
+	}
+}
+
+func TestT(t *testing.T) {
+	values := []struct {
+		lang, key, expected string
+	}{
+		{lang: "en", key: "not_found", expected: "Not found"},
+		{lang: "ru", key: "not_found", expected: "Не найдено"},
+		{lang: "de", key: "not_found", expected: "Not found"},
+		{lang: "", key: "submit", expected: "Submit"},
+		{lang: "ru", key: "unknown", expected: "unknown"},
+	}
+	for i, v := range values {
+		if s := T(v.lang, v.key); s != v.expected {
+			t.Errorf("[%v] failed string: %v", i, s)
+		}
+	}
+}
+
+func TestLang(t *testing.T) {
+	values := map[string]string{
+		"":                           DefaultLang,
+		"*":                          DefaultLang,
+		"ru":                         "ru",
+		"ru-RU,ru;q=0.9,en-US;q=0.8": "ru",
+		"en-US,en;q=0.9,ru;q=0.8":    "en",
+		"de-DE, en;q=0.5, RU;q=0.7":  "ru",
+		"fr, ru;q=0":                 DefaultLang,
+		"ru;q=bad":                   "ru",
+		"de-DE,de;q=0.9":             DefaultLang,
+	}
+	for accept, expected := range values {
+		if lang := Lang(accept); lang != expected {
+			t.Errorf("failed language for %q: %v", accept, lang)
 		}
 	}
 }
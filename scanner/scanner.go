@@ -0,0 +1,120 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+// Package scanner implements ClamAV daemon client to check uploaded files.
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is max size of one data chunk of INSTREAM command.
+const chunkSize = 32 << 10
+
+// Client sends files to clamd by INSTREAM command.
+// Nil value is a disabled client, it accepts all files.
+type Client struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// New returns new client, it is nil if addr is empty.
+// An address starting with "/" is a unix socket, otherwise it's TCP host:port.
+func New(addr string, timeout time.Duration) *Client {
+	if addr == "" {
+		return nil
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	return &Client{network: network, addr: addr, timeout: timeout}
+}
+
+// Scan sends data to clamd and returns a name of found signature,
+// it is empty for clean data. The whole check is limited by the client timeout.
+func (c *Client) Scan(ctx context.Context, r io.Reader) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// the response is already read or the scan is failed
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return "", err
+		}
+	}
+	if err = stream(conn, r); err != nil {
+		return "", err
+	}
+	return readVerdict(conn)
+}
+
+// stream writes INSTREAM command with data chunks, every one has 4 bytes big-endian length prefix,
+// and a zero length chunk is the end of data.
+func stream(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriterSize(w, chunkSize+4)
+	if _, err := bw.WriteString("zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, e := bw.Write(size); e != nil {
+				return e
+			}
+			if _, e := bw.Write(buf[:n]); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := bw.Write(size); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readVerdict parses clamd response like "stream: OK", "stream: <name> FOUND" or "<message> ERROR".
+func readVerdict(r io.Reader) (string, error) {
+	response, err := bufio.NewReader(r).ReadString(0)
+	if (err != nil) && (err != io.EOF) {
+		return "", err
+	}
+	response = strings.TrimSpace(strings.TrimRight(response, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(response, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("unexpected clamd response: %q", response)
+}
@@ -0,0 +1,162 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts INSTREAM commands and finds "EICAR" signature in received data.
+func fakeClamd(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer func() {
+				if err := conn.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+			r := bufio.NewReader(conn)
+			command, err := r.ReadString(0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if command != "zINSTREAM\x00" {
+				_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				return
+			}
+			var data bytes.Buffer
+			size := make([]byte, 4)
+			for {
+				if _, err = io.ReadFull(r, size); err != nil {
+					t.Error(err)
+					return
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				if _, err = io.CopyN(&data, r, int64(n)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			response := "stream: OK\x00"
+			if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+				response = "stream: Eicar-Test-Signature FOUND\x00"
+			}
+			if _, err = conn.Write([]byte(response)); err != nil {
+				t.Error(err)
+			}
+		}(conn)
+	}
+}
+
+func TestClient_Scan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := ln.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	go fakeClamd(t, ln)
+
+	c := New(ln.Addr().String(), time.Second)
+	values := []struct {
+		data string
+		name string
+	}{
+		{data: "clean content", name: ""},
+		{data: "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*", name: "Eicar-Test-Signature"},
+		{data: strings.Repeat("a", 3*chunkSize+1) + "EICAR", name: "Eicar-Test-Signature"},
+		{data: strings.Repeat("b", 2*chunkSize), name: ""},
+	}
+	for i, v := range values {
+		name, err := c.Scan(context.Background(), strings.NewReader(v.data))
+		if err != nil {
+			t.Errorf("[%v] failed scan: %v", i, err)
+		}
+		if name != v.name {
+			t.Errorf("[%v] failed signature name: %v", i, name)
+		}
+	}
+}
+
+func TestClient_Disabled(t *testing.T) {
+	c := New("", time.Second)
+	if c != nil {
+		t.Fatal("client is not nil")
+	}
+	name, err := c.Scan(context.Background(), strings.NewReader("EICAR"))
+	if (err != nil) || (name != "") {
+		t.Errorf("failed disabled scan: %v, %v", name, err)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := ln.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// a dead clamd accepts connections but doesn't respond
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	c := New(ln.Addr().String(), 100*time.Millisecond)
+	start := time.Now()
+	if _, err = c.Scan(context.Background(), strings.NewReader("content")); err == nil {
+		t.Error("expected timeout error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("too long scan: %v", d)
+	}
+}
+
+func TestReadVerdict(t *testing.T) {
+	values := []struct {
+		response string
+		name     string
+		fail     bool
+	}{
+		{response: "stream: OK\x00"},
+		{response: "stream: Win.Test.EICAR_HDB-1 FOUND\x00", name: "Win.Test.EICAR_HDB-1"},
+		{response: "INSTREAM size limit exceeded. ERROR\x00", fail: true},
+		{response: "", fail: true},
+	}
+	for i, v := range values {
+		name, err := readVerdict(strings.NewReader(v.response))
+		if v.fail != (err != nil) {
+			t.Errorf("[%v] failed check: %v", i, err)
+		}
+		if name != v.name {
+			t.Errorf("[%v] failed name: %v", i, name)
+		}
+	}
+}
@@ -3,11 +3,70 @@ CREATE TABLE IF NOT EXISTS `storage` (
   `name` TEXT,
   `path` TEXT,
   `counter` INTEGER NOT NULL DEFAULT 1,
+  `format` INTEGER NOT NULL DEFAULT 0,
+  `iter` INTEGER NOT NULL DEFAULT 0,
+  `mime` TEXT NOT NULL DEFAULT '',
+  `size` INTEGER NOT NULL DEFAULT 0,
+  `confirm` INTEGER NOT NULL DEFAULT 0,
+  `compressed` INTEGER NOT NULL DEFAULT 0,
+  `owner` VARCHAR(64) NOT NULL DEFAULT '',
+  `label` TEXT NOT NULL DEFAULT '',
+  `max_fails` INTEGER NOT NULL DEFAULT 0,
+  `fails` INTEGER NOT NULL DEFAULT 0,
+  `salt_version` VARCHAR(64) NOT NULL DEFAULT '',
+  `checksum` VARCHAR(256) NOT NULL DEFAULT '',
+  `session` VARCHAR(64) NOT NULL DEFAULT '',
+  `blob_id` VARCHAR(64) NOT NULL DEFAULT '',
+  `content_key` VARCHAR(256) NOT NULL DEFAULT '',
+  `hint` TEXT NOT NULL DEFAULT '',
+  `passwordless` VARCHAR(256) NOT NULL DEFAULT '',
   `hash` VARCHAR(64) NOT NULL,
+  `storage_id` VARCHAR(64) NOT NULL DEFAULT '',
   `salt` VARCHAR(256) NOT NULL,
   `created` DATETIME NOT NULL,
   `updated` DATETIME NOT NULL,
   `expired` DATETIME NOT NULL
 );
 CREATE UNIQUE INDEX IF NOT EXISTS `hash` ON `storage` (`hash`);
-CREATE INDEX IF NOT EXISTS `expired` ON `storage` (`expired`);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS `expired` ON `storage` (`expired`);
+CREATE INDEX IF NOT EXISTS `session` ON `storage` (`session`);
+CREATE TABLE IF NOT EXISTS `unlock` (
+  `token` VARCHAR(64) PRIMARY KEY,
+  `item` INTEGER NOT NULL,
+  `expired` DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS `unlock_expired` ON `unlock` (`expired`);
+CREATE TABLE IF NOT EXISTS `claim` (
+  `token` VARCHAR(64) PRIMARY KEY,
+  `password` VARCHAR(512) NOT NULL,
+  `expired` DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS `claim_expired` ON `claim` (`expired`);
+CREATE TABLE IF NOT EXISTS `blob` (
+  `id` VARCHAR(64) PRIMARY KEY,
+  `storage_id` VARCHAR(64) NOT NULL,
+  `compressed` INTEGER NOT NULL DEFAULT 0,
+  `refcount` INTEGER NOT NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS `access_log` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `hash` VARCHAR(64) NOT NULL,
+  `success` INTEGER NOT NULL DEFAULT 0,
+  `ip` VARCHAR(64) NOT NULL DEFAULT '',
+  `created` DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS `access_log_hash` ON `access_log` (`hash`);
+CREATE INDEX IF NOT EXISTS `access_log_created` ON `access_log` (`created`);
+CREATE TABLE IF NOT EXISTS `upload_session` (
+  `id` VARCHAR(64) PRIMARY KEY,
+  `name` TEXT NOT NULL DEFAULT '',
+  `received` INTEGER NOT NULL DEFAULT 0,
+  `total` INTEGER NOT NULL,
+  `created` DATETIME NOT NULL,
+  `expired` DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS `upload_session_expired` ON `upload_session` (`expired`);
+CREATE TABLE IF NOT EXISTS `schema_version` (
+  `version` INTEGER PRIMARY KEY,
+  `applied` DATETIME NOT NULL
+);
\ No newline at end of file
@@ -5,16 +5,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/z0rr0/unigma/conf"
 	"github.com/z0rr0/unigma/db"
+	"github.com/z0rr0/unigma/logging"
 	"github.com/z0rr0/unigma/web"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -41,6 +47,8 @@ var (
 		log.Ldate|log.Ltime|log.Lshortfile)
 	loggerInfo = log.New(os.Stdout, fmt.Sprintf("INFO [%v]: ", Name),
 		log.Ldate|log.Ltime|log.Lshortfile)
+	// errHost is an error of a request to not allowed host
+	errHost = errors.New("host is not allowed")
 )
 
 func getVersion(w http.ResponseWriter) error {
@@ -51,70 +59,278 @@ func getVersion(w http.ResponseWriter) error {
 	return err
 }
 
-func main() {
-	defer func() {
-		if r := recover(); r != nil {
-			loggerError.Printf("abnormal termination [%v]: \n\t%v\n", Version, r)
-		}
-	}()
-	version := flag.Bool("version", false, "show version")
-	config := flag.String("config", Config, "configuration file")
-	flag.Parse()
+// serve accepts incoming connections on the listener, it uses TLS if it's configured.
+func serve(srv *http.Server, ln net.Listener, cfg *conf.Cfg) error {
+	if cfg.TLS() {
+		return srv.ServeTLS(ln, cfg.CertFile, cfg.KeyFile)
+	}
+	return srv.Serve(ln)
+}
 
-	versionInfo := fmt.Sprintf("\tVersion: %v\n\tRevision: %v\n\tBuild date: %v\n\tGo version: %v",
-		Version, Revision, BuildDate, GoVersion)
-	if *version {
-		fmt.Println(versionInfo)
-		return
+// shutdown stops the server and waits all in-flight requests,
+// only after that GC monitor is stopped, so no handler can send to GC channel
+// after its closing. It returns when the monitor has processed queued items.
+func shutdown(srv *http.Server, monitorClosed chan struct{}, monitorDone <-chan struct{}) {
+	if err := srv.Shutdown(context.Background()); err != nil {
+		loggerInfo.Printf("HTTP server Shutdown: %v", err)
 	}
-	cfg, err := conf.New(*config, loggerError)
+	close(monitorClosed)
+	<-monitorDone
+}
+
+// checkConfig validates the configuration file, database connection and storage,
+// it writes a summary to w and returns an error on any problem.
+func checkConfig(filename string, w io.Writer) error {
+	cfg, err := conf.New(filename, loggerError)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer func() {
 		if err := cfg.Close(); err != nil {
 			loggerError.Println(err)
 		}
 	}()
-	timeout := cfg.HandleTimeout()
+	if err = cfg.Db.Ping(); err != nil {
+		return fmt.Errorf("database connection: %v", err)
+	}
+	// the schema is already migrated, the query checks its access
+	size, err := db.TotalSize(cfg.Db)
+	if err != nil {
+		return fmt.Errorf("database schema: %v", err)
+	}
+	if err = web.IsWritable(cfg.StorageDir); err != nil {
+		return fmt.Errorf("storage: %v", err)
+	}
+	storage := cfg.StorageDir
+	if storage == "" {
+		storage = "s3 " + cfg.S3.Endpoint
+	}
+	_, err = fmt.Fprintf(w,
+		"config: OK\ndatabase: %v\nstorage: %v\nstored bytes: %v\nlisten addr: %v\ntls: %v\ntemplates: %v\n",
+		cfg.Driver, storage, size, cfg.Addr(), cfg.TLS(), len(cfg.Templates),
+	)
+	return err
+}
+
+// textAccessLog writes a request info to the info logger as a text.
+// Client's IP address is the last field if it's logged.
+func textAccessLog(r *http.Request, code int, duration time.Duration) {
+	if ip := web.LogIP(r); ip != "" {
+		loggerInfo.Printf("%-5v %v\t%-12v\t%v\t%v\t%v", r.Method, code, duration, r.URL.String(), web.RequestID(r), ip)
+		return
+	}
+	loggerInfo.Printf("%-5v %v\t%-12v\t%v\t%v", r.Method, code, duration, r.URL.String(), web.RequestID(r))
+}
+
+// jsonAccessLog returns a function which writes a request info to w as JSON.
+func jsonAccessLog(w *logging.JSONWriter) func(r *http.Request, code int, duration time.Duration) {
+	return func(r *http.Request, code int, duration time.Duration) {
+		fields := map[string]interface{}{
+			"method":     r.Method,
+			"code":       code,
+			"duration":   duration.Seconds(),
+			"path":       r.URL.String(),
+			"request_id": web.RequestID(r),
+		}
+		if ip := web.LogIP(r); ip != "" {
+			fields["client_ip"] = ip
+		}
+		err := w.Log("request", fields)
+		if err != nil {
+			loggerError.Println(err)
+		}
+	}
+}
+
+// newServer returns HTTP server with configured address and timeouts.
+func newServer(cfg *conf.Cfg) *http.Server {
+	readTimeout, writeTimeout, idleTimeout := cfg.ServerTimeouts()
 	srv := &http.Server{
 		Addr:           cfg.Addr(),
 		Handler:        http.DefaultServeMux,
-		ReadTimeout:    timeout,
-		WriteTimeout:   timeout,
+		ReadTimeout:    readTimeout,
+		WriteTimeout:   writeTimeout,
+		IdleTimeout:    idleTimeout,
 		MaxHeaderBytes: cfg.MaxFileSize(),
 		ErrorLog:       loggerInfo,
 	}
-	loggerInfo.Printf("\n%v\nstorage: %v\nlisten addr: %v\n", versionInfo, cfg.StorageDir, srv.Addr)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	if cfg.AdminClientCAs() != nil {
+		// certificates are verified only by admin requests, other routes stay open
+		srv.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
+	return srv
+}
+
+// recovery returns a handler which recovers panics of the next one, so a failed request
+// gets 500 status and doesn't break the server. The panic is logged with the request ID.
+func recovery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// it's a signal to abort the response, the server handles it quietly
+				panic(rec)
+			}
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			loggerError.Printf("request %v panic: %v\n%s", w.Header().Get("X-Request-ID"), rec, buf)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next(w, r)
+	}
+}
+
+// handler returns HTTP requests dispatcher, every request gets a random ID for logs correlation.
+func handler(cfg *conf.Cfg, logRequest func(r *http.Request, code int, duration time.Duration)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		start, code := time.Now(), http.StatusOK
+		id := web.NewRequestID()
+		r = web.WithLogIP(web.WithRequestID(r, id), cfg)
+		w.Header().Set("X-Request-ID", id)
+		quiet, origin := false, r
 		defer func() {
-			loggerInfo.Printf("%-5v %v\t%-12v\t%v",
-				r.Method,
-				code,
-				time.Since(start),
-				r.URL.String(),
-			)
+			// successful health checks and favicon requests are not logged, full request path is logged even for sub-path deployment
+			if !quiet || (code != http.StatusOK) {
+				logRequest(origin, code, time.Since(start))
+			}
 		}()
+		// the service can be deployed by a sub-path, so routes are relative to it
+		servicePath, ok := cfg.StripBasePath(r.URL.Path)
+		if !ok {
+			code = web.Error(w, r, cfg, http.StatusNotFound, nil, "")
+			return
+		}
+		if servicePath != r.URL.Path {
+			u := *r.URL
+			u.Path, u.RawPath = servicePath, ""
+			r.URL = &u
+		}
+		// links can't be generated for a foreign host, but probes can use any address
+		if !web.IsAllowedHost(r, cfg.AllowedHosts, cfg.TrustProxyHeaders) && (r.URL.Path != "/health") && (r.URL.Path != "/ready") {
+			code = web.Error(w, r, cfg, http.StatusBadRequest, errHost, "")
+			return
+		}
 		switch r.URL.Path {
+		case "/health":
+			quiet = true
+			code, err = web.Health(w, r, cfg)
+		case "/ready":
+			quiet = true
+			code, err = web.Ready(w, r, cfg)
+		case "/status":
+			code, err = web.Status(w, r, cfg)
 		case "/version":
 			code, err = http.StatusOK, getVersion(w)
+		case "/robots.txt":
+			code, err = web.Robots(w, r, cfg)
+		case "/favicon.ico":
+			quiet = true
+			code, err = web.Favicon(w, r, cfg)
 		case "/":
 			code, err = web.Index(w, r, cfg)
 		case "/upload":
 			code, err = web.Upload(w, r, cfg)
 		case "/u":
 			code, err = web.UploadShort(w, r, cfg)
+		case "/api/upload":
+			code, err = web.UploadJSON(w, r, cfg)
+		case "/api/upload-sealed":
+			code, err = web.UploadSealed(w, r, cfg)
+		case "/upload-url":
+			code, err = web.UploadURL(w, r, cfg)
+		case "/bulk":
+			code, err = web.Bulk(w, r, cfg)
+		case "/metrics":
+			code, err = web.Metrics(w, r, cfg)
 		default:
-			code, err = web.Download(w, r, cfg)
+			if strings.HasPrefix(r.URL.Path, "/admin/") {
+				code, err = web.Admin(w, r, cfg)
+			} else if strings.HasPrefix(r.URL.Path, "/static/") {
+				code, err = web.Static(w, r, cfg)
+			} else if strings.HasPrefix(r.URL.Path, "/claim/") {
+				code, err = web.Claim(w, r, cfg)
+			} else if (r.URL.Path == "/mine") || strings.HasPrefix(r.URL.Path, "/mine/") {
+				code, err = web.Mine(w, r, cfg)
+			} else if (r.URL.Path == "/api/uploads") || strings.HasPrefix(r.URL.Path, "/api/uploads/") {
+				code, err = web.Resumable(w, r, cfg)
+			} else if strings.HasPrefix(r.URL.Path, "/api/") {
+				code, err = web.DownloadAPI(w, r, cfg)
+			} else if strings.HasSuffix(r.URL.Path, "/extend") {
+				code, err = web.Extend(w, r, cfg)
+			} else if strings.HasSuffix(r.URL.Path, "/password") {
+				code, err = web.Password(w, r, cfg)
+			} else if strings.HasSuffix(r.URL.Path, "/info") {
+				code, err = web.Info(w, r, cfg)
+			} else {
+				code, err = web.Download(w, r, cfg)
+			}
 		}
 		if err != nil {
+			loggerError.Printf("request %v: %v", id, err)
+		}
+	}
+}
+
+func main() {
+	defer func() {
+		if r := recover(); r != nil {
+			loggerError.Printf("abnormal termination [%v]: \n\t%v\n", Version, r)
+		}
+	}()
+	// offline subcommands don't use the server configuration
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:], os.Stdout, loggerError); err != nil {
+				loggerError.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	version := flag.Bool("version", false, "show version")
+	config := flag.String("config", Config, "configuration file")
+	check := flag.Bool("check", false, "validate configuration and exit")
+	flag.Parse()
+
+	versionInfo := fmt.Sprintf("\tVersion: %v\n\tRevision: %v\n\tBuild date: %v\n\tGo version: %v",
+		Version, Revision, BuildDate, GoVersion)
+	if *version {
+		fmt.Println(versionInfo)
+		return
+	}
+	if *check {
+		if err := checkConfig(*config, os.Stdout); err != nil {
 			loggerError.Println(err)
+			os.Exit(1)
 		}
-	})
-	monitorClosed := make(chan struct{})
-	go db.GCMonitor(cfg.Ch, monitorClosed, cfg.Db, loggerInfo, loggerError, time.Duration(cfg.GCPeriod)*time.Second)
+		return
+	}
+	cfg, err := conf.New(*config, loggerError)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			loggerError.Println(err)
+		}
+	}()
+	logRequest := textAccessLog
+	if cfg.LogFormat == logging.FormatJSON {
+		logging.SetJSON(loggerError, "error")
+		logRequest = jsonAccessLog(logging.SetJSON(loggerInfo, "info"))
+	}
+	srv := newServer(cfg)
+	loggerInfo.Printf("\n%v\nstorage: %v\nlisten addr: %v\ntls: %v\n", versionInfo, cfg.StorageDir, srv.Addr, cfg.TLS())
+	http.HandleFunc("/", recovery(handler(cfg, logRequest)))
+	monitorClosed, monitorDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		db.GCMonitor(cfg.Ch, monitorClosed, web.NewGCConfig(cfg, loggerInfo, loggerError))
+		close(monitorDone)
+	}()
 
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -122,17 +338,17 @@ func main() {
 		signal.Notify(sigint, os.Interrupt, os.Signal(syscall.SIGTERM), os.Signal(syscall.SIGQUIT))
 		<-sigint
 
-		if err := srv.Shutdown(context.Background()); err != nil {
-			loggerInfo.Printf("HTTP server Shutdown: %v", err)
-		}
+		shutdown(srv, monitorClosed, monitorDone)
 		close(idleConnsClosed)
-		close(monitorClosed)
 	}()
 
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		loggerInfo.Printf("HTTP server ListenAndServe: %v", err)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		panic(err)
+	}
+	if err := serve(srv, ln, cfg); err != http.ErrServerClosed {
+		loggerInfo.Printf("HTTP server Serve: %v", err)
 	}
 	<-idleConnsClosed
-	<-monitorClosed
 	loggerInfo.Println("stopped")
 }
@@ -0,0 +1,1049 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+	"github.com/z0rr0/unigma/web"
+)
+
+var (
+	loggerTest = log.New(os.Stdout, "[TEST]", log.Ltime|log.Lshortfile)
+	rgEncrypt  = regexp.MustCompile(`(?m)^(\w+): (\S+)$`)
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	content := []byte("test content")
+	in := filepath.Join(dir, "test.txt")
+	if err = ioutil.WriteFile(in, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(dir, "blob")
+	var b bytes.Buffer
+	err = runEncrypt([]string{"-in", in, "-out", blob, "-password", "secret", "-iter", "10000"}, &b, loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := make(map[string]string)
+	for _, m := range rgEncrypt.FindAllStringSubmatch(b.String(), -1) {
+		params[m[1]] = m[2]
+	}
+	args := []string{
+		"-in", blob,
+		"-salt", params["Salt"],
+		"-hash", params["Hash"],
+		"-name", params["Name"],
+		"-iter", params["Iterations"],
+	}
+	out := filepath.Join(dir, "result.txt")
+	err = runDecrypt(append([]string{"-password", "bad", "-out", out}, args...), &b, loggerTest)
+	if err == nil {
+		t.Error("unexpected result")
+	}
+	b.Reset()
+	err = runDecrypt(append([]string{"-password", "secret", "-out", out}, args...), &b, loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), out) {
+		t.Errorf("failed output: %v", b.String())
+	}
+	result, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, content) {
+		t.Errorf("failed content: %s", result)
+	}
+}
+
+// writeCert creates a self-signed certificate and its key in the directory.
+func writeCert(dir string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Unigma test"}},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	certFile, keyFile, err := writeCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("failed certificate pool")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.Cfg{CertFile: certFile, KeyFile: keyFile}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := getVersion(w); err != nil {
+				t.Error(err)
+			}
+		}),
+		ErrorLog: loggerTest,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, cfg)
+	}()
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	if resp.TLS == nil {
+		t.Error("not TLS connection")
+	}
+	if !strings.HasPrefix(string(body), Name) {
+		t.Errorf("failed response: %s", body)
+	}
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Errorf("failed serve result: %v", err)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	cfg, err := conf.New("/tmp/unigma.json", loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout = 5, 600, 90
+	srv := newServer(cfg)
+	if srv.ReadTimeout != 5*time.Second {
+		t.Errorf("failed read timeout: %v", srv.ReadTimeout)
+	}
+	if srv.WriteTimeout != 10*time.Minute {
+		t.Errorf("failed write timeout: %v", srv.WriteTimeout)
+	}
+	if srv.IdleTimeout != 90*time.Second {
+		t.Errorf("failed idle timeout: %v", srv.IdleTimeout)
+	}
+	if srv.Addr != cfg.Addr() {
+		t.Errorf("failed address: %v", srv.Addr)
+	}
+}
+
+func TestHandlerRequestID(t *testing.T) {
+	cfg, err := conf.New("/tmp/unigma.json", loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	var errLog, infoLog bytes.Buffer
+	errOut, infoOut := loggerError.Writer(), loggerInfo.Writer()
+	loggerError.SetOutput(&errLog)
+	loggerInfo.SetOutput(&infoLog)
+	defer func() {
+		loggerError.SetOutput(errOut)
+		loggerInfo.SetOutput(infoOut)
+	}()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/upload", strings.NewReader("ttl=bad"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler(cfg, textAccessLog)(w, r)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("failed code: %v", resp.StatusCode)
+	}
+	id := resp.Header.Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("empty request ID")
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Reference: "+id) {
+		t.Errorf("no request ID in the body: %v", body)
+	}
+	if !strings.Contains(errLog.String(), id) {
+		t.Errorf("no request ID in the error log: %v", errLog.String())
+	}
+	if !strings.Contains(infoLog.String(), id) {
+		t.Errorf("no request ID in the access log: %v", infoLog.String())
+	}
+}
+
+func TestHandlerBasePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a separate database, so uploads don't affect other packages tests
+	dbFile, storageDir := filepath.Join(dir, "db.sqlite"), filepath.Join(dir, "storage")
+	if err = os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("/tmp/unigma.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["db"], settings["storage"] = dbFile, storageDir
+	settings["base_path"] = "/unigma/"
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.New(config, loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err = cfg.Db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	h := handler(cfg, func(*http.Request, int, time.Duration) {})
+	values := []struct {
+		path string
+		code int
+	}{
+		{path: "/unigma/health", code: http.StatusOK},
+		{path: "/unigma", code: http.StatusOK},
+		{path: "/health", code: http.StatusNotFound},
+		{path: "/", code: http.StatusNotFound},
+		{path: "/unigmax/health", code: http.StatusNotFound},
+	}
+	for i, v := range values {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", v.path, nil))
+		if w.Code != v.code {
+			t.Errorf("[%v] failed code: %v", i, w.Code)
+		}
+	}
+	// index page links
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/unigma/", nil))
+	if body := w.Body.String(); !strings.Contains(body, `action="/unigma/upload"`) {
+		t.Errorf("failed index page: %v", body)
+	}
+	// upload and download by generated URL
+	var b bytes.Buffer
+	fw := multipart.NewWriter(&b)
+	fileWriter, err := fw.CreateFormFile("file", "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fileWriter.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.WriteField("password", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/unigma/u?format=plain-url", &b)
+	r.Header.Set("Content-Type", fw.FormDataContentType())
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed upload code: %v", w.Code)
+	}
+	link := strings.TrimSpace(w.Body.String())
+	if !regexp.MustCompile(`^http://example\.com/unigma/[0-9a-f]{64}$`).MatchString(link) {
+		t.Fatalf("failed link: %v", link)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", link, strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("failed download code: %v", w.Code)
+	}
+	if s := w.Body.String(); s != "content" {
+		t.Errorf("failed content: %v", s)
+	}
+}
+
+// newTestConfig returns a configuration with a new database and storage in the directory,
+// settings of the test configuration are replaced by options.
+func newTestConfig(t *testing.T, dir string, options map[string]interface{}) *conf.Cfg {
+	schema, err := ioutil.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFile, storageDir := filepath.Join(dir, "db.sqlite"), filepath.Join(dir, "storage")
+	if err = os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("/tmp/unigma.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["db"], settings["storage"] = dbFile, storageDir
+	for k, v := range options {
+		settings[k] = v
+	}
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.New(config, loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfg.Db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestHandlerAllowedHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg := newTestConfig(t, dir, map[string]interface{}{"allowed_hosts": []string{"unigma.com"}})
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	h := handler(cfg, func(*http.Request, int, time.Duration) {})
+	upload := func(host string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		fw := multipart.NewWriter(&b)
+		fileWriter, err := fw.CreateFormFile("file", "test.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fileWriter.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if err = fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/u?format=plain-url", &b)
+		r.Host = host
+		r.Header.Set("Content-Type", fw.FormDataContentType())
+		h(w, r)
+		return w
+	}
+	w := upload("unigma.com:8080")
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed upload code: %v", w.Code)
+	}
+	if link := strings.TrimSpace(w.Body.String()); !regexp.MustCompile(`^http://unigma\.com:8080/[0-9a-f]{64}$`).MatchString(link) {
+		t.Errorf("failed link: %v", link)
+	}
+	if w = upload("evil.com"); (w.Code != http.StatusBadRequest) || strings.Contains(w.Body.String(), "evil.com") {
+		t.Errorf("failed code of not allowed host: %v, %v", w.Code, w.Body.String())
+	}
+	values := []struct {
+		path string
+		code int
+	}{
+		{path: "/health", code: http.StatusOK},
+		{path: "/ready", code: http.StatusOK},
+		{path: "/", code: http.StatusBadRequest},
+		{path: "/status", code: http.StatusBadRequest},
+	}
+	for i, v := range values {
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", v.path, nil)
+		r.Host = "10.0.0.1:8080"
+		h(w, r)
+		if w.Code != v.code {
+			t.Errorf("[%v] failed code: %v", i, w.Code)
+		}
+	}
+}
+
+func TestHandlerAPIOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg := newTestConfig(t, dir, map[string]interface{}{"api_only": true})
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if len(cfg.Templates) != 0 {
+		t.Errorf("templates are loaded: %v", len(cfg.Templates))
+	}
+	h := handler(cfg, func(*http.Request, int, time.Duration) {})
+	var b bytes.Buffer
+	fw := multipart.NewWriter(&b)
+	fileWriter, err := fw.CreateFormFile("file", "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fileWriter.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.WriteField("password", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/u?format=plain-url", &b)
+	r.Header.Set("Content-Type", fw.FormDataContentType())
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed upload code: %v, %v", w.Code, w.Body.String())
+	}
+	link, err := url.Parse(strings.TrimSpace(w.Body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{method: "GET", path: "/", code: http.StatusNotFound},
+		{method: "POST", path: "/upload", code: http.StatusNotFound},
+		{method: "GET", path: link.Path, code: http.StatusNotFound},
+		{method: "GET", path: "/" + strings.Repeat("0", 64), code: http.StatusNotFound},
+		{method: "GET", path: "/api" + link.Path, code: http.StatusOK},
+	}
+	for i, v := range values {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest(v.method, v.path, nil))
+		if w.Code != v.code {
+			t.Errorf("[%v] failed code: %v", i, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); strings.HasPrefix(ct, "text/html") {
+			t.Errorf("[%v] unexpected HTML response: %v", i, ct)
+		}
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/api"+link.Path, strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h(w, r)
+	if (w.Code != http.StatusOK) || (w.Body.String() != "content") {
+		t.Errorf("failed download: %v, %v", w.Code, w.Body.String())
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	for _, format := range []string{"text", "csv", "json"} {
+		var b bytes.Buffer
+		err := runStats([]string{"-config", "/tmp/unigma.json", "-format", format}, &b, loggerTest)
+		if err != nil {
+			t.Fatalf("[%v] %v", format, err)
+		}
+		if b.Len() == 0 {
+			t.Errorf("[%v] empty output", format)
+		}
+	}
+	var b bytes.Buffer
+	if err := writeStats(&b, db.StatsResult{Items: 2, Bytes: 10, Expiring: 1, AvgCounter: 1.5}, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.String(); s != "items,bytes,expiring,avg_counter\n2,10,1,1.50\n" {
+		t.Errorf("failed csv: %q", s)
+	}
+	b.Reset()
+	if err := writeStats(&b, db.StatsResult{Items: 2}, "json"); err != nil {
+		t.Fatal(err)
+	}
+	result := db.StatsResult{}
+	if err := json.Unmarshal(b.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Items != 2 {
+		t.Errorf("failed json: %v", b.String())
+	}
+	if err := writeStats(&b, result, "xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	cfg, err := conf.New("/tmp/unigma.json", loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	now := time.Now().UTC()
+	secret := "secret"
+	content := bytes.Repeat([]byte("0123456789"), 1<<20)
+	item := &db.Item{
+		Name:    "test.txt",
+		Path:    cfg.StorageDir,
+		Salt:    "abc",
+		Counter: 1,
+		Storage: cfg.Backend,
+		Created: now,
+		Expired: now.Add(time.Minute),
+	}
+	if err = item.Encrypt(bytes.NewReader(content), cfg.Secret(secret, item.SaltVersion), loggerTest); err != nil {
+		t.Fatal(err)
+	}
+	if err = item.Save(cfg.Db); err != nil {
+		t.Fatal(err)
+	}
+	monitorClosed, monitorDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		gc := web.NewGCConfig(cfg, loggerTest, loggerTest)
+		gc.Period, gc.Grace = time.Hour, 0
+		db.GCMonitor(cfg.Ch, monitorClosed, gc)
+		close(monitorDone)
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler(cfg, func(*http.Request, int, time.Duration) {}), ErrorLog: loggerTest}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, cfg)
+	}()
+	req, err := http.NewRequest("POST", "http://"+ln.Addr().String()+"/"+item.Hash, strings.NewReader(url.Values{"password": {secret}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// compressed content is too small to keep the download in progress
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed code: %v", resp.StatusCode)
+	}
+	// the download is in progress, only its beginning is read
+	b := make([]byte, 1024)
+	if _, err = io.ReadFull(resp.Body, b); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(srv, monitorClosed, monitorDone)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("shutdown did not wait the download")
+	case <-time.After(100 * time.Millisecond):
+	}
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = resp.Body.Close(); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(append(b, rest...), content) {
+		t.Error("failed content")
+	}
+	<-stopped
+	if err = <-served; err != http.ErrServerClosed {
+		t.Errorf("failed serve result: %v", err)
+	}
+	if item.IsFileExists() {
+		t.Error("file was not deleted")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	var b bytes.Buffer
+	if err := checkConfig("/tmp/unigma.json", &b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "config: OK") {
+		t.Errorf("failed summary: %v", b.String())
+	}
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	data, err := ioutil.ReadFile("/tmp/unigma.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []map[string]interface{}{
+		{"storage": filepath.Join(dir, "missing")},
+		{"db": filepath.Join(dir, "missing", "db.sqlite")},
+		{"settings": map[string]interface{}{"ttl": 0, "times": 1, "size": 1}},
+	}
+	for i, c := range cases {
+		values := make(map[string]interface{})
+		if err = json.Unmarshal(data, &values); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range c {
+			values[k] = v
+		}
+		config, err := json.Marshal(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, "config.json")
+		if err = ioutil.WriteFile(name, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = checkConfig(name, &b); err == nil {
+			t.Errorf("[%v] expected error", i)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	cfg, err := conf.New("/tmp/unigma.json", loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	var errLog bytes.Buffer
+	errOut, infoOut := loggerError.Writer(), loggerInfo.Writer()
+	loggerError.SetOutput(&errLog)
+	loggerInfo.SetOutput(ioutil.Discard)
+	defer func() {
+		loggerError.SetOutput(errOut)
+		loggerInfo.SetOutput(infoOut)
+	}()
+	// the index page panics without its template
+	delete(cfg.Templates, "index")
+	s := httptest.NewServer(recovery(handler(cfg, textAccessLog)))
+	defer s.Close()
+
+	for _, path := range []string{"/", "/version"} {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = resp.Body.Close(); err != nil {
+			t.Error(err)
+		}
+		expected := http.StatusOK
+		if path == "/" {
+			expected = http.StatusInternalServerError
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("failed code of %v: %v", path, resp.StatusCode)
+		}
+		if path == "/" {
+			id := resp.Header.Get("X-Request-ID")
+			if (id == "") || !strings.Contains(errLog.String(), "request "+id+" panic") {
+				t.Errorf("no request ID in the error log: %v", errLog.String())
+			}
+		}
+	}
+}
+
+// newClientCert returns a client certificate signed by a new authority and PEM of this authority.
+func newClientCert() (tls.Certificate, []byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{Organization: []string{"Unigma test CA"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageCertSign,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "admin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), nil
+}
+
+func TestAdminClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	certFile, keyFile, err := writeCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("failed certificate pool")
+	}
+	trusted, caPEM, err := newClientCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, _, err := newClientCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err = ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("/tmp/unigma.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["cert_file"], settings["key_file"] = certFile, keyFile
+	settings["admin_client_ca"] = caFile
+	settings["admin_token"] = "admin-token"
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.New(config, loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	infoOut := loggerInfo.Writer()
+	loggerInfo.SetOutput(ioutil.Discard)
+	defer loggerInfo.SetOutput(infoOut)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg)
+	srv.Handler = handler(cfg, textAccessLog)
+	srv.ErrorLog = loggerTest
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, cfg)
+	}()
+	request := func(path string, certs []tls.Certificate) int {
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}},
+			Timeout:   5 * time.Second,
+		}
+		r, err := http.NewRequest("GET", "https://"+ln.Addr().String()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer admin-token")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = resp.Body.Close(); err != nil {
+			t.Error(err)
+		}
+		return resp.StatusCode
+	}
+	values := []struct {
+		path  string
+		certs []tls.Certificate
+		code  int
+	}{
+		{path: "/admin/items", certs: []tls.Certificate{trusted}, code: http.StatusOK},
+		{path: "/admin/items", certs: []tls.Certificate{untrusted}, code: http.StatusForbidden},
+		{path: "/admin/items", code: http.StatusForbidden},
+		{path: "/version", code: http.StatusOK},
+		{path: "/version", certs: []tls.Certificate{untrusted}, code: http.StatusOK},
+	}
+	for i, v := range values {
+		if code := request(v.path, v.certs); code != v.code {
+			t.Errorf("[%v] failed code: %v", i, code)
+		}
+	}
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Errorf("failed serve result: %v", err)
+	}
+}
+
+func TestRunVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	schema, err := ioutil.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFile, storageDir := filepath.Join(dir, "db.sqlite"), filepath.Join(dir, "storage")
+	if err = os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("/tmp/unigma.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["db"], settings["storage"] = dbFile, storageDir
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.New(config, loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfg.Db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	item := &db.Item{Name: "test.txt", Counter: 1, Path: storageDir, Storage: cfg.Backend, Created: now, Expired: now.Add(time.Minute)}
+	if err = item.Encrypt(strings.NewReader("content"), "secret", loggerTest); err != nil {
+		t.Fatal(err)
+	}
+	if err = item.Save(cfg.Db); err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	var b bytes.Buffer
+	if err = runVerify([]string{"-config", config}, &b, loggerTest); err != nil {
+		t.Errorf("failed consistent storage: %v, %v", err, b.String())
+	}
+	if !strings.HasPrefix(b.String(), "Checked items: 1\n") {
+		t.Errorf("failed report: %v", b.String())
+	}
+	orphan := filepath.Join(storageDir, "orphan")
+	if err = ioutil.WriteFile(orphan, []byte("orphan"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err = runVerify([]string{"-config", config}, &b, loggerTest); err == nil {
+		t.Error("expected error for orphaned file")
+	}
+	if !strings.Contains(b.String(), "Orphans: 1\n\t"+orphan+"\n") {
+		t.Errorf("failed report: %v", b.String())
+	}
+}
+
+func TestHandlerFavicon(t *testing.T) {
+	cfg, err := conf.New("/tmp/unigma.json", loggerTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	var logged []string
+	h := handler(cfg, func(r *http.Request, code int, _ time.Duration) {
+		logged = append(logged, fmt.Sprintf("%v %v", r.URL.Path, code))
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("failed code: %v", w.Code)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") {
+		t.Errorf("failed content type: %v", ct)
+	}
+	if len(logged) != 0 {
+		t.Errorf("favicon request is logged: %v", logged)
+	}
+	// other not found pages are still logged
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/favicon.png", nil))
+	if (len(logged) != 1) || (logged[0] != "/favicon.png 404") {
+		t.Errorf("failed logged requests: %v", logged)
+	}
+}
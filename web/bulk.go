@@ -0,0 +1,206 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+	"github.com/z0rr0/unigma/metrics"
+)
+
+const (
+	// maxBulkItems is max number of files in one bulk download request.
+	maxBulkItems = 20
+	// bulkErrorsName is a name of the archive entry with errors of skipped files.
+	bulkErrorsName = "errors.txt"
+)
+
+var (
+	// errBulkNotFound is an error of not found or already used file of the bulk download.
+	errBulkNotFound = errors.New("not found")
+	// errBulkSealed is an error of client-side encrypted file, it can't be decrypted by the server.
+	errBulkSealed = errors.New("client-side encrypted file")
+	// errBulkServer is an error of the bulk download file, its details are only logged.
+	errBulkServer = errors.New("server error")
+)
+
+// BulkItem is a file of the bulk download request.
+type BulkItem struct {
+	Hash     string `json:"hash"`
+	Password string `json:"password"`
+}
+
+// validateBulk returns files of the bulk download request, their number is limited.
+func validateBulk(w io.Writer, r *http.Request) ([]*BulkItem, error) {
+	httpWriter, _ := w.(http.ResponseWriter)
+	r.Body = http.MaxBytesReader(httpWriter, r.Body, formReserve)
+	var items []*BulkItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		return nil, &codeError{code: CodeInvalidRequest, msg: "request should be a JSON list of hash and password pairs"}
+	}
+	if n := len(items); (n < 1) || (n > maxBulkItems) {
+		return nil, &codeError{code: CodeInvalidRequest, msg: fmt.Sprintf("number of files should be in range [1 - %v]", maxBulkItems)}
+	}
+	return items, nil
+}
+
+// readBulkItem checks the password and decrements the counter of the file,
+// returned error is a reason to skip it, which is shown to the client.
+func readBulkItem(b *BulkItem, ip string, cfg *conf.Cfg) (*db.Item, []byte, error) {
+	if !db.IsNameHash(b.Hash) {
+		return nil, nil, errBulkNotFound
+	}
+	item, err := db.Read(cfg.Db, b.Hash, cfg.ErrLogger)
+	if err != nil {
+		cfg.ErrLogger.Printf("bulk read of %v: %v", b.Hash, err)
+		cfg.Collector.DownloadError(metrics.ReasonServer)
+		return nil, nil, errBulkServer
+	}
+	if item.ID == 0 {
+		cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		return nil, nil, errBulkNotFound
+	}
+	if item.Format == db.FormatSealed {
+		cfg.Collector.DownloadError(metrics.ReasonBadRequest)
+		return nil, nil, errBulkSealed
+	}
+	item.Storage = cfg.Backend
+	password, err := itemPassword(item, b.Password, cfg)
+	if err != nil {
+		cfg.ErrLogger.Printf("bulk password of item=%v: %v", item.ID, err)
+		cfg.Collector.DownloadError(metrics.ReasonServer)
+		return nil, nil, errBulkServer
+	}
+	if !cfg.Limiter.Attempt(ip) {
+		cfg.Collector.DownloadError(metrics.ReasonRateLimit)
+		return nil, nil, errLimit
+	}
+	key, err := item.IsValidSecret(cfg.Secret(password, item.SaltVersion))
+	if err != db.ErrPassword {
+		// only a failed password keeps the reserved attempt
+		cfg.Limiter.Refund(ip)
+	}
+	if err != nil {
+		if err != db.ErrPassword {
+			cfg.ErrLogger.Printf("bulk secret check of item=%v: %v", item.ID, err)
+			cfg.Collector.DownloadError(metrics.ReasonServer)
+			return nil, nil, errBulkServer
+		}
+		if failPassword(item, ip, cfg) {
+			return nil, nil, errBulkNotFound
+		}
+		return nil, nil, err
+	}
+	if !item.IsFileExists() {
+		// the same message as for a failed password
+		cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		return nil, nil, db.ErrPassword
+	}
+	ok, err := item.Decrement(cfg.Db, cfg.ErrLogger)
+	if err != nil {
+		cfg.ErrLogger.Printf("bulk decrement of item=%v: %v", item.ID, err)
+		cfg.Collector.DownloadError(metrics.ReasonServer)
+		return nil, nil, errBulkServer
+	}
+	if !ok {
+		cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		return nil, nil, errBulkNotFound
+	}
+	return item, key, nil
+}
+
+// bulkName returns unique name of the archive entry, a name of other file gets hash prefix.
+func bulkName(name, hash string, names map[string]bool) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if !isFileName(name) || (name == bulkErrorsName) {
+		name = defaultFileName
+	}
+	if names[name] {
+		name = hash[:8] + "-" + name
+	}
+	names[name] = true
+	return name
+}
+
+// Bulk returns several decrypted files as one zip archive, the request is a JSON list
+// of hash and password pairs. Every file is counted as a download, files which can't be read
+// are skipped and their errors are written to errors.txt entry.
+func Bulk(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if r.Method != "POST" {
+		return methodNotAllowed(w, cfg, "POST"), nil
+	}
+	if isMaintenance(cfg, false) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	items, err := validateBulk(w, r)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	// the archive is one download slot, it's taken before the response is started
+	if !cfg.Downloads.Acquire(r.Context(), concurrencyWait) {
+		cfg.Collector.DownloadError(metrics.ReasonBusy)
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errBusy), errBusy
+	}
+	defer cfg.Downloads.Release()
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		h := httpWriter.Header()
+		h.Set("Content-Type", "application/zip")
+		h.Set("Content-Disposition", `attachment; filename="unigma.zip"`)
+		h.Set("Cache-Control", "no-store, private")
+	}
+	ip := clientIP(r, cfg.Proxy)
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool, len(items))
+	var failed []string
+	for _, b := range items {
+		item, key, err := readBulkItem(b, ip, cfg)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", b.Hash, err))
+			continue
+		}
+		name, err := item.PlainName(key)
+		if err != nil {
+			// the download is already counted
+			queueGC(item, cfg)
+			return http.StatusInternalServerError, err
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: bulkName(name, item.Hash, names), Method: zip.Deflate, Modified: item.Created})
+		if err == nil {
+			err = item.DecryptContext(r.Context(), entry, key, cfg.ErrLogger)
+		}
+		if err != nil {
+			cfg.Collector.DownloadError(metrics.ReasonServer)
+			// the response is already started, so the archive is broken
+			queueGC(item, cfg)
+			return http.StatusInternalServerError, err
+		}
+		cfg.Collector.Download()
+		recordAccess(item, true, ip, cfg)
+		notifyDownload(r, item, cfg)
+		queueGC(item, cfg)
+	}
+	if len(failed) > 0 {
+		entry, err := zw.Create(bulkErrorsName)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if _, err = io.WriteString(entry, strings.Join(failed, "\n")+"\n"); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+)
+
+// newClaim saves the generated password of the item and returns its one-time claim URL,
+// so the link and the password can be sent by different channels.
+// The item is removed if the claim isn't saved, because its password would be lost.
+func newClaim(r *http.Request, item *db.Item, password string, cfg *conf.Cfg) (string, error) {
+	expired := time.Now().UTC().Add(db.ClaimTTL)
+	if item.Expired.Before(expired) {
+		expired = item.Expired
+	}
+	token, err := db.NewClaim(cfg.Db, password, expired)
+	if err != nil {
+		if e := deleteItem(item, cfg); e != nil {
+			cfg.ErrLogger.Printf("remove item without claim: %v", e)
+		}
+		return "", err
+	}
+	u := item.GetURL(r, cfg.Secure, cfg.TrustedHosts(), cfg.BasePath)
+	u.Path = cfg.URLPath("/claim/" + token)
+	return u.String(), nil
+}
+
+// Claim reveals the generated password by its claim token and burns the token,
+// next requests get "404 Not Found" status. GET request only shows a page with a button,
+// so link previews can't burn the token, and the password is revealed by POST one.
+func Claim(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if (r.Method != "GET") && (r.Method != "POST") {
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Allow", "GET, POST")
+		}
+		return writeErrorShort(w, cfg, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed", nil), nil
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/claim/")
+	if !db.IsClaimToken(token) {
+		return writeErrorShort(w, cfg, http.StatusNotFound, CodeNotFound, "not found", nil), nil
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Cache-Control", "no-store")
+	}
+	if r.Method == "GET" {
+		if cfg.APIOnly {
+			if httpWriter, ok := w.(http.ResponseWriter); ok {
+				httpWriter.Header().Set("Allow", "POST")
+			}
+			return writeErrorShort(w, cfg, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST request to reveal the password", nil), nil
+		}
+		err := cfg.Templates["claim"].Execute(w, &IndexData{Lang: language(r)})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusOK, nil
+	}
+	password, err := db.Claim(cfg.Db, token)
+	if err != nil {
+		return writeErrorShort(w, cfg, http.StatusInternalServerError, CodeServerError, "server error", nil), err
+	}
+	if password == "" {
+		return writeErrorShort(w, cfg, http.StatusNotFound, CodeNotFound, "not found", nil), nil
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	_, err = fmt.Fprintf(w, "Password: %v\n", password)
+	if err != nil {
+		return writeErrorShort(w, cfg, http.StatusInternalServerError, CodeServerError, "server error", nil), err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+)
+
+const (
+	// maxFetchRedirects is max number of redirects during a remote file download.
+	maxFetchRedirects = 5
+	// defaultFileName is a name of the stored file if it's unknown.
+	defaultFileName = "download"
+)
+
+var (
+	// errBlockedHost is an error of a remote address from private, loopback or link-local network.
+	errBlockedHost = &codeError{code: CodeForbidden, msg: "host is not allowed"}
+	// isFetchAllowed checks IP address of a remote file, it's replaced in tests to use a local server.
+	isFetchAllowed = isPublicIP
+)
+
+// isPublicIP returns true if ip is a global unicast address outside of private networks.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// fetchControl checks an already resolved address before a connection,
+// so DNS names and redirects can't lead to internal hosts.
+func fetchControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if (ip == nil) || !isFetchAllowed(ip) {
+		return errBlockedHost
+	}
+	return nil
+}
+
+// fetchClient returns HTTP client to download remote files,
+// environment proxy settings are ignored because the proxy address would be checked instead of the host.
+func fetchClient(cfg *conf.Cfg) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.HandleTimeout(), Control: fetchControl}
+	return &http.Client{
+		Timeout:   cfg.HandleTimeout(),
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return errors.New("too many redirects")
+			}
+			return validateFetchURL(req.URL)
+		},
+	}
+}
+
+// validateFetchURL checks a remote file URL, only absolute HTTP and HTTPS URLs are allowed.
+func validateFetchURL(u *url.URL) error {
+	if (u.Scheme != "http") && (u.Scheme != "https") {
+		return &codeError{code: CodeInvalidRequest, msg: "only http and https URLs are allowed"}
+	}
+	if u.Hostname() == "" {
+		return &codeError{code: CodeInvalidRequest, msg: "URL host is required"}
+	}
+	return nil
+}
+
+// fetchName returns a name of the remote file by the last segment of URL path.
+func fetchName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if !isFileName(name) {
+		return defaultFileName
+	}
+	return name
+}
+
+// fetchUpload downloads the remote file, encrypts it and saves the item.
+// It returns item's owner token and http status code, the encrypted file is not kept in the case of failure.
+func fetchUpload(ctx context.Context, u *url.URL, item *db.Item, secret, checksum string, cfg *conf.Cfg) (string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", http.StatusBadRequest, &codeError{code: CodeInvalidRequest, msg: "invalid URL"}
+	}
+	resp, err := fetchClient(cfg).Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedHost) {
+			return "", http.StatusForbidden, errBlockedHost
+		}
+		cfg.ErrLogger.Printf("fetch %v: %v", u.Redacted(), err)
+		return "", http.StatusBadGateway, &codeError{code: CodeFetchFailed, msg: "failed to download the file"}
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			cfg.ErrLogger.Printf("close remote body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("remote server returned status %v", resp.StatusCode)
+		return "", http.StatusBadGateway, &codeError{code: CodeFetchFailed, msg: msg}
+	}
+	maxSize := int64(cfg.MaxFileSize())
+	if resp.ContentLength == 0 {
+		return "", http.StatusBadRequest, errFileEmpty
+	}
+	if resp.ContentLength > maxSize {
+		return "", http.StatusRequestEntityTooLarge, errTooLarge
+	}
+	if resp.ContentLength > 0 {
+		code, err := checkQuota(resp.ContentLength, cfg)
+		if err != nil {
+			return "", code, err
+		}
+	}
+	if !cfg.Uploads.Acquire(ctx, concurrencyWait) {
+		return "", http.StatusServiceUnavailable, errBusy
+	}
+	defer cfg.Uploads.Release()
+	// one extra byte is read to detect too large file without Content-Length
+	body, scanned := scanStream(ctx, io.LimitReader(resp.Body, maxSize+1), cfg)
+	src, err := stripMetadata(body, cfg)
+	if err == nil {
+		err = item.EncryptContext(ctx, src, secret, cfg.ErrLogger)
+	}
+	code, scanErr := scanned(err)
+	if err != nil {
+		// a failed scan stops the encryption, a partially written file is already removed
+		if errors.Is(err, errScan) {
+			return "", code, scanErr
+		}
+		return "", http.StatusInternalServerError, err
+	}
+	if scanErr != nil {
+		if err := item.DeleteFile(); err != nil {
+			cfg.ErrLogger.Printf("remove refused file: %v", err)
+		}
+		return "", code, scanErr
+	}
+	// the stored image can be smaller than the original content
+	if src.size() > maxSize {
+		if err := item.DeleteFile(); err != nil {
+			cfg.ErrLogger.Printf("remove too large file: %v", err)
+		}
+		return "", http.StatusRequestEntityTooLarge, errTooLarge
+	}
+	if item.Size == 0 {
+		if err := item.DeleteFile(); err != nil {
+			cfg.ErrLogger.Printf("remove empty file: %v", err)
+		}
+		return "", http.StatusBadRequest, errFileEmpty
+	}
+	if checksum, err = verifyStripped(item, src, checksum, cfg); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	return saveItem(item, checksum, cfg)
+}
+
+// UploadURL downloads a file by "url" parameter, encrypts and saves it to the storage.
+// It has the same other fields as UploadShort method, a response content-type is "application/json".
+// Remote hosts from private, loopback and link-local networks are refused.
+func UploadURL(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if isMaintenance(cfg, true) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	if r.Method != "POST" {
+		return methodNotAllowed(w, cfg, "POST"), nil
+	}
+	httpWriter, _ := w.(http.ResponseWriter)
+	r.Body = http.MaxBytesReader(httpWriter, r.Body, formReserve)
+	u, err := url.Parse(r.PostFormValue("url"))
+	if err != nil {
+		err = &codeError{code: CodeInvalidRequest, msg: "invalid URL"}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	if err = validateFetchURL(u); err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	name := fetchName(u)
+	if !cfg.IsAllowedFile(name) {
+		err = &codeError{code: CodeFileNotAllowed, msg: fmt.Sprintf("file type of %v is not allowed", name)}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	item, password, err := validateUploadShort(r, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	item.Name = name
+	checksum, err := validateChecksum(r)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	if err = setUploader(w, r, item, cfg); err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	owner, code, err := fetchUpload(r.Context(), u, item, cfg.Secret(password, item.SaltVersion), checksum, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	return writeUploadResult(w, r, item, password, owner, cfg)
+}
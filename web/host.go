@@ -0,0 +1,41 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NormalizeHost returns a host name without port and IPv6 brackets in lower case.
+func NormalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// IsAllowedHost checks the host of generated links is in the allowed list, an empty list permits any host.
+// X-Forwarded-Host header is checked instead of Host one if it's set and proxy headers are trusted.
+func IsAllowedHost(r *http.Request, allowed []string, trustProxy bool) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	host := r.Host
+	if trustProxy {
+		if value := strings.TrimSpace(strings.SplitN(r.Header.Get("X-Forwarded-Host"), ",", 2)[0]); value != "" {
+			host = value
+		}
+	}
+	hostname := NormalizeHost(host)
+	for _, h := range allowed {
+		if NormalizeHost(h) == hostname {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+)
+
+// uploaderCookie is a name of the cookie with signed uploader session.
+const uploaderCookie = "unigma_uploader"
+
+// MineItem is JSON item of uploader's links list, passwords and names are never returned.
+type MineItem struct {
+	Hash    string    `json:"hash"`
+	Counter int       `json:"counter"`
+	Created time.Time `json:"created"`
+	Expired time.Time `json:"expired"`
+}
+
+// uploader returns a valid uploader session from the request cookie or an empty string.
+func uploader(r *http.Request, cfg *conf.Cfg) string {
+	cookie, err := r.Cookie(uploaderCookie)
+	if err != nil {
+		// no cookie
+		return ""
+	}
+	if !db.IsUploader(cookie.Value, cfg.SessionSecret()) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// setUploader links the item with the uploader session if sessions are enabled,
+// a new session is issued for the first upload. The cookie lives as long as the longest link.
+func setUploader(w io.Writer, r *http.Request, item *db.Item, cfg *conf.Cfg) error {
+	if cfg.SessionSecret() == nil {
+		return nil
+	}
+	value := uploader(r, cfg)
+	if value == "" {
+		v, err := db.NewUploader(cfg.SessionSecret())
+		if err != nil {
+			return err
+		}
+		value = v
+	}
+	item.SetUploader(value)
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		http.SetCookie(httpWriter, &http.Cookie{
+			Name:     uploaderCookie,
+			Value:    value,
+			Path:     cfg.URLPath("/"),
+			Expires:  time.Now().Add(time.Duration(cfg.Settings.TTL) * time.Second),
+			Secure:   cfg.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return nil
+}
+
+// Mine handles requests of the uploader session, "GET /mine" returns its active links
+// and "DELETE /mine/<hash>" revokes one of them.
+func Mine(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if cfg.SessionSecret() == nil {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	value := uploader(r, cfg)
+	path := strings.Trim(r.URL.Path, "/ ")
+	switch {
+	case (path == "mine") && (r.Method == "GET"):
+		return mineList(w, value, cfg)
+	case strings.HasPrefix(path, "mine/") && (r.Method == "DELETE"):
+		return mineRevoke(w, strings.TrimPrefix(path, "mine/"), value, cfg)
+	case (path == "mine") || strings.HasPrefix(path, "mine/"):
+		return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+	return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+}
+
+// mineList returns active links of the uploader session, it's empty without a session.
+func mineList(w io.Writer, value string, cfg *conf.Cfg) (int, error) {
+	result := make([]*MineItem, 0)
+	if value != "" {
+		items, err := db.ListUploader(cfg.Db, value, cfg.ErrLogger)
+		if err != nil {
+			return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+		}
+		for _, item := range items {
+			result = append(result, &MineItem{
+				Hash:    item.Hash,
+				Counter: item.Counter,
+				Created: item.Created,
+				Expired: item.Expired,
+			})
+		}
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+		httpWriter.Header().Set("Cache-Control", "no-store")
+	}
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// mineRevoke removes the item and its file if it belongs to the uploader session,
+// items of other sessions are not found.
+func mineRevoke(w io.Writer, hash, value string, cfg *conf.Cfg) (int, error) {
+	if !db.IsNameHash(hash) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	item, err := db.Read(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if (item.ID == 0) || !item.IsUploader(value) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	err = deleteItem(item, cfg)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.WriteHeader(http.StatusNoContent)
+	}
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+)
+
+// maxSessions is max number of open resumable upload sessions.
+const maxSessions = 1000
+
+// SessionResult is a JSON response for a new resumable upload session.
+type SessionResult struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Offset  int64     `json:"offset"`
+	Length  int64     `json:"length"`
+	Expired time.Time `json:"expired"`
+}
+
+// Resumable handles a tus-like resumable upload, its data is sent by chunks:
+// POST /api/uploads creates a session by "Upload-Length" header and optional "name" parameter,
+// HEAD /api/uploads/<id> returns already received bytes in "Upload-Offset" header,
+// PATCH /api/uploads/<id> appends the body from "Upload-Offset" position,
+// POST /api/uploads/<id>/finish encrypts the file, it has the same fields as UploadJSON method,
+// DELETE /api/uploads/<id> cancels the upload.
+func Resumable(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if isMaintenance(cfg, true) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	path := strings.Trim(r.URL.Path, "/ ")
+	if path == "api/uploads" {
+		if r.Method != "POST" {
+			return methodNotAllowed(w, cfg, "POST"), nil
+		}
+		return createSession(w, r, cfg)
+	}
+	id := strings.TrimPrefix(path, "api/uploads/")
+	finish := strings.HasSuffix(id, "/finish")
+	id = strings.TrimSuffix(id, "/finish")
+	if !db.IsSessionID(id) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	s, err := db.ReadSession(cfg.Db, id)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if s == nil {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	switch {
+	case finish && (r.Method == "POST"):
+		return finishSession(w, r, s, cfg)
+	case finish:
+		return methodNotAllowed(w, cfg, "POST"), nil
+	case r.Method == "HEAD":
+		setOffset(w, s)
+		return http.StatusOK, nil
+	case r.Method == "PATCH":
+		return appendSession(w, r, s, cfg)
+	case r.Method == "DELETE":
+		if err = s.Delete(cfg.Db); err != nil {
+			return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+		}
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.WriteHeader(http.StatusNoContent)
+		}
+		return http.StatusNoContent, nil
+	}
+	return methodNotAllowed(w, cfg, "HEAD, PATCH, DELETE"), nil
+}
+
+// methodNotAllowed sets JSON error response with allowed methods.
+func methodNotAllowed(w io.Writer, cfg *conf.Cfg, allow string) int {
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Allow", allow)
+	}
+	return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// setOffset sets headers with received and total bytes of the session, they are not cached.
+func setOffset(w io.Writer, s *db.Session) {
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		h := httpWriter.Header()
+		h.Set("Upload-Offset", strconv.FormatInt(s.Received, 10))
+		h.Set("Upload-Length", strconv.FormatInt(s.Total, 10))
+		h.Set("Cache-Control", "no-store")
+	}
+}
+
+// createSession starts a new resumable upload, the file size is checked before any data is sent.
+func createSession(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	total, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if (err != nil) || (total < 1) {
+		err = &codeError{code: CodeInvalidRequest, msg: "header Upload-Length should be a positive number"}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	if total > int64(cfg.MaxFileSize()) {
+		return errorAPI(w, cfg, http.StatusRequestEntityTooLarge, errTooLarge), errTooLarge
+	}
+	name := r.FormValue("name")
+	if len(name) > maxSealedName {
+		return ErrorJSON(w, cfg, http.StatusBadRequest, "name is too long"), nil
+	}
+	if name != "" {
+		name = filepath.Base(name)
+		if !isFileName(name) {
+			return errorAPI(w, cfg, http.StatusBadRequest, errFileName), errFileName
+		}
+		if !cfg.IsAllowedFile(name) {
+			err = &codeError{code: CodeFileNotAllowed, msg: fmt.Sprintf("file type of %v is not allowed", name)}
+			return errorAPI(w, cfg, http.StatusBadRequest, err), err
+		}
+	}
+	n, _, err := db.SessionsUsage(cfg.Db)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if n >= maxSessions {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errBusy), errBusy
+	}
+	code, err := checkQuota(total, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	s, err := db.NewSession(cfg.Db, name, total)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	result := &SessionResult{ID: s.ID, URL: cfg.URLPath("/api/uploads/" + s.ID), Length: s.Total, Expired: s.Expired}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		setOffset(w, s)
+		httpWriter.Header().Set("Location", result.URL)
+		httpWriter.Header().Set("Content-Type", "application/json")
+		httpWriter.WriteHeader(http.StatusCreated)
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
+
+// appendSession writes the request body to the session's file from "Upload-Offset" position.
+func appendSession(w io.Writer, r *http.Request, s *db.Session, cfg *conf.Cfg) (int, error) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		err = &codeError{code: CodeInvalidOffset, msg: "header Upload-Offset is required"}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	err = s.Append(cfg.Db, offset, r.Body)
+	switch err {
+	case nil:
+	case db.ErrSessionOffset:
+		setOffset(w, s)
+		err = &codeError{code: CodeInvalidOffset, msg: err.Error()}
+		return errorAPI(w, cfg, http.StatusConflict, err), err
+	case db.ErrSessionSize:
+		err = &codeError{code: CodeFileTooLarge, msg: err.Error()}
+		return errorAPI(w, cfg, http.StatusRequestEntityTooLarge, err), err
+	default:
+		// received bytes are kept, the client can resume from a new offset
+		setOffset(w, s)
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	setOffset(w, s)
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.WriteHeader(http.StatusNoContent)
+	}
+	return http.StatusNoContent, nil
+}
+
+// finishSession encrypts fully received session's file and saves the item,
+// the session is removed after that.
+func finishSession(w io.Writer, r *http.Request, s *db.Session, cfg *conf.Cfg) (int, error) {
+	if !s.IsComplete() {
+		setOffset(w, s)
+		err := &codeError{code: CodeIncomplete, msg: fmt.Sprintf("received %v of %v bytes", s.Received, s.Total)}
+		return errorAPI(w, cfg, http.StatusConflict, err), err
+	}
+	item, password, err := validateUploadShort(r, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	checksum, err := validateChecksum(r)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	if err = setUploader(w, r, item, cfg); err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	// the session's size is already reserved in the quota
+	code, err := checkQuota(0, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	f, err := os.Open(s.Path())
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			cfg.ErrLogger.Printf("close session file: %v", err)
+		}
+	}()
+	if code, err = scanFile(r.Context(), f, cfg); err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	item.Name = s.Name
+	if item.Name == "" {
+		item.Name = defaultFileName
+	}
+	src, err := stripMetadata(f, cfg)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if !cfg.Uploads.Acquire(r.Context(), concurrencyWait) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errBusy), errBusy
+	}
+	err = item.EncryptContext(r.Context(), src, cfg.Secret(password, item.SaltVersion), cfg.ErrLogger)
+	cfg.Uploads.Release()
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if checksum, err = verifyStripped(item, src, checksum, cfg); err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	owner, code, err := saveItem(item, checksum, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	if err = s.Delete(cfg.Db); err != nil {
+		// the session is removed by GC after its expiration
+		cfg.ErrLogger.Printf("delete upload session: %v", err)
+	}
+	return writeUploadResult(w, r, item, password, owner, cfg)
+}
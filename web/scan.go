@@ -0,0 +1,84 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/z0rr0/unigma/conf"
+)
+
+var (
+	// errInfected is an error of uploaded file which is refused by the antivirus.
+	errInfected = &codeError{code: CodeFileInfected, msg: "file is refused by the antivirus"}
+	// errScan is an error of unavailable antivirus, files are not stored without the check.
+	errScan = &codeError{code: CodeScanFailed, msg: "antivirus check is unavailable"}
+)
+
+// scanFile checks not encrypted data by the antivirus if it's enabled.
+// It returns http status code of a refused file.
+func scanFile(ctx context.Context, r io.Reader, cfg *conf.Cfg) (int, error) {
+	name, err := cfg.Scanner.Scan(ctx, r)
+	if err != nil {
+		cfg.ErrLogger.Printf("antivirus scan: %v", err)
+		return http.StatusServiceUnavailable, errScan
+	}
+	if name != "" {
+		cfg.ErrLogger.Printf("upload is infected by %v", name)
+		return http.StatusUnprocessableEntity, errInfected
+	}
+	return http.StatusOK, nil
+}
+
+// scanFiles checks every uploaded file before its encryption.
+func scanFiles(ctx context.Context, files []*multipart.FileHeader, cfg *conf.Cfg) (int, error) {
+	if cfg.Scanner == nil {
+		return http.StatusOK, nil
+	}
+	for _, h := range files {
+		f, err := h.Open()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		code, err := scanFile(ctx, f, cfg)
+		if e := f.Close(); e != nil {
+			cfg.ErrLogger.Printf("close scanned file: %v", e)
+		}
+		if err != nil {
+			return code, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// scanStream returns a reader which sends read data to the antivirus too, it's used if data can be read only once.
+// The returned function should be called after reading with its error, it returns a result of the check.
+func scanStream(ctx context.Context, r io.Reader, cfg *conf.Cfg) (io.Reader, func(error) (int, error)) {
+	if cfg.Scanner == nil {
+		return r, func(error) (int, error) { return http.StatusOK, nil }
+	}
+	type verdict struct {
+		code int
+		err  error
+	}
+	result := make(chan verdict, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		code, err := scanFile(ctx, pr, cfg)
+		// a failed scan stops the reading of data
+		pr.CloseWithError(err)
+		result <- verdict{code: code, err: err}
+	}()
+	wait := func(err error) (int, error) {
+		// nil error is the end of data
+		pw.CloseWithError(err)
+		v := <-result
+		return v.code, v.err
+	}
+	return io.TeeReader(r, pw), wait
+}
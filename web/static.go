@@ -0,0 +1,135 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/unigma/conf"
+)
+
+const (
+	// staticMaxAge is a cache period in seconds of the favicon and static files.
+	staticMaxAge = 7 * 24 * 3600
+	// faviconSize is a width and height of the default favicon.
+	faviconSize = 16
+)
+
+// favicon is PNG image of the default favicon, browsers accept it by "/favicon.ico" too.
+var favicon = newFavicon()
+
+// newFavicon draws a dark square with a light frame.
+func newFavicon() []byte {
+	m := image.NewRGBA(image.Rect(0, 0, faviconSize, faviconSize))
+	dark, light := color.RGBA{R: 0x33, G: 0x33, B: 0x33, A: 0xff}, color.RGBA{R: 0xee, G: 0xee, B: 0xee, A: 0xff}
+	for x := 0; x < faviconSize; x++ {
+		for y := 0; y < faviconSize; y++ {
+			c := dark
+			if (x == 2) || (y == 2) || (x == faviconSize-3) || (y == faviconSize-3) {
+				c = light
+			}
+			m.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		panic(fmt.Sprintf("favicon encoding: %v", err))
+	}
+	return buf.Bytes()
+}
+
+// staticCache sets cache headers of the favicon and static files.
+func staticCache(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", staticMaxAge))
+}
+
+// Favicon returns "favicon.ico" of the static directory if it exists or the default icon,
+// so browsers' requests don't get to the download handler.
+func Favicon(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if (r.Method != "GET") && (r.Method != "HEAD") {
+		return methodNotAllowed(w, cfg, "GET, HEAD"), nil
+	}
+	httpWriter, ok := w.(http.ResponseWriter)
+	if !ok {
+		_, err := w.Write(favicon)
+		return http.StatusOK, err
+	}
+	if cfg.StaticDir != "" {
+		found, err := serveStatic(httpWriter, r, filepath.Join(cfg.StaticDir, "favicon.ico"), cfg)
+		if err != nil {
+			return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+		}
+		if found {
+			return http.StatusOK, nil
+		}
+	}
+	staticCache(httpWriter)
+	httpWriter.Header().Set("Content-Type", "image/png")
+	http.ServeContent(httpWriter, r, "favicon.png", time.Time{}, bytes.NewReader(favicon))
+	return http.StatusOK, nil
+}
+
+// Static returns a file of the static directory by "/static/<name>" path,
+// only files of the directory itself are available, not of its subdirectories.
+func Static(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if (r.Method != "GET") && (r.Method != "HEAD") {
+		return methodNotAllowed(w, cfg, "GET, HEAD"), nil
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	httpWriter, ok := w.(http.ResponseWriter)
+	if (cfg.StaticDir == "") || !ok || !isStaticName(name) {
+		return Error(w, r, cfg, http.StatusNotFound, nil, ""), nil
+	}
+	found, err := serveStatic(httpWriter, r, filepath.Join(cfg.StaticDir, name), cfg)
+	if err != nil {
+		return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+	}
+	if !found {
+		return Error(w, r, cfg, http.StatusNotFound, nil, ""), nil
+	}
+	return http.StatusOK, nil
+}
+
+// isStaticName checks the name is a not hidden file name without a path.
+func isStaticName(name string) bool {
+	return (name != "") && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// serveStatic writes the file with its content type and cache headers,
+// nothing is written and false is returned if there is no such regular file.
+func serveStatic(w http.ResponseWriter, r *http.Request, name string, cfg *conf.Cfg) (bool, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			cfg.ErrLogger.Printf("close static file: %v", err)
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+	staticCache(w)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true, nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/z0rr0/unigma/conf"
+	"github.com/z0rr0/unigma/db"
+)
+
+const (
+	// stripBufferSize is a read buffer size of the metadata stripping, it's enough to sniff the content type.
+	stripBufferSize = 4096
+	// exifOrientation is EXIF tag of the image orientation.
+	exifOrientation = 0x0112
+)
+
+var (
+	// pngSignature starts every PNG image.
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	// pngMetadata are ancillary PNG chunks with text and time metadata, other chunks are kept.
+	pngMetadata = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+)
+
+// stripNext reads the next part of the image, it sets the filter's output or discards the metadata.
+type stripNext func(f *metadataFilter) error
+
+// metadataFilter is a streaming reader of the image without metadata. It's not decoded,
+// only metadata segments or chunks are skipped, so memory usage doesn't depend on the image size.
+// A not expected structure stops the filtering, the rest of the content is read as is.
+type metadataFilter struct {
+	r    *bufio.Reader
+	next stripNext
+	head []byte // already read bytes which should be returned
+	pass int64  // number of bytes which are copied as is after head
+	rest bool   // the rest of the content is copied as is
+	err  error
+}
+
+// Read implements io.Reader interface.
+func (f *metadataFilter) Read(p []byte) (int, error) {
+	for {
+		switch {
+		case len(f.head) > 0:
+			n := copy(p, f.head)
+			f.head = f.head[n:]
+			return n, nil
+		case f.pass > 0:
+			if int64(len(p)) > f.pass {
+				p = p[:f.pass]
+			}
+			n, err := f.r.Read(p)
+			f.pass -= int64(n)
+			return n, err
+		case f.rest:
+			return f.r.Read(p)
+		case f.err != nil:
+			return 0, f.err
+		}
+		f.err = f.next(f)
+	}
+}
+
+// tail returns partially read bytes of a truncated image as is.
+func (f *metadataFilter) tail(b []byte, err error) error {
+	if err == io.ErrUnexpectedEOF {
+		f.head, f.rest = b, true
+		return nil
+	}
+	return err
+}
+
+// jpegStart checks JPEG SOI marker.
+func jpegStart(f *metadataFilter) error {
+	b := make([]byte, 2)
+	if n, err := io.ReadFull(f.r, b); err != nil {
+		return f.tail(b[:n], err)
+	}
+	f.head, f.next = b, jpegSegment
+	return nil
+}
+
+// jpegSegment reads the next JPEG marker segment before the image data. APP0 (JFIF), APP2 (ICC profile)
+// and APP14 (Adobe color transform) segments are needed to show the image correctly, other application
+// segments and comments are removed. Only the orientation is kept from EXIF, so the image isn't rotated.
+func jpegSegment(f *metadataFilter) error {
+	b := make([]byte, 4)
+	if n, err := io.ReadFull(f.r, b[:2]); err != nil {
+		return f.tail(b[:n], err)
+	}
+	if b[0] != 0xFF {
+		f.head, f.rest = b[:2], true
+		return nil
+	}
+	marker := b[1]
+	switch {
+	case marker == 0xFF:
+		// a fill byte before the marker
+		return f.r.UnreadByte()
+	case (marker == 0xD9) || (marker == 0xDA):
+		// end of the image or start of the scan, metadata can't follow
+		f.head, f.rest = b[:2], true
+		return nil
+	case (marker == 0x01) || ((marker >= 0xD0) && (marker <= 0xD7)):
+		// markers without a length
+		f.head = b[:2]
+		return nil
+	}
+	if n, err := io.ReadFull(f.r, b[2:]); err != nil {
+		return f.tail(b[:2+n], err)
+	}
+	length := int64(binary.BigEndian.Uint16(b[2:]))
+	if length < 2 {
+		f.head, f.rest = b, true
+		return nil
+	}
+	isMetadata := (marker == 0xFE) || ((marker >= 0xE1) && (marker <= 0xEF) && (marker != 0xE2) && (marker != 0xEE))
+	if !isMetadata {
+		f.head, f.pass = b, length-2
+		return nil
+	}
+	if marker != 0xE1 {
+		_, err := f.r.Discard(int(length - 2))
+		return err
+	}
+	payload := make([]byte, length-2)
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// truncated metadata is removed too
+			return io.EOF
+		}
+		return err
+	}
+	if o := exifOrientationValue(payload); o > 1 {
+		f.head = orientationSegment(o)
+	}
+	return nil
+}
+
+// exifOrientationValue returns the orientation of EXIF payload of APP1 segment, it's zero if it's not found.
+func exifOrientationValue(payload []byte) uint16 {
+	const header = "Exif\x00\x00"
+	if !bytes.HasPrefix(payload, []byte(header)) {
+		return 0
+	}
+	tiff := payload[len(header):]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if (offset < 8) || (offset+2 > len(tiff)) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// SHORT value is in the first bytes of the value field
+		if (order.Uint16(tiff[entry:]) == exifOrientation) && (order.Uint16(tiff[entry+2:]) == 3) {
+			if o := order.Uint16(tiff[entry+8:]); o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationSegment returns APP1 segment with EXIF which contains only the orientation.
+func orientationSegment(orientation uint16) []byte {
+	segment := []byte{0xFF, 0xE1, 0, 34}
+	segment = append(segment, "Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08"...)
+	// one IFD entry: tag, SHORT type, count 1, value; then no next IFD
+	segment = append(segment, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation>>8), byte(orientation), 0, 0)
+	return append(segment, 0, 0, 0, 0)
+}
+
+// pngStart checks PNG signature.
+func pngStart(f *metadataFilter) error {
+	b := make([]byte, len(pngSignature))
+	if n, err := io.ReadFull(f.r, b); err != nil {
+		return f.tail(b[:n], err)
+	}
+	f.head, f.next = b, pngChunk
+	if !bytes.Equal(b, pngSignature) {
+		f.rest = true
+	}
+	return nil
+}
+
+// pngChunk reads the next PNG chunk, text, EXIF and time chunks are removed.
+func pngChunk(f *metadataFilter) error {
+	b := make([]byte, 8)
+	if n, err := io.ReadFull(f.r, b); err != nil {
+		return f.tail(b[:n], err)
+	}
+	// the data and CRC
+	size := int64(binary.BigEndian.Uint32(b[:4])) + 4
+	chunk := string(b[4:])
+	if pngMetadata[chunk] {
+		_, err := io.CopyN(ioutil.Discard, f.r, size)
+		return err
+	}
+	f.head, f.pass = b, size
+	f.rest = chunk == "IEND"
+	return nil
+}
+
+// strippedReader is a reader of the upload content without metadata, SHA-256 and a size
+// of the original content are calculated while it's read.
+type strippedReader struct {
+	io.Reader
+	h     hash.Hash
+	count *countReader
+}
+
+// countReader counts read bytes.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader interface.
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// size returns a size of the original content which is already read.
+func (sr *strippedReader) size() int64 {
+	return sr.count.n
+}
+
+// checksum compares the client's checksum with the original content of the image after its reading,
+// an empty value is returned in this case, because the stored content can be changed.
+// Other checksums are returned as is, they're checked with the stored content.
+func (sr *strippedReader) checksum(checksum string) (string, error) {
+	if (checksum == "") || (sr.h == nil) {
+		return checksum, nil
+	}
+	if checksum != hex.EncodeToString(sr.h.Sum(nil)) {
+		return "", errChecksum
+	}
+	return "", nil
+}
+
+// stripMetadata returns a reader of the content without EXIF and other metadata if stripping is enabled
+// and it's a JPEG or PNG image, the type is detected by the content, not by the file extension.
+// Images are not decoded, metadata is skipped while they're read. Other content is returned as is.
+func stripMetadata(r io.Reader, cfg *conf.Cfg) (*strippedReader, error) {
+	count := &countReader{r: r}
+	if !cfg.StripMetadata {
+		return &strippedReader{Reader: count, count: count}, nil
+	}
+	h := sha256.New()
+	br := bufio.NewReaderSize(io.TeeReader(count, h), stripBufferSize)
+	head, err := br.Peek(512)
+	if (err != nil) && (err != io.EOF) {
+		return nil, err
+	}
+	var next stripNext
+	switch http.DetectContentType(head) {
+	case "image/jpeg":
+		next = jpegStart
+	case "image/png":
+		next = pngStart
+	default:
+		return &strippedReader{Reader: br, count: count}, nil
+	}
+	return &strippedReader{Reader: &metadataFilter{r: br, next: next}, h: h, count: count}, nil
+}
+
+// verifyStripped checks the client's checksum of the encrypted upload with its original content,
+// the file is removed if they're different. It returns a checksum which should be compared with the stored content.
+func verifyStripped(item *db.Item, src *strippedReader, checksum string, cfg *conf.Cfg) (string, error) {
+	checksum, err := src.checksum(checksum)
+	if err != nil {
+		if e := item.DeleteFile(); e != nil {
+			cfg.ErrLogger.Printf("remove corrupted file: %v", e)
+		}
+	}
+	return checksum, err
+}
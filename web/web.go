@@ -3,25 +3,69 @@
 // by a MIT-style license that can be found in the LICENSE file.
 
 // Package web contains HTTP handlers methods.
-// There are 2 URLs:
+// The handlers serve the following URLs:
 // "/" - GET index page
 // "/upload" - POST save file and settings
-// "/<hash>" - GET and POST get file
+// "/u" - POST save file and settings, plain text response
+// "/api/upload" - POST save file and settings, JSON response
+// "/api/upload-sealed" - POST save client-side encrypted file with its salt and hash, JSON response
+// "/upload-url" - POST download a file by URL, save it with settings, JSON response
+// "/api/uploads" - POST create resumable upload session, JSON response
+// "/api/uploads/<id>" - HEAD, PATCH and DELETE resumable upload data
+// "/api/uploads/<id>/finish" - POST save resumable upload, JSON response
+// "/<hash>" - GET and POST get file, HEAD check the link is active
+// "/api/<hash>" - GET download requirement and POST get file, JSON errors
+// "/bulk" - POST get several files as one zip archive by JSON list of hash and password pairs
+// "/<hash>/info" - GET item's info without decryption, JSON response
+// "/<hash>/extend" - POST set new TTL and times by owner token, JSON response
+// "/<hash>/password" - POST change the password by owner token, JSON response with a new URL
+// "/claim/<token>" - GET reveal a generated password of the short upload only once, plain text response
+// "/mine" - GET active links of the uploader session cookie, JSON response
+// "/mine/<hash>" - DELETE revoke a link of the uploader session
+// "/metrics" - GET Prometheus metrics if they are enabled
+// "/favicon.ico" - GET favicon of the static directory or the default one
+// "/robots.txt" - GET rules which forbid crawling of all pages
+// "/static/<name>" - GET file of the static directory if it's set
+// "/health" - GET liveness check
+// "/ready" - GET readiness check of the database and storage
+// "/status" - GET number of active links, JSON response
+// "/admin/items" - GET items metadata, JSON response, admin token is required
+// "/admin/items/<hash>" - DELETE remove item, admin token is required
+// "/admin/maintenance" - GET and POST maintenance mode, JSON response, admin token is required
 package web
 
 import (
+	"archive/tar"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/z0rr0/unigma/conf"
 	"github.com/z0rr0/unigma/db"
+	"github.com/z0rr0/unigma/logging"
+	"github.com/z0rr0/unigma/metrics"
+	"github.com/z0rr0/unigma/page"
+	"github.com/z0rr0/unigma/webhook"
 )
 
 const (
@@ -29,80 +73,551 @@ const (
 	TTL = 86400
 	// Times is default times value
 	Times = 1
-	// PasswordLength is default password length in bytes for auto-generated ones.
-	PasswordLength = 8
+	// HeaderRemaining is a response header with a number of remaining downloads.
+	HeaderRemaining = "X-Unigma-Remaining"
+	// HeaderExpires is a response header with an expiration time in RFC3339 format.
+	HeaderExpires = "X-Unigma-Expires"
+	// HeaderResume is a response header with a token of the counted download,
+	// it's sent back by Range requests to resume the download without a new counting.
+	HeaderResume = "X-Unigma-Resume"
+	// formReserve is a reserve of request body size for not file form fields.
+	formReserve = 1 << 20
+	// maxSealedName is max length of client-side encrypted name.
+	maxSealedName = 1024
+	// maxLabel is max length of item's label in characters.
+	maxLabel = 256
+	// maxHint is max length of password hint in characters.
+	maxHint = 128
+	// maxFails is max value of failed passwords limit of one item.
+	maxFails = 100
+	// concurrencyWait is max time to wait a free slot of concurrent uploads or downloads.
+	concurrencyWait = 2 * time.Second
+)
+
+// Error codes of API responses, clients should check them instead of messages.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeInvalidFormat    = "invalid_format"
+	CodeInvalidTTL       = "invalid_ttl"
+	CodeInvalidTimes     = "invalid_times"
+	CodeInvalidPassword  = "invalid_password"
+	CodeInvalidLabel     = "invalid_label"
+	CodeInvalidHint      = "invalid_hint"
+	CodeInvalidMaxFails  = "invalid_max_fails"
+	CodeInvalidType      = "invalid_content_type"
+	CodePasswordRequired = "password_required"
+	CodeFileRequired     = "file_required"
+	CodeFileEmpty        = "file_empty"
+	CodeInvalidFileName  = "invalid_file_name"
+	CodeFileInfected     = "file_infected"
+	CodeScanFailed       = "scan_failed"
+	CodeFileTooLarge     = "file_too_large"
+	CodeFileNotAllowed   = "file_not_allowed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeInvalidOffset    = "invalid_offset"
+	CodeIncomplete       = "upload_incomplete"
+	CodeTooManyRequests  = "too_many_requests"
+	CodeStorageFull      = "storage_full"
+	CodeMaintenance      = "maintenance"
+	CodeServerError      = "server_error"
+	CodeFetchFailed      = "fetch_failed"
+	CodeServerBusy       = "server_busy"
+	CodeInvalidChecksum  = "invalid_sha256"
+	CodeChecksumMismatch = "checksum_mismatch"
+)
+
+var (
+	// errTooLarge is an error of too large uploaded file.
+	errTooLarge = &codeError{code: CodeFileTooLarge, msg: "file is too large"}
+	// errFileRequired is an error of missing file field.
+	errFileRequired = &codeError{code: CodeFileRequired, msg: "field file is required"}
+	// errFileEmpty is an error of zero-byte uploaded file.
+	errFileEmpty = &codeError{code: CodeFileEmpty, msg: "file is empty"}
+	// errFileName is an error of uploaded file without a name.
+	errFileName = &codeError{code: CodeInvalidFileName, msg: "file name is required"}
+	// errLimit is an error of exceeded failed attempts limit.
+	errLimit = &codeError{code: CodeTooManyRequests, msg: "too many failed attempts"}
+	// errQuota is an error of exceeded storage quota.
+	errQuota = &codeError{code: CodeStorageFull, msg: "storage is full"}
+	// errMaintenance is an error of the service maintenance.
+	errMaintenance = &codeError{code: CodeMaintenance, msg: "service is under maintenance"}
+	// errChecksum is an error of uploaded content which doesn't match the client's checksum.
+	errChecksum = &codeError{code: CodeChecksumMismatch, msg: "sha256 checksum doesn't match the uploaded file"}
+	// errBusy is an error of exceeded limit of concurrent uploads or downloads.
+	errBusy = &codeError{code: CodeServerBusy, msg: "server is busy, try again later"}
+	// errFileMissing is an error of item without a file, clients get the same message as for a failed password.
+	errFileMissing = errors.New("file not found")
+)
+
+// codeError is a client's error with a code of API response.
+type codeError struct {
+	code string
+	msg  string
+}
+
+// Error implements error interface.
+func (e *codeError) Error() string {
+	return e.msg
+}
+
+// fieldError is a validation error of the upload form field.
+type fieldError struct {
+	field string
+	err   error
+}
+
+// fieldErrors are validation errors of all invalid fields of the upload form,
+// so they can be shown at once instead of the first one.
+type fieldErrors []fieldError
+
+// add appends the error of the field if it's not nil.
+func (e *fieldErrors) add(field string, err error) {
+	if err != nil {
+		*e = append(*e, fieldError{field: field, err: err})
+	}
+}
+
+// Error implements error interface.
+func (e fieldErrors) Error() string {
+	return strings.Join(e.messages(), "; ")
+}
+
+// Unwrap returns the first error, so its code is used by API responses.
+func (e fieldErrors) Unwrap() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e[0].err
+}
+
+// messages returns messages of the errors in order of the form fields.
+func (e fieldErrors) messages() []string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.err.Error()
+	}
+	return msgs
+}
+
+// fields returns names of invalid fields.
+func (e fieldErrors) fields() map[string]bool {
+	fields := make(map[string]bool, len(e))
+	for _, fe := range e {
+		fields[fe.field] = true
+	}
+	return fields
+}
+
+// contextKey is a type of request context keys.
+type contextKey int
+
+// Request context keys.
+const (
+	// requestIDKey is a context key of request ID.
+	requestIDKey contextKey = iota
+	// logIPKey is a context key of client's IP address for the access log.
+	logIPKey
 )
 
 // IndexData is a struct for index page init data.
+// Limits of the upload form are the same as ones of the server-side validation.
 type IndexData struct {
-	Err     string
-	Msg     string
-	MaxSize int
+	Err          string
+	Msg          string
+	Msgs         []string
+	Invalid      map[string]bool
+	MaxSize      int
+	MaxTimes     int
+	MaxTTL       int
+	MaxHint      int
+	FileField    string
+	Hints        bool
+	Hint         string
+	RequestID    string
+	Lang         string
+	Notice       string
+	TTL          int
+	Presets      []conf.TTLPreset
+	Passwordless bool
+}
+
+// newIndexData returns index page data with the upload form limits of the settings.
+func newIndexData(lang string, cfg *conf.Cfg) *IndexData {
+	return &IndexData{
+		MaxSize:   cfg.MaxFileSize() >> 20,
+		MaxTimes:  cfg.Settings.Times,
+		MaxTTL:    cfg.Settings.TTL,
+		MaxHint:   maxHint,
+		FileField: cfg.Settings.FileField,
+		Hints:     cfg.AllowHints,
+		Lang:      lang,
+		Notice:    cfg.Notice,
+		TTL:       defaultTTL(cfg),
+		Presets:   ttlPresets(cfg),
+	}
+}
+
+// ttlPresets returns TTL choices of the index page which are in limits of min and max TTL,
+// the max TTL is the only choice if there are no such presets.
+func ttlPresets(cfg *conf.Cfg) []conf.TTLPreset {
+	presets := make([]conf.TTLPreset, 0, len(cfg.Settings.TTLPresets))
+	for _, p := range cfg.Settings.TTLPresets {
+		if (p.Seconds >= cfg.Settings.MinTTL) && (p.Seconds <= cfg.Settings.TTL) {
+			presets = append(presets, p)
+		}
+	}
+	if len(presets) == 0 {
+		presets = append(presets, conf.TTLPreset{Label: "index.ttl.max", Seconds: cfg.Settings.TTL})
+	}
+	return presets
+}
+
+// UploadResult is a JSON response for successful upload.
+type UploadResult struct {
+	URL      string    `json:"url"`
+	Expired  time.Time `json:"expired"`
+	Password string    `json:"password"`
+	Claim    string    `json:"claim_url,omitempty"`
+	Times    int       `json:"times"`
+	Owner    string    `json:"owner_token"`
+}
+
+// PasswordResult is a JSON response of the password change, the item's URL is changed with it.
+type PasswordResult struct {
+	URL     string    `json:"url"`
+	Expired time.Time `json:"expired"`
+}
+
+// AdminItem is item's non-secret metadata for administration.
+type AdminItem struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Counter int       `json:"counter"`
+	Label   string    `json:"label,omitempty"`
+	Created time.Time `json:"created"`
+	Expired time.Time `json:"expired"`
+}
+
+// MaintenanceResult is a JSON response of maintenance mode request.
+type MaintenanceResult struct {
+	Mode string `json:"mode"`
+}
+
+// InfoResult is a JSON response for item's info request.
+type InfoResult struct {
+	Remaining   int       `json:"remaining"`
+	Expired     time.Time `json:"expired"`
+	ContentType string    `json:"content_type"`
+}
+
+// StatusResult is a JSON response of public status, it contains only aggregated values.
+type StatusResult struct {
+	Active int `json:"active"`
+}
+
+// RequirementResult is a JSON response of API download request without data,
+// it describes what the download requires.
+type RequirementResult struct {
+	Requires string `json:"requires"`
+}
+
+// ErrorResult is a JSON response for failed request.
+type ErrorResult struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
 }
 
-// validateRange converts value to integer and checks that it is in a range [1; max].
-func validateRange(value, field string, max int) (int, error) {
+// validateRange converts value to integer and checks that it is in a range [min; max].
+// The error code is "invalid_<field>".
+func validateRange(value, field string, min, max int) (int, error) {
+	code := "invalid_" + field
 	n, err := strconv.Atoi(value)
 	if err != nil {
-		return 0, err
+		return 0, &codeError{code: code, msg: fmt.Sprintf("field %v=%v is not a number", field, value)}
 	}
-	if (n < 1) || (n > max) {
-		return 0, fmt.Errorf("field %v=%v but available range [%v - %v]", field, n, 1, max)
+	if (n < min) || (n > max) {
+		return 0, &codeError{code: code, msg: fmt.Sprintf("field %v=%v but available range [%v - %v]", field, n, min, max)}
 	}
 	return n, nil
 }
 
+// validatePassword checks a user's password by the settings policy.
+// A strong password should contain at least two kinds of characters:
+// lower case letters, upper case letters, digits or other symbols.
+func validatePassword(password string, cfg *conf.Cfg) error {
+	if n := utf8.RuneCountInString(password); n < cfg.Settings.MinPasswordLength {
+		msg := fmt.Sprintf("password is too short, min length is %v", cfg.Settings.MinPasswordLength)
+		return &codeError{code: CodeInvalidPassword, msg: msg}
+	}
+	if !cfg.Settings.StrongPassword {
+		return nil
+	}
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < 2 {
+		return &codeError{code: CodeInvalidPassword, msg: "password is too simple, use letters in different case, digits or symbols"}
+	}
+	return nil
+}
+
+// isFileName returns true if name can be used as a name of the stored file.
+func isFileName(name string) bool {
+	switch strings.TrimSpace(name) {
+	case "", ".", "..", "/":
+		return false
+	}
+	return true
+}
+
+// validateLabel returns optional item's label encrypted by the server key,
+// labels are refused if the key is not set.
+func validateLabel(r *http.Request, cfg *conf.Cfg) (string, error) {
+	label := strings.TrimSpace(r.PostFormValue("label"))
+	if label == "" {
+		return "", nil
+	}
+	key := cfg.LabelSecret()
+	if key == nil {
+		return "", &codeError{code: CodeInvalidLabel, msg: "labels are disabled"}
+	}
+	if utf8.RuneCountInString(label) > maxLabel {
+		return "", &codeError{code: CodeInvalidLabel, msg: fmt.Sprintf("label is too long, max length is %v", maxLabel)}
+	}
+	return db.EncryptLabel(label, key)
+}
+
+// validateHint returns optional plain text hint of the password, it's available only if hints are allowed.
+// The hint can't contain the password itself.
+func validateHint(r *http.Request, password string, cfg *conf.Cfg) (string, error) {
+	hint := strings.TrimSpace(r.PostFormValue("hint"))
+	if hint == "" {
+		return "", nil
+	}
+	if !cfg.AllowHints {
+		return "", &codeError{code: CodeInvalidHint, msg: "hints are disabled"}
+	}
+	if password == "" {
+		return "", &codeError{code: CodeInvalidHint, msg: "hint requires a password"}
+	}
+	if utf8.RuneCountInString(hint) > maxHint {
+		return "", &codeError{code: CodeInvalidHint, msg: fmt.Sprintf("hint is too long, max length is %v", maxHint)}
+	}
+	if strings.Contains(strings.ToLower(hint), strings.ToLower(password)) {
+		return "", &codeError{code: CodeInvalidHint, msg: "hint should not contain the password"}
+	}
+	return hint, nil
+}
+
+// validatePasswordless checks the upload requests a link without a password by "no_password" field,
+// it's available only if it's allowed, and user's or claimed password can't be set then.
+func validatePasswordless(r *http.Request, cfg *conf.Cfg) (bool, error) {
+	if r.PostFormValue("no_password") == "" {
+		return false, nil
+	}
+	if !cfg.AllowPasswordless {
+		return false, &codeError{code: CodeInvalidPassword, msg: "links without a password are disabled"}
+	}
+	if (r.PostFormValue("password") != "") || (r.PostFormValue("claim") != "") {
+		return false, &codeError{code: CodeInvalidPassword, msg: "password can't be set for a link without a password"}
+	}
+	return true, nil
+}
+
+// passwordlessKey returns the server key of the item's random password, it depends on the item's salt version.
+func passwordlessKey(item *db.Item, cfg *conf.Cfg) []byte {
+	return db.PasswordlessKey(cfg.Secret("", item.SaltVersion))
+}
+
+// itemPassword returns the password of the item, it's the request's one or the random one
+// of the item without a password.
+func itemPassword(item *db.Item, password string, cfg *conf.Cfg) (string, error) {
+	if !item.IsPasswordless() {
+		return password, nil
+	}
+	return item.PasswordlessPassword(passwordlessKey(item, cfg))
+}
+
+// validateMaxFails returns optional limit of failed passwords, zero value is no limit.
+func validateMaxFails(r *http.Request) (int, error) {
+	value := r.PostFormValue("max_fails")
+	if value == "" {
+		return 0, nil
+	}
+	return validateRange(value, "max_fails", 1, maxFails)
+}
+
+// validateChecksum returns optional hex encoded SHA-256 of the uploaded plain content.
+func validateChecksum(r *http.Request) (string, error) {
+	value := strings.ToLower(strings.TrimSpace(r.PostFormValue("sha256")))
+	if value == "" {
+		return "", nil
+	}
+	if b, err := hex.DecodeString(value); (err != nil) || (len(b) != sha256.Size) {
+		return "", &codeError{code: CodeInvalidChecksum, msg: "sha256 should be hex encoded SHA-256 checksum"}
+	}
+	return value, nil
+}
+
+// validateContentType returns optional content type which replaces the detected one by file extension,
+// its media type should be in the allowed list and only charset parameter is kept.
+func validateContentType(r *http.Request, cfg *conf.Cfg) (string, error) {
+	value := strings.TrimSpace(r.PostFormValue("content_type"))
+	if value == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", &codeError{code: CodeInvalidType, msg: "content_type is malformed"}
+	}
+	if !cfg.IsAllowedContentType(mediaType) {
+		return "", &codeError{code: CodeInvalidType, msg: fmt.Sprintf("content type %v is not allowed", mediaType)}
+	}
+	for name := range params {
+		if name != "charset" {
+			return "", &codeError{code: CodeInvalidType, msg: fmt.Sprintf("content type parameter %v is not allowed", name)}
+		}
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// validateFiles checks names of uploaded files, they are required and checked by allowed and blocked extensions.
+func validateFiles(r *http.Request, cfg *conf.Cfg) error {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	files := r.MultipartForm.File[cfg.Settings.FileField]
+	if len(files) == 0 {
+		// a part without a file name is parsed as a value, an empty one is a not selected file
+		for _, value := range r.MultipartForm.Value[cfg.Settings.FileField] {
+			if value != "" {
+				return errFileName
+			}
+		}
+	}
+	for _, h := range files {
+		name := filepath.Base(h.Filename)
+		if !isFileName(name) {
+			return errFileName
+		}
+		if !cfg.IsAllowedFile(name) {
+			return &codeError{code: CodeFileNotAllowed, msg: fmt.Sprintf("file type of %v is not allowed", name)}
+		}
+	}
+	return nil
+}
+
+// validateUpload checks all fields of the upload form, an error is fieldErrors of every invalid field.
 func validateUpload(r *http.Request, cfg *conf.Cfg) (*db.Item, string, error) {
+	var (
+		errs         fieldErrors
+		ttl, counter int
+		err          error
+	)
 	// TTL
 	value := r.PostFormValue("ttl")
 	if value == "" {
-		return nil, "", errors.New("required field TTL")
-	}
-	ttl, err := validateRange(value, "ttl", cfg.Settings.TTL)
-	if err != nil {
-		return nil, "", err
+		err = &codeError{code: CodeInvalidTTL, msg: "required field TTL"}
+	} else {
+		ttl, err = validateRange(value, "ttl", cfg.Settings.MinTTL, cfg.Settings.TTL)
 	}
+	errs.add("ttl", err)
 	// times
 	value = r.PostFormValue("times")
 	if value == "" {
-		return nil, "", errors.New("required field times")
-	}
-	counter, err := validateRange(value, "times", cfg.Settings.Times)
-	if err != nil {
-		return nil, "", err
+		err = &codeError{code: CodeInvalidTimes, msg: "required field times"}
+	} else {
+		counter, err = validateRange(value, "times", 1, cfg.Settings.Times)
 	}
+	errs.add("times", err)
 	// password
+	noPassword, err := validatePasswordless(r, cfg)
+	errs.add("password", err)
 	password := r.PostFormValue("password")
-	if password == "" {
-		return nil, "", errors.New("required field password")
+	if (err == nil) && !noPassword {
+		if password == "" {
+			errs.add("password", &codeError{code: CodePasswordRequired, msg: "required field password"})
+		} else {
+			errs.add("password", validatePassword(password, cfg))
+		}
+	}
+	errs.add("file", validateFiles(r, cfg))
+	label, err := validateLabel(r, cfg)
+	errs.add("label", err)
+	hint, err := validateHint(r, password, cfg)
+	errs.add("hint", err)
+	fails, err := validateMaxFails(r)
+	errs.add("max_fails", err)
+	contentType, err := validateContentType(r, cfg)
+	errs.add("content_type", err)
+	if len(errs) > 0 {
+		return nil, "", errs
 	}
 	now := time.Now().UTC()
 	item := &db.Item{
-		Counter: counter,
-		Path:    cfg.StorageDir,
-		Created: now,
-		Expired: now.Add(time.Duration(ttl) * time.Second),
+		Label:       label,
+		Hint:        hint,
+		MaxFails:    fails,
+		MIME:        contentType,
+		Counter:     counter,
+		Iter:        cfg.Settings.Iterations,
+		Path:        cfg.StorageDir,
+		Confirm:     r.PostFormValue("confirm") != "",
+		Compressed:  cfg.Compress,
+		SaltVersion: cfg.SaltVersion,
+		Storage:     cfg.Backend,
+		Dedup:       cfg.Dedup,
+		Created:     now,
+		Expired:     now.Add(time.Duration(ttl) * time.Second),
+	}
+	if noPassword {
+		password, err = item.NewPasswordless(passwordlessKey(item, cfg))
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	return item, cfg.Secret(password), nil
+	return item, cfg.Secret(password, item.SaltVersion), nil
 }
 
-func validateUploadShort(r *http.Request, cfg *conf.Cfg) (*db.Item, string, error) {
+// defaultTTL returns TTL value which is used if it's not set, it's in limits of min and max settings.
+func defaultTTL(cfg *conf.Cfg) int {
+	switch {
+	case TTL > cfg.Settings.TTL:
+		return cfg.Settings.TTL
+	case TTL < cfg.Settings.MinTTL:
+		return cfg.Settings.MinTTL
+	}
+	return TTL
+}
+
+// validateLimits returns optional TTL and times values or their defaults.
+func validateLimits(r *http.Request, cfg *conf.Cfg) (int, int, error) {
 	var (
 		ttl, times int
-		password   string
 		err        error
 	)
 	// TTL
 	value := r.PostFormValue("ttl")
 	if value == "" {
-		ttl = TTL
-		if ttl > cfg.Settings.TTL {
-			ttl = cfg.Settings.TTL
-		}
+		ttl = defaultTTL(cfg)
 	} else {
-		ttl, err = validateRange(value, "ttl", cfg.Settings.TTL)
+		ttl, err = validateRange(value, "ttl", cfg.Settings.MinTTL, cfg.Settings.TTL)
 		if err != nil {
-			return nil, "", err
+			return 0, 0, err
 		}
 	}
 	// times
@@ -110,109 +625,210 @@ func validateUploadShort(r *http.Request, cfg *conf.Cfg) (*db.Item, string, erro
 	if value == "" {
 		times = Times
 	} else {
-		times, err = validateRange(value, "times", cfg.Settings.Times)
+		times, err = validateRange(value, "times", 1, cfg.Settings.Times)
 		if err != nil {
-			return nil, "", err
+			return 0, 0, err
 		}
 	}
+	return ttl, times, nil
+}
+
+func validateUploadShort(r *http.Request, cfg *conf.Cfg) (*db.Item, string, error) {
+	ttl, times, err := validateLimits(r, cfg)
+	if err != nil {
+		return nil, "", err
+	}
 	// password
-	password = r.PostFormValue("password")
-	if password == "" {
-		r := make([]byte, PasswordLength)
+	noPassword, err := validatePasswordless(r, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	password := r.PostFormValue("password")
+	switch {
+	case noPassword:
+		// the random password is generated with the item
+	case password == "":
+		r := make([]byte, cfg.Settings.AutoPasswordLength)
 		_, err := rand.Read(r)
 		if err != nil {
 			return nil, "", err
 		}
 		password = hex.EncodeToString(r)
+	default:
+		// the policy is only for user's passwords
+		err = validatePassword(password, cfg)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err = validateFiles(r, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	label, err := validateLabel(r, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	// a hint is only for user's passwords
+	hint, err := validateHint(r, r.PostFormValue("password"), cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	fails, err := validateMaxFails(r)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType, err := validateContentType(r, cfg)
+	if err != nil {
+		return nil, "", err
 	}
 	now := time.Now().UTC()
 	item := &db.Item{
-		Counter: times,
-		Path:    cfg.StorageDir,
-		Created: now,
-		Expired: now.Add(time.Duration(ttl) * time.Second),
+		Label:       label,
+		Hint:        hint,
+		MaxFails:    fails,
+		MIME:        contentType,
+		Counter:     times,
+		Iter:        cfg.Settings.Iterations,
+		Path:        cfg.StorageDir,
+		Confirm:     r.PostFormValue("confirm") != "",
+		Compressed:  cfg.Compress,
+		SaltVersion: cfg.SaltVersion,
+		Storage:     cfg.Backend,
+		Dedup:       cfg.Dedup,
+		Created:     now,
+		Expired:     now.Add(time.Duration(ttl) * time.Second),
+	}
+	if noPassword {
+		password, err = item.NewPasswordless(passwordlessKey(item, cfg))
+		if err != nil {
+			return nil, "", err
+		}
 	}
 	return item, password, nil
 }
 
 func validateDownload(item *db.Item, r *http.Request, cfg *conf.Cfg) ([]byte, error) {
-	password := r.PostFormValue("password")
+	password, err := itemPassword(item, r.PostFormValue("password"), cfg)
+	if err != nil {
+		return nil, err
+	}
 	if password == "" {
 		return nil, errors.New("required password")
 	}
-	if !item.IsFileExists() {
-		return nil, errors.New("file not found")
-	}
-	key, err := item.IsValidSecret(cfg.Secret(password))
+	// the key is derived before the file check, so a missing file
+	// and a failed password take similar time and can't be distinguished
+	key, err := item.IsValidSecret(cfg.Secret(password, item.SaltVersion))
 	if err != nil {
 		return nil, err
 	}
+	if !item.IsFileExists() {
+		return nil, errFileMissing
+	}
 	return key, nil
 }
 
-// Error sets error page. It returns http status code.
-func Error(w io.Writer, cfg *conf.Cfg, code int, msg string, tplName string) int {
-	if tplName == "" {
-		tplName = "error"
-	}
-	title := "Error"
-	httpWriter, ok := w.(http.ResponseWriter)
-	if ok {
-		httpWriter.WriteHeader(code)
+// limitUpload limits a request body size by max file size with a reserve for other form fields,
+// and parses the multipart form. It returns errTooLarge if the limit is exceeded.
+func limitUpload(w io.Writer, r *http.Request, cfg *conf.Cfg) error {
+	httpWriter, _ := w.(http.ResponseWriter)
+	r.Body = http.MaxBytesReader(httpWriter, r.Body, int64(cfg.MaxFileSize())+formReserve)
+	err := r.ParseMultipartForm(cfg.Settings.MultipartMemory)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return errTooLarge
 	}
-	switch code {
-	case http.StatusNotFound:
-		title, msg = "Not found", "Page not found"
-	case http.StatusBadRequest:
-		if msg == "" {
-			msg = "Failed validation data"
+	// other errors are checked during fields validation
+	return nil
+}
+
+// writeArchive writes all uploaded files to w as one tar archive.
+func writeArchive(w io.Writer, files []*multipart.FileHeader) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, h := range files {
+		hdr := &tar.Header{
+			Name:    filepath.Base(h.Filename),
+			Mode:    0600,
+			Size:    h.Size,
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := h.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
 		}
-	default:
-		msg = "Sorry, it is an error"
-	}
-	tpl := cfg.Templates[tplName]
-	err := tpl.Execute(w, &IndexData{Err: title, Msg: msg})
-	if err != nil {
-		cfg.ErrLogger.Printf("error-template '%v' execute failed: %v\n", tplName, err)
-		return http.StatusInternalServerError
 	}
-	return code
+	return tw.Close()
 }
 
-// ErrorUploadShort sets error response. It returns http status code.
-func ErrorUploadShort(w io.Writer, cfg *conf.Cfg, code int, msg string) int {
-	httpWriter, ok := w.(http.ResponseWriter)
-	if ok {
-		httpWriter.WriteHeader(code)
-	}
-	cfg.ErrLogger.Println(msg)
-	_, err := fmt.Fprintf(w, "ERROR: %v\n", msg)
-	if err != nil {
-		cfg.ErrLogger.Printf("error preparation: %v\n", err)
-		return http.StatusInternalServerError
+// openUpload returns a reader of the uploaded data and its name.
+// Several files are joined to one tar archive on the fly.
+func openUpload(files []*multipart.FileHeader) (io.ReadCloser, string, error) {
+	if len(files) == 1 {
+		f, err := files[0].Open()
+		if err != nil {
+			return nil, "", err
+		}
+		return f, files[0].Filename, nil
 	}
-	return code
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, files))
+	}()
+	return pr, fmt.Sprintf("archive-%d-files.tar", len(files)), nil
 }
 
-// Index is a index page HTTP handler.
-func Index(w io.Writer, _ *http.Request, cfg *conf.Cfg) (int, error) {
-	tpl := cfg.Templates["index"]
-	err := tpl.Execute(w, IndexData{MaxSize: cfg.Settings.Size})
+// storeUpload encrypts the uploaded file and saves the item.
+// It returns item's owner token and http status code,
+// the encrypted file is not kept in the case of failure.
+func storeUpload(r *http.Request, item *db.Item, secret string, cfg *conf.Cfg) (string, int, error) {
+	checksum, err := validateChecksum(r)
 	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", "error"), err
+		return "", http.StatusBadRequest, err
 	}
-	return http.StatusOK, nil
-}
-
-// Upload gets an incoming upload request, encrypts and saves file to the storage.
-func Upload(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
-	item, secret, err := validateUpload(r, cfg)
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File[cfg.Settings.FileField]
+	}
+	if len(files) == 0 {
+		return "", http.StatusBadRequest, errFileRequired
+	}
+	if (checksum != "") && (len(files) > 1) {
+		// several files are stored as an archive, its checksum is unknown for the client
+		return "", http.StatusBadRequest, &codeError{code: CodeInvalidChecksum, msg: "sha256 is supported only for a single file"}
+	}
+	var total int64
+	for _, h := range files {
+		total += h.Size
+	}
+	if total == 0 {
+		return "", http.StatusBadRequest, errFileEmpty
+	}
+	maxSize := int64(cfg.MaxFileSize())
+	if total > maxSize {
+		return "", http.StatusRequestEntityTooLarge, errTooLarge
+	}
+	code, err := checkQuota(total, cfg)
+	if err != nil {
+		return "", code, err
+	}
+	code, err = scanFiles(r.Context(), files, cfg)
 	if err != nil {
-		return Error(w, cfg, http.StatusBadRequest, err.Error(), "index"), err
+		return "", code, err
 	}
-	f, h, err := r.FormFile("file")
+	f, name, err := openUpload(files)
 	if err != nil {
-		return Error(w, cfg, http.StatusBadRequest, "field file is required", "index"), err
+		return "", http.StatusInternalServerError, err
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
@@ -222,106 +838,1656 @@ func Upload(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
 			cfg.ErrLogger.Printf("close incoming file: %v", err)
 		}
 	}()
-	item.Name = h.Filename
-	err = item.Encrypt(f, secret, cfg.ErrLogger)
-	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", ""), err
+	item.Name = name
+	if !cfg.Uploads.Acquire(r.Context(), concurrencyWait) {
+		return "", http.StatusServiceUnavailable, errBusy
 	}
-	err = item.Save(cfg.Db)
-	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", ""), err
+	defer cfg.Uploads.Release()
+	// one extra byte is read to detect too large file,
+	// an archive has service headers, so it's checked only by files sizes
+	if len(files) > 1 {
+		err = item.EncryptContext(r.Context(), f, secret, cfg.ErrLogger)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		return saveItem(item, checksum, cfg)
 	}
-	tpl := cfg.Templates["result"]
-	err = tpl.Execute(w, map[string]string{"URL": item.GetURL(r, cfg.Secure).String()})
+	src, err := stripMetadata(io.LimitReader(f, maxSize+1), cfg)
 	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", ""), err
+		return "", http.StatusInternalServerError, err
 	}
-	return http.StatusOK, nil
-}
-
-// UploadShort gets an incoming upload request, encrypts and saves file to the storage.
-// It differs from Upload method, only file field is required, a response content-type is "plain/text".
-func UploadShort(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
-	item, password, err := validateUploadShort(r, cfg)
+	err = item.EncryptContext(r.Context(), src, secret, cfg.ErrLogger)
 	if err != nil {
-		return ErrorUploadShort(w, cfg, http.StatusBadRequest, err.Error()), err
+		return "", http.StatusInternalServerError, err
 	}
-	f, h, err := r.FormFile("file")
-	if err != nil {
-		return ErrorUploadShort(w, cfg, http.StatusBadRequest, "field file is required"), err
+	// the stored image can be smaller than the original content
+	if src.size() > maxSize {
+		if err := item.DeleteFile(); err != nil {
+			cfg.ErrLogger.Printf("remove too large file: %v", err)
+		}
+		return "", http.StatusRequestEntityTooLarge, errTooLarge
+	}
+	if checksum, err = verifyStripped(item, src, checksum, cfg); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	return saveItem(item, checksum, cfg)
+}
+
+// saveItem saves already encrypted item with a new owner token, not empty checksum
+// is compared with the plain content one. It returns the owner token and http status code,
+// the file is removed in the case of failure.
+func saveItem(item *db.Item, checksum string, cfg *conf.Cfg) (string, int, error) {
+	if (checksum != "") && (checksum != item.ContentChecksum()) {
+		if err := item.DeleteFile(); err != nil {
+			cfg.ErrLogger.Printf("remove corrupted file: %v", err)
+		}
+		return "", http.StatusBadRequest, errChecksum
+	}
+	owner, err := item.NewOwner()
+	if err != nil {
+		if e := item.DeleteFile(); e != nil {
+			cfg.ErrLogger.Printf("remove not saved file: %v", e)
+		}
+		return "", http.StatusInternalServerError, err
+	}
+	err = item.Save(cfg.Db)
+	if err != nil {
+		// no database record, so GC can't find the file later
+		if e := item.DeleteFile(); e != nil {
+			cfg.ErrLogger.Printf("remove not saved file: %v", e)
+		}
+		return "", http.StatusInternalServerError, err
+	}
+	cfg.SizeCache.Add(item.Size)
+	cfg.Collector.Upload(item.Size)
+	return owner, http.StatusOK, nil
+}
+
+// checkQuota returns an error if new data of size bytes exceeds the storage quota,
+// declared sizes of open resumable upload sessions are reserved in it.
+func checkQuota(size int64, cfg *conf.Cfg) (int, error) {
+	if cfg.Settings.MaxStorageBytes < 1 {
+		return http.StatusOK, nil
+	}
+	used, err := cfg.SizeCache.Get(cfg.Db)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	_, reserved, err := db.SessionsUsage(cfg.Db)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if used+reserved+size > cfg.Settings.MaxStorageBytes {
+		return http.StatusInsufficientStorage, errQuota
+	}
+	return http.StatusOK, nil
+}
+
+// isMaintenance returns true if the request is not available in current maintenance mode,
+// write requests are refused in read-only mode and all ones in full mode.
+func isMaintenance(cfg *conf.Cfg, write bool) bool {
+	switch cfg.Maintenance() {
+	case conf.MaintenanceFull:
+		return true
+	case conf.MaintenanceReadOnly:
+		return write
+	}
+	return false
+}
+
+// clientError returns an error message for a client, internal errors are hidden.
+func clientError(code int, err error) string {
+	switch code {
+	case http.StatusBadGateway, http.StatusInsufficientStorage, http.StatusServiceUnavailable:
+		return err.Error()
+	}
+	if code >= http.StatusInternalServerError {
+		return "server error"
+	}
+	return err.Error()
+}
+
+// NewRequestID returns new random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// very unlikely, time is unique enough for logs correlation
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a shallow copy of the request with the ID in its context.
+func WithRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// language returns a language of UI strings by Accept-Language header.
+func language(r *http.Request) string {
+	if r == nil {
+		return page.DefaultLang
+	}
+	return page.Lang(r.Header.Get("Accept-Language"))
+}
+
+// WithLogIP returns a shallow copy of the request with client's IP address for the access log in its context,
+// the address is truncated or isn't set by log_client_ip mode.
+func WithLogIP(r *http.Request, cfg *conf.Cfg) *http.Request {
+	var ip string
+	switch cfg.LogClientIP {
+	case logging.ClientIPFull:
+		ip = clientIP(r, cfg.Proxy)
+	case logging.ClientIPTruncated:
+		ip = logging.TruncateIP(clientIP(r, cfg.Proxy))
+	default:
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), logIPKey, ip))
+}
+
+// LogIP returns client's IP address for the access log from the request context, it's empty if it isn't set.
+func LogIP(r *http.Request) string {
+	ip, _ := r.Context().Value(logIPKey).(string)
+	return ip
+}
+
+// RequestID returns request ID from the request context, it's empty if it isn't set.
+func RequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// errorPage writes an error response of a download request, tplName is used only by HTML pages.
+type errorPage func(w io.Writer, r *http.Request, cfg *conf.Cfg, code int, err error, tplName string) int
+
+// errorDownloadJSON is errorPage of API download requests, a message of nil error is set by http status.
+func errorDownloadJSON(w io.Writer, _ *http.Request, cfg *conf.Cfg, code int, err error, _ string) int {
+	if err == nil {
+		return ErrorJSON(w, cfg, code, strings.ToLower(http.StatusText(code)))
+	}
+	return writeErrorJSON(w, cfg, code, errorCode(code, err), err.Error(), err)
+}
+
+// retryAfter sets Retry-After header in seconds, a part of second is rounded up.
+func retryAfter(w io.Writer, d time.Duration) {
+	httpWriter, ok := w.(http.ResponseWriter)
+	if !ok || (d <= 0) {
+		return
+	}
+	seconds := int64((d + time.Second - 1) / time.Second)
+	httpWriter.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// setRetryAfter sets default Retry-After header of rate limited and unavailable service responses,
+// a handler can set a more precise value before. The delay of unavailable service depends on its error.
+func setRetryAfter(w http.ResponseWriter, status int, err error, cfg *conf.Cfg) {
+	if w.Header().Get("Retry-After") != "" {
+		return
+	}
+	switch status {
+	case http.StatusTooManyRequests:
+		retryAfter(w, cfg.Limiter.Period())
+	case http.StatusServiceUnavailable:
+		_, delay := unavailable(err, cfg)
+		retryAfter(w, delay)
+	}
+}
+
+// unavailable returns a page localization key and Retry-After delay of "503 Service Unavailable" response
+// by its error, unknown reasons get a common page.
+func unavailable(err error, cfg *conf.Cfg) (string, time.Duration) {
+	switch {
+	case errors.Is(err, errBusy):
+		return "busy", concurrencyWait
+	case errors.Is(err, errScan):
+		return "scan_unavailable", cfg.MaintenanceDelay()
+	case errors.Is(err, errMaintenance):
+		return "maintenance", cfg.MaintenanceDelay()
+	}
+	return "unavailable", cfg.MaintenanceDelay()
+}
+
+// Error sets error page, it's JSON response in API-only mode. A message of err is shown
+// only for bad requests, its type also chooses the page of unavailable service. It returns http status code.
+func Error(w io.Writer, r *http.Request, cfg *conf.Cfg, code int, err error, tplName string) int {
+	var msgs []string
+	if err != nil {
+		msgs = []string{err.Error()}
+	}
+	return renderError(w, r, cfg, code, tplName, err, msgs, nil)
+}
+
+// errorFields sets bad request response of the upload form with messages of all invalid fields,
+// the fields are marked by the index page. It returns http status code.
+func errorFields(w io.Writer, r *http.Request, cfg *conf.Cfg, errs fieldErrors) int {
+	return renderError(w, r, cfg, http.StatusBadRequest, "index", errs, errs.messages(), errs.fields())
+}
+
+// renderError is Error with several messages of err and invalid fields of the form.
+func renderError(w io.Writer, r *http.Request, cfg *conf.Cfg, code int, tplName string, err error, msgs []string, invalid map[string]bool) int {
+	if cfg.APIOnly {
+		// there are no HTML templates
+		msg := strings.Join(msgs, "; ")
+		if msg == "" {
+			msg = strings.ToLower(http.StatusText(code))
+		}
+		return writeErrorJSON(w, cfg, code, errorCode(code, err), msg, err)
+	}
+	if tplName == "" {
+		tplName = "error"
+	}
+	lang := language(r)
+	title := page.T(lang, "error")
+	httpWriter, ok := w.(http.ResponseWriter)
+	if ok {
+		setRetryAfter(httpWriter, code, err, cfg)
+		httpWriter.WriteHeader(code)
+	}
+	switch code {
+	case http.StatusNotFound:
+		title, msgs = page.T(lang, "not_found"), []string{page.T(lang, "not_found.message")}
+	case http.StatusBadRequest:
+		if len(msgs) == 0 {
+			msgs = []string{page.T(lang, "bad_request.message")}
+		}
+	case http.StatusMethodNotAllowed:
+		title = page.T(lang, "method_not_allowed")
+		msgs = []string{title}
+	case http.StatusTooManyRequests:
+		title, msgs = page.T(lang, "too_many_requests"), []string{page.T(lang, "too_many_requests.message")}
+	case http.StatusRequestEntityTooLarge:
+		title, msgs = page.T(lang, "too_large"), []string{fmt.Sprintf(page.T(lang, "too_large.message"), cfg.Settings.Size)}
+	case http.StatusInsufficientStorage:
+		title, msgs = page.T(lang, "storage_full"), []string{page.T(lang, "storage_full.message")}
+	case http.StatusServiceUnavailable:
+		key, _ := unavailable(err, cfg)
+		title, msgs = page.T(lang, key), []string{page.T(lang, key+".message")}
+	default:
+		msgs = []string{page.T(lang, "error.message")}
+	}
+	tpl := cfg.Templates[tplName]
+	data := newIndexData(lang, cfg)
+	data.Err, data.RequestID = title, RequestID(r)
+	// Msg is kept for templates which show one message
+	data.Msg, data.Msgs, data.Invalid = strings.Join(msgs, "; "), msgs, invalid
+	if e := tpl.Execute(w, data); e != nil {
+		cfg.ErrLogger.Printf("error-template '%v' execute failed: %v\n", tplName, e)
+		return http.StatusInternalServerError
+	}
+	return code
+}
+
+// ErrorUploadShort sets error response, its error code is set by http status. It returns http status code.
+func ErrorUploadShort(w io.Writer, cfg *conf.Cfg, code int, msg string) int {
+	return writeErrorShort(w, cfg, code, errorCode(code, nil), msg, nil)
+}
+
+// ErrorJSON sets JSON error response, its error code is set by http status. It returns http status code.
+func ErrorJSON(w io.Writer, cfg *conf.Cfg, code int, msg string) int {
+	return writeErrorJSON(w, cfg, code, errorCode(code, nil), msg, nil)
+}
+
+// errorAPI sets JSON error response by err, a message of internal errors is hidden.
+func errorAPI(w io.Writer, cfg *conf.Cfg, status int, err error) int {
+	return writeErrorJSON(w, cfg, status, errorCode(status, err), clientError(status, err), err)
+}
+
+// errorShort sets error response of the short upload by err in the requested format,
+// a message of internal errors is hidden.
+func errorShort(w io.Writer, cfg *conf.Cfg, format string, status int, err error) int {
+	if format == conf.ShortJSON {
+		return errorAPI(w, cfg, status, err)
+	}
+	return writeErrorShort(w, cfg, status, errorCode(status, err), clientError(status, err), err)
+}
+
+// errorCode returns a code of API error response, it's taken from err or set by http status.
+func errorCode(status int, err error) string {
+	var ce *codeError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeFileTooLarge
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	case http.StatusInsufficientStorage:
+		return CodeStorageFull
+	case http.StatusServiceUnavailable:
+		return CodeMaintenance
+	case http.StatusBadGateway:
+		return CodeFetchFailed
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeServerError
+	}
+	return CodeInvalidRequest
+}
+
+// writeErrorShort writes plain text error response with its code, reason is an optional error of the response.
+// It returns http status code.
+func writeErrorShort(w io.Writer, cfg *conf.Cfg, status int, code, msg string, reason error) int {
+	httpWriter, ok := w.(http.ResponseWriter)
+	if ok {
+		setRetryAfter(httpWriter, status, reason, cfg)
+		httpWriter.WriteHeader(status)
+	}
+	cfg.ErrLogger.Println(msg)
+	_, err := fmt.Fprintf(w, "ERROR: %v\nCode: %v\n", msg, code)
+	if err != nil {
+		cfg.ErrLogger.Printf("error preparation: %v\n", err)
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// writeErrorJSON writes JSON error response with its code, reason is an optional error of the response.
+// It returns http status code.
+func writeErrorJSON(w io.Writer, cfg *conf.Cfg, status int, code, msg string, reason error) int {
+	httpWriter, ok := w.(http.ResponseWriter)
+	if ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+		setRetryAfter(httpWriter, status, reason, cfg)
+		httpWriter.WriteHeader(status)
+	}
+	cfg.ErrLogger.Println(msg)
+	err := json.NewEncoder(w).Encode(&ErrorResult{Error: msg, Code: code})
+	if err != nil {
+		cfg.ErrLogger.Printf("error preparation: %v\n", err)
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// Index is a index page HTTP handler.
+func Index(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if cfg.APIOnly {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	tpl := cfg.Templates["index"]
+	err := tpl.Execute(w, newIndexData(language(r), cfg))
+	if err != nil {
+		return Error(w, r, cfg, http.StatusInternalServerError, nil, "error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// Upload gets an incoming upload request, encrypts and saves file to the storage.
+func Upload(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if cfg.APIOnly {
+		// the result is HTML page
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	if isMaintenance(cfg, true) {
+		return Error(w, r, cfg, http.StatusServiceUnavailable, errMaintenance, ""), nil
+	}
+	err := limitUpload(w, r, cfg)
+	if err != nil {
+		return Error(w, r, cfg, http.StatusRequestEntityTooLarge, err, "index"), err
+	}
+	item, secret, err := validateUpload(r, cfg)
+	if err != nil {
+		var errs fieldErrors
+		if errors.As(err, &errs) {
+			return errorFields(w, r, cfg, errs), err
+		}
+		return Error(w, r, cfg, http.StatusBadRequest, err, "index"), err
+	}
+	if err = setUploader(w, r, item, cfg); err != nil {
+		return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+	}
+	owner, code, err := storeUpload(r, item, secret, cfg)
+	if err != nil {
+		if code == http.StatusInternalServerError {
+			return Error(w, r, cfg, code, nil, ""), err
+		}
+		return Error(w, r, cfg, code, err, "index"), err
+	}
+	tpl := cfg.Templates["result"]
+	err = tpl.Execute(w, map[string]string{
+		"URL":   item.GetURL(r, cfg.Secure, cfg.TrustedHosts(), cfg.BasePath).String(),
+		"Owner": owner,
+		"Lang":  language(r),
+	})
+	if err != nil {
+		return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+	}
+	return http.StatusOK, nil
+}
+
+// UploadShort gets an incoming upload request, encrypts and saves file to the storage.
+// It differs from Upload method, only file field is required, a response content-type is "plain/text".
+func UploadShort(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	format, err := shortFormat(r, cfg)
+	if err != nil {
+		return errorShort(w, cfg, cfg.Settings.ShortFormat, http.StatusBadRequest, err), err
+	}
+	if isMaintenance(cfg, true) {
+		return errorShort(w, cfg, format, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	err = limitUpload(w, r, cfg)
+	if err != nil {
+		return errorShort(w, cfg, format, http.StatusRequestEntityTooLarge, err), err
+	}
+	claim := r.PostFormValue("claim") != ""
+	if claim && (r.PostFormValue("password") != "") {
+		err = &codeError{code: CodeInvalidPassword, msg: "claim is available only for generated passwords"}
+		return errorShort(w, cfg, format, http.StatusBadRequest, err), err
+	}
+	item, password, err := validateUploadShort(r, cfg)
+	if err != nil {
+		return errorShort(w, cfg, format, http.StatusBadRequest, err), err
+	}
+	if err = setUploader(w, r, item, cfg); err != nil {
+		return errorShort(w, cfg, format, http.StatusInternalServerError, err), err
+	}
+	owner, code, err := storeUpload(r, item, cfg.Secret(password, item.SaltVersion), cfg)
+	if err != nil {
+		return errorShort(w, cfg, format, code, err), err
+	}
+	uri := item.GetURL(r, cfg.Secure, cfg.TrustedHosts(), cfg.BasePath).String()
+	var claimURI string
+	if claim {
+		claimURI, err = newClaim(r, item, password, cfg)
+		if err != nil {
+			return errorShort(w, cfg, format, http.StatusInternalServerError, err), err
+		}
+		password = ""
+	}
+	if item.IsPasswordless() {
+		// the random password is not needed for the download
+		password = ""
+	}
+
+	switch format {
+	case conf.ShortURL:
+		if claim {
+			_, err = fmt.Fprintf(w, "%v\n%v\n", uri, claimURI)
+		} else {
+			_, err = fmt.Fprintln(w, uri)
+		}
+	case conf.ShortJSON:
+		result := &UploadResult{URL: uri, Expired: item.Expired, Password: password, Claim: claimURI, Times: item.Counter, Owner: owner}
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Content-Type", "application/json")
+		}
+		err = json.NewEncoder(w).Encode(result)
+	default:
+		secret := "Password: " + password
+		switch {
+		case claim:
+			secret = "Claim URL: " + claimURI
+		case item.IsPasswordless():
+			secret = "Password: not required"
+		}
+		_, err = fmt.Fprintf(w,
+			"URL: %v\nExpired: %v\n%v\nOwner token: %v\n",
+			uri, item.Expired.Format(time.RFC850), secret, owner,
+		)
+	}
+	if err != nil {
+		return errorShort(w, cfg, format, http.StatusInternalServerError, err), err
+	}
+	return http.StatusOK, nil
+}
+
+// shortFormat returns a response format of the short upload by "format" parameter,
+// "Accept" header or the default setting.
+func shortFormat(r *http.Request, cfg *conf.Cfg) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch format {
+		case conf.ShortVerbose, conf.ShortURL, conf.ShortJSON:
+			return format, nil
+		}
+		return "", &codeError{code: CodeInvalidFormat, msg: fmt.Sprintf("unsupported format %v", format)}
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return conf.ShortJSON, nil
+	case strings.Contains(accept, "text/uri-list"):
+		return conf.ShortURL, nil
+	}
+	return cfg.Settings.ShortFormat, nil
+}
+
+// UploadSealed stores client-side encrypted file as is, the server never gets a password.
+// The client derives a key and hash by the same db.Key routine and sends salt and hash as hex strings.
+func UploadSealed(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if isMaintenance(cfg, true) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	err := limitUpload(w, r, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusRequestEntityTooLarge, err), err
+	}
+	ttl, times, err := validateLimits(r, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	salt, hash, name := r.PostFormValue("salt"), r.PostFormValue("hash"), r.PostFormValue("name")
+	err = db.ValidateSealed(salt, hash)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusBadRequest, err.Error()), err
+	}
+	if len(name) > maxSealedName {
+		return ErrorJSON(w, cfg, http.StatusBadRequest, "name is too long"), nil
+	}
+	f, h, err := r.FormFile(cfg.Settings.FileField)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, errFileRequired), err
 	}
 	defer func() {
-		if err := r.Body.Close(); err != nil {
-			cfg.ErrLogger.Printf("close body: %v", err)
+		if err := f.Close(); err != nil {
+			cfg.ErrLogger.Printf("close incoming file: %v", err)
+		}
+	}()
+	// the file type is checked by the stored name, the content is encrypted
+	fileName := name
+	if fileName == "" {
+		fileName = filepath.Base(h.Filename)
+	}
+	if !cfg.IsAllowedFile(fileName) {
+		err = &codeError{code: CodeFileNotAllowed, msg: fmt.Sprintf("file type of %v is not allowed", fileName)}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	if h.Size == 0 {
+		return errorAPI(w, cfg, http.StatusBadRequest, errFileEmpty), errFileEmpty
+	}
+	if h.Size > int64(cfg.MaxFileSize()) {
+		return errorAPI(w, cfg, http.StatusRequestEntityTooLarge, errTooLarge), errTooLarge
+	}
+	code, err := checkQuota(h.Size, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	now := time.Now().UTC()
+	item := &db.Item{
+		Name:    name,
+		Salt:    salt,
+		Hash:    hash,
+		Counter: times,
+		Path:    cfg.StorageDir,
+		Storage: cfg.Backend,
+		Created: now,
+		Expired: now.Add(time.Duration(ttl) * time.Second),
+	}
+	exists, err := db.IsHashExists(cfg.Db, item.Hash)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if exists {
+		return ErrorJSON(w, cfg, http.StatusConflict, "already exists"), nil
+	}
+	if err = setUploader(w, r, item, cfg); err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if !cfg.Uploads.Acquire(r.Context(), concurrencyWait) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errBusy), errBusy
+	}
+	err = item.Seal(f, cfg.ErrLogger)
+	cfg.Uploads.Release()
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	owner, err := item.NewOwner()
+	if err == nil {
+		err = item.Save(cfg.Db)
+	}
+	if err != nil {
+		if e := item.DeleteFile(); e != nil {
+			cfg.ErrLogger.Printf("remove not saved file: %v", e)
+		}
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	cfg.SizeCache.Add(item.Size)
+	cfg.Collector.Upload(item.Size)
+	result := &UploadResult{
+		URL:     item.GetURL(r, cfg.Secure, cfg.TrustedHosts(), cfg.BasePath).String(),
+		Expired: item.Expired,
+		Times:   item.Counter,
+		Owner:   owner,
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// parseRange parses a value of Range header for content with size bytes.
+// Only single range is supported, end value is included.
+func parseRange(value string, size int64) (int64, int64, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(value, prefix) {
+		return 0, 0, fmt.Errorf("invalid range unit: %v", value)
+	}
+	value = strings.TrimSpace(strings.TrimPrefix(value, prefix))
+	if strings.Contains(value, ",") {
+		return 0, 0, errors.New("multi-part range is not supported")
+	}
+	i := strings.Index(value, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid range: %v", value)
+	}
+	first, last := strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	if first == "" {
+		// suffix range "-N", last N bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 1 || size < 1 {
+			return 0, 0, fmt.Errorf("invalid suffix range: %v", value)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("invalid range start: %v", value)
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range end: %v", value)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, nil
+}
+
+// UploadJSON gets an incoming upload request, encrypts and saves file to the storage.
+// It has the same fields as UploadShort method, but a response content-type is "application/json".
+func UploadJSON(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if isMaintenance(cfg, true) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	err := limitUpload(w, r, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusRequestEntityTooLarge, err), err
+	}
+	item, password, err := validateUploadShort(r, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), err
+	}
+	if err = setUploader(w, r, item, cfg); err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	owner, code, err := storeUpload(r, item, cfg.Secret(password, item.SaltVersion), cfg)
+	if err != nil {
+		return errorAPI(w, cfg, code, err), err
+	}
+	return writeUploadResult(w, r, item, password, owner, cfg)
+}
+
+// writeUploadResult writes JSON response of the saved item.
+func writeUploadResult(w io.Writer, r *http.Request, item *db.Item, password, owner string, cfg *conf.Cfg) (int, error) {
+	if item.IsPasswordless() {
+		// the random password is not needed for the download
+		password = ""
+	}
+	result := &UploadResult{
+		URL:      item.GetURL(r, cfg.Secure, cfg.TrustedHosts(), cfg.BasePath).String(),
+		Expired:  item.Expired,
+		Password: password,
+		Times:    item.Counter,
+		Owner:    owner,
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// unlockCookie returns a name of the unlock token cookie.
+func unlockCookie(item *db.Item) string {
+	return "unlock_" + item.Hash[:16]
+}
+
+// isUnlocked checks the request has a valid unlock token cookie for the item.
+func isUnlocked(r *http.Request, item *db.Item, cfg *conf.Cfg) (bool, error) {
+	cookie, err := r.Cookie(unlockCookie(item))
+	if err != nil {
+		// no cookie
+		return false, nil
+	}
+	return item.IsUnlocked(cfg.Db, cookie.Value)
+}
+
+// confirm handles a download confirmation of the locked item.
+// A confirmed request gets an unlock token cookie and the password form,
+// other ones get the confirmation page, so links previews can't consume downloads.
+func confirm(w io.Writer, r *http.Request, item *db.Item, cfg *conf.Cfg) (int, error) {
+	if cfg.APIOnly {
+		// API requests don't need a confirmation
+		return ErrorJSON(w, cfg, http.StatusForbidden, "confirmation page is not available, use /api/"+item.Hash), nil
+	}
+	code, tplName := http.StatusOK, "confirm"
+	switch {
+	case r.Method != "POST":
+		// only show the confirmation page
+	case r.PostFormValue("confirm") == "":
+		code = http.StatusForbidden
+	default:
+		token, err := item.Unlock(cfg.Db)
+		if err != nil {
+			return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+		}
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			http.SetCookie(httpWriter, &http.Cookie{
+				Name:     unlockCookie(item),
+				Value:    token,
+				Path:     cfg.URLPath("/" + item.Hash),
+				Expires:  time.Now().Add(db.UnlockTTL),
+				Secure:   cfg.Secure,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		tplName = "read"
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.WriteHeader(code)
+	}
+	err := cfg.Templates[tplName].Execute(w, &IndexData{Lang: language(r)})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return code, nil
+}
+
+// clientIP returns client's IP address,
+// X-Forwarded-For header is used only if the service is behind a trusted proxy.
+func clientIP(r *http.Request, proxy bool) string {
+	if proxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.SplitN(forwarded, ",", 2)[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// queueGC sends fully downloaded item to GC.
+func queueGC(item *db.Item, cfg *conf.Cfg) {
+	if item.Counter > 0 {
+		return
+	}
+	// a slow GC should not block the response
+	select {
+	case cfg.Ch <- item:
+	default:
+		cfg.ErrLogger.Printf("gc queue is full, item=%v will be deleted later\n", item.ID)
+	}
+}
+
+// NewGCConfig returns GC monitoring settings of the configuration,
+// deleted items are reported by the webhook.
+func NewGCConfig(cfg *conf.Cfg, li, le *log.Logger) *db.GCConfig {
+	return &db.GCConfig{
+		Db:        cfg.Db,
+		Storage:   cfg.Backend,
+		Collector: cfg.Collector,
+		SizeCache: cfg.SizeCache,
+		OnDelete:  func(item *db.Item) { notifyDelete(item, cfg) },
+		Info:      li,
+		Err:       le,
+		Period:    time.Duration(cfg.GCPeriod) * time.Second,
+		Batch:     cfg.GCBatch,
+		Grace:     time.Duration(cfg.OrphanGrace) * time.Second,
+	}
+}
+
+// failPassword counts a failed password of the item, the client's attempt is already reserved by the limiter.
+// The returned flag is true if the item has reached its limit of failed passwords and is destroyed.
+func failPassword(item *db.Item, ip string, cfg *conf.Cfg) bool {
+	cfg.Collector.DownloadError(metrics.ReasonBadPassword)
+	recordAccess(item, false, ip, cfg)
+	destroyed, err := item.Fail(cfg.Db)
+	if err != nil {
+		cfg.ErrLogger.Printf("failed password of item=%v: %v\n", item.ID, err)
+		return false
+	}
+	if destroyed {
+		queueGC(item, cfg)
+	}
+	return destroyed
+}
+
+// recordAccess saves the download attempt to the access log,
+// its failure doesn't affect the download.
+func recordAccess(item *db.Item, success bool, ip string, cfg *conf.Cfg) {
+	if err := item.RecordAccess(cfg.Db, success, ip); err != nil {
+		cfg.ErrLogger.Printf("access log of item=%v: %v\n", item.ID, err)
+	}
+}
+
+// notifyDelete sends the webhook event about the item deleted by GC.
+func notifyDelete(item *db.Item, cfg *conf.Cfg) {
+	cfg.Webhook.Send(&webhook.Event{
+		Event:     webhook.EventDelete,
+		Hash:      item.Hash,
+		Timestamp: time.Now().UTC(),
+		Remaining: item.Counter,
+	})
+}
+
+// notifyDownload sends the webhook event about the downloaded item.
+func notifyDownload(r *http.Request, item *db.Item, cfg *conf.Cfg) {
+	cfg.Webhook.Send(&webhook.Event{
+		Event:     webhook.EventDownload,
+		Hash:      item.Hash,
+		Timestamp: time.Now().UTC(),
+		Remaining: item.Counter,
+		ClientIP:  clientIP(r, cfg.Proxy),
+	})
+}
+
+// readSealed returns client-side encrypted data as is, the password can't be checked for it.
+func readSealed(w io.Writer, r *http.Request, item *db.Item, cfg *conf.Cfg, fail errorPage) (int, error) {
+	if !item.IsFileExists() {
+		cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		return fail(w, r, cfg, http.StatusNotFound, nil, ""), nil
+	}
+	if !cfg.Downloads.Acquire(r.Context(), concurrencyWait) {
+		cfg.Collector.DownloadError(metrics.ReasonBusy)
+		return fail(w, r, cfg, http.StatusServiceUnavailable, errBusy, "error"), errBusy
+	}
+	defer cfg.Downloads.Release()
+	ok, err := item.Decrement(cfg.Db, cfg.ErrLogger)
+	if err != nil {
+		cfg.Collector.DownloadError(metrics.ReasonServer)
+		return fail(w, r, cfg, http.StatusInternalServerError, nil, "error"), err
+	}
+	if !ok {
+		cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		return fail(w, r, cfg, http.StatusNotFound, nil, "used"), nil
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set(HeaderRemaining, strconv.Itoa(item.Counter))
+		httpWriter.Header().Set(HeaderExpires, item.Expired.UTC().Format(time.RFC3339))
+	}
+	err = item.StreamContext(r.Context(), w, cfg.ErrLogger)
+	if err != nil {
+		cfg.Collector.DownloadError(metrics.ReasonServer)
+		// the attempt is already counted, e.g. a client has closed the connection
+		queueGC(item, cfg)
+		return fail(w, r, cfg, http.StatusInternalServerError, nil, "error"), err
+	}
+	cfg.Collector.Download()
+	notifyDownload(r, item, cfg)
+	queueGC(item, cfg)
+	return http.StatusOK, nil
+}
+
+// readFile checks the password and returns decrypted data, errors are written by fail.
+func readFile(w io.Writer, r *http.Request, item *db.Item, cfg *conf.Cfg, fail errorPage) (int, error) {
+	ip := clientIP(r, cfg.Proxy)
+	if !cfg.Limiter.Attempt(ip) {
+		cfg.Collector.DownloadError(metrics.ReasonRateLimit)
+		retryAfter(w, cfg.Limiter.Retry(ip))
+		return fail(w, r, cfg, http.StatusTooManyRequests, nil, "read"), errLimit
+	}
+	key, err := validateDownload(item, r, cfg)
+	if err != db.ErrPassword {
+		// only a failed password keeps the reserved attempt
+		cfg.Limiter.Refund(ip)
+	}
+	if err != nil {
+		shown := err
+		switch err {
+		case db.ErrPassword:
+			if failPassword(item, ip, cfg) {
+				return fail(w, r, cfg, http.StatusNotFound, nil, ""), err
+			}
+		case errFileMissing:
+			shown = db.ErrPassword
+			cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		default:
+			cfg.Collector.DownloadError(metrics.ReasonBadRequest)
 		}
-		if err := f.Close(); err != nil {
-			cfg.ErrLogger.Printf("close incoming file: %v", err)
+		return fail(w, r, cfg, http.StatusBadRequest, shown, "read"), err
+	}
+	var start, end int64
+	code := http.StatusOK
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		size, err := item.ContentSize()
+		if err != nil {
+			cfg.Collector.DownloadError(metrics.ReasonServer)
+			return fail(w, r, cfg, http.StatusInternalServerError, nil, "error"), err
 		}
-	}()
-	item.Name = h.Filename
-	err = item.Encrypt(f, cfg.Secret(password), cfg.ErrLogger)
+		start, end, err = parseRange(rangeHeader, size)
+		if err != nil {
+			if httpWriter, ok := w.(http.ResponseWriter); ok {
+				httpWriter.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			}
+			cfg.Collector.DownloadError(metrics.ReasonBadRequest)
+			return fail(w, r, cfg, http.StatusRequestedRangeNotSatisfiable, nil, "error"), err
+		}
+		if (start > 0) || (end < size-1) {
+			code = http.StatusPartialContent
+		}
+	}
+	// a resume token is accepted only with the valid password, it's signed by the item's key
+	resumed := (rangeHeader != "") && !item.IsExpired() && item.IsResumeToken(key, r.Header.Get(HeaderResume))
+	if (item.Counter < 1) && !resumed {
+		cfg.Collector.DownloadError(metrics.ReasonNotFound)
+		return fail(w, r, cfg, http.StatusNotFound, nil, "used"), nil
+	}
+	if !cfg.Downloads.Acquire(r.Context(), concurrencyWait) {
+		// the download is not counted yet, so it can be repeated later
+		cfg.Collector.DownloadError(metrics.ReasonBusy)
+		return fail(w, r, cfg, http.StatusServiceUnavailable, errBusy, "error"), errBusy
+	}
+	defer cfg.Downloads.Release()
+	// every served range is counted, only a resume token proves
+	// that the request continues already counted download
+	remaining := item.Counter
+	switch {
+	case resumed:
+	case cfg.DeferredCounter:
+		// the counter is decremented only after the content is sent
+		remaining--
+	default:
+		// file exists and secret is valid, so decrement counter
+		ok, err := item.Decrement(cfg.Db, cfg.ErrLogger)
+		if err != nil {
+			cfg.Collector.DownloadError(metrics.ReasonServer)
+			return fail(w, r, cfg, http.StatusInternalServerError, nil, "error"), err
+		}
+		if !ok {
+			// the password is valid, but a concurrent request has used the last download
+			cfg.Collector.DownloadError(metrics.ReasonNotFound)
+			return fail(w, r, cfg, http.StatusNotFound, nil, "used"), nil
+		}
+		remaining = item.Counter
+	}
+	item.Inline = r.FormValue("inline") != ""
+	item.DownloadName = r.FormValue("filename")
+	// only a full content can be compared with the uploaded one
+	item.Verify = cfg.VerifyChecksum && (rangeHeader == "")
+	// headers should be set before the body writing
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set(HeaderRemaining, strconv.Itoa(remaining))
+		httpWriter.Header().Set(HeaderExpires, item.Expired.UTC().Format(time.RFC3339))
+		if !resumed {
+			httpWriter.Header().Set(HeaderResume, item.ResumeToken(key, time.Now().Add(db.ResumePeriod)))
+		}
+	}
+	if rangeHeader != "" {
+		err = item.DecryptRangeContext(r.Context(), w, key, start, end, cfg.ErrLogger)
+	} else {
+		err = decryptFull(r, w, item, key, cfg)
+	}
 	if err != nil {
-		return ErrorUploadShort(w, cfg, http.StatusInternalServerError, "server error"), err
+		cfg.Collector.DownloadError(metrics.ReasonServer)
+		// the attempt is already counted if the counter is not deferred, e.g. a client has closed the connection,
+		// a used item is deleted by GC after the resume period
+		var shown error
+		if errors.Is(err, db.ErrIntegrity) {
+			// a modified name is detected before any content is written
+			shown = err
+		}
+		return fail(w, r, cfg, http.StatusInternalServerError, shown, "error"), err
 	}
-	err = item.Save(cfg.Db)
+	if resumed {
+		recordAccess(item, true, ip, cfg)
+		return code, nil
+	}
+	if cfg.DeferredCounter {
+		ok, err := item.Decrement(cfg.Db, cfg.ErrLogger)
+		if err != nil {
+			// the content is already sent, so only the status is reported
+			cfg.Collector.DownloadError(metrics.ReasonServer)
+			return http.StatusInternalServerError, err
+		}
+		if !ok {
+			cfg.ErrLogger.Printf("item %v was concurrently downloaded before its counter was decremented", item.ID)
+		}
+	}
+	cfg.Collector.Download()
+	recordAccess(item, true, ip, cfg)
+	notifyDownload(r, item, cfg)
+	if rangeHeader == "" {
+		// a partial download can be resumed, so it's deleted by GC after the resume period
+		queueGC(item, cfg)
+	}
+	return code, nil
+}
+
+// isResume checks the request can resume already counted download of the used item,
+// its token is checked with the password by readFile.
+func isResume(r *http.Request, state int) bool {
+	return (state == db.StateUsed) && (r.Method == "POST") && (r.Header.Get(HeaderResume) != "") && (r.Header.Get("Range") != "")
+}
+
+// decryptFull writes the item full content, it's compressed if the client supports it.
+func decryptFull(r *http.Request, w io.Writer, item *db.Item, key []byte, cfg *conf.Cfg) error {
+	httpWriter, ok := w.(http.ResponseWriter)
+	if !ok || !acceptsGzip(r) {
+		return item.DecryptContext(r.Context(), w, key, cfg.ErrLogger)
+	}
+	gw := &gzipWriter{ResponseWriter: httpWriter}
+	err := item.DecryptContext(r.Context(), gw, key, cfg.ErrLogger)
+	if e := gw.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// unavailablePage returns a template name for not active item, expired and used links
+// are distinguished only if it's allowed by the settings, otherwise they look like never existed ones.
+func unavailablePage(state int, cfg *conf.Cfg) string {
+	if !cfg.RevealExpired {
+		return ""
+	}
+	switch state {
+	case db.StateExpired:
+		return "expired"
+	case db.StateUsed:
+		return "used"
+	}
+	return ""
+}
+
+// Download returns a decrypted file. The password form isn't available in API-only mode,
+// but POST requests are still handled. Download pages and files are not indexed by search engines.
+func Download(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	noIndex(w)
+	switch r.Method {
+	case "GET":
+		if cfg.APIOnly {
+			return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+		}
+		if r.ContentLength > 0 {
+			return Error(w, r, cfg, http.StatusBadRequest, nil, ""), errors.New("GET request with a body")
+		}
+	case "HEAD":
+		return headDownload(w, r, cfg)
+	case "POST":
+	default:
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Allow", "GET, HEAD, POST")
+		}
+		return Error(w, r, cfg, http.StatusMethodNotAllowed, nil, ""), nil
+	}
+	if isMaintenance(cfg, false) {
+		return Error(w, r, cfg, http.StatusServiceUnavailable, errMaintenance, ""), nil
+	}
+	hash := strings.Trim(r.URL.Path, "/ ")
+	if !db.IsNameHash(hash) {
+		return Error(w, r, cfg, http.StatusNotFound, nil, ""), nil
+	}
+	item, state, err := db.ReadState(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+	}
+	if (state != db.StateActive) && !isResume(r, state) {
+		return Error(w, r, cfg, http.StatusNotFound, nil, unavailablePage(state, cfg)), nil
+	}
+	item.Storage = cfg.Backend
+	if item.Confirm {
+		unlocked, err := isUnlocked(r, item, cfg)
+		if err != nil {
+			return Error(w, r, cfg, http.StatusInternalServerError, nil, ""), err
+		}
+		if !unlocked {
+			return confirm(w, r, item, cfg)
+		}
+	}
+	if r.Method == "POST" {
+		if item.Format == db.FormatSealed {
+			return readSealed(w, r, item, cfg, Error)
+		}
+		return readFile(w, r, item, cfg, Error)
+	}
+	// a link without a password is also read only by POST, so link previews don't spend the counter
+	tpl := cfg.Templates["read"]
+	data := &IndexData{Lang: language(r), Notice: cfg.Notice, Passwordless: item.IsPasswordless()}
+	if cfg.AllowHints {
+		// the template escapes the hint
+		data.Hint = item.Hint
+	}
+	err = tpl.Execute(w, data)
 	if err != nil {
-		return ErrorUploadShort(w, cfg, http.StatusInternalServerError, "server error"), err
+		return http.StatusInternalServerError, err
 	}
-	uri := item.GetURL(r, cfg.Secure).String()
+	return http.StatusOK, nil
+}
 
-	_, err = fmt.Fprintf(w,
-		"URL: %v\nExpired: %v\nPassword: %v\n",
-		uri, item.Expired.Format(time.RFC850), password,
-	)
+// headDownload returns only a status of the download link without a body,
+// it's "200 OK" for an active item and "404 Not Found" for other ones, the counter is not changed.
+func headDownload(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	var err error
+	code, hash := http.StatusNotFound, strings.Trim(r.URL.Path, "/ ")
+	switch {
+	case isMaintenance(cfg, false):
+		code = http.StatusServiceUnavailable
+	case !cfg.APIOnly && db.IsNameHash(hash):
+		var state int
+		_, state, err = db.ReadState(cfg.Db, hash, cfg.ErrLogger)
+		if err != nil {
+			code = http.StatusInternalServerError
+		} else if state == db.StateActive {
+			code = http.StatusOK
+		}
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Cache-Control", "no-store")
+		httpWriter.WriteHeader(code)
+	}
+	return code, err
+}
+
+// DownloadAPI returns a decrypted file like Download, but its errors are JSON responses.
+// GET request returns what the download requires instead of the password form,
+// a confirmation isn't asked because API requests are explicit.
+func DownloadAPI(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	noIndex(w)
+	if (r.Method != "GET") && (r.Method != "POST") {
+		return methodNotAllowed(w, cfg, "GET, POST"), nil
+	}
+	if isMaintenance(cfg, false) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/ ")
+	if !db.IsNameHash(hash) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	item, state, err := db.ReadState(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if (state != db.StateActive) && !isResume(r, state) {
+		msg := "not found"
+		switch unavailablePage(state, cfg) {
+		case "expired":
+			msg = "link has expired"
+		case "used":
+			msg = "link has already been fully used"
+		}
+		return ErrorJSON(w, cfg, http.StatusNotFound, msg), nil
+	}
+	item.Storage = cfg.Backend
+	if r.Method == "POST" {
+		if item.Format == db.FormatSealed {
+			return readSealed(w, r, item, cfg, errorDownloadJSON)
+		}
+		return readFile(w, r, item, cfg, errorDownloadJSON)
+	}
+	// client-side encrypted data and links without a password are returned without it
+	result := &RequirementResult{Requires: "password"}
+	if (item.Format == db.FormatSealed) || item.IsPasswordless() {
+		result.Requires = "none"
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(result)
 	if err != nil {
-		return ErrorUploadShort(w, cfg, http.StatusInternalServerError, "server error"), err
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
 	}
 	return http.StatusOK, nil
 }
 
-func readFile(w io.Writer, r *http.Request, item *db.Item, cfg *conf.Cfg) (int, error) {
-	key, err := validateDownload(item, r, cfg)
+// Info returns item's info: remaining downloads, expiration time and content-type.
+// It doesn't require a password and doesn't change the counter.
+func Info(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if isMaintenance(cfg, false) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	hash := strings.TrimSuffix(strings.Trim(r.URL.Path, "/ "), "/info")
+	if !db.IsNameHash(hash) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	item, err := db.Read(cfg.Db, hash, cfg.ErrLogger)
 	if err != nil {
-		return Error(w, cfg, http.StatusBadRequest, err.Error(), "read"), err
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
 	}
-	// file exists and secret is valid, so decrement counter
-	ok, err := item.Decrement(cfg.Db, cfg.ErrLogger)
+	if (item.ID == 0) || item.IsExpired() {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	result := &InfoResult{
+		Remaining:   item.Counter,
+		Expired:     item.Expired,
+		ContentType: item.ContentType(),
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(result)
 	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", "error"), err
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// Metrics returns service's metrics if the collector supports HTTP export.
+func Metrics(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	exporter, ok := cfg.Collector.(interface{ Handler() http.Handler })
+	if !ok {
+		return Error(w, r, cfg, http.StatusNotFound, nil, ""), nil
 	}
+	httpWriter, ok := w.(http.ResponseWriter)
 	if !ok {
-		return Error(w, cfg, http.StatusNotFound, "", ""), nil
+		return http.StatusInternalServerError, errors.New("metrics writer is not http.ResponseWriter")
+	}
+	exporter.Handler().ServeHTTP(httpWriter, r)
+	return http.StatusOK, nil
+}
+
+// Extend sets new TTL and/or times of the item, the owner token is required.
+func Extend(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if r.Method != "POST" {
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Allow", "POST")
+		}
+		return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed"), nil
 	}
-	err = item.Decrypt(w, key, cfg.ErrLogger)
+	if isMaintenance(cfg, true) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	hash := strings.TrimSuffix(strings.Trim(r.URL.Path, "/ "), "/extend")
+	if !db.IsNameHash(hash) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	item, err := db.Read(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if (item.ID == 0) || item.IsExpired() {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	if !item.IsOwner(r.PostFormValue("token")) {
+		return ErrorJSON(w, cfg, http.StatusForbidden, "forbidden"), nil
+	}
+	expired, counter := item.Expired, item.Counter
+	ttlValue, timesValue := r.PostFormValue("ttl"), r.PostFormValue("times")
+	if (ttlValue == "") && (timesValue == "") {
+		return ErrorJSON(w, cfg, http.StatusBadRequest, "required field ttl or times"), nil
+	}
+	if ttlValue != "" {
+		ttl, err := validateRange(ttlValue, "ttl", cfg.Settings.MinTTL, cfg.Settings.TTL)
+		if err != nil {
+			return errorAPI(w, cfg, http.StatusBadRequest, err), err
+		}
+		expired = time.Now().UTC().Add(time.Duration(ttl) * time.Second)
+	}
+	if timesValue != "" {
+		counter, err = validateRange(timesValue, "times", 1, cfg.Settings.Times)
+		if err != nil {
+			return errorAPI(w, cfg, http.StatusBadRequest, err), err
+		}
+	}
+	err = item.Extend(cfg.Db, expired, counter, cfg.ErrLogger)
 	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", "error"), err
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	result := &InfoResult{
+		Remaining:   item.Counter,
+		Expired:     item.Expired,
+		ContentType: item.ContentType(),
 	}
-	if item.Counter < 1 {
-		cfg.Ch <- item
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
 	}
 	return http.StatusOK, nil
 }
 
-// Download returns a decrypted file.
-func Download(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
-	hash := strings.Trim(r.RequestURI, "/ ")
+// Password changes the item's password without a new upload, the owner token and the current password
+// are required, an optional hint replaces the old one. The content is encrypted again, so the old link and password don't work anymore.
+func Password(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if r.Method != "POST" {
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Allow", "POST")
+		}
+		return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+	if isMaintenance(cfg, true) {
+		return errorAPI(w, cfg, http.StatusServiceUnavailable, errMaintenance), nil
+	}
+	hash := strings.TrimSuffix(strings.Trim(r.URL.Path, "/ "), "/password")
 	if !db.IsNameHash(hash) {
-		return Error(w, cfg, http.StatusNotFound, "", ""), nil
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
 	}
 	item, err := db.Read(cfg.Db, hash, cfg.ErrLogger)
 	if err != nil {
-		return Error(w, cfg, http.StatusInternalServerError, "", ""), err
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if (item.ID == 0) || item.IsExpired() {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	if !item.IsOwner(r.PostFormValue("token")) {
+		return ErrorJSON(w, cfg, http.StatusForbidden, "forbidden"), nil
+	}
+	if item.Format == db.FormatSealed {
+		return errorAPI(w, cfg, http.StatusBadRequest, db.ErrRechallengeSealed), nil
+	}
+	if item.IsPasswordless() {
+		err = &codeError{code: CodeInvalidPassword, msg: "link without a password has no password to change"}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), nil
+	}
+	password, newPassword := r.PostFormValue("password"), r.PostFormValue("new_password")
+	if (password == "") || (newPassword == "") {
+		err = &codeError{code: CodePasswordRequired, msg: "required fields password and new_password"}
+		return errorAPI(w, cfg, http.StatusBadRequest, err), nil
+	}
+	if err = validatePassword(newPassword, cfg); err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), nil
+	}
+	// a hint of the old password is not kept
+	item.Hint, err = validateHint(r, newPassword, cfg)
+	if err != nil {
+		return errorAPI(w, cfg, http.StatusBadRequest, err), nil
+	}
+	item.Storage = cfg.Backend
+	if !item.IsFileExists() {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	err = item.Rechallenge(cfg.Db, cfg.Secret(password, item.SaltVersion), cfg.Secret(newPassword, item.SaltVersion), cfg.ErrLogger)
+	if err == db.ErrPassword {
+		return errorAPI(w, cfg, http.StatusBadRequest, &codeError{code: CodeInvalidPassword, msg: err.Error()}), nil
+	}
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	result := &PasswordResult{
+		URL:     item.GetURL(r, cfg.Secure, cfg.TrustedHosts(), cfg.BasePath).String(),
+		Expired: item.Expired,
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// isAdmin checks admin bearer token, an empty configured token disables administration.
+func isAdmin(r *http.Request, cfg *conf.Cfg) bool {
+	if cfg.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// hasAdminCert checks that the client certificate is issued by admins authorities if they are configured.
+// The certificate is only requested by TLS handshake, so untrusted ones get forbidden response here.
+func hasAdminCert(r *http.Request, cfg *conf.Cfg) bool {
+	roots := cfg.AdminClientCAs()
+	if roots == nil {
+		return true
+	}
+	if (r.TLS == nil) || (len(r.TLS.PeerCertificates) == 0) {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// Admin handles items administration requests.
+func Admin(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if cfg.AdminToken == "" {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	if !hasAdminCert(r, cfg) {
+		return ErrorJSON(w, cfg, http.StatusForbidden, "client certificate is required"), nil
+	}
+	if !isAdmin(r, cfg) {
+		return ErrorJSON(w, cfg, http.StatusUnauthorized, "unauthorized"), nil
+	}
+	path := strings.Trim(r.URL.Path, "/ ")
+	switch {
+	case (path == "admin/items") && (r.Method == "GET"):
+		return adminList(w, cfg)
+	case strings.HasPrefix(path, "admin/items/") && strings.HasSuffix(path, "/access") && (r.Method == "GET"):
+		return adminAccess(w, strings.TrimSuffix(strings.TrimPrefix(path, "admin/items/"), "/access"), cfg)
+	case strings.HasPrefix(path, "admin/items/") && (r.Method == "DELETE"):
+		return adminDelete(w, strings.TrimPrefix(path, "admin/items/"), cfg)
+	case (path == "admin/items") || strings.HasPrefix(path, "admin/items/"):
+		return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed"), nil
+	case path == "admin/maintenance":
+		return adminMaintenance(w, r, cfg)
+	}
+	return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+}
+
+// adminList returns metadata of all stored items.
+func adminList(w io.Writer, cfg *conf.Cfg) (int, error) {
+	items, err := db.List(cfg.Db, cfg.ErrLogger)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	result := make([]*AdminItem, len(items))
+	for i, item := range items {
+		result[i] = &AdminItem{
+			Hash:    item.Hash,
+			Size:    item.Size,
+			Counter: item.Counter,
+			Created: item.Created,
+			Expired: item.Expired,
+		}
+		if (item.Label != "") && (cfg.LabelSecret() != nil) {
+			// a label of the changed key can't be decrypted, but other items are listed
+			label, err := db.DecryptLabel(item.Label, cfg.LabelSecret())
+			if err != nil {
+				cfg.ErrLogger.Printf("decrypt label of item=%v: %v", item.ID, err)
+			}
+			result[i].Label = label
+		}
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// adminAccess returns download attempts of the item,
+// they are available even after item's deletion.
+func adminAccess(w io.Writer, hash string, cfg *conf.Cfg) (int, error) {
+	if !db.IsNameHash(hash) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	records, err := db.ReadAccessLog(cfg.Db, hash)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err = json.NewEncoder(w).Encode(records)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// adminDelete removes the item and its file.
+func adminDelete(w io.Writer, hash string, cfg *conf.Cfg) (int, error) {
+	if !db.IsNameHash(hash) {
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
+	}
+	// used and expired items are listed too, so they can be deleted before GC
+	item, err := db.ReadAny(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
 	}
 	if item.ID == 0 {
-		return Error(w, cfg, http.StatusNotFound, "", ""), nil
+		return ErrorJSON(w, cfg, http.StatusNotFound, "not found"), nil
 	}
-	if r.Method == "POST" {
-		return readFile(w, r, item, cfg)
+	err = deleteItem(item, cfg)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
 	}
-	tpl := cfg.Templates["read"]
-	err = tpl.Execute(w, nil)
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.WriteHeader(http.StatusNoContent)
+	}
+	return http.StatusNoContent, nil
+}
+
+// deleteItem removes the item and its file before its expiration.
+func deleteItem(item *db.Item, cfg *conf.Cfg) error {
+	item.Storage = cfg.Backend
+	err := item.Delete(cfg.Db, cfg.ErrLogger)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
+	}
+	cfg.SizeCache.Invalidate()
+	cfg.Collector.GCDeleted(1)
+	return nil
+}
+
+// adminMaintenance returns current maintenance mode, POST request changes it by "mode" parameter.
+func adminMaintenance(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := cfg.SetMaintenance(r.FormValue("mode")); err != nil {
+			return ErrorJSON(w, cfg, http.StatusBadRequest, err.Error()), nil
+		}
+	default:
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Allow", "GET, POST")
+		}
+		return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+	}
+	err := json.NewEncoder(w).Encode(&MaintenanceResult{Mode: cfg.Maintenance()})
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	return http.StatusOK, nil
+}
+
+// Health is a liveness check, it always returns OK.
+func Health(w io.Writer, _ *http.Request, _ *conf.Cfg) (int, error) {
+	_, err := fmt.Fprintln(w, "OK")
+	return http.StatusOK, err
+}
+
+// Robots forbids crawling of all service pages, so shared links can't be indexed.
+func Robots(w io.Writer, _ *http.Request, _ *conf.Cfg) (int, error) {
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	_, err := fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+	return http.StatusOK, err
+}
+
+// noIndex asks search engines to not index the response and follow its links.
+func noIndex(w io.Writer) {
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+}
+
+// Status returns a number of active links, the value is cached for status_cache period.
+func Status(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	if (r.Method != "GET") && (r.Method != "HEAD") {
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.Header().Set("Allow", "GET, HEAD")
+		}
+		return ErrorJSON(w, cfg, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+	n, err := cfg.ActiveCache.Get(cfg.Db)
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
+	}
+	if httpWriter, ok := w.(http.ResponseWriter); ok {
+		httpWriter.Header().Set("Content-Type", "application/json")
+		httpWriter.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.StatusCache))
+	}
+	err = json.NewEncoder(w).Encode(&StatusResult{Active: n})
+	if err != nil {
+		return ErrorJSON(w, cfg, http.StatusInternalServerError, "server error"), err
 	}
 	return http.StatusOK, nil
 }
+
+// Ready checks the database connection and the storage directory are available.
+func Ready(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	err := cfg.Db.PingContext(ctx)
+	if err == nil {
+		err = IsWritable(cfg.StorageDir)
+	}
+	if err != nil {
+		if httpWriter, ok := w.(http.ResponseWriter); ok {
+			httpWriter.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if _, e := fmt.Fprintln(w, "NOT READY"); e != nil {
+			cfg.ErrLogger.Printf("ready response: %v", e)
+		}
+		return http.StatusServiceUnavailable, err
+	}
+	_, err = fmt.Fprintln(w, "OK")
+	return http.StatusOK, err
+}
+
+// IsWritable checks a new file can be created in the directory,
+// an empty name is not a local storage, so it's skipped.
+func IsWritable(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	f, err := ioutil.TempFile(dir, ".ready-*")
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
@@ -1,14 +1,39 @@
 package web
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"html/template"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +41,11 @@ import (
 	_ "github.com/mattn/go-sqlite3" // SQLite3 driver package
 	"github.com/z0rr0/unigma/conf"
 	"github.com/z0rr0/unigma/db"
+	"github.com/z0rr0/unigma/limiter"
+	"github.com/z0rr0/unigma/logging"
+	"github.com/z0rr0/unigma/metrics"
+	"github.com/z0rr0/unigma/scanner"
+	"github.com/z0rr0/unigma/webhook"
 )
 
 const (
@@ -27,14 +57,22 @@ var (
 	loggerInfo   = log.New(os.Stdout, "[TEST]", log.Ltime|log.Lshortfile)
 	rgCheck      = regexp.MustCompile(`href="http(s)?://.+/(?P<key>[0-9a-z]{64})"`)
 	rgShortCheck = regexp.MustCompile(`URL: http(s)?://.+/(?P<key>[0-9a-z]{64})`)
+	rgJSONCheck  = regexp.MustCompile(`^http(s)?://.+/(?P<key>[0-9a-z]{64})$`)
 )
 
 type formData struct {
-	File     string
-	FileName string
-	TTL      string
-	Times    string
-	Password string
+	File        string
+	FileName    string
+	TTL         string
+	Times       string
+	Password    string
+	SHA256      string
+	ContentType string
+	Claim       string
+	Hint        string
+	NoPassword  string
+	// Field is a name of the file field, it's "file" by default.
+	Field string
 }
 
 type uploadTestCase struct {
@@ -59,7 +97,7 @@ func createItem(cfg *conf.Cfg, secret, content string, expired time.Time) (*db.I
 		Expired: expired,
 	}
 	f := strings.NewReader(content)
-	err := item.Encrypt(f, cfg.Secret(secret), loggerInfo)
+	err := item.Encrypt(f, cfg.Secret(secret, item.SaltVersion), loggerInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -74,7 +112,11 @@ func createForm(f *formData) (io.Reader, string, error) {
 	var b bytes.Buffer
 	fw := multipart.NewWriter(&b)
 	// file
-	w, err := fw.CreateFormFile("file", f.FileName)
+	field := f.Field
+	if field == "" {
+		field = "file"
+	}
+	w, err := fw.CreateFormFile(field, f.FileName)
 	if err != nil {
 		return nil, "", err
 	}
@@ -109,6 +151,31 @@ func createForm(f *formData) (io.Reader, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
+	if f.SHA256 != "" {
+		if err = fw.WriteField("sha256", f.SHA256); err != nil {
+			return nil, "", err
+		}
+	}
+	if f.ContentType != "" {
+		if err = fw.WriteField("content_type", f.ContentType); err != nil {
+			return nil, "", err
+		}
+	}
+	if f.Claim != "" {
+		if err = fw.WriteField("claim", f.Claim); err != nil {
+			return nil, "", err
+		}
+	}
+	if f.Hint != "" {
+		if err = fw.WriteField("hint", f.Hint); err != nil {
+			return nil, "", err
+		}
+	}
+	if f.NoPassword != "" {
+		if err = fw.WriteField("no_password", f.NoPassword); err != nil {
+			return nil, "", err
+		}
+	}
 	err = fw.Close()
 	if err != nil {
 		return nil, "", err
@@ -136,6 +203,235 @@ func TestIndex(t *testing.T) {
 	}
 }
 
+func TestIndexNotice(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	if _, err = Index(w, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); strings.Contains(body, "<p><b>") {
+		t.Errorf("unexpected empty notice: %v", body)
+	}
+	cfg.Notice = `maintenance at 2am <script>alert("x")</script>`
+	w = httptest.NewRecorder()
+	code, err := Index(w, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "maintenance at 2am &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;") {
+		t.Errorf("notice is not found or not escaped: %v", body)
+	}
+	if strings.Contains(body, "<script>") {
+		t.Errorf("notice is not escaped: %v", body)
+	}
+}
+
+func TestIndexTTLPresets(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	if _, err = Index(w, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<option value='86400' selected>a day</option>") {
+		t.Errorf("default presets are not found: %v", body)
+	}
+	cfg.Settings.TTLPresets = []conf.TTLPreset{{Label: "5 minutes", Seconds: 300}, {Label: "2 days", Seconds: 172800}}
+	w = httptest.NewRecorder()
+	code, err := Index(w, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	body := w.Body.String()
+	for _, option := range []string{"<option value='300'>5 minutes</option>", "<option value='172800'>2 days</option>"} {
+		if !strings.Contains(body, option) {
+			t.Errorf("option %v is not found: %v", option, body)
+		}
+	}
+	if strings.Contains(body, "'86400'") {
+		t.Errorf("unexpected default preset: %v", body)
+	}
+}
+
+func TestIndexLimits(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.Size = 3
+	cfg.Settings.Times = 7
+	cfg.Settings.TTL = 3600
+	w := httptest.NewRecorder()
+	if _, err = Index(w, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	expected := []string{
+		"max 3 Mb",
+		`name="times" min="1" max="7"`,
+		"<option value='600'>10 minutes</option>",
+		"<option value='3600' selected>a hour</option>",
+	}
+	for _, value := range expected {
+		if !strings.Contains(body, value) {
+			t.Errorf("%v is not found: %v", value, body)
+		}
+	}
+	for _, value := range []string{"'86400'", "'604800'", `max="1000"`} {
+		if strings.Contains(body, value) {
+			t.Errorf("unexpected %v: %v", value, body)
+		}
+	}
+	// no presets in limits
+	cfg.Settings.TTL = 300
+	w = httptest.NewRecorder()
+	code, err := Index(w, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	if body = w.Body.String(); !strings.Contains(body, "<option value='300' selected>max</option>") {
+		t.Errorf("max TTL option is not found: %v", body)
+	}
+}
+
+func TestIndexTemplateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unigma-templates-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Custom</h1> max {{.MaxSize}} Mb"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["template_dir"] = dir
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.New(config, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	code, err := Index(w, httptest.NewRequest("GET", "/", nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	if body, expected := w.Body.String(), fmt.Sprintf("<h1>Custom</h1> max %v Mb", cfg.Settings.Size); body != expected {
+		t.Errorf("failed custom index: %v", body)
+	}
+	// missing template is the default one
+	w = httptest.NewRecorder()
+	Error(w, httptest.NewRequest("GET", "/", nil), cfg, http.StatusNotFound, nil, "")
+	if body := w.Body.String(); !strings.Contains(body, "Page not found") {
+		t.Errorf("failed default error page: %v", body)
+	}
+}
+
+func TestErrorLanguage(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	values := []struct {
+		accept   string
+		expected []string
+	}{
+		{accept: "", expected: []string{"Unigma - Not found", "Page not found"}},
+		{accept: "ru-RU,ru;q=0.9,en;q=0.8", expected: []string{"Unigma - Не найдено", "Страница не найдена"}},
+		{accept: "de", expected: []string{"Unigma - Not found", "Page not found"}},
+	}
+	for i, v := range values {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/"+strings.Repeat("a", 64), nil)
+		if v.accept != "" {
+			r.Header.Set("Accept-Language", v.accept)
+		}
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		if code != http.StatusNotFound {
+			t.Errorf("[%v] failed code: %v", i, code)
+		}
+		body := w.Body.String()
+		for _, s := range v.expected {
+			if !strings.Contains(body, s) {
+				t.Errorf("[%v] missed %q in %v", i, s, body)
+			}
+		}
+	}
+	// index page
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "ru")
+	if _, err = Index(w, r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Срок хранения") {
+		t.Errorf("not localized index: %v", body)
+	}
+}
+
 func TestUpload(t *testing.T) {
 	cfg, err := conf.New(testConfig, loggerInfo)
 	if err != nil {
@@ -183,6 +479,10 @@ func TestUpload(t *testing.T) {
 			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "a", Password: ""},
 			Code: http.StatusBadRequest,
 		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: "abc"},
+			Code: http.StatusBadRequest,
+		},
 	}
 	for i, tc := range values {
 		body, contentType, err := createForm(tc.F)
@@ -229,6 +529,94 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+func TestUploadExtensions(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.BlockedExtensions = []string{".exe"}
+	cfg.Settings.AllowedExtensions = []string{".pdf", ".tar.gz"}
+	values := []struct {
+		FileName string
+		Code     int
+	}{
+		{FileName: "test.pdf", Code: http.StatusOK},
+		{FileName: "TEST.PDF", Code: http.StatusOK},
+		{FileName: "test.tar.gz", Code: http.StatusOK},
+		{FileName: "test.exe", Code: http.StatusBadRequest},
+		{FileName: "test.pdf.exe", Code: http.StatusBadRequest},
+		{FileName: "test.txt", Code: http.StatusBadRequest},
+	}
+	for i, tc := range values {
+		f := &formData{File: "content", FileName: tc.FileName, TTL: "10", Times: "1", Password: "test"}
+		for j, upload := range []func(io.Writer, *http.Request, *conf.Cfg) (int, error){Upload, UploadJSON} {
+			body, contentType, err := createForm(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/upload", body)
+			r.Header.Set("Content-Type", contentType)
+			code, err := upload(w, r, cfg)
+			if code != tc.Code {
+				t.Errorf("[%v/%v] failed code %v!=%v", i, j, code, tc.Code)
+			}
+			if tc.Code == http.StatusOK {
+				if err != nil {
+					t.Errorf("[%v/%v] unexpected error: %v", i, j, err)
+				}
+				continue
+			}
+			if msg := "file type of " + tc.FileName + " is not allowed"; !strings.Contains(w.Body.String(), msg) {
+				t.Errorf("[%v/%v] no error message: %v", i, j, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	used, err := cfg.SizeCache.Get(cfg.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "content"
+	cfg.Settings.MaxStorageBytes = used + int64(len(content)) + 3
+	codes := []int{http.StatusOK, http.StatusInsufficientStorage, http.StatusInsufficientStorage}
+	for i, expected := range codes {
+		body, contentType, err := createForm(&formData{File: content, FileName: "test.txt", TTL: "10", Times: "1", Password: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		if code != expected {
+			t.Errorf("[%v] failed code %v!=%v", i, code, expected)
+		}
+		if (code == http.StatusInsufficientStorage) && !strings.Contains(w.Body.String(), errQuota.Error()) {
+			t.Errorf("[%v] failed response: %v", i, w.Body.String())
+		}
+	}
+	if size, err := cfg.SizeCache.Get(cfg.Db); (err != nil) || (size != used+int64(len(content))) {
+		t.Errorf("failed cached size: %v, %v", size, err)
+	}
+}
+
 func TestDownload(t *testing.T) {
 	cfg, err := conf.New(testConfig, loggerInfo)
 	if err != nil {
@@ -249,7 +637,9 @@ func TestDownload(t *testing.T) {
 	}
 	period := 500 * time.Millisecond
 	monitorClosed := make(chan struct{})
-	go db.GCMonitor(cfg.Ch, monitorClosed, cfg.Db, loggerInfo, loggerInfo, period)
+	gc := NewGCConfig(cfg, loggerInfo, loggerInfo)
+	gc.Period, gc.Grace = period, 0
+	go db.GCMonitor(cfg.Ch, monitorClosed, gc)
 	defer func() {
 		close(monitorClosed)
 		time.Sleep(period)
@@ -290,10 +680,13 @@ func TestDownload(t *testing.T) {
 		if !strings.Contains(string(b), content) {
 			t.Errorf("missed content [%v]", i)
 		}
+		if cl := resp.Header.Get("Content-Length"); cl != fmt.Sprint(len(content)) {
+			t.Errorf("failed content length [%v]: %v", i, cl)
+		}
 	}
 }
 
-func TestUploadShort(t *testing.T) {
+func TestUploadShortFormat(t *testing.T) {
 	cfg, err := conf.New(testConfig, loggerInfo)
 	if err != nil {
 		t.Fatal(err)
@@ -303,77 +696,353 @@ func TestUploadShort(t *testing.T) {
 			t.Error(err)
 		}
 	}()
-	values := []*uploadTestCase{
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: "test"},
-			Code: http.StatusOK,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt"},
-			Code: http.StatusOK,
-		},
-		{
-			F:    &formData{File: "content", TTL: "10", Password: "test"},
-			Code: http.StatusBadRequest,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: ""},
-			Code: http.StatusOK,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "604800", Times: "1000", Password: "test"},
-			Code: http.StatusOK,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "604801", Times: "1000", Password: "test"},
-			Code: http.StatusBadRequest,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "604800", Times: "1001", Password: "test"},
-			Code: http.StatusBadRequest,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "a", Times: "1", Password: ""},
-			Code: http.StatusBadRequest,
-		},
-		{
-			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "a", Password: ""},
-			Code: http.StatusBadRequest,
-		},
+	rgURL := regexp.MustCompile(`^http://[^/]+/([0-9a-f]{64})\n$`)
+	values := []struct {
+		query  string
+		accept string
+		code   int
+		format string
+	}{
+		{code: http.StatusOK, format: conf.ShortVerbose},
+		{query: "?format=verbose", accept: "application/json", code: http.StatusOK, format: conf.ShortVerbose},
+		{query: "?format=plain-url", code: http.StatusOK, format: conf.ShortURL},
+		{accept: "text/uri-list", code: http.StatusOK, format: conf.ShortURL},
+		{query: "?format=json", code: http.StatusOK, format: conf.ShortJSON},
+		{accept: "application/json, text/plain", code: http.StatusOK, format: conf.ShortJSON},
+		{accept: "*/*", code: http.StatusOK, format: conf.ShortVerbose},
+		{query: "?format=xml", code: http.StatusBadRequest},
 	}
 	for i, tc := range values {
-		body, contentType, err := createForm(tc.F)
+		body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", Password: "test"})
 		if err != nil {
 			t.Fatal(err)
 		}
 		wr := httptest.NewRecorder()
-		r := httptest.NewRequest("POST", "/u", body)
+		r := httptest.NewRequest("POST", "/u"+tc.query, body)
 		r.Header.Set("Content-Type", contentType)
-
-		errExpected := tc.Code != http.StatusOK
-		code, err := UploadShort(wr, r, cfg)
-		if !errExpected && (err != nil) {
-			t.Error(err)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
 		}
-		if code != tc.Code {
-			t.Errorf("[%v] failed code %v!=%v", i, code, tc.Code)
+		code, err := UploadShort(wr, r, cfg)
+		if code != tc.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, tc.code)
 		}
-		if errExpected {
+		if code != http.StatusOK {
+			if err == nil {
+				t.Errorf("[%v] expected error", i)
+			}
 			continue
 		}
-		// only status 200
-		b := make([]byte, 1024)
+		if err != nil {
+			t.Errorf("[%v] unexpected error: %v", i, err)
+		}
 		resp := wr.Result()
-		_, err = resp.Body.Read(b)
+		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		finds := rgShortCheck.FindStringSubmatch(string(b))
-		if l := len(finds); l != 3 {
-			t.Fatalf("failed result check lenght: %v", l)
+		switch tc.format {
+		case conf.ShortVerbose:
+			if finds := rgShortCheck.FindStringSubmatch(string(b)); len(finds) != 3 {
+				t.Errorf("[%v] failed verbose response: %s", i, b)
+			}
+		case conf.ShortURL:
+			if !rgURL.Match(b) {
+				t.Errorf("[%v] failed plain-url response: %s", i, b)
+			}
+		case conf.ShortJSON:
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("[%v] failed content type: %v", i, ct)
+			}
+			result := &UploadResult{}
+			if err = json.Unmarshal(b, result); err != nil {
+				t.Fatalf("[%v] %v", i, err)
+			}
+			if !rgURL.MatchString(result.URL+"\n") || (result.Password != "test") || (result.Owner == "") {
+				t.Errorf("[%v] failed json response: %s", i, b)
+			}
 		}
-		key := finds[2]
-
+	}
+}
+
+func TestUploadErrorCodes(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.Size = 1
+	cfg.Settings.MinPasswordLength = 4
+	cfg.Settings.BlockedExtensions = []string{".exe"}
+	values := []struct {
+		F     *formData
+		query string
+		code  int
+		err   string
+	}{
+		{F: &formData{File: "content", FileName: "a.txt", TTL: "a"}, code: http.StatusBadRequest, err: CodeInvalidTTL},
+		{F: &formData{File: "content", FileName: "a.txt", TTL: "604801"}, code: http.StatusBadRequest, err: CodeInvalidTTL},
+		{F: &formData{File: "content", FileName: "a.txt", Times: "0"}, code: http.StatusBadRequest, err: CodeInvalidTimes},
+		{F: &formData{File: "content", FileName: "a.txt", Password: "abc"}, code: http.StatusBadRequest, err: CodeInvalidPassword},
+		{F: &formData{File: "content", FileName: "a.exe"}, code: http.StatusBadRequest, err: CodeFileNotAllowed},
+		{F: &formData{}, code: http.StatusBadRequest, err: CodeFileRequired},
+		{
+			F:    &formData{File: strings.Repeat("a", cfg.MaxFileSize()+1), FileName: "a.txt"},
+			code: http.StatusRequestEntityTooLarge,
+			err:  CodeFileTooLarge,
+		},
+		{F: &formData{File: "content", FileName: "a.txt"}, query: "?format=xml", code: http.StatusBadRequest, err: CodeInvalidFormat},
+	}
+	for i, tc := range values {
+		for _, format := range []string{conf.ShortVerbose, conf.ShortJSON, "api"} {
+			body, contentType, err := createForm(tc.F)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			query := tc.query
+			if query == "" {
+				query = "?format=" + format
+			}
+			r := httptest.NewRequest("POST", "/u"+query, body)
+			r.Header.Set("Content-Type", contentType)
+			var code int
+			if format == "api" {
+				if tc.query != "" {
+					continue // format is not used by JSON API
+				}
+				code, _ = UploadJSON(w, r, cfg)
+			} else {
+				code, _ = UploadShort(w, r, cfg)
+			}
+			if code != tc.code {
+				t.Errorf("[%v-%v] failed status %v", i, format, code)
+			}
+			if (format == conf.ShortVerbose) || (tc.query != "") {
+				if b := w.Body.String(); !strings.HasPrefix(b, "ERROR: ") || !strings.HasSuffix(b, "\nCode: "+tc.err+"\n") {
+					t.Errorf("[%v-%v] failed text error: %v", i, format, b)
+				}
+				continue
+			}
+			result := &ErrorResult{}
+			if err = json.Unmarshal(w.Body.Bytes(), result); err != nil {
+				t.Fatalf("[%v-%v] %v", i, format, err)
+			}
+			if (result.Code != tc.err) || (result.Error == "") {
+				t.Errorf("[%v-%v] failed error result: %+v", i, format, result)
+			}
+		}
+	}
+	if code := errorCode(http.StatusInternalServerError, errors.New("internal")); code != CodeServerError {
+		t.Errorf("failed internal error code: %v", code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	active, err := db.ActiveCount(cfg.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		item.Storage = cfg.Backend
+		if err := item.Delete(cfg.Db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	code, err := Status(w, httptest.NewRequest("GET", "/status", nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	fields := make(map[string]interface{})
+	if err = json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	// only aggregated value, the expired item is not counted
+	if (len(fields) != 1) || (fields["active"] != float64(active)) {
+		t.Errorf("failed status: %v", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	if code, _ = Status(w, httptest.NewRequest("POST", "/status", nil), cfg); code != http.StatusMethodNotAllowed {
+		t.Errorf("failed code: %v", code)
+	}
+}
+
+func TestSaltVersions(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	rgURL := regexp.MustCompile(`^http://[^/]+/([0-9a-f]{64})\n$`)
+	upload := func() *db.Item {
+		body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", Password: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/u?format=plain-url", body)
+		r.Header.Set("Content-Type", contentType)
+		if _, err = UploadShort(w, r, cfg); err != nil {
+			t.Fatal(err)
+		}
+		finds := rgURL.FindStringSubmatch(w.Body.String())
+		if len(finds) != 2 {
+			t.Fatalf("failed response: %v", w.Body.String())
+		}
+		item, err := db.Read(cfg.Db, finds[1], loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	download := func(item *db.Item) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password=test"))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("failed code %v for salt version %q", code, item.SaltVersion)
+		}
+		if s := w.Body.String(); s != "content" {
+			t.Errorf("failed content for salt version %q", item.SaltVersion)
+		}
+	}
+	legacy := upload()
+	cfg.Salts = map[string]string{"v1": "first-salt-value-1234"}
+	cfg.SaltVersion = "v1"
+	first := upload()
+	// rotation, the previous version is kept for stored items
+	cfg.Salts["v2"] = "second-salt-value-1234"
+	cfg.SaltVersion = "v2"
+	second := upload()
+	for i, version := range []string{"", "v1", "v2"} {
+		item := []*db.Item{legacy, first, second}[i]
+		if item.SaltVersion != version {
+			t.Errorf("[%v] failed salt version %q", i, item.SaltVersion)
+		}
+	}
+	// keys differ for versions, so the salt is really used
+	if _, err = first.IsValidSecret(cfg.Secret("test", "v2")); err == nil {
+		t.Error("expected error for other salt version")
+	}
+	for _, item := range []*db.Item{legacy, first, second} {
+		download(item)
+	}
+}
+
+func TestUploadShort(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	values := []*uploadTestCase{
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: "test"},
+			Code: http.StatusOK,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt"},
+			Code: http.StatusOK,
+		},
+		{
+			F:    &formData{File: "content", TTL: "10", Password: "test"},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: ""},
+			Code: http.StatusOK,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "604800", Times: "1000", Password: "test"},
+			Code: http.StatusOK,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "604801", Times: "1000", Password: "test"},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "604800", Times: "1001", Password: "test"},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "a", Times: "1", Password: ""},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "a", Password: ""},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: "abc"},
+			Code: http.StatusBadRequest,
+		},
+	}
+	for i, tc := range values {
+		body, contentType, err := createForm(tc.F)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/u", body)
+		r.Header.Set("Content-Type", contentType)
+
+		errExpected := tc.Code != http.StatusOK
+		code, err := UploadShort(wr, r, cfg)
+		if !errExpected && (err != nil) {
+			t.Error(err)
+		}
+		if code != tc.Code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, tc.Code)
+		}
+		if errExpected {
+			continue
+		}
+		// only status 200
+		b := make([]byte, 1024)
+		resp := wr.Result()
+		_, err = resp.Body.Read(b)
+		if err != nil {
+			t.Error(err)
+		}
+		finds := rgShortCheck.FindStringSubmatch(string(b))
+		if l := len(finds); l != 3 {
+			t.Fatalf("failed result check lenght: %v", l)
+		}
+		key := finds[2]
+
 		wr = httptest.NewRecorder()
 		r = httptest.NewRequest("GET", "/"+key, nil)
 		code, err = Download(wr, r, cfg)
@@ -385,3 +1054,3904 @@ func TestUploadShort(t *testing.T) {
 		}
 	}
 }
+
+func TestValidatePassword(t *testing.T) {
+	cfg := &conf.Cfg{}
+	cfg.Settings.MinPasswordLength = 6
+	values := []struct {
+		Password string
+		Strong   bool
+		Err      bool
+	}{
+		{Password: "", Err: true},
+		{Password: "abc", Err: true},
+		{Password: "абвгд", Err: true},
+		{Password: "abcdef"},
+		{Password: "абвгде"},
+		{Password: "abcdef", Strong: true, Err: true},
+		{Password: "123456", Strong: true, Err: true},
+		{Password: "abcde1", Strong: true},
+		{Password: "Abcdef", Strong: true},
+		{Password: "abcde!", Strong: true},
+	}
+	for i, v := range values {
+		cfg.Settings.StrongPassword = v.Strong
+		err := validatePassword(v.Password, cfg)
+		if v.Err && (err == nil) {
+			t.Errorf("[%v] unexpected result", i)
+		}
+		if !v.Err && (err != nil) {
+			t.Errorf("[%v] %v", i, err)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	values := []struct {
+		Value string
+		Start int64
+		End   int64
+		Err   bool
+	}{
+		{Value: "bytes=0-9", Start: 0, End: 9},
+		{Value: "bytes=5-", Start: 5, End: 99},
+		{Value: "bytes=-10", Start: 90, End: 99},
+		{Value: "bytes=-200", Start: 0, End: 99},
+		{Value: "bytes=90-200", Start: 90, End: 99},
+		{Value: "bytes=100-", Err: true},
+		{Value: "bytes=5-1", Err: true},
+		{Value: "bytes=0-1,5-9", Err: true},
+		{Value: "items=0-9", Err: true},
+		{Value: "bytes=a-9", Err: true},
+	}
+	for i, v := range values {
+		start, end, err := parseRange(v.Value, 100)
+		if v.Err {
+			if err == nil {
+				t.Errorf("[%v] unexpected result", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%v] %v", i, err)
+			continue
+		}
+		if (start != v.Start) || (end != v.End) {
+			t.Errorf("[%v] failed range %v-%v", i, start, end)
+		}
+	}
+}
+
+func TestDownloadWebhook(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	events := make(chan *webhook.Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if s := r.Header.Get(webhook.HeaderSignature); s != "sha256="+webhook.Sign(body, "hook") {
+			t.Errorf("failed signature: %v", s)
+		}
+		e := &webhook.Event{}
+		if err = json.Unmarshal(body, e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer server.Close()
+	cfg.Webhook = webhook.New(server.URL, "hook", 1, time.Second, loggerInfo)
+
+	secret := "secret"
+	item, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Db.Exec("UPDATE `storage` SET `counter`=2 WHERE `id`=?;", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	code, err := Download(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	cfg.Webhook.Close()
+	cfg.Webhook = nil
+	select {
+	case e := <-events:
+		if (e.Event != webhook.EventDownload) || (e.Hash != item.Hash) || (e.Remaining != 1) || (e.ClientIP != "192.0.2.1") {
+			t.Errorf("failed event: %+v", e)
+		}
+	default:
+		t.Error("no webhook event")
+	}
+	if err = item.Delete(cfg.Db, loggerInfo); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadInline(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	values := []struct {
+		Name        string
+		Query       string
+		Disposition string
+	}{
+		{Name: "test.png", Query: "?inline=1", Disposition: "inline"},
+		{Name: "test.png", Disposition: "attachment"},
+		{Name: "test.html", Query: "?inline=1", Disposition: "attachment"},
+		{Name: "test.svg", Query: "?inline=1", Disposition: "attachment"},
+	}
+	for i, tc := range values {
+		now := time.Now().UTC()
+		item := &db.Item{
+			Name:    tc.Name,
+			Path:    testStorage,
+			Counter: 1,
+			Storage: cfg.Backend,
+			Created: now,
+			Expired: now.Add(time.Minute),
+		}
+		if err = item.Encrypt(strings.NewReader("content"), cfg.Secret(secret, item.SaltVersion), loggerInfo); err != nil {
+			t.Fatal(err)
+		}
+		if err = item.Save(cfg.Db); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash+tc.Query, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("[%v] failed code: %v", i, code)
+		}
+		expected := fmt.Sprintf("%v; filename=\"%v\"", tc.Disposition, tc.Name)
+		if cd := w.Header().Get("Content-disposition"); cd != expected {
+			t.Errorf("[%v] failed disposition: %v", i, cd)
+		}
+		if err = item.Delete(cfg.Db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}
+	if !db.IsInlineType("text/plain; charset=utf-8") || db.IsInlineType("text/html; charset=utf-8") {
+		t.Error("failed inline types")
+	}
+}
+
+func TestDownloadFileName(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	values := []struct {
+		Query       string
+		Disposition string
+	}{
+		{Query: "", Disposition: `attachment; filename="test.txt"`},
+		{Query: "?filename=" + url.QueryEscape("a\r\nX-Bad: 1.txt"), Disposition: `attachment; filename="aX-Bad: 1.txt"`},
+		{Query: "?filename=" + url.QueryEscape("файл.txt"), Disposition: `attachment; filename="____.txt"; filename*=UTF-8''%D1%84%D0%B0%D0%B9%D0%BB.txt`},
+	}
+	for i, tc := range values {
+		item, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash+tc.Query, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("[%v] failed code: %v", i, code)
+		}
+		if cd := w.Header().Get("Content-disposition"); cd != tc.Disposition {
+			t.Errorf("[%v] failed disposition: %v", i, cd)
+		}
+		if len(w.Header()["X-Bad"]) > 0 {
+			t.Errorf("[%v] injected header", i)
+		}
+		item.Storage = cfg.Backend
+		if err = item.Delete(cfg.Db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDownloadGzip(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	content := strings.Repeat("compressible text content\n", 100)
+	values := []struct {
+		AcceptEncoding string
+		Compressed     bool
+	}{
+		{AcceptEncoding: "gzip, deflate", Compressed: true},
+		{AcceptEncoding: "br;q=1.0, gzip;q=0.5", Compressed: true},
+		{AcceptEncoding: "gzip;q=0", Compressed: false},
+		{AcceptEncoding: "", Compressed: false},
+	}
+	for i, tc := range values {
+		item, err := createItem(cfg, secret, content, time.Now().UTC().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if tc.AcceptEncoding != "" {
+			r.Header.Add("Accept-Encoding", tc.AcceptEncoding)
+		}
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("[%v] failed code: %v", i, code)
+		}
+		body := w.Body.Bytes()
+		if tc.Compressed {
+			if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+				t.Errorf("[%v] failed content encoding: %v", i, ce)
+			}
+			if cl := w.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("[%v] unexpected content length: %v", i, cl)
+			}
+			if len(body) >= len(content) {
+				t.Errorf("[%v] not compressed body size: %v", i, len(body))
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err = ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("[%v] unexpected content encoding: %v", i, ce)
+		}
+		if string(body) != content {
+			t.Errorf("[%v] failed content", i)
+		}
+		item.Storage = cfg.Backend
+		if err = item.Delete(cfg.Db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	content := "0123456789"
+	item, err := createItem(cfg, secret, content, time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func(rangeValue, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Add("Range", rangeValue)
+		if token != "" {
+			r.Header.Set(HeaderResume, token)
+		}
+		if _, err := Download(w, r, cfg); err != nil {
+			t.Logf("download error: %v", err)
+		}
+		return w
+	}
+	// the only download is counted by the first range
+	w := download("bytes=0-3", "")
+	token := w.Header().Get(HeaderResume)
+	if (w.Code != http.StatusPartialContent) || (w.Body.String() != "0123") || (token == "") {
+		t.Fatalf("failed first range: %v, %q, %q", w.Code, w.Body.String(), token)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 0-3/10" {
+		t.Errorf("failed Content-Range: %v", cr)
+	}
+	values := []struct {
+		Range   string
+		Token   string
+		Code    int
+		Content string
+	}{
+		// other ranges without the token can't bypass the limit
+		{Range: "bytes=4-", Code: http.StatusNotFound},
+		{Range: "bytes=4-", Token: "1." + strings.Repeat("0", 64), Code: http.StatusNotFound},
+		{Range: "bytes=0-1,4-5", Token: token, Code: http.StatusRequestedRangeNotSatisfiable},
+		{Range: "bytes=20-", Token: token, Code: http.StatusRequestedRangeNotSatisfiable},
+		// the download is resumed without counting
+		{Range: "bytes=4-", Token: token, Code: http.StatusPartialContent, Content: "456789"},
+		{Range: "bytes=8-", Token: token, Code: http.StatusPartialContent, Content: "89"},
+	}
+	for i, v := range values {
+		w = download(v.Range, v.Token)
+		if w.Code != v.Code {
+			t.Errorf("[%v] failed code %v!=%v", i, w.Code, v.Code)
+		}
+		if (v.Code == http.StatusPartialContent) && (w.Body.String() != v.Content) {
+			t.Errorf("[%v] failed content %q", i, w.Body.String())
+		}
+		if (v.Code == http.StatusPartialContent) && (w.Header().Get(HeaderResume) != "") {
+			t.Errorf("[%v] resumed download has a new token", i)
+		}
+	}
+	// the token is bound to the item's key, so the password is still required
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password=wrong"))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Add("Range", "bytes=4-")
+	r.Header.Set(HeaderResume, token)
+	if code, _ := Download(w, r, cfg); code != http.StatusBadRequest {
+		t.Errorf("failed code of wrong password: %v", code)
+	}
+	// a plain request of the used item is not found
+	if w = download("", token); w.Code != http.StatusNotFound {
+		t.Errorf("failed code without range: %v", w.Code)
+	}
+	stored, _, err := db.ReadState(cfg.Db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (stored == nil) || (stored.Counter != 0) {
+		t.Fatalf("failed used item: %+v", stored)
+	}
+	if err = stored.Delete(cfg.Db, loggerInfo); err != nil {
+		t.Error(err)
+	}
+}
+
+// brokenWriter is a response writer which fails after limit bytes like a dropped connection.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (bw *brokenWriter) Write(p []byte) (int, error) {
+	if bw.Body.Len()+len(p) > bw.limit {
+		return 0, errors.New("connection reset")
+	}
+	return bw.ResponseRecorder.Write(p)
+}
+
+func TestUploadChecksum(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.VerifyChecksum = true
+	content := "checksum content"
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+	values := []struct {
+		checksum  string
+		code      int
+		errorCode string
+	}{
+		{checksum: checksum, code: http.StatusOK},
+		{checksum: strings.ToUpper(checksum), code: http.StatusOK},
+		{checksum: strings.Repeat("0", 64), code: http.StatusBadRequest, errorCode: CodeChecksumMismatch},
+		{checksum: "abc", code: http.StatusBadRequest, errorCode: CodeInvalidChecksum},
+	}
+	for i, v := range values {
+		body, contentType, err := createForm(&formData{File: content, FileName: "test.txt", Password: "test", SHA256: v.checksum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		if code != v.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, v.code)
+		}
+		if code != http.StatusOK {
+			if !strings.Contains(w.Body.String(), v.errorCode) {
+				t.Errorf("[%v] failed response: %v", i, w.Body.String())
+			}
+			continue
+		}
+		result := &UploadResult{}
+		if err = json.NewDecoder(w.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		// the full download is verified by stored checksum
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", result.URL, strings.NewReader("password=test"))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, err = Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (code != http.StatusOK) || (w.Body.String() != content) {
+			t.Errorf("[%v] failed download: %v, %v", i, code, w.Body.String())
+		}
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.ContentTypes = []string{"text/plain", "application/json"}
+	values := []struct {
+		name        string
+		contentType string
+		code        int
+		expected    string
+	}{
+		{name: "data", contentType: "application/json", code: http.StatusOK, expected: "application/json"},
+		{name: "data", contentType: "Text/Plain; charset=UTF-8", code: http.StatusOK, expected: "text/plain; charset=UTF-8"},
+		{name: "test.json", contentType: "text/plain", code: http.StatusOK, expected: "text/plain"},
+		{name: "test.txt", code: http.StatusOK, expected: "text/plain; charset=utf-8"},
+		{name: "data", code: http.StatusOK, expected: "application/octet-stream"},
+		{name: "data", contentType: "text/html", code: http.StatusBadRequest},
+		{name: "data", contentType: "text/plain; name=x", code: http.StatusBadRequest},
+		{name: "data", contentType: "text/plain;;", code: http.StatusBadRequest},
+	}
+	for i, v := range values {
+		body, contentType, err := createForm(&formData{File: "content", FileName: v.name, Password: "test", ContentType: v.contentType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		if code != v.code {
+			t.Errorf("[%v] failed code %v!=%v: %v", i, code, v.code, w.Body.String())
+			continue
+		}
+		if code != http.StatusOK {
+			if !strings.Contains(w.Body.String(), CodeInvalidType) {
+				t.Errorf("[%v] failed response: %v", i, w.Body.String())
+			}
+			continue
+		}
+		result := &UploadResult{}
+		if err = json.NewDecoder(w.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", result.URL, strings.NewReader("password=test"))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept-Encoding", "identity")
+		code, err = Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("[%v] failed download code: %v", i, code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != v.expected {
+			t.Errorf("[%v] failed content type: %v", i, ct)
+		}
+	}
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Uploads, cfg.Downloads = limiter.NewSemaphore(1), limiter.NewSemaphore(1)
+	// the only slots are taken by other requests
+	for _, s := range []limiter.Semaphore{cfg.Uploads, cfg.Downloads} {
+		if !s.Acquire(context.Background(), 0) {
+			t.Fatal("not acquired")
+		}
+	}
+	// short request timeout to not wait the full period
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", Password: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/upload", body).WithContext(ctx)
+	r.Header.Set("Content-Type", contentType)
+	code, err := UploadJSON(w, r, cfg)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("failed upload code: %v", code)
+	}
+	if err != errBusy {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !strings.Contains(w.Body.String(), CodeServerBusy) || (w.Header().Get("Retry-After") == "") {
+		t.Errorf("failed busy response: %v", w.Body.String())
+	}
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func(ctx context.Context) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password=secret")).WithContext(ctx)
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if _, err := Download(w, r, cfg); (err != nil) && (err != errBusy) {
+			t.Fatal(err)
+		}
+		return w
+	}
+	if w = download(ctx); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("failed download code: %v", w.Code)
+	}
+	// the rejected download is not counted
+	stored, err := db.Read(cfg.Db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Counter != 1 {
+		t.Errorf("failed counter %v", stored.Counter)
+	}
+	cfg.Downloads.Release()
+	if w = download(context.Background()); (w.Code != http.StatusOK) || (w.Body.String() != "content") {
+		t.Errorf("failed download: %v, %v", w.Code, w.Body.String())
+	}
+	cfg.Uploads.Release()
+}
+
+func TestDownloadDeferredCounter(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	content := strings.Repeat("0123456789", 10000)
+	values := []struct {
+		deferred bool
+		counter  int
+	}{
+		{deferred: false, counter: 0},
+		{deferred: true, counter: 1},
+	}
+	for i, v := range values {
+		cfg.DeferredCounter = v.deferred
+		item, err := createItem(cfg, secret, content, time.Now().UTC().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &brokenWriter{ResponseRecorder: httptest.NewRecorder(), limit: 1024}
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if _, err = Download(w, r, cfg); err == nil {
+			t.Errorf("[%v] expected error", i)
+		}
+		stored, err := db.Read(cfg.Db, item.Hash, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Counter != v.counter {
+			t.Errorf("[%v] failed counter %v", i, stored.Counter)
+		}
+		if !v.deferred {
+			continue
+		}
+		// the next full download is counted
+		w = &brokenWriter{ResponseRecorder: httptest.NewRecorder(), limit: len(content)}
+		r = httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("[%v] failed code: %v", i, code)
+		}
+		if s := w.Body.String(); s != content {
+			t.Errorf("[%v] failed content", i)
+		}
+		if rem := w.Header().Get(HeaderRemaining); rem != "0" {
+			t.Errorf("[%v] failed remaining header: %v", i, rem)
+		}
+		stored, err = db.Read(cfg.Db, item.Hash, loggerInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Counter != 0 {
+			t.Errorf("[%v] failed counter %v", i, stored.Counter)
+		}
+	}
+}
+
+func TestUploadJSON(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	values := []*uploadTestCase{
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "2", Password: "test"},
+			Code: http.StatusOK,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt"},
+			Code: http.StatusOK,
+		},
+		{
+			F:    &formData{File: "content", TTL: "10", Password: "test"},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "604801", Times: "1000", Password: "test"},
+			Code: http.StatusBadRequest,
+		},
+		{
+			F:    &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "a", Password: ""},
+			Code: http.StatusBadRequest,
+		},
+	}
+	for i, tc := range values {
+		body, contentType, err := createForm(tc.F)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+
+		errExpected := tc.Code != http.StatusOK
+		code, err := UploadJSON(wr, r, cfg)
+		if !errExpected && (err != nil) {
+			t.Error(err)
+		}
+		if code != tc.Code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, tc.Code)
+		}
+		resp := wr.Result()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("[%v] failed content type: %v", i, ct)
+		}
+		if errExpected {
+			errResult := &ErrorResult{}
+			if err = json.NewDecoder(resp.Body).Decode(errResult); err != nil {
+				t.Errorf("[%v] %v", i, err)
+			}
+			if errResult.Error == "" {
+				t.Errorf("[%v] empty error", i)
+			}
+			continue
+		}
+		// only status 200
+		result := &UploadResult{}
+		if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		if (tc.F.Password != "") && (result.Password != tc.F.Password) {
+			t.Errorf("[%v] failed password: %v", i, result.Password)
+		}
+		if result.Password == "" {
+			t.Errorf("[%v] empty password", i)
+		}
+		if (tc.F.Times != "") && (fmt.Sprint(result.Times) != tc.F.Times) {
+			t.Errorf("[%v] failed times: %v", i, result.Times)
+		}
+		if !result.Expired.After(time.Now()) {
+			t.Errorf("[%v] failed expired: %v", i, result.Expired)
+		}
+		finds := rgJSONCheck.FindStringSubmatch(result.URL)
+		if l := len(finds); l != 3 {
+			t.Fatalf("failed result check lenght: %v", l)
+		}
+		wr = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/"+finds[2], nil)
+		code, err = Download(wr, r, cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("failed code: %v", code)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []struct {
+		Path string
+		Code int
+	}{
+		{Path: "/" + item.Hash + "/info", Code: http.StatusOK},
+		{Path: "/" + item.Hash + "/info", Code: http.StatusOK},
+		{Path: "/abc/info", Code: http.StatusNotFound},
+		{Path: "/ab117372d41c05ba9ee4d4ea2f9ebab8e838990e4ff3316bb8c38cfb3ec2afc2/info", Code: http.StatusNotFound},
+	}
+	for i, v := range values {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", v.Path, nil)
+		code, err := Info(w, r, cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		if code != v.Code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, v.Code)
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		result := &InfoResult{}
+		if err = json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Remaining != 1 {
+			t.Errorf("[%v] failed remaining: %v", i, result.Remaining)
+		}
+		if result.ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("[%v] failed content type: %v", i, result.ContentType)
+		}
+		if strings.Contains(w.Body.String(), item.Name) {
+			t.Errorf("[%v] name is leaked", i)
+		}
+	}
+	stored, err := db.Read(cfg.Db, item.Hash, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Counter != 1 {
+		t.Errorf("failed counter %v", stored.Counter)
+	}
+	if err = stored.Delete(cfg.Db, loggerInfo); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	code, err := Metrics(w, httptest.NewRequest("GET", "/metrics", nil), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusNotFound {
+		t.Errorf("failed code for disabled metrics: %v", code)
+	}
+	cfg.Collector = metrics.NewPrometheus()
+	body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	code, err = Upload(httptest.NewRecorder(), r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("failed code: %v", code)
+	}
+	w = httptest.NewRecorder()
+	code, err = Metrics(w, httptest.NewRequest("GET", "/metrics", nil), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	if s := w.Body.String(); !strings.Contains(s, "unigma_uploads_total 1") {
+		t.Errorf("failed metrics: %v", s)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.Size = 1
+	files, err := ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(files)
+	// file is larger than max size but the body is in limits, and the body exceeds limits
+	sizes := []int{cfg.MaxFileSize() + 1, cfg.MaxFileSize() + formReserve + 1}
+	handlers := []func(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error){Upload, UploadShort, UploadJSON}
+	for i, size := range sizes {
+		for j, handler := range handlers {
+			f := &formData{File: strings.Repeat("a", size), FileName: "test.txt", TTL: "10", Times: "1", Password: "test"}
+			body, contentType, err := createForm(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wr := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/upload", body)
+			r.Header.Set("Content-Type", contentType)
+			code, err := handler(wr, r, cfg)
+			if err == nil {
+				t.Errorf("[%v-%v] expected error", i, j)
+			}
+			if code != http.StatusRequestEntityTooLarge {
+				t.Errorf("[%v-%v] failed code %v", i, j, code)
+			}
+		}
+	}
+	files, err = ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(files); n != before {
+		t.Errorf("failed storage files number %v!=%v", n, before)
+	}
+}
+
+func TestUploadSaveFailed(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(cfg.Ch)
+	// closed database can't save items
+	if err = cfg.Db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(files)
+	handlers := []func(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error){Upload, UploadShort, UploadJSON}
+	for i, handler := range handlers {
+		f := &formData{File: "content", FileName: "test.txt", TTL: "10", Times: "1", Password: "test"}
+		body, contentType, err := createForm(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, err := handler(wr, r, cfg)
+		if err == nil {
+			t.Errorf("[%v] expected error", i)
+		}
+		if code != http.StatusInternalServerError {
+			t.Errorf("[%v] failed code %v", i, code)
+		}
+	}
+	files, err = ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(files); n != before {
+		t.Errorf("failed storage files number %v!=%v", n, before)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.168.1.1:12345"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	if ip := clientIP(r, false); ip != "192.168.1.1" {
+		t.Errorf("failed ip: %v", ip)
+	}
+	if ip := clientIP(r, true); ip != "10.0.0.1" {
+		t.Errorf("failed proxy ip: %v", ip)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if ip := clientIP(r, true); ip != "192.168.1.1" {
+		t.Errorf("failed ip without header: %v", ip)
+	}
+	cfg := &conf.Cfg{LogClientIP: logging.ClientIPOff}
+	if ip := LogIP(WithLogIP(r, cfg)); ip != "" {
+		t.Errorf("unexpected logged ip: %v", ip)
+	}
+	cfg.LogClientIP = logging.ClientIPFull
+	if ip := LogIP(WithLogIP(r, cfg)); ip != "192.168.1.1" {
+		t.Errorf("failed logged ip: %v", ip)
+	}
+	cfg.LogClientIP = logging.ClientIPTruncated
+	if ip := LogIP(WithLogIP(r, cfg)); ip != "192.168.1.0" {
+		t.Errorf("failed truncated ip: %v", ip)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Limiter = limiter.New(3, time.Minute)
+	secret := "secret"
+	item, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Db.Exec("UPDATE `storage` SET `counter`=10 WHERE `id`=?;", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []*downloadTestCase{
+		{Hash: item.Hash, Password: "bad", Code: http.StatusBadRequest},
+		{Hash: item.Hash, Password: "bad", Code: http.StatusBadRequest},
+		{Hash: item.Hash, Password: secret, Code: http.StatusOK}, // not blocked by previous failures
+		{Hash: item.Hash, Password: "bad", Code: http.StatusBadRequest},
+		{Hash: item.Hash, Password: "bad", Code: http.StatusTooManyRequests},
+		{Hash: item.Hash, Password: secret, Code: http.StatusTooManyRequests},
+	}
+	for i, tc := range values {
+		body := strings.NewReader("password=" + tc.Password)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+tc.Hash, body)
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, _ := Download(w, r, cfg)
+		if code != tc.Code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, tc.Code)
+		}
+	}
+	// other client is not limited
+	body := strings.NewReader("password=" + secret)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/"+item.Hash, body)
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.168.1.1:12345"
+	code, err := Download(w, r, cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code for other client: %v", code)
+	}
+	// parallel guesses of one client can't exceed the limit before their passwords are checked
+	n := 10
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password=bad"))
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			r.RemoteAddr = "192.168.1.2:12345"
+			code, _ := Download(httptest.NewRecorder(), r, cfg)
+			codes <- code
+		}()
+	}
+	checked := 0
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case http.StatusBadRequest:
+			checked++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("failed parallel code: %v", code)
+		}
+	}
+	if checked != 3 {
+		t.Errorf("failed number of checked passwords: %v", checked)
+	}
+}
+
+func TestDownloadConfirm(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret, content := "secret", "content"
+	item, err := createItem(cfg, secret, content, time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Db.Exec("UPDATE `storage` SET `confirm`=1 WHERE `id`=?;", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(form string, cookies ...*http.Cookie) *http.Request {
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader(form))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return r
+	}
+	// confirmation page instead of the password form
+	w := httptest.NewRecorder()
+	code, err := Download(w, httptest.NewRequest("GET", "/"+item.Hash, nil), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `name="confirm"`) {
+		t.Errorf("not confirmation page: %v", body)
+	}
+	// password without confirmation
+	w = httptest.NewRecorder()
+	code, err = Download(w, post("password="+secret), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusForbidden {
+		t.Errorf("failed code without confirmation: %v", code)
+	}
+	// confirmation
+	w = httptest.NewRecorder()
+	code, err = Download(w, post("confirm=1"), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed confirmation code: %v", code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("failed cookies: %v", cookies)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `name="password"`) {
+		t.Errorf("not password page: %v", body)
+	}
+	// bad token
+	w = httptest.NewRecorder()
+	badCookie := &http.Cookie{Name: cookies[0].Name, Value: "bad"}
+	code, _ = Download(w, post("password="+secret, badCookie), cfg)
+	if code != http.StatusForbidden {
+		t.Errorf("failed code with bad token: %v", code)
+	}
+	// download
+	w = httptest.NewRecorder()
+	code, err = Download(w, post("password="+secret, cookies[0]), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed download code: %v", code)
+	}
+	if body := w.Body.String(); body != content {
+		t.Errorf("failed content: %v", body)
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	item, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Db.Exec("UPDATE `storage` SET `counter`=3 WHERE `id`=?;", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	code, err := Download(w, r, cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	resp := w.Result()
+	if v := resp.Header.Get(HeaderRemaining); v != "2" {
+		t.Errorf("failed remaining header: %v", v)
+	}
+	if v := resp.Header.Get(HeaderExpires); v != item.Expired.Format(time.RFC3339) {
+		t.Errorf("failed expires header: %v", v)
+	}
+	if v := resp.Header.Get("Cache-Control"); v != "no-store, private" {
+		t.Errorf("failed cache-control header: %v", v)
+	}
+	if v := resp.Header.Get("Pragma"); v != "no-cache" {
+		t.Errorf("failed pragma header: %v", v)
+	}
+	if v := resp.Header.Get("X-Robots-Tag"); v != "noindex, nofollow" {
+		t.Errorf("failed robots header: %v", v)
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	code, err := Favicon(w, httptest.NewRequest("GET", "/favicon.ico", nil), cfg)
+	if (err != nil) || (code != http.StatusOK) || (w.Code != http.StatusOK) {
+		t.Fatalf("failed favicon: %v, %v", code, err)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") {
+		t.Errorf("failed content type: %v", ct)
+	}
+	if cc := w.Result().Header.Get("Cache-Control"); cc != "public, max-age=604800" {
+		t.Errorf("failed cache control: %v", cc)
+	}
+	if _, err = png.Decode(w.Body); err != nil {
+		t.Errorf("failed image: %v", err)
+	}
+	// static directory
+	dir, err := ioutil.TempDir("", "unigma-static-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	files := map[string]string{"favicon.ico": "custom icon", "style.css": "body {}", ".hidden": "secret"}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cfg.StaticDir = dir
+	w = httptest.NewRecorder()
+	if code, err = Favicon(w, httptest.NewRequest("GET", "/favicon.ico", nil), cfg); (err != nil) || (code != http.StatusOK) {
+		t.Fatalf("failed custom favicon: %v, %v", code, err)
+	}
+	if body := w.Body.String(); body != files["favicon.ico"] {
+		t.Errorf("failed custom favicon: %v", body)
+	}
+	values := []struct {
+		path string
+		code int
+	}{
+		{path: "/static/style.css", code: http.StatusOK},
+		{path: "/static/missing.css", code: http.StatusNotFound},
+		{path: "/static/.hidden", code: http.StatusNotFound},
+		{path: "/static/sub", code: http.StatusNotFound},
+		{path: "/static/sub/../style.css", code: http.StatusNotFound},
+		{path: "/static/", code: http.StatusNotFound},
+	}
+	for i, v := range values {
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = v.path
+		if code, _ = Static(w, r, cfg); code != v.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, v.code)
+		}
+	}
+	w = httptest.NewRecorder()
+	if code, _ = Static(w, httptest.NewRequest("GET", "/static/style.css", nil), cfg); code != http.StatusOK {
+		t.Fatalf("failed static file: %v", code)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("failed content type: %v", ct)
+	}
+	if body := w.Body.String(); body != files["style.css"] {
+		t.Errorf("failed static file: %v", body)
+	}
+	// static files are not available without the directory
+	cfg.StaticDir = ""
+	if code, _ = Static(httptest.NewRecorder(), httptest.NewRequest("GET", "/static/style.css", nil), cfg); code != http.StatusNotFound {
+		t.Errorf("failed code without static dir: %v", code)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := httptest.NewRecorder()
+	code, err := Robots(w, httptest.NewRequest("GET", "/robots.txt", nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	if body := w.Body.String(); body != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("failed robots.txt: %v", body)
+	}
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the read page with the password form
+	w = httptest.NewRecorder()
+	if code, err = Download(w, httptest.NewRequest("GET", "/"+item.Hash, nil), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	if v := w.Header().Get("X-Robots-Tag"); v != "noindex, nofollow" {
+		t.Errorf("failed robots header: %v", v)
+	}
+	if !strings.Contains(w.Body.String(), `type="password"`) {
+		t.Errorf("failed read page: %v", w.Body.String())
+	}
+}
+
+func TestUploadArchive(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	files := map[string]string{"a.txt": "first content", "b.txt": "second content"}
+	var b bytes.Buffer
+	fw := multipart.NewWriter(&b)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := fw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fw.WriteField("password", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wr := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/upload", &b)
+	r.Header.Set("Content-Type", fw.FormDataContentType())
+	code, err := UploadJSON(wr, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("failed code: %v", code)
+	}
+	result := &UploadResult{}
+	if err = json.NewDecoder(wr.Result().Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	finds := rgJSONCheck.FindStringSubmatch(result.URL)
+	if l := len(finds); l != 3 {
+		t.Fatalf("failed result check lenght: %v", l)
+	}
+	wr = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/"+finds[2], strings.NewReader("password=test"))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	code, err = Download(wr, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("failed download code: %v", code)
+	}
+	resp := wr.Result()
+	if cd := resp.Header.Get("Content-disposition"); !strings.Contains(cd, "archive-2-files.tar") {
+		t.Errorf("failed name: %v", cd)
+	}
+	tr := tar.NewReader(resp.Body)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != files[hdr.Name] {
+			t.Errorf("failed content of %v: %s", hdr.Name, content)
+		}
+		n++
+	}
+	if n != len(files) {
+		t.Errorf("failed files number: %v", n)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, url, token string) *http.Request {
+		r := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	// disabled administration
+	code, _ := Admin(httptest.NewRecorder(), request("GET", "/admin/items", ""), cfg)
+	if code != http.StatusNotFound {
+		t.Errorf("failed code for disabled admin: %v", code)
+	}
+	cfg.AdminToken = "admin-token"
+	unauthorized := []*http.Request{
+		request("GET", "/admin/items", ""),
+		request("GET", "/admin/items", "bad"),
+		request("DELETE", "/admin/items/"+item.Hash, "bad"),
+	}
+	for i, r := range unauthorized {
+		code, _ = Admin(httptest.NewRecorder(), r, cfg)
+		if code != http.StatusUnauthorized {
+			t.Errorf("[%v] failed code %v", i, code)
+		}
+	}
+	w := httptest.NewRecorder()
+	code, err = Admin(w, request("GET", "/admin/items", cfg.AdminToken), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed list code: %v", code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, item.Salt) || strings.Contains(body, item.Name) {
+		t.Errorf("secret data in the list: %v", body)
+	}
+	var items []*AdminItem
+	if err = json.Unmarshal([]byte(body), &items); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, adminItem := range items {
+		if adminItem.Hash == item.Hash {
+			found = true
+			if (adminItem.Counter != item.Counter) || (adminItem.Size != item.Size) {
+				t.Errorf("failed item: %+v", adminItem)
+			}
+		}
+	}
+	if !found {
+		t.Error("item is not found")
+	}
+	code, err = Admin(httptest.NewRecorder(), request("DELETE", "/admin/items/"+item.Hash, cfg.AdminToken), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusNoContent {
+		t.Errorf("failed delete code: %v", code)
+	}
+	item.Storage = cfg.Backend
+	if item.IsFileExists() {
+		t.Error("file is not deleted")
+	}
+	code, _ = Admin(httptest.NewRecorder(), request("DELETE", "/admin/items/"+item.Hash, cfg.AdminToken), cfg)
+	if code != http.StatusNotFound {
+		t.Errorf("failed code for deleted item: %v", code)
+	}
+	// a used item isn't deleted by GC yet, but it can be purged
+	used, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfg.Db.Exec("UPDATE `storage` SET `counter`=0 WHERE `id`=?;", used.ID); err != nil {
+		t.Fatal(err)
+	}
+	code, err = Admin(httptest.NewRecorder(), request("DELETE", "/admin/items/"+used.Hash, cfg.AdminToken), cfg)
+	if (err != nil) || (code != http.StatusNoContent) {
+		t.Errorf("failed delete code of used item: %v, %v", code, err)
+	}
+	if stored, err := db.ReadAny(cfg.Db, used.Hash, loggerInfo); (err != nil) || (stored.ID != 0) {
+		t.Errorf("used item is not deleted: %v, %v", stored, err)
+	}
+	used.Storage = cfg.Backend
+	if used.IsFileExists() {
+		t.Error("file of used item is not deleted")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.AdminToken = "admin-token"
+	secret := "secret"
+	item, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.Db.Exec("UPDATE `storage` SET `counter`=10 WHERE `id`=?;", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMode := func(mode string, code int) {
+		r := httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader("mode="+mode))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+		w := httptest.NewRecorder()
+		c, _ := Admin(w, r, cfg)
+		if c != code {
+			t.Errorf("failed maintenance code for %v: %v", mode, c)
+		}
+		result := &MaintenanceResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), result); (c == http.StatusOK) && ((err != nil) || (result.Mode != mode)) {
+			t.Errorf("failed maintenance response: %v", w.Body.String())
+		}
+	}
+	upload := func() int {
+		body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", Password: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/u", body)
+		r.Header.Set("Content-Type", contentType)
+		c, _ := UploadShort(httptest.NewRecorder(), r, cfg)
+		return c
+	}
+	download := func() int {
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c, _ := Download(httptest.NewRecorder(), r, cfg)
+		return c
+	}
+	setMode(conf.MaintenanceReadOnly, http.StatusOK)
+	if c := upload(); c != http.StatusServiceUnavailable {
+		t.Errorf("upload is not blocked in read-only mode: %v", c)
+	}
+	if c := download(); c != http.StatusOK {
+		t.Errorf("download is blocked in read-only mode: %v", c)
+	}
+	setMode(conf.MaintenanceFull, http.StatusOK)
+	if c := upload(); c != http.StatusServiceUnavailable {
+		t.Errorf("upload is not blocked in full mode: %v", c)
+	}
+	if c := download(); c != http.StatusServiceUnavailable {
+		t.Errorf("download is not blocked in full mode: %v", c)
+	}
+	setMode("unknown", http.StatusBadRequest)
+	if m := cfg.Maintenance(); m != conf.MaintenanceFull {
+		t.Errorf("failed mode after bad request: %v", m)
+	}
+	setMode(conf.MaintenanceOff, http.StatusOK)
+	if c := upload(); c != http.StatusOK {
+		t.Errorf("upload is blocked after maintenance: %v", c)
+	}
+	if c := download(); c != http.StatusOK {
+		t.Errorf("download is blocked after maintenance: %v", c)
+	}
+	r := httptest.NewRequest("GET", "/admin/maintenance", nil)
+	code, _ := Admin(httptest.NewRecorder(), r, cfg)
+	if code != http.StatusUnauthorized {
+		t.Errorf("failed code without token: %v", code)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	item, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := item.Delete(cfg.Db, loggerInfo); err != nil {
+			t.Error(err)
+		}
+	}()
+	_, err = cfg.Db.Exec("UPDATE `storage` SET `counter`=2 WHERE `id`=?;", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []downloadTestCase{
+		{Password: "bad", Code: http.StatusBadRequest},
+		{Password: secret, Code: http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+tc.Password))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.15:1234"
+		if code, _ := Download(httptest.NewRecorder(), r, cfg); code != tc.Code {
+			t.Errorf("failed code %v!=%v", code, tc.Code)
+		}
+	}
+	cfg.AdminToken = "admin-token"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/items/"+item.Hash+"/access", nil)
+	r.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	code, err := Admin(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code: %v", code)
+	}
+	var records []*db.Access
+	if err = json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(records); n != 2 {
+		t.Fatalf("failed records count: %v", n)
+	}
+	for i, success := range []bool{false, true} {
+		if (records[i].Success != success) || (records[i].IP != "192.0.2.0") {
+			t.Errorf("[%v] failed record: %+v", i, records[i])
+		}
+	}
+}
+
+func TestDownloadFullQueue(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// GC monitor is not running, so the queue is never drained
+	cfg.Ch = make(chan *db.Item, 1)
+	secret, n := "secret", 4
+	items := make([]*db.Item, n)
+	for i := range items {
+		items[i], err = createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	codes := make(chan int, n)
+	for _, item := range items {
+		go func(hash string) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/"+hash, strings.NewReader("password="+secret))
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			code, err := Download(w, r, cfg)
+			if err != nil {
+				t.Error(err)
+			}
+			codes <- code
+		}(item.Hash)
+	}
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case code := <-codes:
+			if code != http.StatusOK {
+				t.Errorf("failed code: %v", code)
+			}
+		case <-timeout:
+			t.Fatal("download handler is blocked")
+		}
+	}
+	if l := len(cfg.Ch); l != 1 {
+		t.Errorf("failed queue length: %v", l)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(cfg.Ch)
+	check := func(handler func(io.Writer, *http.Request, *conf.Cfg) (int, error), path string, expected int) {
+		w := httptest.NewRecorder()
+		code, _ := handler(w, httptest.NewRequest("GET", path, nil), cfg)
+		if code != expected {
+			t.Errorf("failed %v code %v!=%v", path, code, expected)
+		}
+		if c := w.Result().StatusCode; c != expected {
+			t.Errorf("failed %v response code %v!=%v", path, c, expected)
+		}
+	}
+	check(Health, "/health", http.StatusOK)
+	check(Ready, "/ready", http.StatusOK)
+	if err = cfg.Db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(Health, "/health", http.StatusOK)
+	check(Ready, "/ready", http.StatusServiceUnavailable)
+}
+
+func TestDownloadMethods(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"PUT", "DELETE"} {
+		w := httptest.NewRecorder()
+		code, err := Download(w, httptest.NewRequest(method, "/"+item.Hash, nil), cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		if code != http.StatusMethodNotAllowed {
+			t.Errorf("failed %v code: %v", method, code)
+		}
+		if allow := w.Result().Header.Get("Allow"); allow != "GET, HEAD, POST" {
+			t.Errorf("failed %v allow header: %v", method, allow)
+		}
+	}
+	// GET with a body
+	code, _ := Download(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+item.Hash, strings.NewReader("body")), cfg)
+	if code != http.StatusBadRequest {
+		t.Errorf("failed code of GET with body: %v", code)
+	}
+	// query string
+	w := httptest.NewRecorder()
+	code, err = Download(w, httptest.NewRequest("GET", "/"+item.Hash+"?foo=bar", nil), cfg)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed code with query: %v", code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `name="password"`) {
+		t.Errorf("not password page: %v", body)
+	}
+	// HEAD checks the link without a body and a download
+	heads := map[string]int{"/" + item.Hash: http.StatusOK, "/" + strings.Repeat("0", 64): http.StatusNotFound, "/bad": http.StatusNotFound}
+	for path, expected := range heads {
+		w = httptest.NewRecorder()
+		code, err = Download(w, httptest.NewRequest("HEAD", path, nil), cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		if (code != expected) || (w.Code != expected) {
+			t.Errorf("failed HEAD %v code: %v, %v", path, code, w.Code)
+		}
+		if w.Body.Len() > 0 {
+			t.Errorf("HEAD %v has a body: %v", path, w.Body.String())
+		}
+	}
+	stored, err := db.Read(cfg.Db, item.Hash, cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Counter != item.Counter {
+		t.Errorf("counter is changed by HEAD: %v", stored.Counter)
+	}
+}
+
+func TestUploadShortPasswordLength(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.AutoPasswordLength = 16
+	body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/u", body)
+	r.Header.Set("Content-Type", contentType)
+	code, err := UploadShort(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("failed code: %v", code)
+	}
+	finds := regexp.MustCompile(`Password: ([0-9a-f]+)`).FindStringSubmatch(w.Body.String())
+	if len(finds) != 2 {
+		t.Fatalf("no password: %v", w.Body.String())
+	}
+	if n := len(finds[1]); n != 32 {
+		t.Errorf("failed password length: %v", n)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", TTL: "60", Times: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	if code, err := UploadJSON(w, r, cfg); (err != nil) || (code != http.StatusOK) {
+		t.Fatalf("failed upload: %v, %v", code, err)
+	}
+	result := &UploadResult{}
+	if err = json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Owner == "" {
+		t.Fatal("empty owner token")
+	}
+	finds := rgJSONCheck.FindStringSubmatch(result.URL)
+	if l := len(finds); l != 3 {
+		t.Fatalf("failed result check lenght: %v", l)
+	}
+	url := "/" + finds[2] + "/extend"
+	values := []struct {
+		form string
+		code int
+	}{
+		{form: "ttl=3600&times=5", code: http.StatusForbidden},
+		{form: "token=bad&ttl=3600&times=5", code: http.StatusForbidden},
+		{form: "token=" + result.Owner, code: http.StatusBadRequest},
+		{form: "token=" + result.Owner + "&ttl=604801", code: http.StatusBadRequest},
+		{form: "token=" + result.Owner + "&times=1001", code: http.StatusBadRequest},
+		{form: "token=" + result.Owner + "&ttl=3600&times=5", code: http.StatusOK},
+	}
+	for i, v := range values {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", url, strings.NewReader(v.form))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, _ := Extend(w, r, cfg)
+		if code != v.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, v.code)
+		}
+	}
+	info := &InfoResult{}
+	if err = json.NewDecoder(w.Result().Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Remaining != 5 {
+		t.Errorf("failed remaining: %v", info.Remaining)
+	}
+	if d := time.Until(info.Expired); (d < 59*time.Minute) || (d > time.Hour) {
+		t.Errorf("failed expired: %v", info.Expired)
+	}
+	item, err := db.Read(cfg.Db, finds[2], cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (item.Counter != 5) || !item.Expired.Equal(info.Expired) {
+		t.Errorf("failed stored item: %v, %v", item.Counter, item.Expired)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", TTL: "60", Times: "1", Password: "Old-secret1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	if code, err := UploadJSON(w, r, cfg); (err != nil) || (code != http.StatusOK) {
+		t.Fatalf("failed upload: %v, %v", code, err)
+	}
+	result := &UploadResult{}
+	if err = json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	finds := rgJSONCheck.FindStringSubmatch(result.URL)
+	if l := len(finds); l != 3 {
+		t.Fatalf("failed result check lenght: %v", l)
+	}
+	url := "/" + finds[2] + "/password"
+	values := []struct {
+		form string
+		code int
+	}{
+		{form: "password=Old-secret1&new_password=New-secret2", code: http.StatusForbidden},
+		{form: "token=bad&password=Old-secret1&new_password=New-secret2", code: http.StatusForbidden},
+		{form: "token=" + result.Owner + "&password=Old-secret1", code: http.StatusBadRequest},
+		{form: "token=" + result.Owner + "&password=Old-secret1&new_password=a", code: http.StatusBadRequest},
+		{form: "token=" + result.Owner + "&password=Bad-secret1&new_password=New-secret2", code: http.StatusBadRequest},
+		{form: "token=" + result.Owner + "&password=Old-secret1&new_password=New-secret2", code: http.StatusOK},
+	}
+	for i, v := range values {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", url, strings.NewReader(v.form))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		code, _ := Password(w, r, cfg)
+		if code != v.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, v.code)
+		}
+	}
+	changed := &PasswordResult{}
+	if err = json.NewDecoder(w.Result().Body).Decode(changed); err != nil {
+		t.Fatal(err)
+	}
+	newFinds := rgJSONCheck.FindStringSubmatch(changed.URL)
+	if (len(newFinds) != 3) || (newFinds[2] == finds[2]) {
+		t.Fatalf("failed new URL: %v", changed.URL)
+	}
+	// the old link isn't available
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", url, strings.NewReader("token="+result.Owner+"&password=New-secret2&new_password=Old-secret1"))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if code, _ := Password(w, r, cfg); code != http.StatusNotFound {
+		t.Errorf("failed code of old link: %v", code)
+	}
+	item, err := db.Read(cfg.Db, newFinds[2], cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Storage = cfg.Backend
+	for password, code := range map[string]int{"Old-secret1": http.StatusBadRequest, "New-secret2": http.StatusOK} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+password))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if c, _ := readFile(w, r, item, cfg, errorDownloadJSON); c != code {
+			t.Errorf("failed download code by %v: %v", password, c)
+		}
+		if (code == http.StatusOK) && (w.Body.String() != "content") {
+			t.Errorf("failed content: %v", w.Body.String())
+		}
+	}
+}
+
+func TestUploadFileField(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.FileField = "document"
+	// the file content is larger than the memory limit, so it's stored in a temporary file
+	cfg.Settings.MultipartMemory = 16
+	content := strings.Repeat("content", 64)
+	cases := []struct {
+		field string
+		code  int
+	}{
+		{field: "file", code: http.StatusBadRequest},
+		{field: "document", code: http.StatusOK},
+	}
+	for i, c := range cases {
+		body, contentType, err := createForm(&formData{File: content, FileName: "test.txt", TTL: "60", Times: "1", Password: "secret", Field: c.field})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		if code != c.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, c.code)
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		result := &UploadResult{}
+		if err = json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		finds := rgJSONCheck.FindStringSubmatch(result.URL)
+		if l := len(finds); l != 3 {
+			t.Fatalf("failed result check lenght: %v", l)
+		}
+		item, err := db.Read(cfg.Db, finds[2], cfg.ErrLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Size != int64(len(content)) {
+			t.Errorf("failed size: %v", item.Size)
+		}
+	}
+	w := httptest.NewRecorder()
+	if _, err = Index(w, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `name="document"`) {
+		t.Errorf("custom field is not found: %v", body)
+	}
+}
+
+func TestHint(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	hint := `<b>"pet" & year</b>`
+	upload := func(f *formData) (int, *UploadResult) {
+		body, contentType, err := createForm(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		result := &UploadResult{}
+		if code == http.StatusOK {
+			if err = json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, result
+	}
+	readPage := func(url string) string {
+		finds := rgJSONCheck.FindStringSubmatch(url)
+		if l := len(finds); l != 3 {
+			t.Fatalf("failed result check lenght: %v", l)
+		}
+		w := httptest.NewRecorder()
+		if code, err := Download(w, httptest.NewRequest("GET", "/"+finds[2], nil), cfg); (err != nil) || (code != http.StatusOK) {
+			t.Fatalf("failed read page: %v, %v", code, err)
+		}
+		return w.Body.String()
+	}
+	f := &formData{File: "content", FileName: "test.txt", TTL: "60", Times: "1", Password: "Rex-2015", Hint: hint}
+	if code, _ := upload(f); code != http.StatusBadRequest {
+		t.Errorf("hint is accepted when disabled: %v", code)
+	}
+	cfg.AllowHints = true
+	if code, _ := upload(&formData{File: "content", FileName: "test.txt", TTL: "60", Times: "1", Password: "Rex-2015", Hint: "rex-2015!"}); code != http.StatusBadRequest {
+		t.Errorf("hint with the password is accepted: %v", code)
+	}
+	// generated password can't have a hint
+	if code, _ := upload(&formData{File: "content", FileName: "test.txt", TTL: "60", Times: "1", Hint: hint}); code != http.StatusBadRequest {
+		t.Errorf("hint without the password is accepted: %v", code)
+	}
+	code, result := upload(f)
+	if code != http.StatusOK {
+		t.Fatalf("failed upload: %v", code)
+	}
+	body := readPage(result.URL)
+	if strings.Contains(body, hint) {
+		t.Errorf("hint is not escaped: %v", body)
+	}
+	if escaped := template.HTMLEscapeString(hint); !strings.Contains(body, escaped) {
+		t.Errorf("hint is not shown: %v", body)
+	}
+	// stored hints are not shown if they are disabled later
+	cfg.AllowHints = false
+	if body = readPage(result.URL); strings.Contains(body, "pet") {
+		t.Errorf("hint is shown when disabled: %v", body)
+	}
+}
+
+func TestUploadFieldErrors(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", TTL: "604801", Times: "a", Password: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	code, err := Upload(w, r, cfg)
+	if code != http.StatusBadRequest {
+		t.Fatalf("failed code: %v", code)
+	}
+	var errs fieldErrors
+	if !errors.As(err, &errs) || (len(errs) != 2) {
+		t.Fatalf("unexpected errors: %v", err)
+	}
+	page := w.Body.String()
+	for _, msg := range []string{"field ttl=604801 but available range", "field times=a is not a number"} {
+		if !strings.Contains(page, msg) {
+			t.Errorf("message %q is not shown: %v", msg, page)
+		}
+	}
+	for _, field := range []string{`name="ttl" class="invalid"`, `name="times" class="invalid"`} {
+		if !strings.Contains(page, field) {
+			t.Errorf("field %q is not marked: %v", field, page)
+		}
+	}
+	if strings.Contains(page, `name="password" class="invalid"`) {
+		t.Errorf("valid field is marked: %v", page)
+	}
+}
+
+func TestPasswordless(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	upload := func(f *formData) (int, *UploadResult) {
+		body, contentType, err := createForm(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		result := &UploadResult{}
+		if code == http.StatusOK {
+			if err = json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, result
+	}
+	f := &formData{File: "passwordless content", FileName: "test.txt", TTL: "60", Times: "2", NoPassword: "1"}
+	if code, _ := upload(f); code != http.StatusBadRequest {
+		t.Errorf("link without a password is accepted when disabled: %v", code)
+	}
+	cfg.AllowPasswordless = true
+	if code, _ := upload(&formData{File: "content", FileName: "test.txt", TTL: "60", Times: "1", Password: "secret", NoPassword: "1"}); code != http.StatusBadRequest {
+		t.Errorf("link without a password is accepted with a password: %v", code)
+	}
+	code, result := upload(f)
+	if code != http.StatusOK {
+		t.Fatalf("failed upload: %v", code)
+	}
+	if result.Password != "" {
+		t.Errorf("random password is returned: %v", result.Password)
+	}
+	finds := rgJSONCheck.FindStringSubmatch(result.URL)
+	if l := len(finds); l != 3 {
+		t.Fatalf("failed result check lenght: %v", l)
+	}
+	hash := finds[2]
+	item, err := db.Read(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.IsPasswordless() || strings.Contains(item.Passwordless, "passwordless content") {
+		t.Errorf("failed passwordless item: %v", item.Passwordless)
+	}
+	// API requirements
+	w := httptest.NewRecorder()
+	if code, err = DownloadAPI(w, httptest.NewRequest("GET", "/api/"+hash, nil), cfg); (err != nil) || (code != http.StatusOK) {
+		t.Fatalf("failed requirements: %v, %v", code, err)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"requires":"none"`) {
+		t.Errorf("unexpected requirements: %v", body)
+	}
+	// GET shows the form without a password field, link previews don't spend the counter
+	for i := 0; i < 3; i++ {
+		w = httptest.NewRecorder()
+		if code, err = Download(w, httptest.NewRequest("GET", "/"+hash, nil), cfg); (err != nil) || (code != http.StatusOK) {
+			t.Fatalf("failed read page: %v, %v", code, err)
+		}
+		if body := w.Body.String(); strings.Contains(body, "passwordless content") || strings.Contains(body, `name="password"`) {
+			t.Errorf("unexpected read page: %q", body)
+		}
+	}
+	download := func() (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+hash, strings.NewReader(""))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		code, err := Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code, w.Body.String()
+	}
+	// the file is returned without a password
+	if code, body := download(); (code != http.StatusOK) || (body != "passwordless content") {
+		t.Errorf("failed download: %v, %q", code, body)
+	}
+	// a password can't be changed
+	form := url.Values{"token": {result.Owner}, "password": {"secret"}, "new_password": {"new secret"}}
+	r := httptest.NewRequest("POST", "/"+hash+"/password", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if code, _ = Password(httptest.NewRecorder(), r, cfg); code != http.StatusBadRequest {
+		t.Errorf("password of link without it is changed: %v", code)
+	}
+	// disabled flag doesn't break existing links
+	cfg.AllowPasswordless = false
+	if code, body := download(); (code != http.StatusOK) || (body != "passwordless content") {
+		t.Errorf("failed second download: %v, %q", code, body)
+	}
+}
+
+func TestDownloadLostRace(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	created, err := createItem(cfg, secret, "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both requests have already read the item with the last download
+	n := 2
+	recorders := make([]*httptest.ResponseRecorder, n)
+	codes := make(chan int, n)
+	for i := range recorders {
+		item, err := db.Read(cfg.Db, created.Hash, cfg.ErrLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Storage = cfg.Backend
+		recorders[i] = httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password="+secret))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		go func(w *httptest.ResponseRecorder, item *db.Item) {
+			code, err := readFile(w, r, item, cfg, Error)
+			if err != nil {
+				t.Error(err)
+			}
+			codes <- code
+		}(recorders[i], item)
+	}
+	success, used := 0, 0
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case http.StatusOK:
+			success++
+		case http.StatusNotFound:
+			used++
+		default:
+			t.Errorf("unexpected code: %v", code)
+		}
+	}
+	if (success != 1) || (used != 1) {
+		t.Errorf("failed results: success=%v, used=%v", success, used)
+	}
+	found := false
+	for _, w := range recorders {
+		found = found || strings.Contains(w.Body.String(), "already been fully used")
+	}
+	if !found {
+		t.Error("no fully used message")
+	}
+}
+
+func sealedForm(salt, hash string, content []byte) (io.Reader, string, error) {
+	var b bytes.Buffer
+	fw := multipart.NewWriter(&b)
+	w, err := fw.CreateFormFile("file", "sealed")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = w.Write(content); err != nil {
+		return nil, "", err
+	}
+	if err = fw.WriteField("salt", salt); err != nil {
+		return nil, "", err
+	}
+	if err = fw.WriteField("hash", hash); err != nil {
+		return nil, "", err
+	}
+	if err = fw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &b, fw.FormDataContentType(), nil
+}
+
+func TestUploadSealed(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// client side encryption
+	content := []byte("sealed content")
+	salt := make([]byte, 128)
+	if _, err = rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	key, hash := db.Key("secret", salt, db.DefaultIter)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nonce, nonce, content, nil)
+	saltHex, hashHex := hex.EncodeToString(salt), hex.EncodeToString(hash)
+	upload := func(ctx context.Context) (int, error) {
+		body, contentType, err := sealedForm(saltHex, hashHex, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/api/upload-sealed", body).WithContext(ctx)
+		r.Header.Set("Content-Type", contentType)
+		return UploadSealed(httptest.NewRecorder(), r, cfg)
+	}
+	// the file type policy is applied to sealed files too
+	cfg.Settings.AllowedExtensions = []string{".txt"}
+	if code, _ := upload(context.Background()); code != http.StatusBadRequest {
+		t.Errorf("failed code of not allowed file: %v", code)
+	}
+	cfg.Settings.AllowedExtensions = nil
+	// the only upload slot is taken by another request
+	cfg.Uploads = limiter.NewSemaphore(1)
+	if !cfg.Uploads.Acquire(context.Background(), 0) {
+		t.Fatal("not acquired")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if code, err := upload(ctx); (code != http.StatusServiceUnavailable) || (err != errBusy) {
+		t.Errorf("failed busy upload: %v, %v", code, err)
+	}
+	cfg.Uploads.Release()
+
+	values := []struct {
+		salt, hash string
+		code       int
+	}{
+		{salt: saltHex[:64], hash: hashHex, code: http.StatusBadRequest},
+		{salt: saltHex, hash: hashHex[:32], code: http.StatusBadRequest},
+		{salt: "xyz", hash: hashHex, code: http.StatusBadRequest},
+		{salt: saltHex, hash: hashHex, code: http.StatusOK},
+		{salt: saltHex, hash: hashHex, code: http.StatusConflict},
+	}
+	for i, v := range values {
+		body, contentType, err := sealedForm(v.salt, v.hash, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload-sealed", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadSealed(w, r, cfg)
+		if code != v.code {
+			t.Errorf("[%v] failed code %v!=%v", i, code, v.code)
+		}
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/"+hashHex, nil)
+	code, err := Download(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("failed download code: %v", code)
+	}
+	data := w.Body.Bytes()
+	if !bytes.Equal(data, sealed) {
+		t.Fatal("failed sealed data")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) {
+		t.Errorf("failed content: %s", plain)
+	}
+}
+
+func TestResumable(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	content := "first chunk|second chunk"
+	chunks := []string{content[:12], content[12:]}
+	// too large file is refused before uploading
+	r := httptest.NewRequest("POST", "/api/uploads?name=test.txt", nil)
+	r.Header.Set("Upload-Length", fmt.Sprint(cfg.MaxFileSize()+1))
+	if code, _ := Resumable(httptest.NewRecorder(), r, cfg); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("failed code for too large file: %v", code)
+	}
+	r = httptest.NewRequest("POST", "/api/uploads?name=test.txt", nil)
+	r.Header.Set("Upload-Length", fmt.Sprint(len(content)))
+	w := httptest.NewRecorder()
+	code, err := Resumable(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("failed create code: %v", code)
+	}
+	session := &SessionResult{}
+	if err = json.Unmarshal(w.Body.Bytes(), session); err != nil {
+		t.Fatal(err)
+	}
+	if loc := w.Header().Get("Location"); (loc != session.URL) || (session.Length != int64(len(content))) {
+		t.Errorf("failed session: %v %+v", loc, session)
+	}
+	finish := func() (int, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest("POST", session.URL+"/finish", strings.NewReader("password=secret&times=2"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		code, _ := Resumable(w, r, cfg)
+		return code, w
+	}
+	patch := func(offset int, chunk string) (int, string) {
+		r := httptest.NewRequest("PATCH", session.URL, strings.NewReader(chunk))
+		r.Header.Set("Upload-Offset", fmt.Sprint(offset))
+		w := httptest.NewRecorder()
+		code, _ := Resumable(w, r, cfg)
+		return code, w.Header().Get("Upload-Offset")
+	}
+	if code, offset := patch(0, chunks[0]); (code != http.StatusNoContent) || (offset != "12") {
+		t.Errorf("failed first chunk: %v, %v", code, offset)
+	}
+	if code, _ := finish(); code != http.StatusConflict {
+		t.Errorf("failed code for incomplete upload: %v", code)
+	}
+	// wrong offset, the client should ask the current one
+	if code, offset := patch(0, chunks[1]); (code != http.StatusConflict) || (offset != "12") {
+		t.Errorf("failed wrong offset: %v, %v", code, offset)
+	}
+	w = httptest.NewRecorder()
+	if code, _ = Resumable(w, httptest.NewRequest("HEAD", session.URL, nil), cfg); code != http.StatusOK {
+		t.Errorf("failed head code: %v", code)
+	}
+	offset, err := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := patch(offset, chunks[1]); code != http.StatusNoContent {
+		t.Errorf("failed second chunk: %v", code)
+	}
+	code, w = finish()
+	if code != http.StatusOK {
+		t.Fatalf("failed finish code: %v, %v", code, w.Body.String())
+	}
+	result := &UploadResult{}
+	if err = json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if (result.Times != 2) || (result.Password != "secret") {
+		t.Errorf("failed result: %+v", result)
+	}
+	// the session is removed
+	if code, _ := finish(); code != http.StatusNotFound {
+		t.Errorf("failed code for finished session: %v", code)
+	}
+	u, err := url.Parse(result.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("POST", u.Path, strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	code, err = Download(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed download code: %v", code)
+	}
+	if body := w.Body.String(); body != content {
+		t.Errorf("failed content: %v", body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "test.txt") {
+		t.Errorf("failed file name: %v", cd)
+	}
+}
+
+func TestResumableQuota(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	used, err := cfg.SizeCache.Get(cfg.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, reserved, err := db.SessionsUsage(cfg.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Settings.MaxStorageBytes = used + reserved + 100
+	create := func(size int) (int, *SessionResult) {
+		r := httptest.NewRequest("POST", "/api/uploads?name=test.txt", nil)
+		r.Header.Set("Upload-Length", fmt.Sprint(size))
+		w := httptest.NewRecorder()
+		code, _ := Resumable(w, r, cfg)
+		session := &SessionResult{}
+		if code == http.StatusCreated {
+			if err := json.Unmarshal(w.Body.Bytes(), session); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, session
+	}
+	code, session := create(60)
+	if code != http.StatusCreated {
+		t.Fatalf("failed create code: %v", code)
+	}
+	// the first session's size is reserved
+	if code, _ = create(60); code != http.StatusInsufficientStorage {
+		t.Errorf("failed code for exceeded quota: %v", code)
+	}
+	w := httptest.NewRecorder()
+	if code, _ = Resumable(w, httptest.NewRequest("DELETE", session.URL, nil), cfg); code != http.StatusNoContent {
+		t.Errorf("failed delete code: %v", code)
+	}
+	code, session = create(60)
+	if code != http.StatusCreated {
+		t.Fatalf("failed create code after deletion: %v", code)
+	}
+	if code, _ = Resumable(w, httptest.NewRequest("DELETE", session.URL, nil), cfg); code != http.StatusNoContent {
+		t.Errorf("failed delete code: %v", code)
+	}
+}
+
+func TestDownloadSameError(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	secret := "secret"
+	expired := time.Now().UTC().Add(time.Minute)
+	item, err := createItem(cfg, secret, "content", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := createItem(cfg, secret, "content", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing.Storage = cfg.Backend
+	if err = missing.DeleteFile(); err != nil {
+		t.Fatal(err)
+	}
+	download := func(hash, password string) (int, string) {
+		r := httptest.NewRequest("POST", "/"+hash, strings.NewReader("password="+password))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		code, err := Download(w, r, cfg)
+		if err == nil {
+			t.Error("expected error")
+		}
+		return code, w.Body.String()
+	}
+	code, body := download(item.Hash, "bad")
+	codeMissing, bodyMissing := download(missing.Hash, secret)
+	if (code != http.StatusBadRequest) || (codeMissing != code) {
+		t.Errorf("failed codes: %v, %v", code, codeMissing)
+	}
+	if body != bodyMissing {
+		t.Errorf("different bodies:\n%v\n%v", body, bodyMissing)
+	}
+	if _, bodyMissing = download(missing.Hash, "bad"); body != bodyMissing {
+		t.Errorf("different bodies for bad password:\n%v\n%v", body, bodyMissing)
+	}
+}
+
+func TestUploadURL(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.Size = 1
+	content := "remote content"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large.txt" {
+			_, err := fmt.Fprint(w, strings.Repeat("a", cfg.MaxFileSize()+1))
+			if err != nil {
+				t.Error(err)
+			}
+			return
+		}
+		if _, err := fmt.Fprint(w, content); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	upload := func(remote string) (int, *httptest.ResponseRecorder) {
+		form := url.Values{"url": {remote}, "password": {"secret"}, "times": {"2"}}
+		r := httptest.NewRequest("POST", "/upload-url", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		code, _ := UploadURL(w, r, cfg)
+		return code, w
+	}
+	// the test server is on the loopback interface
+	if code, w := upload(server.URL + "/files/report.txt"); code != http.StatusForbidden {
+		t.Errorf("failed code for blocked host: %v, %v", code, w.Body.String())
+	}
+	if code, _ := upload("ftp://example.com/report.txt"); code != http.StatusBadRequest {
+		t.Errorf("failed code for not http URL: %v", code)
+	}
+	isFetchAllowed = func(ip net.IP) bool { return true }
+	defer func() {
+		isFetchAllowed = isPublicIP
+	}()
+	files, err := ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(files)
+	if code, w := upload(server.URL + "/large.txt"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("failed code for too large file: %v, %v", code, w.Body.String())
+	}
+	files, err = ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(files); n != before {
+		t.Errorf("failed storage files number %v!=%v", n, before)
+	}
+	code, w := upload(server.URL + "/files/report.txt?v=1")
+	if code != http.StatusOK {
+		t.Fatalf("failed upload code: %v, %v", code, w.Body.String())
+	}
+	result := &UploadResult{}
+	if err = json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if (result.Times != 2) || (result.Password != "secret") {
+		t.Errorf("failed result: %+v", result)
+	}
+	u, err := url.Parse(result.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", u.Path, strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	code, err = Download(w, r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("failed download code: %v", code)
+	}
+	if body := w.Body.String(); body != content {
+		t.Errorf("failed content: %v", body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "report.txt") {
+		t.Errorf("failed file name: %v", cd)
+	}
+}
+
+func TestDownloadAPI(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	const secret, content = "secret", "api content"
+	item, err := createItem(cfg, secret, content, time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, hash, body string) (int, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(method, "/api/"+hash, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		code, _ := DownloadAPI(w, r, cfg)
+		return code, w
+	}
+	checkError := func(w *httptest.ResponseRecorder, expected string) {
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("failed content type: %v", ct)
+		}
+		result := &ErrorResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Code != expected {
+			t.Errorf("failed error code: %+v", result)
+		}
+	}
+	// not found
+	code, w := request("GET", strings.Repeat("a", len(item.Hash)), "")
+	if code != http.StatusNotFound {
+		t.Errorf("failed not found code: %v", code)
+	}
+	checkError(w, CodeNotFound)
+	// needs password
+	code, w = request("GET", item.Hash, "")
+	if code != http.StatusOK {
+		t.Errorf("failed requirement code: %v", code)
+	}
+	requirement := &RequirementResult{}
+	if err = json.Unmarshal(w.Body.Bytes(), requirement); err != nil {
+		t.Fatal(err)
+	}
+	if requirement.Requires != "password" {
+		t.Errorf("failed requirement: %+v", requirement)
+	}
+	// bad password
+	code, w = request("POST", item.Hash, "password=bad")
+	if code != http.StatusBadRequest {
+		t.Errorf("failed bad password code: %v", code)
+	}
+	checkError(w, CodeInvalidRequest)
+	// success
+	code, w = request("POST", item.Hash, "password="+secret)
+	if code != http.StatusOK {
+		t.Errorf("failed download code: %v", code)
+	}
+	if body := w.Body.String(); body != content {
+		t.Errorf("failed content: %v", body)
+	}
+	// the only download is used
+	code, w = request("GET", item.Hash, "")
+	if code != http.StatusNotFound {
+		t.Errorf("failed code of used item: %v", code)
+	}
+	checkError(w, CodeNotFound)
+}
+
+func TestUploadEmptyFile(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	values := []struct {
+		f    *formData
+		code string
+	}{
+		{f: &formData{File: "content", FileName: "", TTL: "10", Times: "1", Password: "test"}, code: CodeInvalidFileName},
+		{f: &formData{File: "content", FileName: "/", TTL: "10", Times: "1", Password: "test"}, code: CodeInvalidFileName},
+		{f: &formData{File: "", FileName: "test.txt", TTL: "10", Times: "1", Password: "test"}, code: CodeFileEmpty},
+	}
+	handlers := []func(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error){Upload, UploadShort, UploadJSON}
+	for i, v := range values {
+		for j, handler := range handlers {
+			body, contentType, err := createForm(v.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/upload", body)
+			r.Header.Set("Content-Type", contentType)
+			code, err := handler(w, r, cfg)
+			if err == nil {
+				t.Errorf("[%v-%v] expected error", i, j)
+			}
+			if code != http.StatusBadRequest {
+				t.Errorf("[%v-%v] failed code %v", i, j, code)
+			}
+			if ce := new(codeError); !errors.As(err, &ce) || (ce.code != v.code) {
+				t.Errorf("[%v-%v] failed error: %v", i, j, err)
+			}
+		}
+	}
+}
+
+func TestUploadLabel(t *testing.T) {
+	upload := func(cfg *conf.Cfg, label string) (int, *httptest.ResponseRecorder) {
+		var b bytes.Buffer
+		fw := multipart.NewWriter(&b)
+		for name, value := range map[string]string{"password": "secret", "label": label} {
+			if err := fw.WriteField(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fileWriter, err := fw.CreateFormFile("file", "private-name.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fileWriter.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if err = fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/api/upload", &b)
+		r.Header.Set("Content-Type", fw.FormDataContentType())
+		w := httptest.NewRecorder()
+		code, _ := UploadJSON(w, r, cfg)
+		return code, w
+	}
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// labels are disabled without the server key
+	if code, _ := upload(cfg, "project x"); code != http.StatusBadRequest {
+		t.Errorf("failed code for disabled labels: %v", code)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Error(err)
+	}
+	dir, err := ioutil.TempDir("", "unigma-label-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	data, err := ioutil.ReadFile(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["label_key"] = strings.Repeat("ab", db.LabelKeySize)
+	settings["admin_token"] = "admin-token"
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = conf.New(config, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if code, _ := upload(cfg, strings.Repeat("a", maxLabel+1)); code != http.StatusBadRequest {
+		t.Errorf("failed code for too long label: %v", code)
+	}
+	code, w := upload(cfg, "project x")
+	if code != http.StatusOK {
+		t.Fatalf("failed upload code: %v, %v", code, w.Body.String())
+	}
+	result := &UploadResult{}
+	if err = json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	finds := rgJSONCheck.FindStringSubmatch(result.URL)
+	if len(finds) != 3 {
+		t.Fatalf("failed result URL: %v", result.URL)
+	}
+	r := httptest.NewRequest("GET", "/admin/items", nil)
+	r.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	w = httptest.NewRecorder()
+	if code, err = Admin(w, r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "private-name") {
+		t.Errorf("file name in the list: %v", body)
+	}
+	var items []*AdminItem
+	if err = json.Unmarshal([]byte(body), &items); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, item := range items {
+		if item.Hash == finds[2] {
+			found = item.Label == "project x"
+		}
+	}
+	if !found {
+		t.Errorf("label is not found: %v", body)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	expired := time.Now().UTC().Add(time.Minute)
+	first, err := createItem(cfg, "secret1", "first content", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second item has the same name and two downloads
+	now := time.Now().UTC()
+	second := &db.Item{Name: "test.txt", Path: testStorage, Counter: 2, Created: now, Expired: expired}
+	if err = second.Encrypt(strings.NewReader("second content"), cfg.Secret("secret2", second.SaltVersion), loggerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Save(cfg.Db); err != nil {
+		t.Fatal(err)
+	}
+	bulk := func(items []*BulkItem) (int, *httptest.ResponseRecorder) {
+		data, err := json.Marshal(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		code, _ := Bulk(w, httptest.NewRequest("POST", "/bulk", bytes.NewReader(data)), cfg)
+		return code, w
+	}
+	tooMany := make([]*BulkItem, maxBulkItems+1)
+	for i := range tooMany {
+		tooMany[i] = &BulkItem{Hash: first.Hash, Password: "secret1"}
+	}
+	if code, _ := bulk(tooMany); code != http.StatusBadRequest {
+		t.Errorf("failed code for too many files: %v", code)
+	}
+	// the only download slot is taken by another request, nothing is counted
+	cfg.Downloads = limiter.NewSemaphore(1)
+	if !cfg.Downloads.Acquire(context.Background(), 0) {
+		t.Fatal("not acquired")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	data, err := json.Marshal([]*BulkItem{{Hash: first.Hash, Password: "secret1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	code, err := Bulk(w, httptest.NewRequest("POST", "/bulk", bytes.NewReader(data)).WithContext(ctx), cfg)
+	if (code != http.StatusServiceUnavailable) || (err != errBusy) || (w.Header().Get("Content-Type") == "application/zip") {
+		t.Errorf("failed busy bulk: %v, %v, %v", code, err, w.Header())
+	}
+	cfg.Downloads.Release()
+	code, w = bulk([]*BulkItem{
+		{Hash: first.Hash, Password: "secret1"},
+		{Hash: second.Hash, Password: "secret2"},
+		{Hash: second.Hash, Password: "bad"},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("failed code: %v, %v", code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("failed content type: %v", ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"test.txt":                    "first content",
+		second.Hash[:8] + "-test.txt": "second content",
+		bulkErrorsName:                second.Hash + ": " + db.ErrPassword.Error() + "\n",
+	}
+	if n := len(zr.File); n != len(expected) {
+		t.Errorf("failed number of files: %v", n)
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rc.Close(); err != nil {
+			t.Error(err)
+		}
+		if content, ok := expected[f.Name]; !ok || (content != string(data)) {
+			t.Errorf("failed file %v: %s", f.Name, data)
+		}
+	}
+	// counters are decremented
+	item, err := db.Read(cfg.Db, first.Hash, cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != 0 {
+		t.Errorf("first item is not used: %+v", item)
+	}
+	item, err = db.Read(cfg.Db, second.Hash, cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Counter != 1 {
+		t.Errorf("failed second item counter: %v", item.Counter)
+	}
+}
+
+func TestUploadMinTTL(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Settings.MinTTL = 60
+	values := []struct {
+		ttl  string
+		code int
+	}{
+		{ttl: "59", code: http.StatusBadRequest},
+		{ttl: "60", code: http.StatusOK},
+		{ttl: "61", code: http.StatusOK},
+	}
+	handlers := []func(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error){Upload, UploadShort, UploadJSON}
+	for i, v := range values {
+		for j, handler := range handlers {
+			body, contentType, err := createForm(&formData{File: "content", FileName: "test.txt", TTL: v.ttl, Times: "1", Password: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/upload", body)
+			r.Header.Set("Content-Type", contentType)
+			code, err := handler(httptest.NewRecorder(), r, cfg)
+			if code != v.code {
+				t.Errorf("[%v-%v] failed code %v", i, j, code)
+			}
+			if ce := new(codeError); (v.code != http.StatusOK) && (!errors.As(err, &ce) || (ce.code != CodeInvalidTTL)) {
+				t.Errorf("[%v-%v] failed error: %v", i, j, err)
+			}
+		}
+	}
+}
+
+func TestUploadMaxFails(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	upload := func(maxFails string) (int, *UploadResult) {
+		var b bytes.Buffer
+		fw := multipart.NewWriter(&b)
+		for name, value := range map[string]string{"password": "secret", "times": "3", "max_fails": maxFails} {
+			if err := fw.WriteField(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fileWriter, err := fw.CreateFormFile("file", "test.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fileWriter.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if err = fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/api/upload", &b)
+		r.Header.Set("Content-Type", fw.FormDataContentType())
+		w := httptest.NewRecorder()
+		code, _ := UploadJSON(w, r, cfg)
+		result := &UploadResult{}
+		if code == http.StatusOK {
+			if err := json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, result
+	}
+	for _, value := range []string{"0", "101", "x"} {
+		if code, _ := upload(value); code != http.StatusBadRequest {
+			t.Errorf("failed code for max_fails=%v: %v", value, code)
+		}
+	}
+	code, result := upload("2")
+	if code != http.StatusOK {
+		t.Fatalf("failed upload code: %v", code)
+	}
+	finds := rgJSONCheck.FindStringSubmatch(result.URL)
+	if l := len(finds); l != 3 {
+		t.Fatalf("failed result check lenght: %v", l)
+	}
+	hash := finds[2]
+	download := func(password string) int {
+		r := httptest.NewRequest("POST", "/api/"+hash, strings.NewReader("password="+password))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		code, _ := DownloadAPI(httptest.NewRecorder(), r, cfg)
+		return code
+	}
+	// a successful download doesn't reset failed attempts
+	if code = download("secret"); code != http.StatusOK {
+		t.Errorf("failed download code: %v", code)
+	}
+	if code = download("bad"); code != http.StatusBadRequest {
+		t.Errorf("failed code of the first bad password: %v", code)
+	}
+	if code = download("bad"); code != http.StatusNotFound {
+		t.Errorf("failed code of the last bad password: %v", code)
+	}
+	// the right password doesn't help after the limit
+	if code = download("secret"); code != http.StatusNotFound {
+		t.Errorf("failed code of destroyed item: %v", code)
+	}
+	item, err := db.Read(cfg.Db, hash, cfg.ErrLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != 0 {
+		t.Errorf("destroyed item is read: %v", item.ID)
+	}
+}
+
+// fakeClamd responds to INSTREAM commands, data with "EICAR" is infected.
+func fakeClamd(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer func() {
+				if err := conn.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+			r := bufio.NewReader(conn)
+			if _, err := r.ReadString(0); err != nil {
+				t.Error(err)
+				return
+			}
+			var data bytes.Buffer
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(r, size); err != nil {
+					t.Error(err)
+					return
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			response := "stream: OK\x00"
+			if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+				response = "stream: Eicar-Test-Signature FOUND\x00"
+			}
+			if _, err := conn.Write([]byte(response)); err != nil {
+				t.Error(err)
+			}
+		}(conn)
+	}
+}
+
+func TestUploadScan(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fakeClamd(t, ln)
+	cfg.Scanner = scanner.New(ln.Addr().String(), time.Second)
+
+	const infected = "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fmt.Fprint(w, infected); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	isFetchAllowed = func(ip net.IP) bool { return true }
+	defer func() {
+		isFetchAllowed = isPublicIP
+	}()
+	upload := func(content string) (int, string) {
+		body, contentType, err := createForm(&formData{File: content, FileName: "test.txt", TTL: "60", Times: "1", Password: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		code, _ := UploadJSON(w, r, cfg)
+		result := &ErrorResult{}
+		if code != http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, result.Code
+	}
+	fetch := func() int {
+		form := url.Values{"url": {server.URL + "/test.txt"}, "password": {"secret"}}
+		r := httptest.NewRequest("POST", "/upload-url", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		code, _ := UploadURL(httptest.NewRecorder(), r, cfg)
+		return code
+	}
+	if code, _ := upload("clean content"); code != http.StatusOK {
+		t.Errorf("failed code of clean file: %v", code)
+	}
+	files, err := ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(files)
+	if code, errCode := upload(infected); (code != http.StatusUnprocessableEntity) || (errCode != CodeFileInfected) {
+		t.Errorf("failed result of infected file: %v, %v", code, errCode)
+	}
+	if code := fetch(); code != http.StatusUnprocessableEntity {
+		t.Errorf("failed code of infected remote file: %v", code)
+	}
+	files, err = ioutil.ReadDir(testStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(files); n != before {
+		t.Errorf("infected files are stored %v!=%v", n, before)
+	}
+	// files are not stored without the check
+	if err = ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if code, errCode := upload("clean content"); (code != http.StatusServiceUnavailable) || (errCode != CodeScanFailed) {
+		t.Errorf("failed result of unavailable scanner: %v, %v", code, errCode)
+	}
+	if code := fetch(); code != http.StatusServiceUnavailable {
+		t.Errorf("failed code of remote file with unavailable scanner: %v", code)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg.Limiter = limiter.New(1, time.Minute)
+	item, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry := func(w *httptest.ResponseRecorder) int {
+		value := w.Header().Get("Retry-After")
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			t.Errorf("not numeric Retry-After header: %q", value)
+		}
+		return n
+	}
+	download := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/"+item.Hash, strings.NewReader("password=bad"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		if _, err := Download(w, r, cfg); (err == nil) || (w.Code == http.StatusOK) {
+			t.Errorf("unexpected download result: %v, %v", w.Code, err)
+		}
+		return w
+	}
+	if w := download(); w.Header().Get("Retry-After") != "" {
+		t.Errorf("unexpected Retry-After header of bad password: %v", w.Header().Get("Retry-After"))
+	}
+	w := download()
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("failed rate limited code: %v", w.Code)
+	}
+	if n := retry(w); (n < 1) || (n > 60) {
+		t.Errorf("failed rate limited Retry-After: %v", n)
+	}
+	if err = cfg.SetMaintenance(conf.MaintenanceFull); err != nil {
+		t.Fatal(err)
+	}
+	handlers := []func(w io.Writer, r *http.Request, cfg *conf.Cfg) (int, error){Upload, UploadShort, UploadJSON}
+	for i, handler := range handlers {
+		w = httptest.NewRecorder()
+		code, _ := handler(w, httptest.NewRequest("POST", "/upload", nil), cfg)
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("[%v] failed maintenance code: %v", i, code)
+		}
+		if n := retry(w); n != conf.DefaultMaintenanceRetry {
+			t.Errorf("[%v] failed maintenance Retry-After: %v", i, n)
+		}
+	}
+	if err = cfg.SetMaintenance(conf.MaintenanceOff); err != nil {
+		t.Fatal(err)
+	}
+	// other unavailable reasons have their own pages and delays
+	reasons := []struct {
+		err   error
+		page  string
+		retry int
+	}{
+		{err: errBusy, page: "Server is busy", retry: int(concurrencyWait / time.Second)},
+		{err: errScan, page: "Antivirus is unavailable", retry: conf.DefaultMaintenanceRetry},
+		{err: errMaintenance, page: "Maintenance", retry: conf.DefaultMaintenanceRetry},
+		{err: fmt.Errorf("upload: %w", errBusy), page: "Server is busy", retry: int(concurrencyWait / time.Second)},
+		// the page is chosen by the error, not by its message
+		{err: errors.New(errMaintenance.Error()), page: "Service unavailable", retry: conf.DefaultMaintenanceRetry},
+	}
+	for i, reason := range reasons {
+		w = httptest.NewRecorder()
+		Error(w, httptest.NewRequest("POST", "/upload", nil), cfg, http.StatusServiceUnavailable, reason.err, "")
+		if body := w.Body.String(); !strings.Contains(body, reason.page) {
+			t.Errorf("[%v] failed unavailable page: %v", i, body)
+		}
+		if n := retry(w); n != reason.retry {
+			t.Errorf("[%v] failed page Retry-After: %v", i, n)
+		}
+		w = httptest.NewRecorder()
+		errorAPI(w, cfg, http.StatusServiceUnavailable, reason.err)
+		if n := retry(w); n != reason.retry {
+			t.Errorf("[%v] failed API Retry-After: %v", i, n)
+		}
+	}
+}
+
+func TestDownloadExpired(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	expired, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := createItem(cfg, "secret", "content", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, hash, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/"+hash, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept-Language", "en")
+		w := httptest.NewRecorder()
+		if _, err := Download(w, r, cfg); err != nil {
+			t.Error(err)
+		}
+		return w
+	}
+	if w := request("POST", used.Hash, "password=secret"); w.Code != http.StatusOK {
+		t.Fatalf("failed download code: %v", w.Code)
+	}
+	// an expired item can't be downloaded before GC
+	if w := request("POST", expired.Hash, "password=secret"); w.Code != http.StatusNotFound {
+		t.Errorf("failed code of expired item download: %v", w.Code)
+	}
+	values := []struct {
+		hash    string
+		reveal  bool
+		message string
+	}{
+		{hash: expired.Hash, message: "Page not found"},
+		{hash: used.Hash, message: "Page not found"},
+		{hash: expired.Hash, reveal: true, message: "This link has expired"},
+		{hash: used.Hash, reveal: true, message: "This link has already been fully used"},
+		{hash: strings.Repeat("a", len(used.Hash)), reveal: true, message: "Page not found"},
+	}
+	for i, v := range values {
+		cfg.RevealExpired = v.reveal
+		w := request("GET", v.hash, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("[%v] failed code: %v", i, w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, v.message) {
+			t.Errorf("[%v] failed message: %v", i, body)
+		}
+	}
+}
+
+func TestMine(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	code, err := Mine(w, httptest.NewRequest("GET", "/mine", nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Errorf("failed code of disabled sessions: %v", code)
+	}
+	if err = cfg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "unigma-mine-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	data, err := ioutil.ReadFile(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := make(map[string]interface{})
+	if err = json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings["session_key"] = strings.Repeat("cd", db.SessionKeySize)
+	if data, err = json.Marshal(settings); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(config, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = conf.New(config, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	upload := func(cookie *http.Cookie) (string, *http.Cookie) {
+		body, contentType, err := createForm(&formData{File: "mine", FileName: "test.txt", Password: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if code, err := UploadJSON(w, r, cfg); err != nil || code != http.StatusOK {
+			t.Fatalf("failed upload: %v, %v", code, err)
+		}
+		result := &UploadResult{}
+		if err = json.NewDecoder(w.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		finds := rgJSONCheck.FindStringSubmatch(result.URL)
+		if len(finds) != 3 {
+			t.Fatalf("failed result URL: %v", result.URL)
+		}
+		cookies := w.Result().Cookies()
+		if (len(cookies) != 1) || (cookies[0].Name != uploaderCookie) || !cookies[0].HttpOnly {
+			t.Fatalf("failed uploader cookie: %v", cookies)
+		}
+		return finds[2], cookies[0]
+	}
+	list := func(cookie *http.Cookie) []string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/mine", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if code, err := Mine(w, r, cfg); err != nil || code != http.StatusOK {
+			t.Fatalf("failed list: %v, %v", code, err)
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "test.txt") || strings.Contains(body, "password") {
+			t.Errorf("secret data in the list: %v", body)
+		}
+		var items []*MineItem
+		if err := json.Unmarshal([]byte(body), &items); err != nil {
+			t.Fatal(err)
+		}
+		hashes := make([]string, len(items))
+		for i, item := range items {
+			hashes[i] = item.Hash
+		}
+		return hashes
+	}
+	revoke := func(hash string, cookie *http.Cookie) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", "/mine/"+hash, nil)
+		r.AddCookie(cookie)
+		code, err := Mine(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	first, cookie := upload(nil)
+	second, c := upload(cookie)
+	if c.Value != cookie.Value {
+		t.Errorf("session is changed: %v", c.Value)
+	}
+	other, otherCookie := upload(nil)
+	if otherCookie.Value == cookie.Value {
+		t.Error("the same session for a new uploader")
+	}
+	if hashes := list(cookie); (len(hashes) != 2) || (hashes[0] != first) || (hashes[1] != second) {
+		t.Errorf("failed session list: %v", hashes)
+	}
+	if hashes := list(nil); len(hashes) != 0 {
+		t.Errorf("failed list without session: %v", hashes)
+	}
+	forged := &http.Cookie{Name: uploaderCookie, Value: strings.Split(cookie.Value, ".")[0] + "." + strings.Repeat("0", 64)}
+	if hashes := list(forged); len(hashes) != 0 {
+		t.Errorf("failed list of forged session: %v", hashes)
+	}
+	if code := revoke(other, cookie); code != http.StatusNotFound {
+		t.Errorf("failed code of other session item: %v", code)
+	}
+	if code := revoke(first, forged); code != http.StatusNotFound {
+		t.Errorf("failed code of forged session: %v", code)
+	}
+	if code := revoke(first, cookie); code != http.StatusNoContent {
+		t.Errorf("failed revoke code: %v", code)
+	}
+	if hashes := list(cookie); (len(hashes) != 1) || (hashes[0] != second) {
+		t.Errorf("failed session list after revoke: %v", hashes)
+	}
+	if hashes := list(otherCookie); (len(hashes) != 1) || (hashes[0] != other) {
+		t.Errorf("failed other session list: %v", hashes)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/mine", nil)
+	r.AddCookie(cookie)
+	if code, _ = Mine(w, r, cfg); code != http.StatusMethodNotAllowed {
+		t.Errorf("failed code of not allowed method: %v", code)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	rgClaim := regexp.MustCompile(`^http://[^/]+(/claim/[0-9a-f]{64})$`)
+	upload := func(password, query string) (int, string) {
+		body, contentType, err := createForm(&formData{File: "claimed content", FileName: "test.txt", Password: password, Claim: "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/u"+query, body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadShort(w, r, cfg)
+		return code, w.Body.String()
+	}
+	claim := func(path, method string) (int, string) {
+		w := httptest.NewRecorder()
+		code, err := Claim(w, httptest.NewRequest(method, path, nil), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (code == http.StatusOK) && (w.Header().Get("Cache-Control") != "no-store") {
+			t.Errorf("failed cache control: %v", w.Header().Get("Cache-Control"))
+		}
+		return code, w.Body.String()
+	}
+	if code, body := upload("test", "?format=json"); (code != http.StatusBadRequest) || !strings.Contains(body, CodeInvalidPassword) {
+		t.Errorf("failed claim with user password: %v, %v", code, body)
+	}
+	code, body := upload("", "?format=json")
+	if code != http.StatusOK {
+		t.Fatalf("failed upload: %v, %v", code, body)
+	}
+	result := &UploadResult{}
+	if err = json.Unmarshal([]byte(body), result); err != nil {
+		t.Fatal(err)
+	}
+	finds := rgClaim.FindStringSubmatch(result.Claim)
+	if (len(finds) != 2) || (result.Password != "") {
+		t.Fatalf("failed json response: %v", body)
+	}
+	if code, _ = claim(finds[1], "PUT"); code != http.StatusMethodNotAllowed {
+		t.Errorf("failed code of not allowed method: %v", code)
+	}
+	// GET only shows the page, link previews don't burn the token
+	for i := 0; i < 2; i++ {
+		code, body = claim(finds[1], "GET")
+		if (code != http.StatusOK) || strings.Contains(body, "Password:") || !strings.Contains(body, `method="POST"`) {
+			t.Fatalf("failed claim page: %v, %v", code, body)
+		}
+	}
+	code, body = claim(finds[1], "POST")
+	if (code != http.StatusOK) || !strings.HasPrefix(body, "Password: ") {
+		t.Fatalf("failed claim: %v, %v", code, body)
+	}
+	password := strings.TrimSpace(strings.TrimPrefix(body, "Password: "))
+	// the revealed password decrypts the file
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", result.URL, strings.NewReader("password="+password))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if code, err = Download(w, r, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if (code != http.StatusOK) || (w.Body.String() != "claimed content") {
+		t.Errorf("failed download: %v, %v", code, w.Body.String())
+	}
+	if code, body = claim(finds[1], "POST"); (code != http.StatusNotFound) || strings.Contains(body, password) {
+		t.Errorf("failed second claim: %v, %v", code, body)
+	}
+	if code, _ = claim("/claim/"+strings.Repeat("0", 64), "POST"); code != http.StatusNotFound {
+		t.Errorf("failed code of unknown token: %v", code)
+	}
+	if code, _ = claim("/claim/abc", "GET"); code != http.StatusNotFound {
+		t.Errorf("failed code of invalid token: %v", code)
+	}
+	code, body = upload("", "?format=verbose")
+	if (code != http.StatusOK) || strings.Contains(body, "Password:") || !strings.Contains(body, "Claim URL: http://") {
+		t.Errorf("failed verbose response: %v, %v", code, body)
+	}
+	code, body = upload("", "?format=plain-url")
+	if lines := strings.Split(strings.TrimSpace(body), "\n"); (code != http.StatusOK) || (len(lines) != 2) || !rgClaim.MatchString(lines[1]) {
+		t.Errorf("failed plain-url response: %v, %v", code, body)
+	}
+}
+
+// jpegWithEXIF returns JPEG image with APP1 EXIF segment which contains the orientation and the marker.
+func jpegWithEXIF(marker string, orientation uint16) ([]byte, error) {
+	m := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			m.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		return nil, err
+	}
+	// IFD with one orientation entry and without a next IFD
+	payload := []byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00")
+	payload = append(payload, byte(orientation), byte(orientation>>8), 0, 0, 0, 0, 0, 0)
+	payload = append(payload, marker...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	data := buf.Bytes()
+	// the segment follows SOI marker
+	result := append([]byte{}, data[:2]...)
+	result = append(result, segment...)
+	result = append(result, payload...)
+	return append(result, data[2:]...), nil
+}
+
+// pngWithText returns PNG image with tEXt chunk which contains the marker.
+func pngWithText(marker string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, 8, 12+len(marker))
+	binary.BigEndian.PutUint32(chunk, uint32(len(marker)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, marker...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[8+len(marker):], crc32.ChecksumIEEE(chunk[4:8+len(marker)]))
+	data := buf.Bytes()
+	// the chunk follows the signature and IHDR chunk
+	result := append([]byte{}, data[:33]...)
+	result = append(result, chunk...)
+	return append(result, data[33:]...), nil
+}
+
+func TestStripMetadata(t *testing.T) {
+	cfg, err := conf.New(testConfig, loggerInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cfg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	marker := "GPS-55.7558N-37.6173E"
+	photo, err := jpegWithEXIF(marker, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picture, err := pngWithText(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = png.Decode(bytes.NewReader(picture)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jpeg.Decode(bytes.NewReader(photo)); err != nil {
+		t.Fatal(err)
+	}
+	photoSum := sha256.Sum256(photo)
+	text := "plain text " + marker
+	upload := func(content, name, checksum string) (int, string) {
+		body, contentType, err := createForm(&formData{File: content, FileName: name, Password: "test", SHA256: checksum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		code, _ := UploadJSON(w, r, cfg)
+		if code != http.StatusOK {
+			return code, ""
+		}
+		result := &UploadResult{}
+		if err = json.NewDecoder(w.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", result.URL, strings.NewReader("password=test"))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept-Encoding", "identity")
+		code, err = Download(w, r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("failed download code: %v", code)
+		}
+		return code, w.Body.String()
+	}
+	// disabled stripping keeps metadata
+	if _, content := upload(string(photo), "photo.jpg", ""); content != string(photo) {
+		t.Error("image is changed")
+	}
+	cfg.StripMetadata = true
+	// the extension doesn't matter
+	_, content := upload(string(photo), "photo.txt", hex.EncodeToString(photoSum[:]))
+	if strings.Contains(content, marker) {
+		t.Error("metadata is not removed")
+	}
+	m, err := jpeg.Decode(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := m.Bounds(); (b.Dx() != 16) || (b.Dy() != 16) {
+		t.Errorf("failed image size: %v", b)
+	}
+	// only the orientation is kept, the image data is not re-encoded
+	if o := exifOrientationValue([]byte(content[6:])); o != 6 {
+		t.Errorf("failed orientation: %v", o)
+	}
+	if !strings.HasSuffix(string(photo), content[2+4+34:]) {
+		t.Error("image data is changed")
+	}
+	_, content = upload(string(picture), "picture.png", "")
+	if strings.Contains(content, marker) || strings.Contains(content, "tEXt") {
+		t.Error("PNG metadata is not removed")
+	}
+	if _, err = png.Decode(strings.NewReader(content)); err != nil {
+		t.Errorf("failed PNG image: %v", err)
+	}
+	if code, _ := upload(string(photo), "photo.jpg", strings.Repeat("0", 64)); code != http.StatusBadRequest {
+		t.Errorf("failed code of mismatched checksum: %v", code)
+	}
+	if _, content = upload(text, "text.jpg", ""); content != text {
+		t.Errorf("not image is changed: %v", content)
+	}
+	// metadata is removed from a broken image too, its other content is stored as is
+	broken := string(photo[:len(photo)/2])
+	if _, content = upload(broken, "broken.jpg", ""); strings.Contains(content, marker) || !strings.HasSuffix(broken, content[2+4+34:]) {
+		t.Error("failed broken image")
+	}
+}
+
+func TestIsAllowedHost(t *testing.T) {
+	allowed := []string{"unigma.com", "::1"}
+	values := []struct {
+		host, forwarded string
+		allowed         []string
+		trust           bool
+		result          bool
+	}{
+		{host: "evil.com", result: true},
+		{host: "unigma.com", allowed: allowed, result: true},
+		{host: "UNIGMA.com:8080", allowed: allowed, result: true},
+		{host: "[::1]:8080", allowed: allowed, result: true},
+		{host: "unigma.com", allowed: []string{" UNIGMA.com:443 "}, result: true},
+		{host: "evil.com", allowed: allowed},
+		{host: "unigma.com.evil.com", allowed: allowed},
+		// forwarded host is checked only if it's trusted
+		{host: "unigma.com", forwarded: "evil.com", allowed: allowed, result: true},
+		{host: "unigma.com", forwarded: "evil.com, unigma.com", allowed: allowed, trust: true},
+		{host: "backend:8080", forwarded: "unigma.com", allowed: allowed, trust: true, result: true},
+		{host: "backend:8080", allowed: allowed, trust: true},
+	}
+	for i, v := range values {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = v.host
+		if v.forwarded != "" {
+			r.Header.Set("X-Forwarded-Host", v.forwarded)
+		}
+		if result := IsAllowedHost(r, v.allowed, v.trust); result != v.result {
+			t.Errorf("[%v] failed result: %v", i, result)
+		}
+	}
+}
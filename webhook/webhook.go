@@ -0,0 +1,149 @@
+// Copyright 2020 Alexander Zaytsev <me@axv.email>.
+// All rights reserved. Use of this source code is governed
+// by a MIT-style license that can be found in the LICENSE file.
+
+// Package webhook implements asynchronous notifications about items events.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// EventDownload is a type of file download event.
+	EventDownload = "download"
+	// EventDelete is a type of item deletion by GC event.
+	EventDelete = "delete"
+	// HeaderSignature is a header with HMAC-SHA256 signature of the request body.
+	HeaderSignature = "X-Unigma-Signature"
+	// Attempts is a max number of delivery attempts of one event.
+	Attempts = 3
+)
+
+// Event is a JSON payload of a webhook request.
+type Event struct {
+	Event     string    `json:"event"`
+	Hash      string    `json:"hash"`
+	Timestamp time.Time `json:"timestamp"`
+	Remaining int       `json:"remaining"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+}
+
+// Sender delivers events to the webhook URL by one background worker.
+// Nil value is a disabled sender, its methods do nothing.
+type Sender struct {
+	url    string
+	secret string
+	client *http.Client
+	queue  chan *Event
+	logger *log.Logger
+	delay  time.Duration
+	wg     sync.WaitGroup
+}
+
+// New returns new started sender, it is nil if url is empty.
+// Events are dropped if there are more than size not delivered ones.
+func New(url, secret string, size int, timeout time.Duration, logger *log.Logger) *Sender {
+	if url == "" {
+		return nil
+	}
+	s := &Sender{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan *Event, size),
+		logger: logger,
+		delay:  time.Second,
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Sign returns hex encoded HMAC-SHA256 signature of body.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send queues the event without blocking.
+func (s *Sender) Send(e *Event) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		s.logger.Printf("webhook queue is full, %v event for %v is dropped\n", e.Event, e.Hash)
+	}
+}
+
+// Close stops the sender after delivery of already queued events.
+// Send must not be called after that.
+func (s *Sender) Close() {
+	if s == nil {
+		return
+	}
+	close(s.queue)
+	s.wg.Wait()
+}
+
+// run delivers queued events, failed requests are repeated with growing delays.
+func (s *Sender) run() {
+	defer s.wg.Done()
+	for e := range s.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			s.logger.Printf("webhook event marshal: %v\n", err)
+			continue
+		}
+		for i := 0; i < Attempts; i++ {
+			if i > 0 {
+				time.Sleep(s.delay << (i - 1))
+			}
+			if err = s.post(body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			s.logger.Printf("webhook %v event for %v is not delivered: %v\n", e.Event, e.Hash, err)
+		}
+	}
+}
+
+// post sends the signed body to the webhook URL.
+func (s *Sender) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderSignature, "sha256="+Sign(body, s.secret))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	if e := resp.Body.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var loggerTest = log.New(os.Stdout, "[TEST]", log.Ltime|log.Lshortfile)
+
+type request struct {
+	body      []byte
+	signature string
+}
+
+func TestSender(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []request
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request{body: body, signature: r.Header.Get(HeaderSignature)})
+		// the first attempt fails
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	secret := "secret"
+	s := New(server.URL, secret, 4, time.Second, loggerTest)
+	s.delay = time.Millisecond
+	now := time.Now().UTC().Truncate(time.Second)
+	s.Send(&Event{Event: EventDownload, Hash: "abc", Timestamp: now, Remaining: 2, ClientIP: "127.0.0.1"})
+	s.Send(&Event{Event: EventDelete, Hash: "abc", Timestamp: now})
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := len(requests); n != 3 {
+		t.Fatalf("failed requests count: %v", n)
+	}
+	if string(requests[0].body) != string(requests[1].body) {
+		t.Error("failed retry")
+	}
+	expected := []Event{
+		{Event: EventDownload, Hash: "abc", Timestamp: now, Remaining: 2, ClientIP: "127.0.0.1"},
+		{Event: EventDelete, Hash: "abc", Timestamp: now},
+	}
+	for i, req := range requests[1:] {
+		if req.signature != "sha256="+Sign(req.body, secret) {
+			t.Errorf("[%v] failed signature: %v", i, req.signature)
+		}
+		e := Event{}
+		if err := json.Unmarshal(req.body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e != expected[i] {
+			t.Errorf("[%v] failed event: %+v", i, e)
+		}
+	}
+	if Sign([]byte("body"), "other") == Sign([]byte("body"), secret) {
+		t.Error("signature doesn't depend on secret")
+	}
+}
+
+func TestSenderDisabled(t *testing.T) {
+	s := New("", "secret", 4, time.Second, loggerTest)
+	if s != nil {
+		t.Fatal("not nil sender")
+	}
+	s.Send(&Event{Event: EventDownload})
+	s.Close()
+}